@@ -4,25 +4,33 @@
 package api
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/swaggo/http-swagger"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/square/etre"
 	"github.com/square/etre/app"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/cdc"
 	"github.com/square/etre/cdc/changestream"
 	"github.com/square/etre/docs"
 	"github.com/square/etre/entity"
@@ -45,6 +53,7 @@ type req struct {
 	entityType string
 	entityId   string
 	write      bool
+	requestId  string // from etre.REQUEST_ID_HEADER, if valid
 }
 
 // API provides controllers for endpoints it registers with a router.
@@ -57,6 +66,7 @@ type API struct {
 	auth                     auth.Plugin
 	metricsStore             metrics.Store
 	cdcDisabled              bool
+	cdcStore                 cdc.Store
 	streamFactory            changestream.StreamerFactory
 	metricsFactory           metrics.Factory
 	systemMetrics            metrics.Metrics
@@ -64,6 +74,7 @@ type API struct {
 	queryLatencySLA          time.Duration
 	queryProfSampleRate      int
 	queryProfReportThreshold time.Duration
+	idempotency              *idempotencyCache
 	srv                      *http.Server
 }
 
@@ -78,6 +89,7 @@ func NewAPI(appCtx app.Context) *API {
 	queryLatencySLA, _ := time.ParseDuration(appCtx.Config.Metrics.QueryLatencySLA)
 	queryProfReportThreshold, _ := time.ParseDuration(appCtx.Config.Metrics.QueryProfileReportThreshold)
 	queryTimeout, _ := time.ParseDuration(appCtx.Config.Datasource.QueryTimeout)
+	idempotencyWindow, _ := time.ParseDuration(appCtx.Config.Server.IdempotencyWindow)
 	api := &API{
 		addr:                     appCtx.Config.Server.Addr,
 		crt:                      appCtx.Config.Server.TLSCert,
@@ -86,6 +98,7 @@ func NewAPI(appCtx app.Context) *API {
 		validate:                 appCtx.EntityValidator,
 		auth:                     appCtx.Auth,
 		cdcDisabled:              appCtx.Config.CDC.Disabled,
+		cdcStore:                 appCtx.CDCStore,
 		streamFactory:            appCtx.StreamerFactory,
 		metricsFactory:           appCtx.MetricsFactory,
 		metricsStore:             appCtx.MetricsStore,
@@ -94,6 +107,7 @@ func NewAPI(appCtx app.Context) *API {
 		queryLatencySLA:          queryLatencySLA,
 		queryProfSampleRate:      int(appCtx.Config.Metrics.QueryProfileSampleRate * 100),
 		queryProfReportThreshold: queryProfReportThreshold,
+		idempotency:              newIdempotencyCache(idempotencyWindow, appCtx.Config.Server.IdempotencyMaxKeys),
 	}
 
 	mux := http.NewServeMux()
@@ -102,6 +116,10 @@ func NewAPI(appCtx app.Context) *API {
 	// Query
 	// /////////////////////////////////////////////////////////////////////
 	mux.Handle("GET "+etre.API_ROOT+"/entities/{type}", api.requestWrapper(http.HandlerFunc(api.getEntitiesHandler)))
+	mux.Handle("GET "+etre.API_ROOT+"/entities/{type}/count", api.requestWrapper(http.HandlerFunc(api.countEntitiesHandler)))
+	mux.Handle("GET "+etre.API_ROOT+"/entities/{type}/aggregate", api.requestWrapper(http.HandlerFunc(api.aggregateEntitiesHandler)))
+	mux.Handle("GET "+etre.API_ROOT+"/entities/{type}/explain", api.requestWrapper(http.HandlerFunc(api.explainEntitiesHandler)))
+	mux.Handle("GET "+etre.API_ROOT+"/entities/{type}/labels", api.requestWrapper(http.HandlerFunc(api.getEntitiesLabelsHandler)))
 
 	// /////////////////////////////////////////////////////////////////////
 	// Bulk Write
@@ -118,6 +136,7 @@ func NewAPI(appCtx app.Context) *API {
 	mux.Handle("PUT "+etre.API_ROOT+"/entity/{type}/{id}", api.requestWrapper(api.id(http.HandlerFunc(api.putEntityHandler))))
 	mux.Handle("DELETE "+etre.API_ROOT+"/entity/{type}/{id}", api.requestWrapper(api.id(http.HandlerFunc(api.deleteEntityHandler))))
 	mux.Handle("GET "+etre.API_ROOT+"/entity/{type}/{id}/labels", api.requestWrapper(api.id(http.HandlerFunc(api.getLabelsHandler))))
+	mux.Handle("GET "+etre.API_ROOT+"/entity/{type}/{id}/history", api.requestWrapper(api.id(http.HandlerFunc(api.getEntityHistoryHandler))))
 	mux.Handle("DELETE "+etre.API_ROOT+"/entity/{type}/{id}/labels/{label}", api.requestWrapper(api.id(http.HandlerFunc(api.deleteLabelHandler))))
 
 	// /////////////////////////////////////////////////////////////////////
@@ -130,6 +149,8 @@ func NewAPI(appCtx app.Context) *API {
 	// Changes
 	// /////////////////////////////////////////////////////////////////////
 	mux.Handle("GET "+etre.API_ROOT+"/changes", api.cdcWrapper(http.HandlerFunc(api.changesHandler)))
+	mux.Handle("GET "+etre.API_ROOT+"/changes/events", api.cdcWrapper(http.HandlerFunc(api.getChangesEventsHandler)))
+	mux.Handle("GET "+etre.API_ROOT+"/changes/latest", api.cdcWrapper(http.HandlerFunc(api.getChangesLatestHandler)))
 
 	// /////////////////////////////////////////////////////////////////////
 	// OpenAPI docs
@@ -187,6 +208,10 @@ func (api *API) requestWrapper(next http.Handler) http.Handler {
 		rc := &req{
 			entityType: r.PathValue("type"),
 			write:      write,
+			requestId:  requestId(r),
+		}
+		if rc.requestId != "" {
+			w.Header().Set(etre.REQUEST_ID_HEADER, rc.requestId)
 		}
 
 		// requests passed to requestWrapper should always have an entity type
@@ -204,6 +229,24 @@ func (api *API) requestWrapper(next http.Handler) http.Handler {
 			return
 		}
 
+		// Decompress request payload if the client compressed it
+		// (see etre.EntityClientConfig.CompressRequests)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gzr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				etreErr := ErrInvalidContent
+				etreErr.Message = "invalid gzip payload: " + err.Error()
+				if write {
+					api.WriteResult(rc, w, nil, etreErr)
+				} else {
+					api.readError(rc, w, etreErr)
+				}
+				return
+			}
+			defer gzr.Close()
+			r.Body = gzr
+		}
+
 		defer func() {
 			if r := recover(); r != nil {
 				err, ok := r.(error)
@@ -343,6 +386,20 @@ func (api *API) requestWrapper(next http.Handler) http.Handler {
 			if rc.wo.SetOp != "" {
 				gm.Inc(metrics.SetOp, 1)
 			}
+			if rc.wo.DryRun && r.Method == "POST" {
+				api.WriteResult(rc, w, nil, ErrInvalidParam.New("dryRun is not supported on insert"))
+				return
+			}
+			if mode := r.URL.Query().Get("updateMode"); mode != "" {
+				if mode != etre.UPDATE_MODE_MERGE && mode != etre.UPDATE_MODE_REPLACE {
+					api.WriteResult(rc, w, nil, ErrInvalidParam.New("invalid updateMode: %s; valid modes: %s, %s", mode, etre.UPDATE_MODE_MERGE, etre.UPDATE_MODE_REPLACE))
+					return
+				}
+				if r.Method != "PUT" {
+					api.WriteResult(rc, w, nil, ErrInvalidParam.New("updateMode is only supported on update"))
+					return
+				}
+			}
 
 			if err := api.auth.Authorize(caller, auth.Action{EntityType: rc.entityType, Op: auth.OP_WRITE}); err != nil {
 				log.Printf("AUTH: not authorized: %s (caller: %+v request: %+v)", err, caller, r)
@@ -530,13 +587,22 @@ func (api *API) id(next http.Handler) http.Handler {
 // @Description All labels of each entity are returned, unless specific labels are specified in the `labels` query parameter.
 // @Description The result set is reduced to distinct values if the request includes the `distinct` query parameter (requires `lables` name a single label).
 // @Description If the query is longer than 2000 characters, use the POST /query endpoint (to be implemented).
+// @Description If header Accept includes application/bson, entities are returned as concatenated BSON documents.
+// @Description If header Accept includes application/x-ndjson, entities are streamed as newline-delimited JSON, one entity per line.
+// @Description Else, the response has an ETag. If header If-None-Match matches it, the response is 304 Not Modified without entities.
 // @ID getEntitiesHandler
-// @Produce json
+// @Produce json,application/bson,application/x-ndjson
 // @Param type path string true "Entity type"
 // @Param query query string true "Selector"
-// @Param labels query string false "Comma-separated list of labels to return"
+// @Param labels query string false "Comma-separated list of labels to return, or dotted paths to nested keys like metadata.region"
 // @Param distinct query boolean false "Reduce results to one per distinct value"
+// @Param sort query string false "Comma-separated labels to sort by, prefix with - for descending"
+// @Param limit query int false "Return at most this many entities"
+// @Param offset query int false "Skip this many entities before returning any"
+// @Param consistency query string false "eventual (secondary, local), read-your-writes (primary, local), or strong (primary, majority); default: datasource URL read preference and concern"
+// @Param deleted query string false "include (tombstones, too) or only (only tombstones); default: no tombstones"
 // @Success 200 {array} etre.Entity "OK"
+// @Success 304 "Not Modified"
 // @Failure 400,404 {object} etre.Error
 // @Router /entities/:type [get]
 func (api *API) getEntitiesHandler(w http.ResponseWriter, r *http.Request) {
@@ -564,7 +630,20 @@ func (api *API) getEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 	f := etre.QueryFilter{}
 	qv := r.URL.Query() // ?x=1&y=2&z -> https://godoc.org/net/url#Values
 	if csv, ok := qv["labels"]; ok {
-		f.ReturnLabels = strings.Split(csv[0], ",")
+		f.ReturnLabels = etre.UniqueLabels(strings.Split(csv[0], ","))
+		if err := etre.ValidateLabelPaths(f.ReturnLabels); err != nil {
+			api.readError(rc, w, ErrInvalidParam.New("%s (labels=%s)", err, csv[0]))
+			return
+		}
+	}
+	f.Consistency = qv.Get("consistency")
+	if err := etre.ValidateConsistency(f.Consistency); err != nil {
+		api.readError(rc, w, ErrInvalidParam.New("%s", err))
+		return
+	}
+	if err := deletedParam(qv, &f); err != nil {
+		api.readError(rc, w, err)
+		return
 	}
 	if _, ok := qv["distinct"]; ok {
 		f.Distinct = true
@@ -573,6 +652,23 @@ func (api *API) getEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 		api.readError(rc, w, ErrInvalidQuery.New("distinct requires only 1 return label but %d specified: %v", len(f.ReturnLabels), f.ReturnLabels))
 		return
 	}
+	if csv, ok := qv["sort"]; ok {
+		f.Sort = strings.Split(csv[0], ",")
+		for _, label := range f.Sort {
+			if strings.TrimPrefix(label, "-") == "" {
+				api.readError(rc, w, ErrInvalidParam.New("invalid sort label: '%s' (sort=%s)", label, csv[0]))
+				return
+			}
+		}
+	}
+	if f.Limit, err = intParam(qv, "limit"); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	if f.Offset, err = intParam(qv, "offset"); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
 
 	// Query data store (instrumented)
 	rc.inst.Start("db")
@@ -586,17 +682,322 @@ func (api *API) getEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Success: return matching entities (possibly empty list)
 	rc.inst.Start("encode-response")
-	if len(entities) > 0 && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-		// use gzip compression if we have data to send back and the client accepts gzip
-		w.Header().Set("Content-Encoding", "gzip")
-		gzw := gzip.NewWriter(w)
-		defer gzw.Close()
-		json.NewEncoder(gzw).Encode(entities)
+	defer rc.inst.Stop("encode-response")
+
+	// NDJSON is streamed one entity per line, so it has no ETag
+	if acceptNDJSON(r) {
+		w.Header().Set("Content-Type", etre.CONTENT_TYPE_NDJSON)
+		out, gzw := gzipWriter(w, r, len(entities) > 0)
+		if gzw != nil {
+			defer gzw.Close()
+		}
+		enc := json.NewEncoder(out)
+		for _, e := range entities {
+			if err := enc.Encode(e); err != nil {
+				log.Printf("Error encoding NDJSON response: %s", err)
+				return
+			}
+		}
+		return
+	}
+
+	// Other responses are encoded first to make the ETag, and not sent if the
+	// client already has it
+	var body bytes.Buffer
+	if acceptBSON(r) {
+		w.Header().Set("Content-Type", etre.CONTENT_TYPE_BSON)
+		if err := encodeBSON(&body, entities); err != nil {
+			log.Printf("Error encoding BSON response: %s", err)
+		}
 	} else {
-		// no compression
-		json.NewEncoder(w).Encode(entities)
+		json.NewEncoder(&body).Encode(entities)
+	}
+	tag := etag(body.Bytes())
+	w.Header().Set("ETag", tag)
+	if etagMatch(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	out, gzw := gzipWriter(w, r, len(entities) > 0)
+	if gzw != nil {
+		defer gzw.Close()
+	}
+	out.Write(body.Bytes())
+}
+
+// gzipWriter returns a gzip writer for the response if there's data to send back
+// and the client accepts gzip, else it returns w and nil. The caller must close
+// the gzip writer.
+func gzipWriter(w http.ResponseWriter, r *http.Request, data bool) (io.Writer, *gzip.Writer) {
+	if !data || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		return w, nil // no compression
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gzw := gzip.NewWriter(w)
+	return gzw, gzw
+}
+
+// countEntitiesHandler godoc
+// @Summary Count a set of entities
+// @Description Count entities of a type specified by the :type endpoint that match the labels in the `query` query parameter.
+// @Description Entities are not returned, only the number of matching entities.
+// @Description If the request includes the `distinct` query parameter, the number of distinct values of the one label in the `labels` query parameter is returned.
+// @ID countEntitiesHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param query query string true "Selector"
+// @Param labels query string false "Label to count distinct values of (requires distinct)"
+// @Param distinct query boolean false "Count distinct values"
+// @Param consistency query string false "eventual (secondary, local), read-your-writes (primary, local), or strong (primary, majority); default: datasource URL read preference and concern"
+// @Param deleted query string false "include (tombstones, too) or only (only tombstones); default: no tombstones"
+// @Success 200 {integer} int64 "Number of matching entities"
+// @Failure 400,404 {object} etre.Error
+// @Router /entities/:type/count [get]
+func (api *API) countEntitiesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.ReadQuery, 1) // specific read type
+
+	q, err := parseQuery(r)
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	// Label metrics
+	rc.gm.Val(metrics.Labels, int64(len(q.Predicates)))
+	for _, p := range q.Predicates {
+		rc.gm.IncLabel(metrics.LabelRead, p.Label)
+	}
+
+	f := etre.QueryFilter{}
+	qv := r.URL.Query()
+	if csv, ok := qv["labels"]; ok {
+		f.ReturnLabels = etre.UniqueLabels(strings.Split(csv[0], ","))
+		if err := etre.ValidateLabelPaths(f.ReturnLabels); err != nil {
+			api.readError(rc, w, ErrInvalidParam.New("%s (labels=%s)", err, csv[0]))
+			return
+		}
+	}
+	f.Consistency = qv.Get("consistency")
+	if err := etre.ValidateConsistency(f.Consistency); err != nil {
+		api.readError(rc, w, ErrInvalidParam.New("%s", err))
+		return
+	}
+	if err := deletedParam(qv, &f); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	if _, ok := qv["distinct"]; ok {
+		f.Distinct = true
+	}
+	if f.Distinct && len(f.ReturnLabels) != 1 {
+		api.readError(rc, w, ErrInvalidQuery.New("distinct requires only 1 return label but %d specified: %v", len(f.ReturnLabels), f.ReturnLabels))
+		return
+	}
+
+	rc.inst.Start("db")
+	n, err := api.es.WithContext(ctx).CountEntities(rc.entityType, q, f)
+	rc.inst.Stop("db")
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	rc.gm.Val(metrics.ReadMatch, n)
+
+	json.NewEncoder(w).Encode(n)
+}
+
+// aggregateEntitiesHandler godoc
+// @Summary Group and count a set of entities
+// @Description Group entities of a type specified by the :type endpoint that match the labels in the `query` query parameter by the values of the labels in the `group` query parameter.
+// @Description Entities are not returned, only the groups: the group-by label values (null for entities without the label) and the number of entities in the group, sorted by the label values.
+// @ID aggregateEntitiesHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param query query string true "Selector"
+// @Param group query string true "Comma-separated labels to group by"
+// @Param limit query int false "Return at most this many groups"
+// @Param offset query int false "Skip this many groups before returning any"
+// @Param consistency query string false "eventual (secondary, local), read-your-writes (primary, local), or strong (primary, majority); default: datasource URL read preference and concern"
+// @Param deleted query string false "include (tombstones, too) or only (only tombstones); default: no tombstones"
+// @Success 200 {array} etre.GroupResult "OK"
+// @Failure 400,404 {object} etre.Error
+// @Router /entities/:type/aggregate [get]
+func (api *API) aggregateEntitiesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.ReadQuery, 1) // specific read type
+
+	q, err := parseQuery(r)
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	// Label metrics
+	rc.gm.Val(metrics.Labels, int64(len(q.Predicates)))
+	for _, p := range q.Predicates {
+		rc.gm.IncLabel(metrics.LabelRead, p.Label)
+	}
+
+	qv := r.URL.Query()
+	csv := qv.Get("group")
+	if csv == "" {
+		api.readError(rc, w, ErrInvalidParam.New("missing group-by labels: group query parameter not set"))
+		return
+	}
+	groupBy := strings.Split(csv, ",")
+	seen := map[string]bool{}
+	for _, label := range groupBy {
+		if err := etre.ValidateLabel(label); err != nil {
+			api.readError(rc, w, ErrInvalidParam.New("invalid group-by label (group=%s): %s", csv, err))
+			return
+		}
+		if seen[label] {
+			api.readError(rc, w, ErrInvalidParam.New("duplicate group-by label: %s (group=%s)", label, csv))
+			return
+		}
+		seen[label] = true
+		rc.gm.IncLabel(metrics.LabelRead, label)
+	}
+
+	f := etre.QueryFilter{Consistency: qv.Get("consistency")}
+	if err := etre.ValidateConsistency(f.Consistency); err != nil {
+		api.readError(rc, w, ErrInvalidParam.New("%s", err))
+		return
+	}
+	if err := deletedParam(qv, &f); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	if f.Limit, err = intParam(qv, "limit"); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	if f.Offset, err = intParam(qv, "offset"); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	rc.inst.Start("db")
+	groups, err := api.es.WithContext(ctx).AggregateEntities(rc.entityType, q, groupBy, f)
+	rc.inst.Stop("db")
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	var n int64
+	for _, g := range groups {
+		n += g.Count
+	}
+	rc.gm.Val(metrics.ReadMatch, n)
+
+	if groups == nil {
+		groups = []etre.GroupResult{}
+	}
+	json.NewEncoder(w).Encode(groups)
+}
+
+// explainEntitiesHandler godoc
+// @Summary Explain a query
+// @Description Return the execution plan of the query for entities of a type specified by the :type endpoint that match the labels in the `query` query parameter.
+// @Description The query is executed to measure it, but entities are not returned, only the plan: the access stage and index of the winning plan, and the execution stats.
+// @Description Distinct queries cannot be explained.
+// @ID explainEntitiesHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param query query string true "Selector"
+// @Param sort query string false "Comma-separated labels to sort by, prefixed with - for descending"
+// @Param limit query int false "Examine at most this many matching entities"
+// @Param offset query int false "Skip this many matching entities"
+// @Success 200 {object} etre.QueryPlan "OK"
+// @Failure 400,404 {object} etre.Error
+// @Router /entities/:type/explain [get]
+func (api *API) explainEntitiesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.ReadQuery, 1) // specific read type
+
+	q, err := parseQuery(r)
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	f := etre.QueryFilter{}
+	qv := r.URL.Query()
+	if _, ok := qv["distinct"]; ok {
+		api.readError(rc, w, ErrInvalidQuery.New("distinct queries cannot be explained"))
+		return
+	}
+	if csv, ok := qv["sort"]; ok {
+		f.Sort = strings.Split(csv[0], ",")
+		for _, label := range f.Sort {
+			if strings.TrimPrefix(label, "-") == "" {
+				api.readError(rc, w, ErrInvalidParam.New("invalid sort label: '%s' (sort=%s)", label, csv[0]))
+				return
+			}
+		}
+	}
+	if f.Limit, err = intParam(qv, "limit"); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	if f.Offset, err = intParam(qv, "offset"); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	rc.inst.Start("db")
+	plan, err := api.es.WithContext(ctx).ExplainEntities(rc.entityType, q, f)
+	rc.inst.Stop("db")
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(plan)
+}
+
+// getEntitiesLabelsHandler godoc
+// @Summary Return the labels for all entities of a type
+// @Description Return a sorted array of the distinct label names used by all entities of the given :type, including meta-labels.
+// @Description The values of these labels are not returned.
+// @ID getEntitiesLabelsHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Success 200 {array} string "OK"
+// @Failure 400,404 {object} etre.Error
+// @Router /entities/:type/labels [get]
+func (api *API) getEntitiesLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.ReadLabels, 1) // specific read type
+
+	rc.inst.Start("db")
+	labels, err := api.es.WithContext(ctx).ReadLabels(rc.entityType)
+	rc.inst.Stop("db")
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	if labels == nil {
+		labels = []string{}
 	}
-	rc.inst.Stop("encode-response")
+	json.NewEncoder(w).Encode(labels)
 }
 
 // //////////////////////////////////////////////////////////////////////////
@@ -608,15 +1009,18 @@ func (api *API) getEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 // @Description Given JSON payload, create new entities of the given :type.
 // @Description Some meta-labels are filled in by Etre, e.g. `_id`.
 // @Description Optionally specify `setOp`, `setId`, and `setSize` together to define a SetOp.
+// @Description If header Content-Type is application/x-ndjson, entities are read one per line and inserted as they're read, and the response is a stream of etre.Write, one per line, in order.
+// @Description If header X-Etre-Idempotency-Key is set, a retry with the same key and entities within the server idempotency window returns the result of the first insert (with header X-Etre-Idempotent-Replay: true) instead of inserting the entities again. The same key with different entities returns idempotency-key-reused (422). NDJSON inserts ignore the key.
 // @ID postEntitiesHandler
-// @Accept json
-// @Produce json
+// @Accept json,application/x-ndjson
+// @Produce json,application/x-ndjson
 // @Param type path string true "Entity type"
 // @Param setOp query string false "SetOp"
 // @Param setId query string false "SetId"
 // @Param setSize query int false "SetSize"
+// @Param X-Etre-Idempotency-Key header string false "Idempotency key"
 // @Success 201 {array} string "List of new entity id's"
-// @Failure 400 {object} etre.Error
+// @Failure 400,409,422 {object} etre.Error
 // @Router /entities/:type [post]
 func (api *API) postEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()             // query timeout
@@ -626,9 +1030,15 @@ func (api *API) postEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 
 	rc.gm.Inc(metrics.CreateMany, 1) // specific write type
 
+	if r.Header.Get("Content-Type") == etre.CONTENT_TYPE_NDJSON {
+		api.insertNDJSON(rc, w, r)
+		return
+	}
+
 	// Return values at reply (not mutually exclusive)
 	var ids []string
 	var err error
+	var replayed bool
 
 	// Read new entities from client. Should be an array of entities like:
 	//   [{a:1,b:"foo"},{a:2,b:"bar"}]
@@ -649,18 +1059,121 @@ func (api *API) postEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 		goto reply
 	}
 
-	// Write new entities to data store
-	ids, err = api.es.WithContext(ctx).CreateEntities(rc.wo, entities)
-	rc.gm.Inc(metrics.Created, int64(len(ids)))
+	// Write new entities to data store, unless it's a retry of an insert with
+	// the same idempotency key
+	ids, replayed, err = api.createEntities(rc, w, r, entities)
+	if !replayed {
+		rc.gm.Inc(metrics.Created, int64(len(ids)))
+	}
 
 reply:
 	api.WriteResult(rc, w, ids, err)
 }
 
+// createEntities creates the entities. If the request has an idempotency key
+// (etre.IDEMPOTENCY_KEY_HEADER) and the server idempotency window is not zero,
+// it returns the result of the first insert with the key and the same entities
+// in the window, with replayed true and header etre.IDEMPOTENT_REPLAY_HEADER.
+func (api *API) createEntities(rc *req, w http.ResponseWriter, r *http.Request, entities []etre.Entity) ([]string, bool, error) {
+	key := r.Header.Get(etre.IDEMPOTENCY_KEY_HEADER)
+	if key == "" || api.idempotency == nil {
+		ids, err := api.es.WithContext(r.Context()).CreateEntities(rc.wo, entities)
+		return ids, false, err
+	}
+	if !validId(key) {
+		return nil, false, ErrInvalidParam.New("invalid %s header: must be 1-128 letters, digits, and -_.: characters", etre.IDEMPOTENCY_KEY_HEADER)
+	}
+	hash, err := entitiesHash(entities)
+	if err != nil {
+		return nil, false, ErrInvalidContent.New("%s", err)
+	}
+	// Keys are unique per entity type and caller, so callers can't see (or
+	// collide with) each other's inserts
+	key = rc.entityType + " " + rc.caller.Name + " " + key
+	ids, replayed, err := api.idempotency.insert(r.Context(), key, hash, func() ([]string, error) {
+		return api.es.WithContext(r.Context()).CreateEntities(rc.wo, entities)
+	})
+	if replayed {
+		w.Header().Set(etre.IDEMPOTENT_REPLAY_HEADER, "true")
+	}
+	return ids, replayed, err
+}
+
+// insertNDJSON inserts entities from an NDJSON request body as they're read, and
+// streams an NDJSON response of one etre.Write per entity, in order, with Index
+// set to the line number (from 0) of the entity. An entity that fails, like a
+// duplicate entity, has the Write.Error, and the next entities are inserted. If
+// the body isn't valid NDJSON or the request context is done (query timeout),
+// it stops after a last Write with Index -1 and the error. Neither the client
+// nor the API buffers all the entities, so there's no limit on how many can be
+// inserted in one request, but the whole request must finish within the query
+// timeout (etre.QUERY_TIMEOUT_HEADER).
+func (api *API) insertNDJSON(rc *req, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	// Read the request while writing the response, else net/http closes the
+	// request body on the first write
+	http.NewResponseController(w).EnableFullDuplex()
+	w.Header().Set("Content-Type", etre.CONTENT_TYPE_NDJSON)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush() // send the response header, which the client waits for
+	}
+	enc := json.NewEncoder(w)
+	reply := func(wr etre.Write) bool {
+		if err := enc.Encode(wr); err != nil {
+			log.Printf("Error encoding NDJSON response: %s%s", err, rc.logRequestId())
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	es := api.es.WithContext(ctx)
+	dec := json.NewDecoder(r.Body)
+	n := 0
+	defer func() { rc.gm.Val(metrics.CreateBulk, int64(n)) }()
+	for {
+		if err := ctx.Err(); err != nil {
+			reply(etre.Write{Index: -1, Error: api.writeError(rc, entity.DbError{Err: err, Type: "db-insert"})})
+			return
+		}
+		var e etre.Entity
+		if err := dec.Decode(&e); err != nil {
+			if err != io.EOF {
+				reply(etre.Write{Index: -1, Error: api.writeError(rc, ErrInvalidContent)})
+			}
+			return
+		}
+		wr := etre.Write{Index: n}
+		n++
+		err := api.validate.Entities([]etre.Entity{e}, entity.VALIDATE_ON_CREATE)
+		if err == nil {
+			var ids []string
+			ids, err = es.CreateEntities(rc.wo, []etre.Entity{e})
+			if len(ids) == 1 {
+				wr.EntityId = ids[0]
+				wr.URI = api.addr + etre.API_ROOT + "/entity/" + ids[0]
+				rc.gm.Inc(metrics.Created, 1)
+			}
+		}
+		if err != nil {
+			wr.Error = api.writeError(rc, err)
+		}
+		if !reply(wr) {
+			return
+		}
+	}
+}
+
 // putEntitiesHandler godoc
 // @Summary Update matching entities in bulk
 // @Description Given JSON payload, update labels in matching entities of the given :type.
 // @Description Applies update to the set of entities matching the labels in the `query` query parameter.
+// @Description Array labels can be updated atomically with operators: `{"tags": {"$addToSet": ["a"]}}` adds values not in the array, and `{"tags": {"$pull": ["b"]}}` removes values.
+// @Description Integer labels can be incremented atomically with `{"restarts": {"$inc": 1}}`. The diff has the value before the increment.
 // @Description Optionally specify `setOp`, `setId`, and `setSize` together to define a SetOp.
 // @ID putEntitiesHandler
 // @Accept json
@@ -670,6 +1183,8 @@ reply:
 // @Param setOp query string false "SetOp"
 // @Param setId query string false "SetId"
 // @Param setSize query int false "SetSize"
+// @Param dryRun query boolean false "Return diffs of entities that would change without changing them"
+// @Param updateMode query string false "merge (default) patches labels, replace also removes labels not in the patch"
 // @Success 200 {array} etre.Entity "Set of matching entities after update applied."
 // @Failure 400 {object} etre.Error
 // @Router /entities/:type [put]
@@ -706,6 +1221,9 @@ func (api *API) putEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 	if err = api.validate.Entities([]etre.Entity{patch}, entity.VALIDATE_ON_UPDATE); err != nil {
 		goto reply
 	}
+	if err = replaceOps(rc.wo, patch); err != nil {
+		goto reply
+	}
 
 	// Label metrics (read and update)
 	rc.gm.Val(metrics.Labels, int64(len(q.Predicates)))
@@ -719,7 +1237,9 @@ func (api *API) putEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 	// Patch all entities matching query
 	entities, err = api.es.WithContext(ctx).UpdateEntities(rc.wo, q, patch)
 	rc.gm.Val(metrics.UpdateBulk, int64(len(entities)))
-	rc.gm.Inc(metrics.Updated, int64(len(entities)))
+	if !rc.wo.DryRun {
+		rc.gm.Inc(metrics.Updated, int64(len(entities)))
+	}
 
 reply:
 	api.WriteResult(rc, w, entities, err)
@@ -732,9 +1252,11 @@ reply:
 // @Produce json
 // @Param type path string true "Entity type"
 // @Param query query string true "Selector"
+// @Param limit query int false "Delete at most this many matching entities"
 // @Param setOp query string false "SetOp"
 // @Param setId query string false "SetId"
 // @Param setSize query int false "SetSize"
+// @Param dryRun query boolean false "Return diffs of entities that would change without changing them"
 // @Success 200 {array} etre.Entity "OK"
 // @Failure 400 {object} etre.Error
 // @Router /entities/:type [delete]
@@ -749,6 +1271,7 @@ func (api *API) deleteEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 	// Return values at reply (not mutually exclusive)
 	var entities []etre.Entity
 	var err error
+	var limit int
 
 	// Parse query (label selector) from URL
 	var q query.Query
@@ -756,6 +1279,9 @@ func (api *API) deleteEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		goto reply
 	}
+	if limit, err = intParam(r.URL.Query(), "limit"); err != nil {
+		goto reply
+	}
 
 	// Label metrics
 	rc.gm.Val(metrics.Labels, int64(len(q.Predicates)))
@@ -764,9 +1290,11 @@ func (api *API) deleteEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete entities, returns the deleted entities
-	entities, err = api.es.WithContext(ctx).DeleteEntities(rc.wo, q)
+	entities, err = api.es.WithContext(ctx).DeleteEntities(rc.wo, q, limit)
 	rc.gm.Val(metrics.DeleteBulk, int64(len(entities)))
-	rc.gm.Inc(metrics.Deleted, int64(len(entities)))
+	if !rc.wo.DryRun {
+		rc.gm.Inc(metrics.Deleted, int64(len(entities)))
+	}
 
 reply:
 	api.WriteResult(rc, w, entities, err)
@@ -780,11 +1308,13 @@ reply:
 // @Summary Get one entity by id
 // @Description Return one entity of the given :type, identified by the path parameter :id.
 // @Description All labels of each entity are returned, unless specific labels are specified in the `labels` query parameter.
+// @Description If header Accept includes application/bson, the entity is returned as a BSON document.
 // @ID getEntityHandler
-// @Produce json
+// @Produce json,application/bson
 // @Param type path string true "Entity type"
 // @Param id path string true "Entity ID"
-// @Param labels query string false "Comma-separated list of labels to return"
+// @Param labels query string false "Comma-separated list of labels to return, or dotted paths to nested keys like metadata.region"
+// @Param consistency query string false "eventual (secondary, local), read-your-writes (primary, local), or strong (primary, majority); default: datasource URL read preference and concern"
 // @Success 200 {object} etre.Entity "OK"
 // @Failure 400,404 {object} etre.Error
 // @Router /entity/:type/:id [get]
@@ -800,7 +1330,16 @@ func (api *API) getEntityHandler(w http.ResponseWriter, r *http.Request) {
 	f := etre.QueryFilter{}
 	qv := r.URL.Query() // ?x=1&y=2&z -> https://godoc.org/net/url#Values
 	if csv, ok := qv["labels"]; ok {
-		f.ReturnLabels = strings.Split(csv[0], ",")
+		f.ReturnLabels = etre.UniqueLabels(strings.Split(csv[0], ","))
+		if err := etre.ValidateLabelPaths(f.ReturnLabels); err != nil {
+			api.readError(rc, w, ErrInvalidParam.New("%s (labels=%s)", err, csv[0]))
+			return
+		}
+	}
+	f.Consistency = qv.Get("consistency")
+	if err := etre.ValidateConsistency(f.Consistency); err != nil {
+		api.readError(rc, w, ErrInvalidParam.New("%s", err))
+		return
 	}
 
 	// Read the entity by ID
@@ -815,6 +1354,13 @@ func (api *API) getEntityHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if acceptBSON(r) {
+		w.Header().Set("Content-Type", etre.CONTENT_TYPE_BSON)
+		if err := encodeBSON(w, entities[:1]); err != nil {
+			log.Printf("Error encoding BSON response: %s", err)
+		}
+		return
+	}
 	json.NewEncoder(w).Encode(entities[0])
 }
 
@@ -851,6 +1397,47 @@ func (api *API) getLabelsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(entities[0].Labels())
 }
 
+// getEntityHistoryHandler godoc
+// @Summary Return the CDC events of a single entity
+// @Description Return the stored CDC events of the entity of the given :type and :id in revision order, from insert to the latest revision.
+// @Description Events older than the CDC retention of the server are not returned, so the first event might not be the insert.
+// @Description The entity can be deleted: the last event is the delete.
+// @ID getEntityHistoryHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param id path string true "Entity ID"
+// @Param limit query int false "Return only the most recent limit events"
+// @Success 200 {array} etre.CDCEvent "OK"
+// @Failure 400,501 {object} etre.Error
+// @Router /entity/:type/:id/history [get]
+func (api *API) getEntityHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.ReadId, 1) // specific read type
+
+	if api.cdcDisabled {
+		api.readError(rc, w, ErrCDCDisabled)
+		return
+	}
+	limit, err := intParam(r.URL.Query(), "limit")
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	events, err := api.cdcStore.History(ctx, rc.entityType, rc.entityId, int64(limit))
+	if err != nil {
+		api.readError(rc, w, ErrInternal.New("cannot read CDC events: %s", err))
+		return
+	}
+	if events == nil {
+		events = []etre.CDCEvent{}
+	}
+	json.NewEncoder(w).Encode(events)
+}
+
 // --------------------------------------------------------------------------
 // Single entity writes
 // --------------------------------------------------------------------------
@@ -860,6 +1447,7 @@ func (api *API) getLabelsHandler(w http.ResponseWriter, r *http.Request) {
 // @Description Given JSON payload, create one new entity of the given :type.
 // @Description Some meta-labels are filled in by Etre, e.g. `_id`.
 // @Description Optionally specify `setOp`, `setId`, and `setSize` together to define a SetOp.
+// @Description If header X-Etre-Idempotency-Key is set, a retry with the same key and entity is deduped like postEntitiesHandler.
 // @ID postEntityHandler
 // @Accept json
 // @Produce json
@@ -867,8 +1455,9 @@ func (api *API) getLabelsHandler(w http.ResponseWriter, r *http.Request) {
 // @Param setOp query string false "SetOp"
 // @Param setId query string false "SetId"
 // @Param setSize query int false "SetSize"
+// @Param X-Etre-Idempotency-Key header string false "Idempotency key"
 // @Success 201 {array} string "List of new entity id's"
-// @Failure 400,404 {object} etre.Error
+// @Failure 400,404,409,422 {object} etre.Error
 // @Router /entity/:type [post]
 func (api *API) postEntityHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()             // query timeout
@@ -881,6 +1470,7 @@ func (api *API) postEntityHandler(w http.ResponseWriter, r *http.Request) {
 	var newEntity etre.Entity
 	var ids []string
 	var err error
+	var replayed bool
 
 	// Read and validate new entity
 	if err = json.NewDecoder(r.Body).Decode(&newEntity); err != nil {
@@ -892,9 +1482,10 @@ func (api *API) postEntityHandler(w http.ResponseWriter, r *http.Request) {
 		goto reply
 	}
 
-	// Create new entity
-	ids, err = api.es.WithContext(ctx).CreateEntities(rc.wo, []etre.Entity{newEntity})
-	if err == nil {
+	// Create new entity, unless it's a retry of an insert with the same
+	// idempotency key
+	ids, replayed, err = api.createEntities(rc, w, r, []etre.Entity{newEntity})
+	if err == nil && !replayed {
 		rc.gm.Inc(metrics.Created, 1)
 	}
 
@@ -905,6 +1496,8 @@ reply:
 // putEntityHandler godoc
 // @Summary Patch one entity by _id
 // @Description Given JSON payload, update labels in the entity of the given :type and :id.
+// @Description Array labels can be updated atomically with operators: `{"tags": {"$addToSet": ["a"]}}` adds values not in the array, and `{"tags": {"$pull": ["b"]}}` removes values.
+// @Description Integer labels can be incremented atomically with `{"restarts": {"$inc": 1}}`. The diff has the value before the increment.
 // @Description Optionally specify `setOp`, `setId`, and `setSize` together to define a SetOp.
 // @ID putEntityHandler
 // @Accept json
@@ -914,8 +1507,11 @@ reply:
 // @Param setOp query string false "SetOp"
 // @Param setId query string false "SetId"
 // @Param setSize query int false "SetSize"
+// @Param dryRun query boolean false "Return diffs of entities that would change without changing them"
+// @Param updateMode query string false "merge (default) patches labels, replace also removes labels not in the patch"
+// @Param rev query int false "Update only if entity _rev equals rev, else return rev-conflict with the current _rev"
 // @Success 200 {array} etre.Entity "Entity after update applied."
-// @Failure 400,404 {object} etre.Error
+// @Failure 400,404,409 {object} etre.Error
 // @Router /entity/:type/:id [put]
 func (api *API) putEntityHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()             // query timeout
@@ -929,9 +1525,19 @@ func (api *API) putEntityHandler(w http.ResponseWriter, r *http.Request) {
 	var patch etre.Entity
 	var entities []etre.Entity
 	var err error
+	var rev int
 
 	q, _ := query.Translate("_id=" + rc.entityId)
 
+	// Optional ?rev=N: update only if entity is still at that revision
+	checkRev := r.URL.Query().Get("rev") != ""
+	if checkRev {
+		if rev, err = intParam(r.URL.Query(), "rev"); err != nil {
+			goto reply
+		}
+		q, _ = query.Translate(fmt.Sprintf("_id=%s,_rev=%d", rc.entityId, rev))
+	}
+
 	// Read and validate patch entity
 	if err = json.NewDecoder(r.Body).Decode(&patch); err != nil {
 		err = ErrInvalidContent
@@ -940,6 +1546,9 @@ func (api *API) putEntityHandler(w http.ResponseWriter, r *http.Request) {
 	if err = api.validate.Entities([]etre.Entity{patch}, entity.VALIDATE_ON_UPDATE); err != nil {
 		goto reply
 	}
+	if err = replaceOps(rc.wo, patch); err != nil {
+		goto reply
+	}
 
 	// Label metrics (update)
 	for label := range patch {
@@ -952,8 +1561,11 @@ func (api *API) putEntityHandler(w http.ResponseWriter, r *http.Request) {
 		goto reply
 	} else if len(entities) == 0 {
 		err = ErrNotFound
+		if checkRev {
+			err = api.revConflict(ctx, rc, rev)
+		}
 		goto reply
-	} else {
+	} else if !rc.wo.DryRun {
 		rc.gm.Inc(metrics.Updated, 1)
 	}
 
@@ -961,6 +1573,25 @@ reply:
 	api.WriteResult(rc, w, entities, err)
 }
 
+// revConflict returns ErrRevConflict with the current _rev of the entity if it
+// exists but not at the expected revision, else it returns ErrNotFound.
+func (api *API) revConflict(ctx context.Context, rc *req, expectedRev int) error {
+	q, _ := query.Translate("_id=" + rc.entityId)
+	f := etre.QueryFilter{ReturnLabels: []string{"_rev"}}
+	entities, err := api.es.WithContext(ctx).ReadEntities(rc.wo.EntityType, q, f)
+	if err != nil {
+		return err
+	}
+	if len(entities) == 0 {
+		return ErrNotFound
+	}
+	conflict := ErrRevConflict // copy
+	conflict.EntityId = rc.entityId
+	conflict.Rev = entities[0].Rev()
+	conflict.Message = fmt.Sprintf("entity _rev is %d, expected %d", conflict.Rev, expectedRev)
+	return conflict
+}
+
 // deleteEntityHandler godoc
 // @Summary Delete one entity
 // @Summary Remove entity of the given :type and matching the :id parameter.
@@ -972,6 +1603,7 @@ reply:
 // @Param setOp query string false "SetOp"
 // @Param setId query string false "SetId"
 // @Param setSize query int false "SetSize"
+// @Param dryRun query boolean false "Return diffs of entities that would change without changing them"
 // @Success 200 {array} etre.Entity "Set of deleted entities."
 // @Failure 400,404 {object} etre.Error
 // @Router /entity/:type/:id [delete]
@@ -991,12 +1623,12 @@ func (api *API) deleteEntityHandler(w http.ResponseWriter, r *http.Request) {
 	q, _ := query.Translate("_id=" + rc.entityId)
 
 	// Delete one entity by ID
-	entities, err = api.es.WithContext(ctx).DeleteEntities(rc.wo, q)
+	entities, err = api.es.WithContext(ctx).DeleteEntities(rc.wo, q, 0)
 	if err != nil {
 		goto reply
 	} else if len(entities) == 0 {
 		err = ErrNotFound
-	} else {
+	} else if !rc.wo.DryRun {
 		rc.gm.Inc(metrics.Deleted, 1)
 	}
 
@@ -1015,6 +1647,7 @@ reply:
 // @Param setOp query string false "SetOp"
 // @Param setId query string false "SetId"
 // @Param setSize query int false "SetSize"
+// @Param dryRun query boolean false "Return diffs of entities that would change without changing them"
 // @Success 200 {object} etre.Entity "Entity after the label is deleted."
 // @Failure 400,404 {object} etre.Error
 // @Router /entity/:type/:id/labels/:label [delete]
@@ -1173,6 +1806,119 @@ func (api *API) changesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// getChangesEventsHandler godoc
+// @Summary Get stored CDC events
+// @Description Returns stored CDC events with since <= ts < until in ts order.
+// @Description This is used to replay a bounded range of changes; use the websocket endpoint to stream live changes.
+// @ID getChangesEventsHandler
+// @Produce json
+// @Param since query int true "Start ts, inclusive"
+// @Param until query int true "End ts, exclusive"
+// @Param types query string false "Comma-separated entity types"
+// @Param ops query string false "Comma-separated ops: i, u, d"
+// @Success 200 {array} etre.CDCEvent "OK"
+// @Failure 400,501 {object} etre.Error
+// @Router /changes/events [get]
+func (api *API) getChangesEventsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+
+	if api.cdcDisabled {
+		api.readError(rc, w, ErrCDCDisabled)
+		return
+	}
+
+	qv := r.URL.Query()
+	since, err := intParam(qv, "since")
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	until, err := intParam(qv, "until")
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	if since == 0 || until == 0 {
+		api.readError(rc, w, ErrMissingParam.New("since and until are required"))
+		return
+	}
+	if until <= since {
+		api.readError(rc, w, ErrInvalidParam.New("until must be greater than since: since=%d until=%d", since, until))
+		return
+	}
+
+	filter := etre.CDCFilter{}
+	if v := qv.Get("types"); v != "" {
+		filter.Types = strings.Split(v, ",")
+	}
+	if v := qv.Get("ops"); v != "" {
+		filter.Ops = strings.Split(v, ",")
+	}
+	if err := filter.Validate(); err != nil {
+		api.readError(rc, w, ErrInvalidParam.New("%s", err))
+		return
+	}
+
+	events, err := api.cdcStore.Read(cdc.Filter{
+		SinceTs: int64(since), // >= since
+		UntilTs: int64(until), //  < until
+		Order:   cdc.ByTsAsc{},
+	})
+	if err != nil {
+		api.readError(rc, w, ErrInternal.New("cannot read CDC events: %s", err))
+		return
+	}
+	matched := []etre.CDCEvent{}
+	for _, e := range events {
+		if filter.Match(e) {
+			matched = append(matched, e)
+		}
+	}
+	json.NewEncoder(w).Encode(matched)
+}
+
+// getChangesLatestHandler godoc
+// @Summary Get the latest CDC event ts
+// @Description Returns the ts of the most recent stored CDC event that matches the optional filter, or zero if there are none.
+// @Description CDC consumers compare it to the ts of the last event they received to measure lag.
+// @ID getChangesLatestHandler
+// @Produce json
+// @Param types query string false "Comma-separated entity types"
+// @Param ops query string false "Comma-separated ops: i, u, d"
+// @Success 200 {object} etre.CDCLatest "OK"
+// @Failure 400,501 {object} etre.Error
+// @Router /changes/latest [get]
+func (api *API) getChangesLatestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+
+	if api.cdcDisabled {
+		api.readError(rc, w, ErrCDCDisabled)
+		return
+	}
+
+	qv := r.URL.Query()
+	filter := etre.CDCFilter{}
+	if v := qv.Get("types"); v != "" {
+		filter.Types = strings.Split(v, ",")
+	}
+	if v := qv.Get("ops"); v != "" {
+		filter.Ops = strings.Split(v, ",")
+	}
+	if err := filter.Validate(); err != nil {
+		api.readError(rc, w, ErrInvalidParam.New("%s", err))
+		return
+	}
+
+	ts, err := api.cdcStore.LatestTs(ctx, filter)
+	if err != nil {
+		api.readError(rc, w, ErrInternal.New("cannot read latest CDC event: %s", err))
+		return
+	}
+	json.NewEncoder(w).Encode(etre.CDCLatest{Ts: ts})
+}
+
 // Return error on read. Writes always return an etre.WriteResult by calling WriteResult.
 func (api *API) readError(rc *req, w http.ResponseWriter, err error) {
 	api.systemMetrics.Inc(metrics.Error, 1)
@@ -1204,18 +1950,18 @@ func (api *API) readError(rc *req, w http.ResponseWriter, err error) {
 		if dbErr.Err == context.DeadlineExceeded {
 			maybeInc(metrics.QueryTimeout, 1, rc.gm)
 		} else {
-			log.Printf("DATABASE ERROR: %v", dbErr)
+			log.Printf("DATABASE ERROR: %v%s", dbErr, rc.logRequestId())
 			maybeInc(metrics.DbError, 1, rc.gm)
 		}
 		ret = etre.Error{
 			Message:    dbErr.Error(),
-			Type:       dbErr.Type,
+			Type:       dbErrorType(dbErr),
 			HTTPStatus: http.StatusServiceUnavailable,
 			EntityId:   dbErr.EntityId,
 		}
 		httpStatus = http.StatusServiceUnavailable
 	default:
-		log.Printf("API ERROR: %v", err)
+		log.Printf("API ERROR: %v%s", err, rc.logRequestId())
 		maybeInc(metrics.APIError, 1, rc.gm)
 		httpStatus = http.StatusInternalServerError
 	}
@@ -1224,6 +1970,16 @@ func (api *API) readError(rc *req, w http.ResponseWriter, err error) {
 	json.NewEncoder(w).Encode(ret)
 }
 
+// dbErrorType returns the etre.Error type for a database error: "db-query-timeout"
+// if the query timeout (etre.QUERY_TIMEOUT_HEADER) was exceeded, which clients
+// match with etre.ErrQueryTimeout, else the DbError type, like "db-query".
+func dbErrorType(err entity.DbError) string {
+	if err.Err == context.DeadlineExceeded {
+		return "db-query-timeout"
+	}
+	return err.Type
+}
+
 // Return an etre.WriteResult for all writes, successful of not. ids are the
 // writes from entity.Store calls, which is why it can be different types.
 // ids and err are not mutually exclusive; writes can be partially successful.
@@ -1231,61 +1987,12 @@ func (api *API) WriteResult(rc *req, w http.ResponseWriter, ids interface{}, err
 	var httpStatus = http.StatusInternalServerError
 	var wr etre.WriteResult
 	var writes []etre.Write
+	wr.DryRun = rc.wo.DryRun
+	wr.RequestId = rc.requestId
 
 	// Map error to etre.Error
 	if err != nil {
-		api.systemMetrics.Inc(metrics.Error, 1)
-		switch v := err.(type) {
-		case etre.Error:
-			wr.Error = &v
-			switch err {
-			case ErrNotFound:
-				// Not an error
-			default:
-				maybeInc(metrics.ClientError, 1, rc.gm)
-			}
-		case entity.ValidationError:
-			maybeInc(metrics.ClientError, 1, rc.gm)
-			wr.Error = &etre.Error{
-				Message:    v.Err.Error(),
-				Type:       v.Type,
-				HTTPStatus: http.StatusBadRequest,
-			}
-		case entity.DbError:
-			if err.(entity.DbError).Err == context.DeadlineExceeded {
-				maybeInc(metrics.QueryTimeout, 1, rc.gm)
-			} else {
-				maybeInc(metrics.DbError, 1, rc.gm)
-			}
-			switch v.Type {
-			case "duplicate-entity":
-				dupeErr := ErrDuplicateEntity // copy
-				dupeErr.EntityId = v.EntityId
-				dupeErr.Message += " (db err: " + v.Err.Error() + ")"
-				wr.Error = &dupeErr
-			default:
-				wr.Error = &etre.Error{
-					Message:    v.Err.Error(),
-					Type:       v.Type,
-					HTTPStatus: http.StatusServiceUnavailable,
-					EntityId:   v.EntityId,
-				}
-			}
-		case auth.Error:
-			// Metric incremented by caller
-			wr.Error = &etre.Error{
-				Message:    v.Err.Error(),
-				Type:       v.Type,
-				HTTPStatus: v.HTTPStatus,
-			}
-		default:
-			maybeInc(metrics.APIError, 1, rc.gm)
-			wr.Error = &etre.Error{
-				Message:    err.Error(),
-				Type:       "unhandled-error",
-				HTTPStatus: http.StatusInternalServerError,
-			}
-		}
+		wr.Error = api.writeError(rc, err)
 		httpStatus = wr.Error.HTTPStatus
 	} else {
 		httpStatus = http.StatusOK
@@ -1343,11 +2050,70 @@ func (api *API) WriteResult(rc *req, w http.ResponseWriter, ids interface{}, err
 	json.NewEncoder(w).Encode(wr)
 }
 
+// writeError maps a write error to an etre.Error and increments its metrics.
+func (api *API) writeError(rc *req, err error) *etre.Error {
+	api.systemMetrics.Inc(metrics.Error, 1)
+	var ret *etre.Error
+	switch v := err.(type) {
+	case etre.Error:
+		ret = &v
+		switch err {
+		case ErrNotFound:
+			// Not an error
+		default:
+			maybeInc(metrics.ClientError, 1, rc.gm)
+		}
+	case entity.ValidationError:
+		maybeInc(metrics.ClientError, 1, rc.gm)
+		ret = &etre.Error{
+			Message:    v.Err.Error(),
+			Type:       v.Type,
+			HTTPStatus: http.StatusBadRequest,
+		}
+	case entity.DbError:
+		if err.(entity.DbError).Err == context.DeadlineExceeded {
+			maybeInc(metrics.QueryTimeout, 1, rc.gm)
+		} else {
+			maybeInc(metrics.DbError, 1, rc.gm)
+		}
+		switch v.Type {
+		case "duplicate-entity":
+			dupeErr := ErrDuplicateEntity // copy
+			dupeErr.EntityId = v.EntityId
+			dupeErr.Message += " (db err: " + v.Err.Error() + ")"
+			ret = &dupeErr
+		default:
+			ret = &etre.Error{
+				Message:    v.Err.Error(),
+				Type:       dbErrorType(v),
+				HTTPStatus: http.StatusServiceUnavailable,
+				EntityId:   v.EntityId,
+			}
+		}
+	case auth.Error:
+		// Metric incremented by caller
+		ret = &etre.Error{
+			Message:    v.Err.Error(),
+			Type:       v.Type,
+			HTTPStatus: v.HTTPStatus,
+		}
+	default:
+		maybeInc(metrics.APIError, 1, rc.gm)
+		ret = &etre.Error{
+			Message:    err.Error(),
+			Type:       "unhandled-error",
+			HTTPStatus: http.StatusInternalServerError,
+		}
+	}
+	return ret
+}
+
 func writeOp(r *http.Request, caller auth.Caller) entity.WriteOp {
 	wo := entity.WriteOp{
 		Caller:     caller.Name,
 		EntityType: r.PathValue("type"),
 		EntityId:   r.PathValue("id"),
+		RequestId:  requestId(r),
 	}
 
 	qv := r.URL.Query()
@@ -1364,10 +2130,65 @@ func writeOp(r *http.Request, caller auth.Caller) entity.WriteOp {
 		i, _ := strconv.Atoi(setSize)
 		wo.SetSize = i
 	}
+	dryRun := strings.ToLower(qv.Get("dryRun"))
+	wo.DryRun = dryRun == "yes" || dryRun == "true"
+	wo.Replace = qv.Get("updateMode") == etre.UPDATE_MODE_REPLACE
 
 	return wo
 }
 
+// replaceOps returns ErrInvalidParam if the patch has an array operator (see
+// etre.Entity.AddToSet) or counter operator (see etre.Entity.Increment) and the
+// update mode is replace, which sets labels to the patch values.
+func replaceOps(wo entity.WriteOp, patch etre.Entity) error {
+	if !wo.Replace {
+		return nil
+	}
+	for label, v := range patch {
+		if op, _, ok := etre.ArrayOp(v); ok {
+			return ErrInvalidParam.New("array operator %s for label %s is not supported with updateMode=%s", op, label, etre.UPDATE_MODE_REPLACE)
+		}
+		if _, ok := etre.IncrementOp(v); ok {
+			return ErrInvalidParam.New("counter operator %s for label %s is not supported with updateMode=%s", etre.COUNTER_OP_INC, label, etre.UPDATE_MODE_REPLACE)
+		}
+	}
+	return nil
+}
+
+// requestId returns the request ID header value, or "" if not set or invalid:
+// longer than 128 characters or with characters other than letters, digits,
+// and "-_.:". The limits keep it safe to log.
+func requestId(r *http.Request) string {
+	id := r.Header.Get(etre.REQUEST_ID_HEADER)
+	if !validId(id) {
+		return ""
+	}
+	return id
+}
+
+// validId returns true if id, a request ID or idempotency key, is at most 128
+// characters of letters, digits, and "-_.:".
+func validId(id string) bool {
+	if len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// logRequestId returns " (request id: ID)" for log messages, or "" if there's no
+// request ID.
+func (rc *req) logRequestId() string {
+	if rc == nil || rc.requestId == "" {
+		return ""
+	}
+	return " (request id: " + rc.requestId + ")"
+}
+
 func maybeInc(metric byte, n int64, v interface{}) {
 	if v == nil {
 		return
@@ -1394,6 +2215,130 @@ func parseQuery(r *http.Request) (query.Query, error) {
 	return q, nil
 }
 
+// acceptBSON returns true if the client accepts BSON entities (header Accept).
+// Only GET /entities/:type and GET /entity/:type/:id return BSON.
+func acceptBSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), etre.CONTENT_TYPE_BSON)
+}
+
+// acceptNDJSON returns true if header Accept includes NDJSON.
+func acceptNDJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), etre.CONTENT_TYPE_NDJSON)
+}
+
+// encodeBSON writes the entities as concatenated BSON documents. Labels and the
+// keys of nested documents are sorted, like JSON, so the same entities have the
+// same encoding (and ETag).
+func encodeBSON(w io.Writer, entities []etre.Entity) error {
+	for _, e := range entities {
+		b, err := bson.Marshal(sortedDoc(e))
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedDoc returns the document with keys sorted.
+func sortedDoc(m map[string]interface{}) bson.D {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	doc := make(bson.D, len(keys))
+	for i, k := range keys {
+		doc[i] = bson.E{Key: k, Value: sortedValue(m[k])}
+	}
+	return doc
+}
+
+// sortedValue returns v with the keys of nested documents sorted (see sortedDoc).
+func sortedValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case etre.Entity:
+		return sortedDoc(t)
+	case map[string]interface{}:
+		return sortedDoc(t)
+	case bson.M:
+		return sortedDoc(t)
+	case bson.D:
+		m := make(map[string]interface{}, len(t))
+		for _, e := range t {
+			m[e.Key] = e.Value
+		}
+		return sortedDoc(m)
+	case []interface{}:
+		cp := make([]interface{}, len(t))
+		for i := range t {
+			cp[i] = sortedValue(t[i])
+		}
+		return cp
+	case bson.A:
+		cp := make(bson.A, len(t))
+		for i := range t {
+			cp[i] = sortedValue(t[i])
+		}
+		return cp
+	}
+	return v
+}
+
+// etag returns a weak ETag for the response body. It's weak because the body
+// can be sent gzip-compressed or not.
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatch returns true if header If-None-Match matches the ETag. Like RFC 9110,
+// it uses weak comparison and matches "*".
+func etagMatch(ifNoneMatch, tag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// intParam returns the non-negative int value of URL query param name, or zero
+// if the param is not set.
+func intParam(qv url.Values, name string) (int, error) {
+	v := qv.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, ErrInvalidParam.New("%s must be a non-negative integer: %s", name, v)
+	}
+	return n, nil
+}
+
+// deletedParam sets f.IncludeDeleted or OnlyDeleted from query parameter deleted:
+// "include" or "only", respectively. If not set, tombstones are not returned.
+func deletedParam(qv url.Values, f *etre.QueryFilter) error {
+	switch v := qv.Get("deleted"); v {
+	case "":
+	case "include":
+		f.IncludeDeleted = true
+	case "only":
+		f.OnlyDeleted = true
+	default:
+		return ErrInvalidParam.New("invalid deleted: %s; valid values: include, only", v)
+	}
+	return nil
+}
+
 func isWriteRequest(method string) bool {
 	// Only these HTTP methods are writes
 	// method != "GET" doesn't work because of "HEAD", "OPTIONS", etc.
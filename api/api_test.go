@@ -107,6 +107,7 @@ func setup(t *testing.T, cfg config.Config, store mock.EntityStore) *server {
 		Auth:            auth.NewManager(acls, server.auth),
 		MetricsStore:    ms,
 		MetricsFactory:  mock.NewMetricsFactory(mf, server.metricsrec),
+		CDCStore:        server.cdcStore,
 		StreamerFactory: server.streamerFactory,
 		SystemMetrics:   mock.NewSystemMetrics(sm, server.sysmetrics),
 	}
@@ -125,14 +126,6 @@ func uri(id string) string {
 	return addr + etre.API_ROOT + "/entity/" + id
 }
 
-func fixRev(e []etre.Entity) {
-	for i := range e {
-		f := e[i]["_rev"].(float64)
-		delete(e[i], "_rev")
-		e[i]["_rev"] = int64(f)
-	}
-}
-
 // --------------------------------------------------------------------------
 
 func TestStatus(t *testing.T) {
@@ -256,7 +249,7 @@ func TestContextPropagation(t *testing.T) {
 	store.UpdateEntitiesFunc = func(op entity.WriteOp, q query.Query, e etre.Entity) ([]etre.Entity, error) {
 		return testEntitiesWithObjectIDs[0:1], nil
 	}
-	store.DeleteEntitiesFunc = func(op entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+	store.DeleteEntitiesFunc = func(op entity.WriteOp, q query.Query, limit int) ([]etre.Entity, error) {
 		return testEntitiesWithObjectIDs[0:1], nil
 	}
 	store.DeleteLabelFunc = func(op entity.WriteOp, label string) (etre.Entity, error) {
@@ -3,10 +3,17 @@
 package api_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -88,6 +95,296 @@ func TestPostEntitiesOK(t *testing.T) {
 	}}, server.auth.AuthorizeArgs)
 }
 
+func TestPostEntitiesGzip(t *testing.T) {
+	// Test that the API decompresses a gzip payload (etre.EntityClientConfig.CompressRequests)
+	var gotEntities []etre.Entity
+	store := mock.EntityStore{
+		CreateEntitiesFunc: func(wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			gotEntities = entities
+			return []string{"id1", "id2"}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	entities := []etre.Entity{{"a": "1"}, {"b": "2"}}
+	payload, err := json.Marshal(entities)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	gzw.Write(payload)
+	gzw.Close()
+
+	test.Headers = map[string]string{
+		"Content-Encoding": "gzip",
+	}
+	defer func() { test.Headers = map[string]string{} }()
+
+	var gotWR etre.WriteResult
+	url := server.url + etre.API_ROOT + "/entities/" + entityType
+	statusCode, err := test.MakeHTTPRequest("POST", url, buf.Bytes(), &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, statusCode)
+	assert.Nil(t, gotWR.Error)
+	assert.Equal(t, entities, gotEntities)
+
+	// Payload that's not gzip is invalid content
+	gotEntities = nil
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("POST", url, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-content", gotWR.Error.Type)
+	assert.Nil(t, gotEntities)
+}
+
+func TestPostEntitiesNDJSON(t *testing.T) {
+	// Test that the API inserts entities from an NDJSON payload one by one and
+	// replies one etre.Write per entity, continuing after an entity fails
+	var gotEntities []etre.Entity
+	store := mock.EntityStore{
+		CreateEntitiesFunc: func(wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			require.Len(t, entities, 1)
+			if entities[0]["a"] == "dupe" {
+				return nil, entity.DbError{Err: fmt.Errorf("E11000"), Type: "duplicate-entity"}
+			}
+			gotEntities = append(gotEntities, entities[0])
+			return []string{fmt.Sprintf("id%d", len(gotEntities))}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	body := `{"a":"1"}` + "\n" + `{"_id":"abc","a":"2"}` + "\n" + `{"a":"dupe"}` + "\n" + `{"a":"3"}` + "\n"
+	req, err := http.NewRequest("POST", server.url+etre.API_ROOT+"/entities/"+entityType, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", etre.CONTENT_TYPE_NDJSON)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etre.CONTENT_TYPE_NDJSON, resp.Header.Get("Content-Type"))
+
+	var got []etre.Write
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var w etre.Write
+		if err := dec.Decode(&w); err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+		got = append(got, w)
+	}
+	require.Len(t, got, 4)
+	assert.Equal(t, etre.Write{Index: 0, EntityId: "id1", URI: addr + etre.API_ROOT + "/entity/id1"}, got[0])
+	assert.Equal(t, 1, got[1].Index)
+	require.NotNil(t, got[1].Error)
+	assert.Empty(t, got[1].EntityId)
+	assert.Equal(t, 2, got[2].Index)
+	assert.ErrorIs(t, got[2].Err(), etre.ErrDuplicateEntity)
+	assert.Equal(t, "id2", got[3].EntityId)
+	assert.Equal(t, []etre.Entity{{"a": "1"}, {"a": "3"}}, gotEntities)
+
+	// Invalid JSON stops with a last Write
+	gotEntities = nil
+	req, err = http.NewRequest("POST", server.url+etre.API_ROOT+"/entities/"+entityType, strings.NewReader(`{"a":"1"}`+"\n{"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", etre.CONTENT_TYPE_NDJSON)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	got = nil
+	dec = json.NewDecoder(resp.Body)
+	for {
+		var w etre.Write
+		if err := dec.Decode(&w); err != nil {
+			break
+		}
+		got = append(got, w)
+	}
+	require.Len(t, got, 2)
+	assert.NoError(t, got[0].Err())
+	assert.Equal(t, -1, got[1].Index)
+	assert.ErrorIs(t, got[1].Err(), etre.ErrInvalidContent)
+}
+
+func TestPostEntitiesRequestId(t *testing.T) {
+	// Test that the API passes the request ID header to the store (for CDC events)
+	// and returns it in the WriteResult and response header
+	var gotWO entity.WriteOp
+	store := mock.EntityStore{
+		CreateEntitiesFunc: func(wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			gotWO = wo
+			return []string{"id1"}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	ec := etre.NewEntityClient(entityType, server.url, http.DefaultClient)
+	ctx := etre.WithRequestId(context.Background(), "req-1")
+	wr, err := ec.InsertContext(ctx, []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	assert.Equal(t, "req-1", wr.RequestId)
+	assert.Equal(t, "req-1", gotWO.RequestId)
+
+	// Invalid request ID is ignored
+	test.Headers = map[string]string{
+		etre.REQUEST_ID_HEADER: "bad id",
+	}
+	defer func() { test.Headers = map[string]string{} }()
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("POST", server.url+etre.API_ROOT+"/entities/"+entityType, []byte(`[{"a":"1"}]`), &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, statusCode)
+	assert.Equal(t, "", gotWR.RequestId)
+	assert.Equal(t, "", gotWO.RequestId)
+}
+
+func TestPostEntitiesIdempotencyKey(t *testing.T) {
+	// Test that an insert with the same idempotency key and entities returns the
+	// result of the first insert instead of inserting the entities again
+	calls := 0
+	var failErr error
+	store := mock.EntityStore{
+		CreateEntitiesFunc: func(wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			calls++
+			if failErr != nil {
+				return nil, failErr
+			}
+			return []string{fmt.Sprintf("id%d", calls)}, nil
+		},
+	}
+	cfg := defaultConfig
+	cfg.Server.IdempotencyWindow = "1m"
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	ec := etre.NewEntityClient(entityType, server.url, http.DefaultClient)
+	ctx := etre.WithIdempotencyKey(context.Background(), "k1")
+	wr, err := ec.InsertContext(ctx, []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	require.NoError(t, wr.Err())
+	require.Len(t, wr.Writes, 1)
+	assert.Equal(t, "id1", wr.Writes[0].EntityId)
+	assert.False(t, wr.Replayed)
+
+	wr, err = ec.InsertContext(ctx, []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	require.NoError(t, wr.Err())
+	require.Len(t, wr.Writes, 1)
+	assert.Equal(t, "id1", wr.Writes[0].EntityId)
+	assert.True(t, wr.Replayed)
+	assert.Equal(t, 1, calls)
+
+	// Same key, different entities
+	wr, err = ec.InsertContext(ctx, []etre.Entity{{"a": "2"}})
+	require.NoError(t, err)
+	assert.ErrorIs(t, wr.Err(), etre.ErrIdempotencyKeyReused)
+	assert.Empty(t, wr.Writes)
+	assert.Equal(t, 1, calls)
+
+	// Different key inserts again. So does a different entity type or caller,
+	// but the mock auth plugin has one caller.
+	wr, err = ec.InsertContext(etre.WithIdempotencyKey(context.Background(), "k2"), []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	require.Len(t, wr.Writes, 1)
+	assert.Equal(t, "id2", wr.Writes[0].EntityId)
+	assert.False(t, wr.Replayed)
+
+	// Nothing inserted, so the result isn't saved and a retry inserts
+	failErr = fmt.Errorf("db error")
+	ctx = etre.WithIdempotencyKey(context.Background(), "k3")
+	wr, err = ec.InsertContext(ctx, []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	require.Error(t, wr.Err())
+	failErr = nil
+	wr, err = ec.InsertContext(ctx, []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	require.Len(t, wr.Writes, 1)
+	assert.Equal(t, "id4", wr.Writes[0].EntityId)
+	assert.False(t, wr.Replayed)
+
+	// Single entity endpoint too
+	test.Headers = map[string]string{
+		etre.IDEMPOTENCY_KEY_HEADER: "k4",
+	}
+	defer func() { test.Headers = map[string]string{} }()
+	for i := 0; i < 2; i++ {
+		var gotWR etre.WriteResult
+		statusCode, err := test.MakeHTTPRequest("POST", server.url+etre.API_ROOT+"/entity/"+entityType, []byte(`{"a":"1"}`), &gotWR)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, statusCode)
+		require.Len(t, gotWR.Writes, 1)
+		assert.Equal(t, "id5", gotWR.Writes[0].EntityId)
+	}
+	assert.Equal(t, 5, calls)
+
+	// Invalid key
+	test.Headers[etre.IDEMPOTENCY_KEY_HEADER] = "bad key"
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("POST", server.url+etre.API_ROOT+"/entities/"+entityType, []byte(`[{"a":"1"}]`), &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-param", gotWR.Error.Type)
+	assert.Equal(t, 5, calls)
+
+	// Zero window disables keys
+	server2 := setup(t, defaultConfig, store)
+	defer server2.ts.Close()
+	ec = etre.NewEntityClient(entityType, server2.url, http.DefaultClient)
+	ctx = etre.WithIdempotencyKey(context.Background(), "k1")
+	for i := 0; i < 2; i++ {
+		wr, err = ec.InsertContext(ctx, []etre.Entity{{"a": "1"}})
+		require.NoError(t, err)
+		assert.False(t, wr.Replayed)
+	}
+	assert.Equal(t, 7, calls)
+
+	// Max keys: the oldest key is forgotten, so it inserts again
+	cfg.Server.IdempotencyMaxKeys = 2
+	server3 := setup(t, cfg, store)
+	defer server3.ts.Close()
+	ec = etre.NewEntityClient(entityType, server3.url, http.DefaultClient)
+	keys := []string{"k1", "k2", "k3", "k3", "k1"}
+	replayed := []bool{false, false, false, true, false}
+	for i, key := range keys {
+		wr, err = ec.InsertContext(etre.WithIdempotencyKey(context.Background(), key), []etre.Entity{{"a": "1"}})
+		require.NoError(t, err)
+		assert.Equal(t, replayed[i], wr.Replayed, key)
+	}
+	assert.Equal(t, 11, calls)
+
+	// A key retried after nothing was inserted doesn't keep older keys past
+	// the window
+	cfg.Server.IdempotencyMaxKeys = 0
+	cfg.Server.IdempotencyWindow = "300ms"
+	server4 := setup(t, cfg, store)
+	defer server4.ts.Close()
+	ec = etre.NewEntityClient(entityType, server4.url, http.DefaultClient)
+	_, err = ec.InsertContext(etre.WithIdempotencyKey(context.Background(), "k0"), []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	failErr = fmt.Errorf("db error")
+	wr, err = ec.InsertContext(etre.WithIdempotencyKey(context.Background(), "k1"), []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	require.Error(t, wr.Err())
+	failErr = nil
+	_, err = ec.InsertContext(etre.WithIdempotencyKey(context.Background(), "k2"), []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+	_, err = ec.InsertContext(etre.WithIdempotencyKey(context.Background(), "k1"), []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	time.Sleep(200 * time.Millisecond) // k0 and k2 expired, retried k1 not
+	wr, err = ec.InsertContext(etre.WithIdempotencyKey(context.Background(), "k2"), []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	assert.False(t, wr.Replayed)
+	wr, err = ec.InsertContext(etre.WithIdempotencyKey(context.Background(), "k1"), []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	assert.True(t, wr.Replayed)
+}
+
 func TestPostEntitiesErrors(t *testing.T) {
 	// Test that POST /entities handler validate the clients HTTP payload.
 	// If invalid, it should return an etre.WriteResult with an error.
@@ -277,7 +574,7 @@ func TestPutEntitiesOK(t *testing.T) {
 				Diff: etre.Entity{
 					"_id":   testEntityIds[0],
 					"_type": entityType,
-					"_rev":  float64(0), // float64 because all JSON numbers are float
+					"_rev":  int64(0), // etre.Entity decodes _rev as int64
 					"foo":   "oldVal",
 				},
 			},
@@ -319,6 +616,113 @@ func TestPutEntitiesOK(t *testing.T) {
 	}}, server.auth.AuthorizeArgs)
 }
 
+func TestPutEntitiesDryRun(t *testing.T) {
+	// Test that PUT /entities?dryRun=true passes WriteOp.DryRun to UpdateEntities()
+	// and the WriteResult shows it's a dry run. The store func does the dry run;
+	// the API doesn't count the entities as updated.
+	var gotWO entity.WriteOp
+	store := mock.EntityStore{
+		UpdateEntitiesFunc: func(wo entity.WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+			gotWO = wo
+			diff := []etre.Entity{
+				{"_id": testEntityId0, "_type": entityType, "_rev": int64(0), "foo": "oldVal"},
+			}
+			return diff, nil
+		},
+		CreateEntitiesFunc: func(wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			t.Error("CreateEntities called on dry run")
+			return nil, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	payload, err := json.Marshal(etre.Entity{"foo": "bar"})
+	require.NoError(t, err)
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b") + "&dryRun=true"
+
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.True(t, gotWO.DryRun)
+	assert.True(t, gotWR.DryRun)
+	require.Len(t, gotWR.Writes, 1)
+	assert.Equal(t, "oldVal", gotWR.Writes[0].Diff["foo"])
+	for _, m := range server.metricsrec.Called {
+		assert.NotEqual(t, metrics.Updated, m.Metric, "updated metric incremented on dry run: %+v", m)
+	}
+
+	// Insert does not support dry run
+	gotWR = etre.WriteResult{}
+	payload, err = json.Marshal([]etre.Entity{{"foo": "bar"}})
+	require.NoError(t, err)
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "?dryRun=true"
+	statusCode, err = test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-param", gotWR.Error.Type)
+}
+
+func TestPutEntitiesUpdateMode(t *testing.T) {
+	// Test that PUT /entities?updateMode=replace passes WriteOp.Replace to
+	// UpdateEntities(), and invalid or unsupported update modes are errors
+	var gotWO entity.WriteOp
+	called := false
+	store := mock.EntityStore{
+		UpdateEntitiesFunc: func(wo entity.WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+			called = true
+			gotWO = wo
+			diff := []etre.Entity{
+				{"_id": testEntityId0, "_type": entityType, "_rev": int64(0), "foo": "oldVal", "bar": "removed"},
+			}
+			return diff, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	payload, err := json.Marshal(etre.Entity{"foo": "bar"})
+	require.NoError(t, err)
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=" + url.QueryEscape("a=b")
+
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl+"&updateMode=replace", payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.True(t, gotWO.Replace)
+	require.Len(t, gotWR.Writes, 1)
+	assert.Equal(t, "removed", gotWR.Writes[0].Diff["bar"])
+
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl+"&updateMode=merge", payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.False(t, gotWO.Replace)
+
+	// Invalid mode
+	called = false
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl+"&updateMode=patch", payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-param", gotWR.Error.Type)
+	assert.False(t, called)
+
+	// Insert does not support update mode
+	gotWR = etre.WriteResult{}
+	payload, err = json.Marshal([]etre.Entity{{"foo": "bar"}})
+	require.NoError(t, err)
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "?updateMode=replace"
+	statusCode, err = test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-param", gotWR.Error.Type)
+}
+
 func TestPutEntitiesErrors(t *testing.T) {
 	// Test that PUT /entities returns the proper errors and increments the proper
 	// metrics when any input is invalid. The UpdateEntities() should not be called.
@@ -485,7 +889,7 @@ func TestDeleteEntitiesOK(t *testing.T) {
 	var gotWO entity.WriteOp
 	var gotQuery query.Query
 	store := mock.EntityStore{
-		DeleteEntitiesFunc: func(wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+		DeleteEntitiesFunc: func(wo entity.WriteOp, q query.Query, limit int) ([]etre.Entity, error) {
 			gotWO = wo
 			gotQuery = q
 			return []etre.Entity{
@@ -519,7 +923,7 @@ func TestDeleteEntitiesOK(t *testing.T) {
 				Diff: etre.Entity{
 					"_id":   testEntityIds[0],
 					"_type": entityType,
-					"_rev":  float64(0), // float64 because all JSON numbers are float
+					"_rev":  int64(0), // etre.Entity decodes _rev as int64
 					"foo":   "oldVal",
 				},
 			},
@@ -558,12 +962,49 @@ func TestDeleteEntitiesOK(t *testing.T) {
 	}}, server.auth.AuthorizeArgs)
 }
 
+func TestDeleteEntitiesLimit(t *testing.T) {
+	// Test that DELETE /entities?limit=N passes the limit to DeleteEntities()
+	gotLimit := -1
+	store := mock.EntityStore{
+		DeleteEntitiesFunc: func(wo entity.WriteOp, q query.Query, limit int) ([]etre.Entity, error) {
+			gotLimit = limit
+			return []etre.Entity{}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=" + url.QueryEscape("a=b")
+
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("DELETE", etreurl+"&limit=2", nil, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, 2, gotLimit)
+
+	// No limit = 0 = all matching entities
+	statusCode, err = test.MakeHTTPRequest("DELETE", etreurl, nil, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, 0, gotLimit)
+
+	// Invalid limit
+	gotLimit = -1
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("DELETE", etreurl+"&limit=x", nil, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-param", gotWR.Error.Type)
+	assert.Equal(t, -1, gotLimit, "DeleteEntities called")
+}
+
 func TestDeleteEntitiesErrors(t *testing.T) {
 	// Test that DELETE /entities returns the proper errors and increments the proper
 	// metrics when any input is invalid. The DeleteEntities() should not be called.
 	deleted := false
 	store := mock.EntityStore{
-		DeleteEntitiesFunc: func(wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+		DeleteEntitiesFunc: func(wo entity.WriteOp, q query.Query, limit int) ([]etre.Entity, error) {
 			deleted = true
 			return []etre.Entity{}, nil
 		},
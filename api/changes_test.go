@@ -3,6 +3,8 @@
 package api_test
 
 import (
+	"context"
+	"net/http"
 	"strings"
 	"sync"
 	"testing"
@@ -13,7 +15,9 @@ import (
 
 	"github.com/square/etre"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/cdc"
 	"github.com/square/etre/cdc/changestream"
+	"github.com/square/etre/test"
 	"github.com/square/etre/test/mock"
 )
 
@@ -107,3 +111,176 @@ func TestChanges(t *testing.T) {
 		}
 	*/
 }
+
+func TestChangesEvents(t *testing.T) {
+	server := setup(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	var gotFilter cdc.Filter
+	server.cdcStore.ReadFunc = func(f cdc.Filter) ([]etre.CDCEvent, error) {
+		gotFilter = f
+		events := []etre.CDCEvent{}
+		for _, e := range mock.CDCEvents {
+			if e.Ts >= f.SinceTs && e.Ts < f.UntilTs {
+				events = append(events, e)
+			}
+		}
+		return events, nil
+	}
+
+	// Replay uses GET /changes/events?since=&until= for each range
+	wsURL := strings.Replace(server.url, "http", "ws", 1)
+	client := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:         wsURL,
+		ReplayWindow: 10 * time.Millisecond,
+	})
+	eventsChan, err := client.Replay(context.Background(), 13, 35)
+	require.NoError(t, err)
+	events := []etre.CDCEvent{}
+	for e := range eventsChan {
+		events = append(events, e)
+	}
+	assert.Equal(t, mock.CDCEvents[1:6], events)
+	assert.Equal(t, cdc.Filter{SinceTs: 33, UntilTs: 36, Order: cdc.ByTsAsc{}}, gotFilter)
+
+	require.Len(t, server.auth.AuthorizeArgs, 3)
+	assert.Equal(t, auth.Action{Op: auth.OP_CDC}, server.auth.AuthorizeArgs[0].Action)
+
+	// since and until are required, and until must be greater than since
+	for _, params := range []string{"", "?since=10", "?until=10", "?since=10&until=10", "?since=x&until=10"} {
+		var gotErr etre.Error
+		statusCode, err := test.MakeHTTPRequest("GET", server.url+etre.API_ROOT+"/changes/events"+params, nil, &gotErr)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, params)
+	}
+}
+
+func TestChangesFilter(t *testing.T) {
+	server := setup(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	events := []etre.CDCEvent{
+		{Id: "a", Ts: 10, EntityType: "host", Op: etre.CDC_OP_INSERT},
+		{Id: "b", Ts: 11, EntityType: "rack", Op: etre.CDC_OP_DELETE},
+		{Id: "c", Ts: 12, EntityType: "host", Op: etre.CDC_OP_DELETE},
+	}
+	streamChan := make(chan etre.CDCEvent, len(events))
+	server.streamerFactory.MakeFunc = func(clientId string) changestream.Streamer {
+		return mock.Stream{
+			StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+				return streamChan
+			},
+		}
+	}
+	server.cdcStore.ReadFunc = func(f cdc.Filter) ([]etre.CDCEvent, error) {
+		return events, nil
+	}
+
+	// Only host deletes are streamed
+	wsURL := strings.Replace(server.url, "http", "ws", 1)
+	client := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:   wsURL,
+		Filter: etre.CDCFilter{Types: []string{"host"}, Ops: []string{etre.CDC_OP_DELETE}},
+	})
+	eventsChan, err := client.Start(time.Time{})
+	require.NoError(t, err)
+	defer client.Stop()
+	for _, e := range events {
+		streamChan <- e
+	}
+	select {
+	case e := <-eventsChan:
+		assert.Equal(t, "c", e.Id)
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+
+	// Replay applies the filter, too
+	replayChan, err := client.Replay(context.Background(), 10, 12)
+	require.NoError(t, err)
+	gotIds := []string{}
+	for e := range replayChan {
+		gotIds = append(gotIds, e.Id)
+	}
+	assert.Equal(t, []string{"c"}, gotIds)
+
+	// Invalid op is an error
+	client = etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:   wsURL,
+		Filter: etre.CDCFilter{Ops: []string{"x"}},
+	})
+	_, err = client.Start(time.Time{})
+	assert.ErrorContains(t, err, "invalid op: x")
+	var gotErr etre.Error
+	statusCode, err := test.MakeHTTPRequest("GET", server.url+etre.API_ROOT+"/changes/events?since=1&until=2&ops=x", nil, &gotErr)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestChangesLatest(t *testing.T) {
+	server := setup(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	var gotFilter etre.CDCFilter
+	latestTs := int64(42)
+	server.cdcStore.LatestTsFunc = func(ctx context.Context, f etre.CDCFilter) (int64, error) {
+		gotFilter = f
+		return latestTs, nil
+	}
+	streamChan := make(chan etre.CDCEvent, 1)
+	server.streamerFactory.MakeFunc = func(clientId string) changestream.Streamer {
+		return mock.Stream{
+			StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+				return streamChan
+			},
+		}
+	}
+
+	var got etre.CDCLatest
+	statusCode, err := test.MakeHTTPRequest("GET", server.url+etre.API_ROOT+"/changes/latest?types=host&ops=i,d", nil, &got)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.CDCLatest{Ts: 42}, got)
+	assert.Equal(t, etre.CDCFilter{Types: []string{"host"}, Ops: []string{"i", "d"}}, gotFilter)
+
+	var gotErr etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", server.url+etre.API_ROOT+"/changes/latest?ops=x", nil, &gotErr)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	// Client lag is the latest ts minus the ts of the last event received,
+	// or the start ts before the first event
+	wsURL := strings.Replace(server.url, "http", "ws", 1)
+	client := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:   wsURL,
+		Filter: etre.CDCFilter{Types: []string{"host"}},
+	})
+	_, err = client.Lag(context.Background())
+	assert.ErrorIs(t, err, etre.ErrNoCDCPosition)
+
+	eventsChan, err := client.StartContext(context.Background(), 10)
+	require.NoError(t, err)
+	defer client.Stop()
+	assert.Equal(t, int64(10), client.Position())
+	lag, err := client.Lag(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 32*time.Millisecond, lag)
+	assert.Equal(t, etre.CDCFilter{Types: []string{"host"}}, gotFilter)
+
+	streamChan <- etre.CDCEvent{Id: "a", Ts: 40, EntityType: "host"}
+	select {
+	case <-eventsChan:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	assert.Eventually(t, func() bool { return client.Position() == 40 }, time.Second, 10*time.Millisecond)
+	lag, err = client.Lag(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Millisecond, lag)
+
+	// Caught up
+	latestTs = 40
+	lag, err = client.Lag(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, lag)
+}
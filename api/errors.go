@@ -24,6 +24,12 @@ var ErrNotFound = etre.Error{
 	Message:    "entity not found",
 }
 
+var ErrRevConflict = etre.Error{
+	Type:       "rev-conflict",
+	HTTPStatus: http.StatusConflict,
+	Message:    "entity revision changed",
+}
+
 var ErrMissingParam = etre.Error{
 	Type:       "missing-param",
 	HTTPStatus: http.StatusBadRequest,
@@ -71,3 +77,15 @@ var ErrEndpointNotFound = etre.Error{
 	Type:       "endpoint-not-found",
 	HTTPStatus: http.StatusNotFound,
 }
+
+var ErrIdempotencyKeyReused = etre.Error{
+	Message:    "idempotency key was used for an insert with different entities",
+	Type:       "idempotency-key-reused",
+	HTTPStatus: http.StatusUnprocessableEntity,
+}
+
+var ErrInsertInProgress = etre.Error{
+	Message:    "insert with the same idempotency key is in progress",
+	Type:       "insert-in-progress",
+	HTTPStatus: http.StatusConflict,
+}
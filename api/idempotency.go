@@ -0,0 +1,175 @@
+// Copyright 2026, Square, Inc.
+
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/square/etre"
+	"github.com/square/etre/config"
+)
+
+// idempotencyCache dedupes inserts with an idempotency key (etre.IDEMPOTENCY_KEY_HEADER).
+// The first insert with a key runs, and the result (entity IDs and error) is
+// saved for the window, which starts when the insert is received. An insert
+// with the same key and entities in the window returns the saved result instead
+// of inserting the entities again. If nothing was inserted, the result isn't
+// saved, so a retry inserts the entities.
+//
+// The cache is in memory, per API instance, so inserts are deduped only if
+// retries go to the same instance. It has at most max keys: if it's full, the
+// oldest inserts that are done are removed before the window (see evict).
+type idempotencyCache struct {
+	window  time.Duration
+	max     int
+	mu      *sync.Mutex
+	inserts map[string]*idempotentInsert
+	order   []queuedInsert // in order received, for expiring
+}
+
+// queuedInsert is a key and its insert in idempotencyCache.order. If the key was
+// deleted and inserted again, c.inserts[key] is a newer insert, so the entry is
+// stale: the newer insert is queued after it.
+type queuedInsert struct {
+	key string
+	in  *idempotentInsert
+}
+
+type idempotentInsert struct {
+	hash     string // of the entities, see entitiesHash
+	received time.Time
+	done     chan struct{} // closed when ids and err are set
+	ids      []string
+	err      error
+}
+
+// newIdempotencyCache returns a cache with the given window and at most max keys
+// (config.DEFAULT_IDEMPOTENCY_MAX_KEYS if zero), or nil if the window is zero,
+// which disables idempotency keys.
+func newIdempotencyCache(window time.Duration, max int) *idempotencyCache {
+	if window <= 0 {
+		return nil
+	}
+	if max <= 0 {
+		max = config.DEFAULT_IDEMPOTENCY_MAX_KEYS
+	}
+	return &idempotencyCache{
+		window:  window,
+		max:     max,
+		mu:      &sync.Mutex{},
+		inserts: map[string]*idempotentInsert{},
+		order:   []queuedInsert{},
+	}
+}
+
+// insert calls create to insert the entities unless there's a saved result for
+// the key, which it returns with replayed true. If the key is saved with a hash
+// of different entities, it returns ErrIdempotencyKeyReused. If an insert with
+// the key is in progress, it waits for the result; if ctx is done first, it
+// returns ErrInsertInProgress.
+func (c *idempotencyCache) insert(ctx context.Context, key, hash string, create func() ([]string, error)) (ids []string, replayed bool, err error) {
+	for {
+		c.mu.Lock()
+		c.expire(time.Now())
+		in, ok := c.inserts[key]
+		if !ok {
+			if len(c.inserts) >= c.max {
+				c.evict()
+			}
+			in = &idempotentInsert{
+				hash:     hash,
+				received: time.Now(),
+				done:     make(chan struct{}),
+			}
+			c.inserts[key] = in
+			c.order = append(c.order, queuedInsert{key: key, in: in})
+			c.mu.Unlock()
+
+			in.ids, in.err = create()
+
+			c.mu.Lock()
+			if len(in.ids) == 0 && c.inserts[key] == in {
+				delete(c.inserts, key) // nothing inserted, so a retry can insert
+			}
+			c.mu.Unlock()
+			close(in.done)
+			return in.ids, false, in.err
+		}
+		c.mu.Unlock()
+
+		if in.hash != hash {
+			return nil, false, ErrIdempotencyKeyReused
+		}
+		select {
+		case <-in.done:
+		case <-ctx.Done():
+			return nil, false, ErrInsertInProgress
+		}
+		if len(in.ids) == 0 {
+			continue // nothing inserted and not saved, so insert again
+		}
+		return in.ids, true, in.err
+	}
+}
+
+// expire removes inserts received more than the window ago. An insert in
+// progress is removed after it's done. The caller must lock c.mu.
+func (c *idempotencyCache) expire(now time.Time) {
+	n := 0
+	for _, q := range c.order {
+		if c.inserts[q.key] == q.in { // else deleted or stale
+			if now.Sub(q.in.received) < c.window || !q.in.isDone() {
+				break
+			}
+			delete(c.inserts, q.key)
+		}
+		n++
+	}
+	c.order = c.order[n:]
+}
+
+// evict removes the oldest inserts that are done until there are fewer than
+// max, even if they're in the window. Inserts in progress are not removed, so
+// there can be more than max while they're running. The caller must lock c.mu.
+func (c *idempotencyCache) evict() {
+	order := c.order[:0]
+	for _, q := range c.order {
+		if c.inserts[q.key] != q.in {
+			continue // deleted or stale
+		}
+		if len(c.inserts) >= c.max && q.in.isDone() {
+			delete(c.inserts, q.key)
+			continue
+		}
+		order = append(order, q)
+	}
+	c.order = order
+}
+
+func (in *idempotentInsert) isDone() bool {
+	select {
+	case <-in.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// entitiesHash returns a hash of the entities, in order, for comparing the
+// entities of inserts with the same idempotency key.
+func entitiesHash(entities []etre.Entity) (string, error) {
+	h := sha256.New()
+	for _, e := range entities {
+		b, err := e.CanonicalJSON()
+		if err != nil {
+			return "", err
+		}
+		h.Write(b)
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -5,8 +5,10 @@ package api_test
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -52,7 +54,6 @@ func TestQueryBasic(t *testing.T) {
 	expectFilter := etre.QueryFilter{}
 	assert.Equal(t, expectFilter, gotFilter)
 
-	fixRev(gotEntities) // JSON float64(_rev) ->, int64(_rev)
 	assert.Equal(t, testEntities, gotEntities)
 
 	// -- Metrics -----------------------------------------------------------
@@ -301,6 +302,329 @@ func TestQueryErrorsNoEntityType(t *testing.T) {
 	assert.Equal(t, expectMetrics, server.metricsrec.Called)
 }
 
+func TestQueryLimitOffset(t *testing.T) {
+	// Test that GET /entities/:type?query=Q&limit=N&offset=M passes the paging
+	// options to the store in the query filter
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			gotFilter = f
+			return testEntitiesWithObjectIDs, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b") + "&limit=2&offset=1"
+
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.QueryFilter{Limit: 2, Offset: 1}, gotFilter)
+
+	// Invalid values are a client error
+	for _, param := range []string{"limit=x", "limit=-1", "offset=x"} {
+		gotFilter = etre.QueryFilter{}
+		etreurl = server.url + etre.API_ROOT + "/entities/" + entityType +
+			"?query=" + url.QueryEscape("a=b") + "&" + param
+
+		var gotError etre.Error
+		statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, param)
+		assert.Equal(t, "invalid-param", gotError.Type, param)
+		assert.Equal(t, etre.QueryFilter{}, gotFilter, "store called, expected error before db query")
+	}
+}
+
+func TestQuerySort(t *testing.T) {
+	// Test that GET /entities/:type?query=Q&sort=a,-b passes the sort labels
+	// to the store in order
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			gotFilter = f
+			return testEntitiesWithObjectIDs, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b") + "&sort=hostname,-_rev"
+
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.QueryFilter{Sort: []string{"hostname", "-_rev"}}, gotFilter)
+
+	// Empty sort label is a client error
+	gotFilter = etre.QueryFilter{}
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b") + "&sort=hostname,-"
+
+	var gotError etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, "invalid-param", gotError.Type)
+	assert.Equal(t, etre.QueryFilter{}, gotFilter, "store called, expected error before db query")
+}
+
+func TestQueryLabelPaths(t *testing.T) {
+	// Test that GET /entities/:type?query=Q&labels=a.b passes dotted paths to the
+	// store, and overlapping paths are a client error
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			gotFilter = f
+			return testEntitiesWithObjectIDs, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b") + "&labels=hostname,metadata.region,hostname"
+
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.QueryFilter{ReturnLabels: []string{"hostname", "metadata.region"}}, gotFilter)
+
+	for _, labels := range []string{"metadata,metadata.region", "metadata..region", "a.$b"} {
+		gotFilter = etre.QueryFilter{}
+		etreurl = server.url + etre.API_ROOT + "/entities/" + entityType +
+			"?query=" + url.QueryEscape("a=b") + "&labels=" + url.QueryEscape(labels)
+		var gotError etre.Error
+		statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, labels)
+		assert.Equal(t, "invalid-param", gotError.Type, labels)
+		assert.Equal(t, etre.QueryFilter{}, gotFilter, "store called, expected error before db query")
+	}
+}
+
+func TestQueryConsistency(t *testing.T) {
+	// Test that GET /entities/:type?query=Q&consistency=C passes the consistency
+	// to the store, and an invalid one is a client error
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			gotFilter = f
+			return testEntitiesWithObjectIDs, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b") + "&consistency=strong"
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.QueryFilter{Consistency: etre.CONSISTENCY_STRONG}, gotFilter)
+
+	gotFilter = etre.QueryFilter{}
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b") + "&consistency=linearizable"
+	var gotError etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, "invalid-param", gotError.Type)
+	assert.Equal(t, etre.QueryFilter{}, gotFilter, "store called, expected error before db query")
+}
+
+func TestQueryDeleted(t *testing.T) {
+	// Test that GET /entities/:type?query=Q&deleted=D passes IncludeDeleted or
+	// OnlyDeleted to the store, and an invalid value is a client error
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			gotFilter = f
+			return testEntitiesWithObjectIDs, nil
+		},
+		CountEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) (int64, error) {
+			gotFilter = f
+			return 1, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b") + "&deleted=include"
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.QueryFilter{IncludeDeleted: true}, gotFilter)
+
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType +
+		"/count?query=" + url.QueryEscape("a=b") + "&deleted=only"
+	var n int64
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &n)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.QueryFilter{OnlyDeleted: true}, gotFilter)
+
+	gotFilter = etre.QueryFilter{}
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b") + "&deleted=yes"
+	var gotError etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, "invalid-param", gotError.Type)
+	assert.Equal(t, etre.QueryFilter{}, gotFilter, "store called, expected error before db query")
+}
+
+func TestCount(t *testing.T) {
+	// Test that GET /entities/:type/count?query=Q returns only the count
+	var gotQuery query.Query
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		CountEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) (int64, error) {
+			gotQuery = q
+			gotFilter = f
+			return 5, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/count?query=" + url.QueryEscape("foo=bar")
+
+	var got int64
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &got)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, int64(5), got)
+	expectQuery := query.Query{
+		Predicates: []query.Predicate{{Label: "foo", Operator: "=", Value: "bar"}},
+	}
+	assert.Equal(t, expectQuery, gotQuery)
+	assert.Equal(t, etre.QueryFilter{}, gotFilter)
+
+	// Distinct requires 1 label
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "/count?query=" + url.QueryEscape("foo=bar") + "&distinct"
+	var gotError etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	// Query required
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "/count"
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestAggregate(t *testing.T) {
+	// Test that GET /entities/:type/aggregate?query=Q&group=L returns the groups
+	var gotQuery query.Query
+	var gotGroupBy []string
+	var gotFilter etre.QueryFilter
+	groups := []etre.GroupResult{
+		{Group: etre.Entity{"dc": "east", "zone": nil}, Count: 2},
+		{Group: etre.Entity{"dc": "west", "zone": "a"}, Count: 1},
+	}
+	store := mock.EntityStore{
+		AggregateEntitiesFunc: func(entityType string, q query.Query, groupBy []string, f etre.QueryFilter) ([]etre.GroupResult, error) {
+			gotQuery = q
+			gotGroupBy = groupBy
+			gotFilter = f
+			return groups, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/aggregate?query=" + url.QueryEscape("foo=bar") + "&group=dc,zone&limit=10&offset=1"
+
+	var got []etre.GroupResult
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &got)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, groups, got)
+	expectQuery := query.Query{
+		Predicates: []query.Predicate{{Label: "foo", Operator: "=", Value: "bar"}},
+	}
+	assert.Equal(t, expectQuery, gotQuery)
+	assert.Equal(t, []string{"dc", "zone"}, gotGroupBy)
+	assert.Equal(t, etre.QueryFilter{Limit: 10, Offset: 1}, gotFilter)
+
+	// No groups is an empty list, not null
+	groups = nil
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "/aggregate?query=" + url.QueryEscape("foo=bar") + "&group=dc"
+	got = nil
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &got)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, []etre.GroupResult{}, got)
+
+	// Group-by labels required, valid, and unique
+	gotGroupBy = nil
+	for _, group := range []string{"", "&group=", "&group=a.b", "&group=dc,", "&group=dc,dc"} {
+		etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "/aggregate?query=" + url.QueryEscape("foo=bar") + group
+		var gotError etre.Error
+		statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, group)
+		assert.Equal(t, "invalid-param", gotError.Type, group)
+	}
+	assert.Nil(t, gotGroupBy)
+}
+
+func TestExplain(t *testing.T) {
+	// Test that GET /entities/:type/explain?query=Q returns the plan, not entities
+	var gotQuery query.Query
+	var gotFilter etre.QueryFilter
+	plan := etre.QueryPlan{Stage: "IXSCAN", Index: "x_1", KeysExamined: 2, DocsExamined: 2, Returned: 1, TimeMs: 3}
+	store := mock.EntityStore{
+		ExplainEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) (etre.QueryPlan, error) {
+			gotQuery = q
+			gotFilter = f
+			return plan, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/explain?query=" + url.QueryEscape("foo=bar") + "&sort=-x&limit=10&offset=1"
+
+	var got etre.QueryPlan
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &got)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, plan, got)
+	expectQuery := query.Query{
+		Predicates: []query.Predicate{{Label: "foo", Operator: "=", Value: "bar"}},
+	}
+	assert.Equal(t, expectQuery, gotQuery)
+	assert.Equal(t, etre.QueryFilter{Sort: []string{"-x"}, Limit: 10, Offset: 1}, gotFilter)
+
+	// Distinct cannot be explained
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "/explain?query=" + url.QueryEscape("foo=bar") + "&labels=x&distinct"
+	var gotError etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, "invalid-query", gotError.Type)
+
+	// Query required
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "/explain"
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+}
+
 func TestQueryErrorsTimeout(t *testing.T) {
 	// Test that GET /entities/:type?query=Q handles a database timeout correctly.
 	// Db errors (and only db errors return HTTP 503 "Service Unavailable".
@@ -323,7 +647,9 @@ func TestQueryErrorsTimeout(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
-	assert.Equal(t, "db-read", gotError.Type)
+	assert.Equal(t, "db-query-timeout", gotError.Type)
+	assert.ErrorIs(t, gotError, etre.ErrQueryTimeout)
+	assert.ErrorIs(t, gotError, etre.ErrDBError)
 
 	if len(server.metricsrec.Called) == 8 {
 		if server.metricsrec.Called[7].Metric != metrics.LatencyMs || server.metricsrec.Called[7].IntVal < 90 || server.metricsrec.Called[7].IntVal > 150 {
@@ -377,3 +703,213 @@ func TestResponseCompression(t *testing.T) {
 	// Make sure content type is correct
 	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
 }
+
+func TestQueryBSON(t *testing.T) {
+	// Test that GET /entities/:type and GET /entity/:type/:id return BSON if the
+	// client accepts it, which preserves number types
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			return []etre.Entity{
+				{"_id": testEntityId0, "_type": "node", "_rev": int64(1), "x": int32(1), "y": 2.5},
+			}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	expect := etre.Entity{"_id": testEntityIds[0], "_type": "node", "_rev": int64(1), "x": int32(1), "y": 2.5}
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:     entityType,
+		Addr:           server.url,
+		HTTPClient:     http.DefaultClient,
+		ResponseFormat: etre.RESPONSE_FORMAT_BSON,
+	})
+	entities, err := ec.Query("x=1", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{expect}, entities)
+
+	entity, err := ec.Get(testEntityIds[0])
+	require.NoError(t, err)
+	assert.Equal(t, expect, entity)
+
+	// JSON otherwise
+	req, err := http.NewRequest("GET", server.url+etre.API_ROOT+"/entity/"+entityType+"/"+testEntityIds[0], nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", etre.CONTENT_TYPE_JSON)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, etre.CONTENT_TYPE_JSON, res.Header.Get("Content-Type"))
+}
+
+type cacheObserver struct {
+	hits []bool
+}
+
+func (o *cacheObserver) ObserveRequest(string, time.Duration, error) {}
+
+func (o *cacheObserver) ObserveCache(op string, hit bool) {
+	o.hits = append(o.hits, hit)
+}
+
+func TestQueryETag(t *testing.T) {
+	// Test that GET /entities/:type returns an ETag and 304 Not Modified if
+	// header If-None-Match matches it, which the client caches
+	x := "a"
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			return []etre.Entity{{"_id": testEntityId0, "x": x}}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=x"
+	res, err := http.Get(etreurl)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	etag := res.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	for _, inm := range []string{etag, "*", `"other", ` + etag} {
+		req, err := http.NewRequest("GET", etreurl, nil)
+		require.NoError(t, err)
+		req.Header.Set("If-None-Match", inm)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotModified, res.StatusCode, inm)
+		assert.Empty(t, body)
+	}
+
+	obs := &cacheObserver{}
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:     entityType,
+		Addr:           server.url,
+		HTTPClient:     http.DefaultClient,
+		QueryCacheSize: 10,
+		Observer:       obs,
+	})
+	for i := 0; i < 2; i++ {
+		entities, err := ec.Query("x", etre.QueryFilter{})
+		require.NoError(t, err)
+		assert.Equal(t, []etre.Entity{{"_id": testEntityIds[0], "x": "a"}}, entities)
+	}
+	x = "b" // changes the ETag
+	entities, err := ec.Query("x", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"_id": testEntityIds[0], "x": "b"}}, entities)
+	assert.Equal(t, []bool{false, true, false}, obs.hits)
+}
+
+func TestQueryETagNested(t *testing.T) {
+	// Test that the BSON ETag is the same for the same entities with nested
+	// documents, which are maps with random iteration order
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			nested := map[string]interface{}{}
+			for i := 0; i < 10; i++ {
+				nested[fmt.Sprintf("k%d", i)] = []interface{}{map[string]interface{}{"a": i, "b": i}}
+			}
+			return []etre.Entity{{"_id": testEntityId0, "x": "a", "meta": nested}}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etags := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		req, err := http.NewRequest("GET", server.url+etre.API_ROOT+"/entities/"+entityType+"?query=x", nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", etre.CONTENT_TYPE_BSON)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, etre.CONTENT_TYPE_BSON, res.Header.Get("Content-Type"))
+		etags[res.Header.Get("ETag")] = true
+	}
+	assert.Len(t, etags, 1)
+}
+
+func TestQueryNDJSON(t *testing.T) {
+	// Test that GET /entities/:type streams NDJSON if the client accepts it
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			return []etre.Entity{{"_id": testEntityId0, "x": "a"}, {"_id": testEntityId1, "x": "b"}}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:   entityType,
+		Addr:         server.url,
+		HTTPClient:   http.DefaultClient,
+		StreamNDJSON: true,
+	})
+	it, err := ec.Stream(context.Background(), "x", etre.QueryFilter{})
+	require.NoError(t, err)
+	var got []etre.Entity
+	for it.Next() {
+		got = append(got, it.Entity())
+	}
+	require.NoError(t, it.Err())
+	expect := []etre.Entity{{"_id": testEntityIds[0], "x": "a"}, {"_id": testEntityIds[1], "x": "b"}}
+	assert.Equal(t, expect, got)
+
+	req, err := http.NewRequest("GET", server.url+etre.API_ROOT+"/entities/"+entityType+"?query=x", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", etre.CONTENT_TYPE_NDJSON)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, etre.CONTENT_TYPE_NDJSON, res.Header.Get("Content-Type"))
+	assert.Empty(t, res.Header.Get("ETag"))
+	assert.Equal(t, 2, strings.Count(string(body), "\n"))
+}
+
+func TestGetEntitiesLabels(t *testing.T) {
+	// Test GET /entities/:type/labels returns the labels from store.ReadLabels
+	var gotEntityType string
+	store := mock.EntityStore{
+		ReadLabelsFunc: func(entityType string) ([]string, error) {
+			gotEntityType = entityType
+			return []string{"_id", "_rev", "_type", "host"}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/labels"
+	var gotLabels []string
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotLabels)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, entityType, gotEntityType)
+	assert.Equal(t, []string{"_id", "_rev", "_type", "host"}, gotLabels)
+
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Read, IntVal: 1},
+		{Method: "Inc", Metric: metrics.ReadLabels, IntVal: 1},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+
+	// No entities: empty list, not null
+	store.ReadLabelsFunc = func(entityType string) ([]string, error) {
+		return nil, nil
+	}
+	server = setup(t, defaultConfig, store)
+	defer server.ts.Close()
+	gotLabels = nil
+	statusCode, err = test.MakeHTTPRequest("GET", server.url+etre.API_ROOT+"/entities/"+entityType+"/labels", nil, &gotLabels)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, []string{}, gotLabels)
+}
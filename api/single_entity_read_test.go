@@ -3,6 +3,7 @@
 package api_test
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -55,7 +56,6 @@ func TestGetEntityBasic(t *testing.T) {
 	expectFilter := etre.QueryFilter{}
 	assert.Equal(t, expectFilter, gotFilter)
 
-	fixRev([]etre.Entity{gotEntity}) // JSON float64(_rev) ->, int64(_rev)
 	assert.Equal(t, testEntities[0], gotEntity)
 
 	// -- Metrics -----------------------------------------------------------
@@ -295,3 +295,67 @@ func TestGetEntityLabels(t *testing.T) {
 		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
 	}}, server.auth.AuthorizeArgs)
 }
+
+func TestGetEntityHistory(t *testing.T) {
+	// Test that GET /entity/:type/:id/history returns the CDC events of the entity
+	server := setup(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	var gotType, gotId string
+	var gotLimit int64
+	events := []etre.CDCEvent{
+		{Id: "e0", Op: etre.CDC_OP_INSERT, EntityId: testEntityIds[0], EntityType: entityType, EntityRev: 0},
+		{Id: "e1", Op: etre.CDC_OP_UPDATE, EntityId: testEntityIds[0], EntityType: entityType, EntityRev: 1},
+	}
+	server.cdcStore.HistoryFunc = func(ctx context.Context, entityType, entityId string, limit int64) ([]etre.CDCEvent, error) {
+		gotType, gotId, gotLimit = entityType, entityId, limit
+		return events, nil
+	}
+
+	ec := etre.NewEntityClient(entityType, server.url, http.DefaultClient)
+	got, err := ec.History(testEntityIds[0], 0)
+	require.NoError(t, err)
+	assert.Equal(t, events, got)
+	assert.Equal(t, entityType, gotType)
+	assert.Equal(t, testEntityIds[0], gotId)
+	assert.Equal(t, int64(0), gotLimit)
+	assert.Equal(t, []mock.AuthorizeArgs{{
+		Action: auth.Action{Op: auth.OP_READ, EntityType: entityType},
+		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
+	}}, server.auth.AuthorizeArgs)
+
+	_, err = ec.History(testEntityIds[0], 5)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), gotLimit)
+
+	// No events is an empty list, not an error
+	events = nil
+	got, err = ec.History(testEntityIds[0], 0)
+	require.NoError(t, err)
+	assert.Equal(t, []etre.CDCEvent{}, got)
+
+	// Errors
+	var gotErr etre.Error
+	statusCode, err := test.MakeHTTPRequest("GET", server.url+etre.API_ROOT+"/entity/"+entityType+"/"+testEntityIds[0]+"/history?limit=-1", nil, &gotErr)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, "invalid-param", gotErr.Type)
+
+	statusCode, err = test.MakeHTTPRequest("GET", server.url+etre.API_ROOT+"/entity/"+entityType+"/abc/history", nil, &gotErr)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	server.cdcStore.HistoryFunc = func(ctx context.Context, entityType, entityId string, limit int64) ([]etre.CDCEvent, error) {
+		return nil, fmt.Errorf("db error")
+	}
+	_, err = ec.History(testEntityIds[0], 0)
+	assert.ErrorIs(t, err, etre.ErrInternalError)
+
+	cfg := defaultConfig
+	cfg.CDC.Disabled = true
+	server2 := setup(t, cfg, mock.EntityStore{})
+	defer server2.ts.Close()
+	ec = etre.NewEntityClient(entityType, server2.url, http.DefaultClient)
+	_, err = ec.History(testEntityIds[0], 0)
+	assert.ErrorIs(t, err, etre.ErrCDCDisabled)
+}
@@ -91,6 +91,45 @@ func TestPostEntityOK(t *testing.T) {
 	}}, server.auth.AuthorizeArgs)
 }
 
+func TestPostEntityTraceCaller(t *testing.T) {
+	// Test that the CDC caller is only the authenticated caller, not the trace
+	// user, which the client can set to anything
+	var gotWO entity.WriteOp
+	store := mock.EntityStore{
+		CreateEntitiesFunc: func(wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			gotWO = wo
+			return []string{"id1"}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+	server.auth.AuthenticateFunc = func(*http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: auth.DefaultCallerName, MetricGroups: []string{"test"}}, nil
+	}
+
+	test.Headers = map[string]string{
+		etre.TRACE_HEADER: etre.TraceContext{"app": "foo", "user": "bob"}.String(),
+	}
+	defer func() { test.Headers = map[string]string{} }()
+
+	payload, err := json.Marshal([]etre.Entity{{"x": 2}})
+	require.NoError(t, err)
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType
+
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, statusCode)
+	assert.Equal(t, auth.DefaultCallerName, gotWO.Caller)
+
+	// Authenticated caller
+	server.auth.AuthenticateFunc = nil
+	statusCode, err = test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, statusCode)
+	assert.Equal(t, "test", gotWO.Caller) // from mock.AuthRecorder
+}
+
 func TestPostEntityDuplicate(t *testing.T) {
 	// Test that POST /entities/:type returns HTTP 403 Conflict on duplicate
 	// which we simulate by returning what entity.Store would:
@@ -281,7 +320,7 @@ func TestPutEntityOK(t *testing.T) {
 				Diff: etre.Entity{
 					"_id":   testEntityIds[0],
 					"_type": entityType,
-					"_rev":  float64(0),
+					"_rev":  int64(0),
 					"foo":   "oldVal",
 				},
 			},
@@ -319,6 +358,135 @@ func TestPutEntityOK(t *testing.T) {
 	}}, server.auth.AuthorizeArgs)
 }
 
+func TestPutEntityArrayOps(t *testing.T) {
+	// Test that array operators in the patch are passed to UpdateEntities(),
+	// with JSON numbers converted like label values, and are errors with
+	// updateMode=replace, with invalid values, and on create
+	var gotPatch etre.Entity
+	called := false
+	store := mock.EntityStore{
+		UpdateEntitiesFunc: func(wo entity.WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+			called = true
+			gotPatch = patch
+			diff := []etre.Entity{
+				{"_id": testEntityId0, "_type": entityType, "_rev": int64(0), "tags": []interface{}{"a"}},
+			}
+			return diff, nil
+		},
+		CreateEntitiesFunc: func(wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			called = true
+			return []string{testEntityIds[0]}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+	payload := []byte(`{"tags":{"$addToSet":["b",2]},"old":{"$pull":[true]}}`)
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	expect := etre.Entity{
+		"tags": map[string]interface{}{etre.ARRAY_OP_ADD_TO_SET: []interface{}{"b", 2}},
+		"old":  map[string]interface{}{etre.ARRAY_OP_PULL: []interface{}{true}},
+	}
+	assert.Equal(t, expect, gotPatch)
+
+	// Replace sets labels to patch values, so array operators are not supported
+	called = false
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl+"?updateMode=replace", payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-param", gotWR.Error.Type)
+	assert.False(t, called)
+
+	// Values must be valid label values
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl, []byte(`{"tags":{"$addToSet":[{"a":"b"}]}}`), &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-value-type", gotWR.Error.Type)
+	assert.False(t, called)
+
+	// Not allowed on create
+	gotWR = etre.WriteResult{}
+	etreurl = server.url + etre.API_ROOT + "/entity/" + entityType
+	statusCode, err = test.MakeHTTPRequest("POST", etreurl, []byte(`{"tags":{"$addToSet":["a"]}}`), &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-array-op", gotWR.Error.Type)
+	assert.False(t, called)
+}
+
+func TestPutEntityIncrement(t *testing.T) {
+	// Test that the counter operator is passed to UpdateEntities() with an
+	// int64 delta, and is an error with updateMode=replace, with a non-integer
+	// delta, and on create
+	var gotPatch etre.Entity
+	called := false
+	store := mock.EntityStore{
+		UpdateEntitiesFunc: func(wo entity.WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+			called = true
+			gotPatch = patch
+			diff := []etre.Entity{
+				{"_id": testEntityId0, "_type": entityType, "_rev": int64(0), "restarts": int64(2)},
+			}
+			return diff, nil
+		},
+		CreateEntitiesFunc: func(wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			called = true
+			return []string{testEntityIds[0]}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+	payload := []byte(`{"restarts":{"$inc":1}}`)
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	expect := etre.Entity{
+		"restarts": map[string]interface{}{etre.COUNTER_OP_INC: int64(1)},
+	}
+	assert.Equal(t, expect, gotPatch)
+
+	// Replace sets labels to patch values, so counter operators are not supported
+	called = false
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl+"?updateMode=replace", payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-param", gotWR.Error.Type)
+	assert.False(t, called)
+
+	// Delta must be an integer
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl, []byte(`{"restarts":{"$inc":1.5}}`), &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-value-type", gotWR.Error.Type)
+	assert.False(t, called)
+
+	// Not allowed on create
+	gotWR = etre.WriteResult{}
+	etreurl = server.url + etre.API_ROOT + "/entity/" + entityType
+	statusCode, err = test.MakeHTTPRequest("POST", etreurl, []byte(`{"restarts":{"$inc":1}}`), &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-counter-op", gotWR.Error.Type)
+	assert.False(t, called)
+}
+
 func TestPutEntityDuplicate(t *testing.T) {
 	// Test that PUT /entities/:type/:id returns HTTP 403 Conflict on duplicate
 	// which we simulate by returning what entity.Store would:
@@ -407,6 +575,72 @@ func TestPutEntityNotFound(t *testing.T) {
 	assert.Equal(t, expectMetrics, server.metricsrec.Called)
 }
 
+func TestPutEntityRev(t *testing.T) {
+	// Test that PUT /entities/:type/:id?rev=N updates only if the entity _rev
+	// is N, else returns HTTP 409 Conflict with the current _rev
+	var gotQuery query.Query
+	var currentRev int64 = 3
+	store := mock.EntityStore{
+		UpdateEntitiesFunc: func(wo entity.WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+			gotQuery = q
+			if q.Predicates[1].Value != fmt.Sprintf("%d", currentRev) {
+				return []etre.Entity{}, nil // _rev didn't match
+			}
+			return []etre.Entity{{"_id": testEntityId0, "_type": entityType, "_rev": currentRev, "foo": "oldVal"}}, nil
+		},
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			return []etre.Entity{{"_rev": currentRev}}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	payload, err := json.Marshal(etre.Entity{"foo": "bar"})
+	require.NoError(t, err)
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+
+	// Rev matches: updated
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl+"?rev=3", payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Nil(t, gotWR.Error)
+	require.Len(t, gotWR.Writes, 1)
+	expectQuery, _ := query.Translate("_id=" + testEntityIds[0] + ",_rev=3")
+	assert.Equal(t, expectQuery, gotQuery)
+
+	// Rev doesn't match: conflict with current rev
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl+"?rev=2", payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "rev-conflict", gotWR.Error.Type)
+	assert.Equal(t, int64(3), gotWR.Error.Rev)
+	assert.Equal(t, testEntityIds[0], gotWR.Error.EntityId)
+	assert.ErrorIs(t, *gotWR.Error, etre.ErrRevConflict)
+	assert.Empty(t, gotWR.Writes)
+
+	// Entity doesn't exist: not found
+	store.ReadEntitiesFunc = func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+		return []etre.Entity{}, nil
+	}
+	server2 := setup(t, defaultConfig, store)
+	defer server2.ts.Close()
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", server2.url+etre.API_ROOT+"/entity/"+entityType+"/"+testEntityIds[0]+"?rev=2", payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+
+	// Invalid rev
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl+"?rev=x", payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-param", gotWR.Error.Type)
+}
+
 func TestPutEntityErrors(t *testing.T) {
 	// Test that PUT /entities/:type/:id returns errors unless all inputs are correct
 	updated := false
@@ -579,7 +813,7 @@ func TestDeleteEntityOK(t *testing.T) {
 	var gotWO entity.WriteOp
 	var gotQuery query.Query
 	store := mock.EntityStore{
-		DeleteEntitiesFunc: func(wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+		DeleteEntitiesFunc: func(wo entity.WriteOp, q query.Query, limit int) ([]etre.Entity, error) {
 			gotWO = wo
 			gotQuery = q
 			diff := []etre.Entity{
@@ -611,7 +845,7 @@ func TestDeleteEntityOK(t *testing.T) {
 				Diff: etre.Entity{
 					"_id":   testEntityIds[0],
 					"_type": entityType,
-					"_rev":  float64(0),
+					"_rev":  int64(0),
 					"foo":   "oldVal",
 				},
 			},
@@ -683,7 +917,7 @@ func TestDeleteLabel(t *testing.T) {
 				Diff: etre.Entity{
 					"_id":   testEntityIds[0],
 					"_type": entityType,
-					"_rev":  float64(0),
+					"_rev":  int64(0),
 					"foo":   "oldVal", // deleted label
 				},
 			},
@@ -5,7 +5,8 @@ package auth
 import (
 	"fmt"
 	"net/http"
-	"strings"
+
+	"github.com/square/etre"
 )
 
 type Manager struct {
@@ -33,23 +34,18 @@ func (m Manager) Authenticate(req *http.Request) (Caller, error) {
 	}
 
 	// Set any key-value trace values from header if not already set by plugin
-	traceValue := req.Header.Get("X-Etre-Trace")
+	traceValue := req.Header.Get(etre.TRACE_HEADER)
 	if traceValue != "" {
 		if caller.Trace == nil {
 			caller.Trace = map[string]string{}
 		}
-		keyValPairs := strings.Split(traceValue, ",")
-		for _, kv := range keyValPairs {
-			p := strings.SplitN(kv, "=", 2)
-			if len(p) != 2 {
-				continue // bad value, ignore
-			}
+		for k, v := range etre.ParseTraceContext(traceValue) {
 			// Set trace value if not already set by plugin,
 			// i.e. values from plugin takes precedence
-			if _, ok := caller.Trace[p[0]]; ok {
+			if _, ok := caller.Trace[k]; ok {
 				continue // already set by plugin, ignore
 			}
-			caller.Trace[p[0]] = p[1]
+			caller.Trace[k] = v
 		}
 	}
 
@@ -174,6 +174,12 @@ func (f *WebsocketClient) control(msg map[string]interface{}, now time.Time) err
 		if f.streamStarted {
 			return ErrAlreadyStarted
 		}
+
+		// Optional filter: "types" and "ops" lists
+		filter, err := startFilter(msg)
+		if err != nil {
+			return err
+		}
 		f.streamStarted = true
 
 		v, ok := msg["startTs"]
@@ -183,8 +189,8 @@ func (f *WebsocketClient) control(msg map[string]interface{}, now time.Time) err
 		} else {
 			startTs = time.Now().Unix()
 		}
-		etre.Debug("startTs %d", startTs)
-		go f.runStreamer(startTs)
+		etre.Debug("startTs %d, filter %+v", startTs, filter)
+		go f.runStreamer(startTs, filter)
 
 		// Client expects us to ack their start
 		ack := map[string]string{
@@ -200,7 +206,7 @@ func (f *WebsocketClient) control(msg map[string]interface{}, now time.Time) err
 	return nil
 }
 
-func (f *WebsocketClient) runStreamer(startTs int64) {
+func (f *WebsocketClient) runStreamer(startTs int64, filter etre.CDCFilter) {
 	etre.Debug("runStreamer call")
 	defer etre.Debug("runStreamer return")
 
@@ -210,6 +216,9 @@ func (f *WebsocketClient) runStreamer(startTs int64) {
 	var sendErr error
 	eventsChan := f.stream.Start(startTs)
 	for event := range eventsChan {
+		if !filter.Match(event) {
+			continue
+		}
 		if sendErr = f.send(event); sendErr != nil {
 			break
 		}
@@ -233,6 +242,24 @@ func (f *WebsocketClient) runStreamer(startTs int64) {
 	f.Stop()
 }
 
+// startFilter returns the optional filter in the start control message.
+func startFilter(msg map[string]interface{}) (etre.CDCFilter, error) {
+	var filter etre.CDCFilter
+	if _, ok := msg["types"]; !ok {
+		if _, ok := msg["ops"]; !ok {
+			return filter, nil
+		}
+	}
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return filter, err
+	}
+	if err := json.Unmarshal(bytes, &filter); err != nil {
+		return filter, fmt.Errorf("invalid CDC filter: types and ops must be lists of strings: %s", err)
+	}
+	return filter, filter.Validate()
+}
+
 func (f *WebsocketClient) sendError(err error) error {
 	etre.Debug("Error to client: %s", err)
 	msg := map[string]interface{}{
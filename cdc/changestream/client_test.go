@@ -237,6 +237,61 @@ func TestClientStreamer(t *testing.T) {
 	assert.Equal(t, changestream.ErrWebsocketClosed, gotErr)
 }
 
+func TestClientStreamerFilter(t *testing.T) {
+	// Test that the optional filter in the "start" control message is applied
+	// to events from the Streamer, and that an invalid filter is an error
+	eventsChan := make(chan etre.CDCEvent, 3)
+	streamer := mock.Stream{
+		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+			return eventsChan
+		},
+	}
+	server := setupClient(t, streamer)
+	defer server.ts.Close()
+
+	clientConn, _, err := websocket.DefaultDialer.Dial(server.url, nil)
+	require.NoError(t, err)
+	defer clientConn.Close()
+
+	start := map[string]interface{}{
+		"control": "start",
+		"startTs": 1,
+		"types":   []string{"host"},
+		"ops":     []string{"d"},
+	}
+	err = clientConn.WriteJSON(start)
+	require.NoError(t, err)
+
+	var ack map[string]interface{}
+	err = clientConn.ReadJSON(&ack)
+	require.NoError(t, err)
+	assert.Equal(t, "start", ack["control"])
+	assert.Empty(t, ack["error"])
+
+	eventsChan <- etre.CDCEvent{Id: "abc", Ts: 2, EntityType: "host", Op: "i"}
+	eventsChan <- etre.CDCEvent{Id: "def", Ts: 3, EntityType: "rack", Op: "d"}
+	eventsChan <- etre.CDCEvent{Id: "ghi", Ts: 4, EntityType: "host", Op: "d"}
+	var recvdEvent etre.CDCEvent
+	err = clientConn.ReadJSON(&recvdEvent)
+	require.NoError(t, err)
+	assert.Equal(t, "ghi", recvdEvent.Id)
+
+	// Invalid op
+	server2 := setupClient(t, streamer)
+	defer server2.ts.Close()
+	clientConn2, _, err := websocket.DefaultDialer.Dial(server2.url, nil)
+	require.NoError(t, err)
+	defer clientConn2.Close()
+	start["ops"] = []string{"x"}
+	err = clientConn2.WriteJSON(start)
+	require.NoError(t, err)
+	var errControl map[string]interface{}
+	err = clientConn2.ReadJSON(&errControl)
+	require.NoError(t, err)
+	assert.Equal(t, "error", errControl["control"])
+	assert.Contains(t, errControl["error"], "invalid op: x")
+}
+
 func TestClientInvalidMessageType(t *testing.T) {
 	// Test that client returns an error control message if given an invalid message
 	eventsChan := make(chan etre.CDCEvent, 1)
@@ -76,6 +76,14 @@ type Store interface {
 	// Read queries a persistent data store for events that satisfy the
 	// given filter.
 	Read(Filter) ([]etre.CDCEvent, error)
+
+	// LatestTs returns the Ts of the most recent event that matches the filter,
+	// or zero if there are none. It reads one event, not all events.
+	LatestTs(context.Context, etre.CDCFilter) (int64, error)
+
+	// History returns the events of one entity in EntityRev order, ascending.
+	// If limit is greater than zero, it returns only the most recent limit events.
+	History(ctx context.Context, entityType, entityId string, limit int64) ([]etre.CDCEvent, error)
 }
 
 // mongoStore implements the Store interface with MongoDB.
@@ -144,6 +152,49 @@ func (s *store) Read(f Filter) ([]etre.CDCEvent, error) {
 	return events, nil
 }
 
+func (s *store) LatestTs(ctx context.Context, f etre.CDCFilter) (int64, error) {
+	q := bson.M{}
+	if len(f.Types) > 0 {
+		q["entityType"] = bson.M{"$in": f.Types}
+	}
+	if len(f.Ops) > 0 {
+		q["op"] = bson.M{"$in": f.Ops}
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "ts", Value: -1}}).SetProjection(bson.M{"ts": 1})
+	var event etre.CDCEvent
+	if err := s.coll.FindOne(ctx, q, opts).Decode(&event); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return event.Ts, nil
+}
+
+func (s *store) History(ctx context.Context, entityType, entityId string, limit int64) ([]etre.CDCEvent, error) {
+	// Let Mongo sort, unlike Read, because one entity has few events, and the
+	// limit must apply to the most recent. Etre doesn't create indexes, so
+	// without an index on {entityType: 1, entityId: 1, entityRev: -1} in the
+	// CDC collection, this is a collection scan.
+	q := bson.M{"entityType": entityType, "entityId": entityId}
+	opts := options.Find().SetSort(bson.D{{Key: "entityRev", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cursor, err := s.coll.Find(ctx, q, opts)
+	if err != nil {
+		return nil, err
+	}
+	events := []etre.CDCEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i] // ascending
+	}
+	return events, nil
+}
+
 func (s *store) Write(ctx context.Context, event etre.CDCEvent) error {
 	var werr error
 	tries := 1 + s.wrp.RetryCount
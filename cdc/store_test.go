@@ -110,6 +110,33 @@ func TestRead(t *testing.T) {
 	assert.Equal(t, expectedIds, actualIds)
 }
 
+func TestHistory(t *testing.T) {
+	cdcs := setup(t, "", cdc.NoRetryPolicy)
+
+	// The test events have no entity type. Events of e1 are out of order by
+	// rev, but History returns them in rev order.
+	events, err := cdcs.History(context.TODO(), "", "e1", 0)
+	require.NoError(t, err)
+	gotIds := []string{}
+	for _, e := range events {
+		gotIds = append(gotIds, e.Id)
+	}
+	assert.Equal(t, []string{"nru", "p34", "61p", "qwp"}, gotIds)
+
+	// Limit returns the most recent events
+	events, err = cdcs.History(context.TODO(), "", "e1", 2)
+	require.NoError(t, err)
+	gotIds = []string{}
+	for _, e := range events {
+		gotIds = append(gotIds, e.Id)
+	}
+	assert.Equal(t, []string{"61p", "qwp"}, gotIds)
+
+	events, err = cdcs.History(context.TODO(), entityType, "e1", 0)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
 func TestWriteSuccess(t *testing.T) {
 	cdcs := setup(t, "", cdc.NoRetryPolicy)
 
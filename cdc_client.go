@@ -3,14 +3,16 @@
 package etre
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/url"
-	"path"
-	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -19,7 +21,8 @@ import (
 // A CDCClient consumes a change feed of Change Data Capture (CDC) events for
 // all entity types. It handles all control messages. The caller should call
 // Stop when done to shutdown the feed. On error or abnormal shutdown, Error
-// returns the last error.
+// returns the last error. To call handlers by the labels that changed in each
+// event, use a CDCDispatcher with the feed channel.
 type CDCClient interface {
 	// Start starts the CDC feed from the given time. On success, a feed channel
 	// is returned on which the caller can receive CDC events for as long as
@@ -29,10 +32,58 @@ type CDCClient interface {
 	// Error returns the error.
 	Start(time.Time) (<-chan CDCEvent, error)
 
+	// StartContext is like Start but starts the feed from sinceTs, which has the
+	// same units as CDCEvent.Ts (zero starts from the last hour), and
+	// automatically reconnects if the connection is lost or the API closes it.
+	// On reconnect, the feed resumes from the Ts of the last event received by
+	// the caller without resending it. The feed is stopped, and the feed channel
+	// closed, when ctx is cancelled, Stop is called, or on a fatal error, which is
+	// sent to the Errors channel. Fatal errors are ErrCallerBlocked, ErrBadData,
+	// and API client errors (HTTP 4xx status) on reconnect.
+	StartContext(ctx context.Context, sinceTs int64) (<-chan CDCEvent, error)
+
+	// Replay streams stored CDC events with startTs <= Ts <= endTs, in Ts order,
+	// on the returned channel, which is closed when the range is exhausted or
+	// ctx is cancelled. Events are fetched from the API in ranges of
+	// CDCClientConfig.ReplayWindow, not all at once. An error fetching the first
+	// range is returned; on error fetching a later range, the channel is closed
+	// early and Error returns the error. Replay is independent of the feed
+	// started by Start and StartContext.
+	Replay(ctx context.Context, startTs, endTs int64) (<-chan CDCEvent, error)
+
 	// Stop stops the feed and closes the feed channel returned by Start. It is
 	// safe to call multiple times.
 	Stop()
 
+	// Drain stops the feed gracefully: it closes the websocket to stop the API
+	// sending events, sends the events already received or in transit to the feed
+	// channel, in order, then closes the feed channel. Events buffered in the feed
+	// channel can be received after it's closed, so a consumer that receives until
+	// the channel is closed receives every event sent by the API before the feed
+	// stopped, without loss. Drain waits for the feed channel to be closed, so
+	// call it from a goroutine other than the consumer. The feed does not
+	// reconnect while draining. If the consumer blocks for CDC_WRITE_TIMEOUT
+	// seconds, draining stops and Drain returns ErrCallerBlocked like the feed.
+	// If ctx is done first, Drain stops the feed like Stop, which can drop events,
+	// and returns an error that wraps ctx.Err(). If the feed is not started,
+	// Drain returns nil.
+	Drain(ctx context.Context) error
+
+	// Position returns the Ts of the last event sent on the feed channel, or the
+	// start Ts of the feed if none has been sent yet. It's zero if the feed has
+	// not been started, or was started from the last hour (Ts zero) and no event
+	// has been sent. It's safe to call while the feed is running.
+	Position() int64
+
+	// Lag returns how far behind the feed is: the Ts of the most recent CDC event
+	// stored by the API, from a lightweight request (GET /changes/latest) that
+	// doesn't read events, minus Position. It's zero if the feed is caught up.
+	// The latest event matches CDCClientConfig.Filter, so events the feed doesn't
+	// receive don't count. Lag measures delivery to the feed channel, not
+	// processing by the caller, so events buffered in the channel aren't lag. If
+	// Position is zero, it returns ErrNoCDCPosition.
+	Lag(ctx context.Context) (time.Duration, error)
+
 	// Ping pings the API and reports latency. Latency values are all zero on
 	// timeout or error. On error, the feed is most likely closed.
 	Ping(timeout time.Duration) Latency
@@ -40,71 +91,248 @@ type CDCClient interface {
 	// Error returns the error that caused the feed channel to be closed. Start
 	// resets the error.
 	Error() error
+
+	// Errors returns a channel that receives the error that caused the feed
+	// channel to be closed, if any, then is closed after the feed channel is
+	// closed. Start returns a new channel; call Errors after Start.
+	Errors() <-chan error
+
+	// Close stops the feed like Stop, waits for it to close, and closes idle
+	// connections used by Replay and Lag. Then, Start, StartContext, Replay, and
+	// Lag return ErrClientClosed. A closed client cannot be reused; make a new one. Replays
+	// in progress are not stopped; cancel their context for that. It's safe to
+	// call more than once.
+	Close() error
 }
 
+// CDCClientConfig represents required and optional configuration for a CDCClient.
+// This is used to make a CDCClient by calling NewCDCClientWithConfig.
+type CDCClientConfig struct {
+	Addr             string        // Etre server websocket address (e.g. wss://localhost:3848)
+	TLSConfig        *tls.Config   // optional TLS config for wss://
+	BufferSize       int           // feed channel buffer size (see NewCDCClient)
+	ReconnectWait    time.Duration // initial wait before reconnect, doubled on each try (default: 1s)
+	MaxReconnectWait time.Duration // maximum wait between reconnects (default: 30s)
+	ReplayWindow     time.Duration // Ts range fetched per request by Replay (default: 5m)
+	Filter           CDCFilter     // optional filter sent to the API (default: all events)
+	Debug            bool
+	Logger           Logger // optional debug logger (default: STDERR)
+
+	// Clock is the time source for Ping latency, like EntityClientConfig.Clock.
+	// Websocket deadlines and reconnect waits use real time. The default is the
+	// system clock.
+	Clock Clock
+}
+
+const (
+	DEFAULT_CDC_RECONNECT_WAIT     = 1 * time.Second
+	DEFAULT_CDC_MAX_RECONNECT_WAIT = 30 * time.Second
+	DEFAULT_CDC_REPLAY_WINDOW      = 5 * time.Minute
+)
+
 var _ CDCClient = &cdcClient{}
 
 // Internal implementation of CDCClient over a websocket.
 type cdcClient struct {
-	addr       string
-	tlsConfig  *tls.Config
-	bufferSize int
-	dbg        bool
+	addr             string
+	tlsConfig        *tls.Config
+	bufferSize       int
+	reconnectWait    time.Duration
+	maxReconnectWait time.Duration
+	replayWindow     int64 // Ts units
+	filter           CDCFilter
+	httpClient       *http.Client
+	dbg              bool
+	logger           Logger
+	clock            Clock
 	// --
-	*sync.Mutex             // guard function calls
-	wsMutex     *sync.Mutex // guard ws send/write
-	wsConn      *websocket.Conn
-	events      chan CDCEvent
-	err         error        // last error in recv()
-	started     bool         // Start called and successful
-	stopped     bool         // Stop called
-	pingChan    chan Latency // for Ping
+	*sync.Mutex                 // guard function calls
+	wsMutex     *sync.Mutex     // guard ws send/write
+	wsConn      *websocket.Conn // current connection, guarded by wsMutex
+	feed        *cdcFeed        // current or last feed
+	err         error           // last error in recv()
+	started     bool            // Start called and successful
+	stopped     bool            // Stop called
+	closed      bool            // Close called
+	pingChan    chan Latency    // for Ping
+	position    *atomic.Int64   // Ts returned by Position
+}
+
+// cdcFeed is one feed started by Start or StartContext. It's separate from the
+// cdcClient so that the recv goroutine of a stopped feed cannot affect the next
+// feed if the client is restarted.
+type cdcFeed struct {
+	events    chan CDCEvent
+	errs      chan error
+	stopChan  chan struct{} // closed by Stop
+	drainChan chan struct{} // closed by Drain
+	doneChan  chan struct{} // closed by recv on return
+	reconnect bool          // started by StartContext
+
+	// Resume point for reconnect: Ts of last event sent to caller and IDs of
+	// events sent with that Ts, which the API sends again on resume
+	lastTs  int64
+	lastIds map[string]bool
+}
+
+func (f *cdcFeed) stopped() bool {
+	select {
+	case <-f.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *cdcFeed) draining() bool {
+	select {
+	case <-f.drainChan:
+		return true
+	default:
+		return false
+	}
 }
 
 // NewCDCClient creates a CDC feed consumer on the given websocket address.
 // addr must be ws://host:port or wss://host:port.
 //
 // bufferSize causes Start to create and return a buffered feed channel. A value
-// of 10 is reasonable. If the channel blocks, it is closed and Error returns
-// ErrCallerBlocked.
+// of 10 is reasonable. If the channel blocks for CDC_WRITE_TIMEOUT seconds, it is
+// closed and Error returns ErrCallerBlocked.
 //
 // Enable debug prints a lot of low-level feed/websocket logging to STDERR.
 //
 // The client does not automatically ping the server. The caller should run a
 // separate goroutine to periodically call Ping. Every 10-60s is reasonable.
 func NewCDCClient(addr string, tlsConfig *tls.Config, bufferSize int, debug bool) CDCClient {
-	addr += API_ROOT + "/changes"
+	return NewCDCClientWithConfig(CDCClientConfig{
+		Addr:       addr,
+		TLSConfig:  tlsConfig,
+		BufferSize: bufferSize,
+		Debug:      debug,
+	})
+}
+
+// NewCDCClientWithConfig creates a CDC feed consumer like NewCDCClient with
+// additional options. The reconnect options apply only to StartContext.
+func NewCDCClientWithConfig(cfg CDCClientConfig) CDCClient {
+	addr := cfg.Addr + API_ROOT + "/changes"
+	if cfg.ReconnectWait <= 0 {
+		cfg.ReconnectWait = DEFAULT_CDC_RECONNECT_WAIT
+	}
+	if cfg.MaxReconnectWait <= 0 {
+		cfg.MaxReconnectWait = DEFAULT_CDC_MAX_RECONNECT_WAIT
+	}
+	if cfg.ReplayWindow < time.Millisecond {
+		cfg.ReplayWindow = DEFAULT_CDC_REPLAY_WINDOW
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = systemClock{}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg.TLSConfig
 	c := &cdcClient{
-		addr:       addr,
-		tlsConfig:  tlsConfig,
-		bufferSize: bufferSize,
-		dbg:        debug,
+		addr:             addr,
+		tlsConfig:        cfg.TLSConfig,
+		bufferSize:       cfg.BufferSize,
+		reconnectWait:    cfg.ReconnectWait,
+		maxReconnectWait: cfg.MaxReconnectWait,
+		replayWindow:     int64(cfg.ReplayWindow / time.Millisecond),
+		filter:           cfg.Filter,
+		httpClient:       &http.Client{Transport: transport},
+		dbg:              cfg.Debug,
+		logger:           cfg.Logger,
+		clock:            cfg.Clock,
 		// --
 		Mutex:    &sync.Mutex{},
 		wsMutex:  &sync.Mutex{},
 		pingChan: make(chan Latency, 1),
+		position: &atomic.Int64{},
 	}
 	c.debug("addr: %s", addr)
 	return c
 }
 
 func (c *cdcClient) Start(startTime time.Time) (<-chan CDCEvent, error) {
+	startTs := int64(0)
+	if !startTime.IsZero() {
+		startTs = startTime.UnixNano() / int64(time.Millisecond)
+	}
+	return c.start(context.Background(), startTs, false)
+}
+
+func (c *cdcClient) StartContext(ctx context.Context, sinceTs int64) (<-chan CDCEvent, error) {
+	return c.start(ctx, sinceTs, true)
+}
+
+func (c *cdcClient) start(ctx context.Context, startTs int64, reconnect bool) (<-chan CDCEvent, error) {
 	c.debug("Start call")
 	defer c.debug("Start return")
 	c.Lock()
 	defer c.Unlock()
 
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+
 	// If already started, return the existing event chan
 	if c.started {
 		c.debug("already started")
-		return c.events, nil
+		return c.feed.events, nil
 	}
 
-	// Connect
-	u, err := url.Parse(c.addr)
+	if err := c.filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	conn, _, err := c.connect(startTs)
 	if err != nil {
 		return nil, err
 	}
+	c.setConn(conn)
+
+	// Start consuming CDC feed
+	c.debug("cdc feed started")
+	f := &cdcFeed{
+		events:    make(chan CDCEvent, c.bufferSize),
+		errs:      make(chan error, 1),
+		stopChan:  make(chan struct{}),
+		drainChan: make(chan struct{}),
+		doneChan:  make(chan struct{}),
+		reconnect: reconnect,
+		lastTs:    startTs,
+		lastIds:   map[string]bool{},
+	}
+	c.feed = f
+	c.position.Store(startTs)
+	c.started = true
+	c.stopped = false
+	c.err = nil
+	go c.recv(f, conn)
+
+	// Stop when ctx is cancelled, unless feed closes first
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.debug("context done: %v", ctx.Err())
+				c.stop(f)
+			case <-f.doneChan:
+			}
+		}()
+	}
+
+	return f.events, nil
+}
+
+// connect connects to the API and does the start sequence: send start control,
+// receive start control ack. On error, fatal is true if retrying is futile (API
+// returned client error).
+func (c *cdcClient) connect(startTs int64) (conn *websocket.Conn, fatal bool, err error) {
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		return nil, true, err
+	}
 	c.debug("connecting to %s", c.addr)
 	dialer := &websocket.Dialer{
 		TLSClientConfig: c.tlsConfig,
@@ -114,67 +342,274 @@ func (c *cdcClient) Start(startTime time.Time) (<-chan CDCEvent, error) {
 		if resp != nil {
 			defer resp.Body.Close()
 			body, _ := ioutil.ReadAll(resp.Body)
-			_, err = readError(resp, body)
-			return nil, err
+			fatal, err = readError(resp, body)
+			return nil, fatal, err
 		}
-		return nil, fmt.Errorf("websocket.DefaultDialer.Dial(%s): %s", u.String(), err)
+		return nil, false, fmt.Errorf("websocket.DefaultDialer.Dial(%s): %s", u.String(), err)
 	}
-	c.wsConn = conn
 
-	startTs := int64(0)
-	if !startTime.IsZero() {
-		startTs = startTime.UnixNano() / int64(time.Millisecond)
-	}
-
-	// Send start control message
+	// Send start control message. Nothing else can send on conn yet, so
+	// there's no need to guard it like send does.
 	start := map[string]interface{}{
 		"control": "start",
 		"startTs": startTs,
 	}
+	if len(c.filter.Types) > 0 {
+		start["types"] = c.filter.Types
+	}
+	if len(c.filter.Ops) > 0 {
+		start["ops"] = c.filter.Ops
+	}
 	c.debug("sending start")
-	if err := c.send(start); err != nil {
-		c.wsConn.Close()
-		return nil, err
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(CDC_WRITE_TIMEOUT) * time.Second))
+	if err := conn.WriteJSON(start); err != nil {
+		conn.Close()
+		return nil, false, fmt.Errorf("wsConn.WriteJSON: %s", err)
 	}
 
 	// Receive start control ack
 	var ack map[string]string
 	c.debug("waiting for start ack")
-	if err := c.wsConn.ReadJSON(&ack); err != nil {
-		c.wsConn.Close()
-		return nil, fmt.Errorf("wsConn.ReadJSON: %s", err)
+	if err := conn.ReadJSON(&ack); err != nil {
+		conn.Close()
+		return nil, false, fmt.Errorf("wsConn.ReadJSON: %s", err)
 	}
 	c.debug("start ack received: %#v", ack)
 	errMsg, ok := ack["error"]
 	if ok && errMsg != "" {
-		return nil, fmt.Errorf("API error: %s", errMsg)
+		conn.Close()
+		return nil, false, fmt.Errorf("API error: %s", errMsg)
+	}
+	return conn, false, nil
+}
+
+func (c *cdcClient) Replay(ctx context.Context, startTs, endTs int64) (<-chan CDCEvent, error) {
+	c.debug("Replay call: %d-%d", startTs, endTs)
+	c.Lock()
+	closed := c.closed
+	c.Unlock()
+	if closed {
+		return nil, ErrClientClosed
+	}
+	if startTs <= 0 || endTs < startTs {
+		return nil, fmt.Errorf("invalid replay range %d-%d: startTs must be greater than zero and less than or equal to endTs", startTs, endTs)
+	}
+	if err := c.filter.Validate(); err != nil {
+		return nil, err
 	}
 
-	// Start consuming CDC feed
-	c.debug("cdc feed started")
-	c.started = true
-	c.stopped = false
-	c.err = nil
-	c.events = make(chan CDCEvent, c.bufferSize)
-	go c.recv()
+	// Fetch the first range before returning so API errors, like CDC disabled
+	// or not authorized, are returned to the caller
+	until := min(startTs+c.replayWindow, endTs+1) // endTs is inclusive
+	events, err := c.replay(ctx, startTs, until)
+	if err != nil {
+		return nil, err
+	}
+
+	replayChan := make(chan CDCEvent, c.bufferSize)
+	go func() {
+		defer close(replayChan)
+		for {
+			for _, e := range events {
+				if e.Ts < startTs || e.Ts > endTs {
+					continue // shouldn't happen; API returns only events in range
+				}
+				select {
+				case replayChan <- e:
+				case <-ctx.Done():
+					c.debug("context done: %v", ctx.Err())
+					return
+				}
+			}
+			if until > endTs {
+				c.debug("replay done")
+				return
+			}
+			since := until
+			until = min(since+c.replayWindow, endTs+1)
+			if events, err = c.replay(ctx, since, until); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				c.debug("replay error: %s", err)
+				c.Lock()
+				c.err = err
+				c.Unlock()
+				return
+			}
+		}
+	}()
+	return replayChan, nil
+}
+
+// replay fetches stored CDC events with since <= Ts < until from the API.
+func (c *cdcClient) replay(ctx context.Context, since, until int64) ([]CDCEvent, error) {
+	var events []CDCEvent
+	err := c.get(ctx, "/events", fmt.Sprintf("since=%d&until=%d", since, until), &events)
+	return events, err
+}
+
+func (c *cdcClient) Position() int64 {
+	return c.position.Load()
+}
+
+func (c *cdcClient) Lag(ctx context.Context) (time.Duration, error) {
+	c.Lock()
+	closed := c.closed
+	c.Unlock()
+	if closed {
+		return 0, ErrClientClosed
+	}
+	pos := c.Position()
+	if pos == 0 {
+		return 0, ErrNoCDCPosition
+	}
+	var latest CDCLatest
+	if err := c.get(ctx, "/latest", "", &latest); err != nil {
+		return 0, err
+	}
+	if latest.Ts <= pos {
+		return 0, nil
+	}
+	return time.Duration(latest.Ts-pos) * time.Millisecond, nil
+}
 
-	return c.events, nil
+// get makes a GET request to the API path under /changes with the query and
+// the filter, and decodes the JSON response into v.
+func (c *cdcClient) get(ctx context.Context, path, query string, v interface{}) error {
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path += path
+	params := []string{}
+	if query != "" {
+		params = append(params, query)
+	}
+	if len(c.filter.Types) > 0 {
+		params = append(params, "types="+url.QueryEscape(strings.Join(c.filter.Types, ",")))
+	}
+	if len(c.filter.Ops) > 0 {
+		params = append(params, "ops="+strings.Join(c.filter.Ops, ","))
+	}
+	u.RawQuery = strings.Join(params, "&")
+	c.debug("GET %s", u.String())
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %s: %s", u.String(), err)
+	}
+	req.Header.Set(VERSION_HEADER, VERSION)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("request aborted: %w", err)
+		}
+		return fmt.Errorf("http.Client.Do: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("ioutil.ReadAll: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, err := readError(resp, body)
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("json.Unmarshal: %s: %s", err, string(body))
+	}
+	return nil
 }
 
 func (c *cdcClient) Stop() {
+	c.Lock()
+	f := c.feed
+	c.Unlock()
+	c.stop(f)
+}
+
+// stop stops feed f if it's the current feed.
+func (c *cdcClient) stop(f *cdcFeed) {
 	c.debug("Stop call")
 	defer c.debug("Stop return")
 	c.Lock()
 	defer c.Unlock()
-	if c.stopped {
+	if c.stopped || c.feed != f {
 		c.debug("already stopped")
 		return
 	}
+	c.wsMutex.Lock()
 	if c.wsConn != nil {
 		c.wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1000, "etre.CDCClient stopped"))
 		c.wsConn.Close()
 	}
+	c.wsMutex.Unlock()
 	c.stopped = true
+	c.started = false
+	if f != nil {
+		close(f.stopChan)
+	}
+}
+
+func (c *cdcClient) Drain(ctx context.Context) error {
+	c.debug("Drain call")
+	defer c.debug("Drain return")
+	c.Lock()
+	f := c.feed
+	if !c.started || f == nil {
+		c.Unlock()
+		c.debug("not started")
+		return nil
+	}
+	if !f.draining() {
+		// Closing the websocket stops the API sending events, but the API can
+		// send events until it receives the close, so keep receiving until it
+		// closes the websocket, too
+		close(f.drainChan)
+		c.wsMutex.Lock()
+		if c.wsConn != nil {
+			c.wsConn.SetWriteDeadline(time.Now().Add(time.Duration(CDC_WRITE_TIMEOUT) * time.Second))
+			c.wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1000, "etre.CDCClient draining"))
+		}
+		c.wsMutex.Unlock()
+	}
+	c.Unlock()
+
+	select {
+	case <-f.doneChan:
+	case <-ctx.Done():
+		c.debug("context done: %v", ctx.Err())
+		c.stop(f)
+		<-f.doneChan
+		return fmt.Errorf("drain aborted: %w", ctx.Err())
+	}
+	c.Lock()
+	err := c.err
+	c.Unlock()
+	c.stop(f)
+	return err
+}
+
+func (c *cdcClient) Close() error {
+	c.debug("Close call")
+	defer c.debug("Close return")
+	c.Lock()
+	c.closed = true
+	f := c.feed
+	c.Unlock()
+	if f != nil {
+		c.stop(f)
+		<-f.doneChan
+	}
+	c.httpClient.CloseIdleConnections()
+	return nil
 }
 
 func (c *cdcClient) Ping(timeout time.Duration) Latency {
@@ -187,13 +622,21 @@ func (c *cdcClient) Ping(timeout time.Duration) Latency {
 	var lag Latency
 	ping := map[string]interface{}{
 		"control": "ping",
-		"srcTs":   time.Now().UnixNano(),
+		"srcTs":   c.clock.Now().UnixNano(),
 	}
 	if err := c.send(ping); err != nil {
 		// A half-dead/open/close connection is detected by trying to send,
 		// so an error here probably means the API went away without closing
 		// the TCP connection. Receive doesn't detect this, but send does.
-		c.shutdown(err)
+		// If reconnecting, closing the connection makes recv reconnect.
+		c.Lock()
+		f := c.feed
+		c.Unlock()
+		if f != nil && f.reconnect {
+			c.closeConn()
+		} else {
+			c.shutdown(f, err)
+		}
 		return lag
 	}
 	select {
@@ -212,67 +655,187 @@ func (c *cdcClient) Error() error {
 	return c.err
 }
 
+func (c *cdcClient) Errors() <-chan error {
+	c.Lock()
+	defer c.Unlock()
+	if c.feed == nil {
+		return nil
+	}
+	return c.feed.errs
+}
+
 // --------------------------------------------------------------------------
 
 // Receive CDC events and control messages until there's an error or caller
-// calls Stop. Control messages should be infrequent.
-func (c *cdcClient) recv() {
+// calls Stop. Control messages should be infrequent. If the feed reconnects,
+// recv reconnects on non-fatal errors.
+func (c *cdcClient) recv(f *cdcFeed, conn *websocket.Conn) {
 	c.debug("recv call")
 	defer c.debug("recv return")
 
 	var err error
 	defer func() {
 		if err != nil {
-			c.shutdown(err)
+			c.shutdown(f, err)
 		}
-		close(c.events)
+		c.Lock()
+		if c.feed == f {
+			c.started = false
+		}
+		c.Unlock()
+		close(f.events)
+		close(f.errs)
+		close(f.doneChan)
 	}()
 
+	for {
+		err = c.stream(f, conn)
+		if err == nil || f.stopped() {
+			err = nil
+			return
+		}
+		if !f.reconnect || f.draining() || err == ErrCallerBlocked || err == ErrBadData {
+			return
+		}
+		conn, err = c.reconnectFeed(f, err)
+		if err != nil || conn == nil {
+			return
+		}
+	}
+}
+
+// stream receives and handles messages on conn until there's an error, which is
+// returned. The error is nil only if the feed is stopped.
+func (c *cdcClient) stream(f *cdcFeed, conn *websocket.Conn) error {
 	var now time.Time
 	for {
-		_, bytes, rerr := c.wsConn.ReadMessage()
-		now = time.Now()
+		_, bytes, err := conn.ReadMessage()
+		now = c.clock.Now()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				err = rerr
+			if f.stopped() {
+				return nil
 			}
-			return
+			if f.draining() && websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.debug("drained")
+				return nil
+			}
+			return err
 		}
 
 		// CDC events should be the bulk of data we recv, so presume it's that.
 		var e CDCEvent
-		if err = json.Unmarshal(bytes, &e); err != nil {
-			return
+		if err := json.Unmarshal(bytes, &e); err != nil {
+			return err
 		}
 
 		// If event ID is set (not empty), then it's a CDC event as expected
 		if e.Id != "" {
 			c.debug("cdc event: %#v", e)
-			select {
-			case c.events <- e: // send CDC event to caller
-			default:
-				c.debug("caller blocked")
-				c.shutdown(ErrCallerBlocked)
-				return
+			if e.Ts == f.lastTs && f.lastIds[e.Id] {
+				c.debug("duplicate event on resume: %s", e.Id)
+				continue
+			}
+			if err := c.sendEvent(f, e); err != nil {
+				return err
 			}
+			c.position.Store(e.Ts)
+			if e.Ts != f.lastTs {
+				f.lastTs = e.Ts
+				f.lastIds = map[string]bool{}
+			}
+			f.lastIds[e.Id] = true
 		} else {
 			// It's not a CDC event, so it should be a control message
 			var msg map[string]interface{}
-			if err = json.Unmarshal(bytes, &msg); err != nil {
-				return
+			if err := json.Unmarshal(bytes, &msg); err != nil {
+				return err
 			}
 			if _, ok := msg["control"]; !ok {
 				// This shouldn't happen: data is not a CDC event or a control message
-				c.shutdown(ErrBadData)
-				return
+				return ErrBadData
 			}
-			if err = c.control(msg, now); err != nil {
-				return
+			if f.draining() && msg["control"] == "ping" {
+				continue // can't pong after sending close
+			}
+			if err := c.control(msg, now); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendEvent sends the CDC event to the caller, waiting up to CDC_WRITE_TIMEOUT
+// seconds if the feed channel is full.
+func (c *cdcClient) sendEvent(f *cdcFeed, e CDCEvent) error {
+	select {
+	case f.events <- e:
+		return nil
+	default:
+	}
+	c.debug("feed chan full, waiting")
+	timer := time.NewTimer(time.Duration(CDC_WRITE_TIMEOUT) * time.Second)
+	defer timer.Stop()
+	select {
+	case f.events <- e:
+		return nil
+	case <-timer.C:
+		c.debug("caller blocked")
+		return ErrCallerBlocked
+	case <-f.stopChan:
+		return nil
+	}
+}
+
+// reconnectFeed reconnects with backoff, resuming the feed from the last event
+// sent to the caller. It returns the new connection, or nil if the feed is stopped
+// while reconnecting. The error is fatal: it prevents reconnecting.
+func (c *cdcClient) reconnectFeed(f *cdcFeed, lastErr error) (*websocket.Conn, error) {
+	c.closeConn()
+	wait := c.reconnectWait
+	for tryNo := 1; ; tryNo++ {
+		c.debug("reconnect %d in %s: %v", tryNo, wait, lastErr)
+		select {
+		case <-time.After(wait):
+		case <-f.stopChan:
+			return nil, nil
+		}
+		conn, fatal, err := c.connect(f.lastTs)
+		if err == nil {
+			c.Lock()
+			defer c.Unlock()
+			if c.feed != f || f.stopped() {
+				conn.Close() // stopped while connecting
+				return nil, nil
 			}
+			c.setConn(conn)
+			c.debug("reconnected from ts %d", f.lastTs)
+			return conn, nil
+		}
+		if fatal {
+			return nil, err
+		}
+		lastErr = err
+		wait *= 2
+		if wait > c.maxReconnectWait {
+			wait = c.maxReconnectWait
 		}
 	}
 }
 
+func (c *cdcClient) setConn(conn *websocket.Conn) {
+	c.wsMutex.Lock()
+	defer c.wsMutex.Unlock()
+	c.wsConn = conn
+}
+
+func (c *cdcClient) closeConn() {
+	c.wsMutex.Lock()
+	defer c.wsMutex.Unlock()
+	if c.wsConn != nil {
+		c.wsConn.Close()
+	}
+}
+
 // Handle a control message from the API. Returning an error causes the recv loop
 // to shutdown.
 func (c *cdcClient) control(msg map[string]interface{}, now time.Time) error {
@@ -340,29 +903,32 @@ func (c *cdcClient) send(v interface{}) error {
 	return nil
 }
 
-// Close websocket and save error, if not already stopped gracefully.
-func (c *cdcClient) shutdown(err error) {
+// Close websocket and save error, if not already stopped gracefully. Only the
+// current feed can be shut down.
+func (c *cdcClient) shutdown(f *cdcFeed, err error) {
 	c.debug("shutdown call: %v", err)
 	defer c.debug("shutdown return")
 	c.Lock()
 	defer c.Unlock()
-	if c.stopped {
+	if c.stopped || c.feed != f {
 		c.debug("already stopped")
 		return
 	}
-	if c.wsConn != nil {
-		c.wsConn.Close()
-	}
+	c.closeConn()
 	c.err = err
+	if f != nil && c.started {
+		select {
+		case f.errs <- err:
+		default:
+		}
+	}
 }
 
 func (c *cdcClient) debug(msg string, v ...interface{}) {
 	if !c.dbg {
 		return
 	}
-	_, file, line, _ := runtime.Caller(1)
-	msg = fmt.Sprintf("%s:%d %s", path.Base(file), line, msg)
-	debugLog.Printf(msg, v...)
+	debugf(c.logger, 1, msg, v...)
 }
 
 // //////////////////////////////////////////////////////////////////////////
@@ -372,10 +938,17 @@ func (c *cdcClient) debug(msg string, v ...interface{}) {
 var _ CDCClient = MockCDCClient{}
 
 type MockCDCClient struct {
-	StartFunc func(time.Time) (<-chan CDCEvent, error)
-	StopFunc  func()
-	PingFunc  func(time.Duration) Latency
-	ErrorFunc func() error
+	StartFunc        func(time.Time) (<-chan CDCEvent, error)
+	StartContextFunc func(context.Context, int64) (<-chan CDCEvent, error)
+	ReplayFunc       func(context.Context, int64, int64) (<-chan CDCEvent, error)
+	StopFunc         func()
+	DrainFunc        func(context.Context) error
+	PositionFunc     func() int64
+	LagFunc          func(context.Context) (time.Duration, error)
+	PingFunc         func(time.Duration) Latency
+	ErrorFunc        func() error
+	ErrorsFunc       func() <-chan error
+	CloseFunc        func() error
 }
 
 func (c MockCDCClient) Start(startTs time.Time) (<-chan CDCEvent, error) {
@@ -385,6 +958,20 @@ func (c MockCDCClient) Start(startTs time.Time) (<-chan CDCEvent, error) {
 	return nil, nil
 }
 
+func (c MockCDCClient) StartContext(ctx context.Context, sinceTs int64) (<-chan CDCEvent, error) {
+	if c.StartContextFunc != nil {
+		return c.StartContextFunc(ctx, sinceTs)
+	}
+	return nil, nil
+}
+
+func (c MockCDCClient) Replay(ctx context.Context, startTs, endTs int64) (<-chan CDCEvent, error) {
+	if c.ReplayFunc != nil {
+		return c.ReplayFunc(ctx, startTs, endTs)
+	}
+	return nil, nil
+}
+
 func (c MockCDCClient) Stop() {
 	if c.StopFunc != nil {
 		c.StopFunc()
@@ -392,6 +979,27 @@ func (c MockCDCClient) Stop() {
 	return
 }
 
+func (c MockCDCClient) Drain(ctx context.Context) error {
+	if c.DrainFunc != nil {
+		return c.DrainFunc(ctx)
+	}
+	return nil
+}
+
+func (c MockCDCClient) Position() int64 {
+	if c.PositionFunc != nil {
+		return c.PositionFunc()
+	}
+	return 0
+}
+
+func (c MockCDCClient) Lag(ctx context.Context) (time.Duration, error) {
+	if c.LagFunc != nil {
+		return c.LagFunc(ctx)
+	}
+	return 0, nil
+}
+
 func (c MockCDCClient) Ping(timeout time.Duration) Latency {
 	if c.PingFunc != nil {
 		return c.PingFunc(timeout)
@@ -405,3 +1013,17 @@ func (c MockCDCClient) Error() error {
 	}
 	return nil
 }
+
+func (c MockCDCClient) Errors() <-chan error {
+	if c.ErrorsFunc != nil {
+		return c.ErrorsFunc()
+	}
+	return nil
+}
+
+func (c MockCDCClient) Close() error {
+	if c.CloseFunc != nil {
+		return c.CloseFunc()
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2026, Square, Inc.
+
+package etre
+
+import (
+	"context"
+	"sync"
+)
+
+// CDCHandler handles a CDC event. See CDCDispatcher.
+type CDCHandler func(CDCEvent)
+
+// CDCDispatcher calls handlers by the labels that changed in a CDC event, so a
+// feed consumer doesn't compare Old and New for every event. A label changed if
+// it's in CDCEvent.ChangedLabels: its value differs between Old and New, with
+// integer values equal regardless of type, like Diff. It can be used with the
+// feed channel returned by CDCClient.Start, StartContext, or Replay like:
+//
+//	d := etre.NewCDCDispatcher()
+//	d.Handle("status", func(e etre.CDCEvent) {
+//	    // Status changed: e.OldEntity()["status"] -> e.NewEntity()["status"]
+//	})
+//	d.Default(func(e etre.CDCEvent) {
+//	    // No handled label changed
+//	})
+//	err := d.Run(ctx, events)
+//
+// Or call Dispatch for each event received from the channel. Using a
+// CDCDispatcher is optional; the feed channel works without it. It's safe
+// to register handlers while dispatching, but handlers are called in the
+// dispatching goroutine, so a slow handler blocks the next events.
+type CDCDispatcher struct {
+	mu       sync.Mutex
+	handlers map[string]CDCHandler // keyed on label
+	def      CDCHandler
+}
+
+// NewCDCDispatcher returns a CDCDispatcher with no handlers.
+func NewCDCDispatcher() *CDCDispatcher {
+	return &CDCDispatcher{
+		handlers: map[string]CDCHandler{},
+	}
+}
+
+// Handle registers the handler for the label, replacing the current one, if any.
+// A nil handler removes the current one.
+func (d *CDCDispatcher) Handle(label string, h CDCHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if h == nil {
+		delete(d.handlers, label)
+		return
+	}
+	d.handlers[label] = h
+}
+
+// Default registers the handler for events that don't change a label with a
+// handler, including events that change no labels. A nil handler ignores them,
+// which is the default.
+func (d *CDCDispatcher) Default(h CDCHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.def = h
+}
+
+// Dispatch calls the handler of every changed label, in label order, with the
+// event. If there are none, it calls the default handler, if any. It returns
+// true if a label handler was called. Handlers share the event, so they must
+// not change Old or New.
+func (d *CDCDispatcher) Dispatch(e CDCEvent) bool {
+	var handlers []CDCHandler
+	d.mu.Lock()
+	for _, label := range e.ChangedLabels() {
+		if h, ok := d.handlers[label]; ok {
+			handlers = append(handlers, h)
+		}
+	}
+	def := d.def
+	d.mu.Unlock()
+
+	if len(handlers) == 0 {
+		if def != nil {
+			def(e)
+		}
+		return false
+	}
+	for _, h := range handlers {
+		h(e)
+	}
+	return true
+}
+
+// Run dispatches every event received from the channel until it's closed,
+// then returns nil, or until ctx is done, then returns ctx.Err(). When the
+// channel is a feed channel, check CDCClient.Error after Run returns nil to
+// know why the feed was closed.
+func (d *CDCDispatcher) Run(ctx context.Context, events <-chan CDCEvent) error {
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			d.Dispatch(e)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
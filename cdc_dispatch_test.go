@@ -0,0 +1,69 @@
+// Copyright 2026, Square, Inc.
+
+package etre_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/square/etre"
+)
+
+func TestCDCEventChangedLabels(t *testing.T) {
+	tests := []struct {
+		old, new *etre.Entity
+		changed  []string
+	}{
+		{nil, &etre.Entity{"a": 1, "b": "x"}, []string{"a", "b"}},                                // insert
+		{&etre.Entity{"a": 1, "b": "x"}, nil, []string{"a", "b"}},                                // delete
+		{&etre.Entity{"a": int64(1), "b": "x"}, &etre.Entity{"a": 1.0, "b": "y"}, []string{"b"}}, // numbers equal by value
+		{&etre.Entity{"a": 1, "b": "x"}, &etre.Entity{"a": 1}, []string{"b"}},                    // label removed
+		{&etre.Entity{"a": 1}, &etre.Entity{"a": 1}, []string{}},
+	}
+	for _, tt := range tests {
+		e := etre.CDCEvent{Old: tt.old, New: tt.new}
+		assert.Equal(t, tt.changed, e.ChangedLabels())
+	}
+}
+
+func TestCDCDispatcher(t *testing.T) {
+	var got []string
+	d := etre.NewCDCDispatcher()
+	d.Handle("status", func(e etre.CDCEvent) { got = append(got, "status:"+e.Id) })
+	d.Handle("zone", func(e etre.CDCEvent) { got = append(got, "zone:"+e.Id) })
+
+	// No default handler: unhandled events are ignored
+	assert.False(t, d.Dispatch(etre.CDCEvent{Id: "1", Old: &etre.Entity{"x": 1}, New: &etre.Entity{"x": 2}}))
+	assert.Empty(t, got)
+
+	d.Default(func(e etre.CDCEvent) { got = append(got, "default:"+e.Id) })
+	events := []etre.CDCEvent{
+		{Id: "2", Old: &etre.Entity{"status": "up", "zone": "a"}, New: &etre.Entity{"status": "down", "zone": "b"}},
+		{Id: "3", Old: &etre.Entity{"status": "up", "n": 1}, New: &etre.Entity{"status": "up", "n": 2}},
+		{Id: "4", New: &etre.Entity{"zone": "a"}},
+		{Id: "5", Old: &etre.Entity{"zone": "a", "n": int64(1)}, New: &etre.Entity{"zone": "a", "n": 1.0}},
+	}
+	ch := make(chan etre.CDCEvent, len(events))
+	for _, e := range events {
+		ch <- e
+	}
+	close(ch)
+	require.NoError(t, d.Run(context.Background(), ch))
+	expect := []string{"status:2", "zone:2", "default:3", "zone:4", "default:5"}
+	assert.Equal(t, expect, got)
+
+	// Nil handler removes the label handler
+	got = nil
+	d.Handle("zone", nil)
+	assert.False(t, d.Dispatch(events[2]))
+	assert.Equal(t, []string{"default:4"}, got)
+
+	// Run stops when ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := d.Run(ctx, make(chan etre.CDCEvent))
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -3,18 +3,34 @@
 package etre_test
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/square/etre"
 )
@@ -97,6 +113,32 @@ func TestEntityType(t *testing.T) {
 	assert.Equal(t, "node", ec.EntityType())
 }
 
+func TestPing(t *testing.T) {
+	status := map[string]string{"ok": "yes", "version": etre.VERSION}
+	pts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, etre.API_ROOT+"/status", r.URL.Path)
+		json.NewEncoder(w).Encode(status)
+	}))
+	defer pts.Close()
+
+	ec := etre.NewEntityClient("node", pts.URL, httpClient)
+	version, err := ec.ServerVersion()
+	require.NoError(t, err)
+	assert.Equal(t, etre.VERSION, version)
+	assert.NoError(t, ec.Ping())
+
+	status["version"] = "99.0.0"
+	err = ec.Ping()
+	require.Error(t, err)
+	assert.ErrorIs(t, err, etre.ErrVersionMismatch)
+	assert.Contains(t, err.Error(), "99.0.0")
+
+	status["ok"] = "no"
+	_, err = ec.ServerVersion()
+	assert.Error(t, err)
+	assert.NotErrorIs(t, ec.Ping(), etre.ErrVersionMismatch)
+}
+
 func TestQueryAndIdRequired(t *testing.T) {
 	setup(t)
 
@@ -132,6 +174,552 @@ func TestQueryAndIdRequired(t *testing.T) {
 	assert.ErrorIs(t, err, etre.ErrIdNotSet)
 }
 
+func TestContextVariants(t *testing.T) {
+	setup(t)
+	respData = []etre.Entity{}
+
+	// XxxContext uses the given context, not the client's context
+	ec := etre.NewEntityClient("node", ts.URL, httpClient).WithContext(testContext())
+	ctx := testContext()
+	_, err := ec.QueryContext(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, ctx, httpRT.gotCtx)
+	assert.NotEqual(t, ctx, ec.Context(), "client context changed")
+
+	// Cancelled context aborts the request and isn't retried even though
+	// the client is configured to retry
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       ts.URL,
+		HTTPClient: httpClient,
+		Retry:      3,
+		RetryWait:  time.Second,
+	})
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	t0 := time.Now()
+	_, err = ec.QueryContext(cctx, "x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = ec.InsertContext(cctx, []etre.Entity{{"x": 1}})
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = ec.DeleteOneContext(cctx, "abc")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(t0), time.Second, "retried after context cancelled")
+}
+
+func TestWithTraceContext(t *testing.T) {
+	var gotTrace string
+	tts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTrace = r.Header.Get(etre.TRACE_HEADER)
+		w.Write([]byte("[]"))
+	}))
+	defer tts.Close()
+
+	// No trace = no header
+	ec := etre.NewEntityClient("node", tts.URL, httpClient)
+	_, err := ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, gotTrace)
+
+	// Client trace sent with every request in a stable format
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       tts.URL,
+		HTTPClient: httpClient,
+		Trace:      etre.TraceContext{"user": "bob", "app": "foo"},
+	})
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "app=foo,user=bob", gotTrace)
+
+	// Per-call trace overrides and adds values
+	ctx := etre.ContextWithTrace(context.Background(), etre.TraceContext{"user": "alice", "request-id": "123"})
+	_, err = ec.QueryContext(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "app=foo,request-id=123,user=alice", gotTrace)
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "app=foo,user=bob", gotTrace)
+
+	// WithTrace and WithTraceContext replace the client trace. The WithTrace
+	// string is sent as-is, and per-call values replace or are appended to it
+	_, err = ec.WithTrace("host=h1,app=bar").Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "host=h1,app=bar", gotTrace)
+	ctx = etre.ContextWithTrace(context.Background(), etre.TraceContext{"app": "baz", "user": "alice"})
+	_, err = ec.WithTrace("host=h1,app=bar").QueryContext(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "host=h1,app=baz,user=alice", gotTrace)
+	_, err = ec.WithTraceContext(etre.TraceContext{"app": "baz"}).Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "app=baz", gotTrace)
+}
+
+func TestTLSConfig(t *testing.T) {
+	tlsts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer tlsts.Close()
+
+	// Write the server cert (as CA) and key like files from a cert manager
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsts.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, certPEM, 0600))
+	keyFile := filepath.Join(dir, "key.pem")
+	keyDER, err := x509.MarshalPKCS8PrivateKey(tlsts.TLS.Certificates[0].PrivateKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	// Without the CA, the server cert is not trusted
+	ec := etre.NewEntityClient("node", tlsts.URL, &http.Client{})
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.Error(t, err)
+
+	tlsConfig, err := etre.NewTLSConfig(caFile, keyFile, caFile) // cert + key for mTLS
+	require.NoError(t, err)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	tlsConfig, err = etre.NewTLSConfig("", "", caFile)
+	require.NoError(t, err)
+	assert.Empty(t, tlsConfig.Certificates)
+
+	// TLSConfig is set on a copy of the HTTPClient transport
+	httpClient := &http.Client{}
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       tlsts.URL,
+		HTTPClient: httpClient,
+		TLSConfig:  tlsConfig,
+	})
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Nil(t, httpClient.Transport, "HTTPClient modified")
+
+	// Invalid files
+	_, err = etre.NewTLSConfig(caFile, "", "")
+	assert.Error(t, err)
+	_, err = etre.NewTLSConfig("", "", filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+	_, err = etre.NewTLSConfig("", "", keyFile) // not a cert
+	assert.Error(t, err)
+}
+
+func TestConnectionPooling(t *testing.T) {
+	// Each round, the server blocks until all n concurrent requests arrive,
+	// so the client must have n connections open at once
+	const n = 5
+	var round sync.WaitGroup
+	var newConns int32
+	pts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		round.Done()
+		round.Wait()
+		w.Write([]byte("[]"))
+	}))
+	pts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	pts.Start()
+	defer pts.Close()
+
+	queryRound := func(ec etre.EntityClient) {
+		round.Add(n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := ec.Query("x=y", etre.QueryFilter{})
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+	}
+
+	// With MaxIdleConnsPerHost = n, the second round reuses all connections
+	httpClient := &http.Client{}
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:          "node",
+		Addr:                pts.URL,
+		HTTPClient:          httpClient,
+		MaxIdleConns:        n,
+		MaxIdleConnsPerHost: n,
+		IdleConnTimeout:     time.Minute,
+	})
+	queryRound(ec)
+	queryRound(ec.WithContext(context.Background())) // copies share the transport
+	assert.Equal(t, int32(n), atomic.LoadInt32(&newConns))
+	assert.Nil(t, httpClient.Transport, "HTTPClient modified")
+}
+
+func TestWithLatency(t *testing.T) {
+	// Server takes 20ms to respond, so latency should be at least that
+	lts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("[]"))
+	}))
+	defer lts.Close()
+
+	ec := etre.NewEntityClient("node", lts.URL, http.DefaultClient)
+
+	var lat etre.Latency
+	_, err := ec.WithLatency(&lat).Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, lat.RTT, int64(20))
+	assert.GreaterOrEqual(t, lat.Recv, int64(20))
+	assert.InDelta(t, lat.RTT, lat.Send+lat.Recv, 1) // ms truncation
+
+	// Original client doesn't save latency
+	lat = etre.Latency{}
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, etre.Latency{}, lat)
+}
+
+func TestResponseFormat(t *testing.T) {
+	// Server returns BSON for queries and Get if the client accepts it, like the API
+	var gotAccept string
+	bts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAccept = r.Header.Get("Accept")
+		e := map[string]interface{}{
+			"_id":    primitive.ObjectID{0x01},
+			"_rev":   int64(2),
+			"i32":    int32(1),
+			"i64":    int64(1),
+			"f64":    float64(1),
+			"list":   primitive.A{int32(1), "a"},
+			"nested": primitive.M{"n": int32(5)},
+		}
+		if !strings.Contains(gotAccept, etre.CONTENT_TYPE_BSON) {
+			w.Write([]byte(`[{"_id":"010000000000000000000000","_rev":2,"i32":1}]`))
+			return
+		}
+		w.Header().Set("Content-Type", etre.CONTENT_TYPE_BSON)
+		n := 1
+		if strings.HasPrefix(r.URL.Path, etre.API_ROOT+"/entities/") {
+			n = 2
+		}
+		for i := 0; i < n; i++ {
+			b, err := bson.Marshal(e)
+			require.NoError(t, err)
+			w.Write(b)
+		}
+	}))
+	defer bts.Close()
+
+	// JSON by default: numbers are float64, except integer meta-labels
+	ec := etre.NewEntityClient("node", bts.URL, http.DefaultClient)
+	entities, err := ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, etre.CONTENT_TYPE_JSON, gotAccept)
+	assert.Equal(t, []etre.Entity{{"_id": "010000000000000000000000", "_rev": int64(2), "i32": float64(1)}}, entities)
+
+	// BSON if configured: number types are preserved
+	expect := etre.Entity{
+		"_id":    "010000000000000000000000",
+		"_rev":   int64(2),
+		"i32":    int32(1),
+		"i64":    int64(1),
+		"f64":    float64(1),
+		"list":   []interface{}{int32(1), "a"},
+		"nested": map[string]interface{}{"n": int32(5)},
+	}
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:     "node",
+		Addr:           bts.URL,
+		HTTPClient:     http.DefaultClient,
+		ResponseFormat: etre.RESPONSE_FORMAT_BSON,
+	})
+	entities, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Contains(t, gotAccept, etre.CONTENT_TYPE_BSON)
+	assert.Equal(t, []etre.Entity{expect, expect}, entities)
+	assert.Equal(t, int64(2), entities[0].Rev())
+	entity, err := ec.Get("010000000000000000000000")
+	require.NoError(t, err)
+	assert.Equal(t, expect, entity)
+}
+
+func TestRequestId(t *testing.T) {
+	var gotRequestId string
+	rts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRequestId = r.Header.Get(etre.REQUEST_ID_HEADER)
+		if r.Method == "GET" {
+			w.Write([]byte("[]"))
+			return
+		}
+		w.Write([]byte(`{"writes":[{"entityId":"abc"}]}`)) // API didn't return requestId
+	}))
+	defer rts.Close()
+
+	// No request ID by default
+	ec := etre.NewEntityClient("node", rts.URL, http.DefaultClient)
+	_, err := ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "", gotRequestId)
+
+	// Request ID from WithRequestId is sent and returned in the WriteResult
+	ctx := etre.WithRequestId(context.Background(), "req-1")
+	assert.Equal(t, "req-1", etre.RequestId(ctx))
+	_, err = ec.QueryContext(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "req-1", gotRequestId)
+	wr, err := ec.WithContext(ctx).Insert([]etre.Entity{{"x": "y"}})
+	require.NoError(t, err)
+	assert.Equal(t, "req-1", gotRequestId)
+	assert.Equal(t, "req-1", wr.RequestId)
+
+	// GenerateRequestIds makes a new UUID for every request without one
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:         "node",
+		Addr:               rts.URL,
+		HTTPClient:         http.DefaultClient,
+		GenerateRequestIds: true,
+	})
+	wr, err = ec.Insert([]etre.Entity{{"x": "y"}})
+	require.NoError(t, err)
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, gotRequestId)
+	assert.Equal(t, gotRequestId, wr.RequestId)
+	firstId := gotRequestId
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.NotEqual(t, firstId, gotRequestId)
+	_, err = ec.QueryContext(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "req-1", gotRequestId)
+}
+
+func TestUserAgentHeaders(t *testing.T) {
+	var got http.Header
+	hts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.Write([]byte("[]"))
+	}))
+	defer hts.Close()
+
+	// Default User-Agent
+	ec := etre.NewEntityClient("node", hts.URL, http.DefaultClient)
+	_, err := ec.Query("x", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "etre-go/"+etre.VERSION, got.Get("User-Agent"))
+
+	// Custom headers can't override client headers
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       hts.URL,
+		HTTPClient: http.DefaultClient,
+		UserAgent:  "my-app/1.2",
+		Headers: map[string]string{
+			"X-App":             "a",
+			"x-etre-version":    "0.0.0",
+			"X-Etre-Custom":     "c",
+			"Content-Type":      "text/plain",
+			"X-Etre-Request-Id": "r",
+		},
+	})
+	_, err = ec.Query("x", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "my-app/1.2", got.Get("User-Agent"))
+	assert.Equal(t, "a", got.Get("X-App"))
+	assert.Equal(t, etre.VERSION, got.Get(etre.VERSION_HEADER))
+	assert.Empty(t, got.Get("X-Etre-Custom"))
+	assert.Empty(t, got.Get(etre.REQUEST_ID_HEADER))
+	assert.Equal(t, etre.CONTENT_TYPE_JSON, got.Get("Content-Type"))
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	// Response is ~1 KB of JSON, but gzip compresses it to much less
+	entities := []etre.Entity{{"_id": "abc", "x": strings.Repeat("y", 1000)}}
+	resp, _ := json.Marshal(entities)
+	var requests int32
+	mts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Accept-Encoding") == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gzw := gzip.NewWriter(w)
+			defer gzw.Close()
+			gzw.Write(resp)
+		} else {
+			w.Write(resp)
+		}
+	}))
+	defer mts.Close()
+
+	newClient := func(max int64, noCompress bool) etre.EntityClient {
+		return etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+			EntityType:         "node",
+			Addr:               mts.URL,
+			HTTPClient:         http.DefaultClient,
+			Retry:              2,
+			MaxResponseBytes:   max,
+			DisableCompression: noCompress,
+		})
+	}
+
+	// Default: no limit
+	got, err := newClient(0, false).Query("x", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, entities, got)
+
+	// Limit applies to the raw body and isn't retried
+	atomic.StoreInt32(&requests, 0)
+	_, err = newClient(500, true).Query("x", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrResponseTooLarge)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// And to the decompressed body
+	_, err = newClient(500, false).Query("x", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrResponseTooLarge)
+
+	got, err = newClient(int64(len(resp)), false).Query("x", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, entities, got)
+}
+
+func TestCompression(t *testing.T) {
+	// Server decompresses gzip requests and compresses responses if the client
+	// accepts gzip, like the API
+	var gotContentEncoding, gotAcceptEncoding string
+	var gotBody []byte
+	cts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotContentEncoding = r.Header.Get("Content-Encoding")
+		gotAcceptEncoding = r.Header.Get("Accept-Encoding")
+		var body io.Reader = r.Body
+		if gotContentEncoding == "gzip" {
+			gzr, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			body = gzr
+		}
+		gotBody, _ = io.ReadAll(body)
+		resp := []byte(`[{"_id":"abc","x":"y"}]`)
+		if r.Method != "GET" {
+			resp = []byte(`{"writes":[{"entityId":"abc"}]}`)
+		}
+		if gotAcceptEncoding == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gzw := gzip.NewWriter(w)
+			defer gzw.Close()
+			gzw.Write(resp)
+		} else {
+			w.Write(resp)
+		}
+	}))
+	defer cts.Close()
+
+	// By default, responses are compressed and requests are not
+	ec := etre.NewEntityClient("node", cts.URL, http.DefaultClient)
+	var lat etre.Latency
+	entities, err := ec.WithLatency(&lat).Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", gotAcceptEncoding)
+	assert.Equal(t, []etre.Entity{{"_id": "abc", "x": "y"}}, entities)
+	assert.InDelta(t, lat.RTT, lat.Send+lat.Recv, 1) // ms truncation
+
+	insert := []etre.Entity{{"x": "y"}}
+	_, err = ec.Insert(insert)
+	require.NoError(t, err)
+	assert.Equal(t, "", gotContentEncoding)
+
+	// CompressRequests compresses payloads at least that many bytes
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:       "node",
+		Addr:             cts.URL,
+		HTTPClient:       http.DefaultClient,
+		CompressRequests: 8,
+	})
+	wr, err := ec.Insert(insert)
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Write{{EntityId: "abc"}}, wr.Writes)
+	assert.Equal(t, "gzip", gotContentEncoding)
+	assert.JSONEq(t, `[{"x":"y"}]`, string(gotBody))
+
+	_, err = ec.Insert([]etre.Entity{{}}) // "[{}]" < 8 bytes
+	require.NoError(t, err)
+	assert.Equal(t, "", gotContentEncoding)
+
+	// DisableCompression disables response compression
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:         "node",
+		Addr:               cts.URL,
+		HTTPClient:         http.DefaultClient,
+		DisableCompression: true,
+	})
+	entities, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "identity", gotAcceptEncoding)
+	assert.Equal(t, []etre.Entity{{"_id": "abc", "x": "y"}}, entities)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	// Server fails the first 2 requests with 503, then succeeds
+	calls := 0
+	failures := 2
+	rts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method == "GET" {
+			w.Write([]byte("[]"))
+		} else {
+			w.Write([]byte(`{"writes":[{"id":"abc"}]}`))
+		}
+	}))
+	defer rts.Close()
+
+	var gotAttempts []int
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       rts.URL,
+		HTTPClient: http.DefaultClient,
+		RetryPolicy: etre.RetryPolicy{
+			MaxRetries: 3,
+			BaseDelay:  time.Millisecond,
+			MaxDelay:   2 * time.Millisecond,
+			OnRetry: func(attempts int, err error, wait time.Duration) {
+				gotAttempts = append(gotAttempts, attempts)
+				assert.LessOrEqual(t, wait, 2*time.Millisecond)
+			},
+		},
+	})
+
+	// Query is idempotent: retried until it succeeds
+	_, err := ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []int{1, 2}, gotAttempts)
+
+	// Insert is not idempotent: not retried
+	calls = 0
+	gotAttempts = nil
+	_, err = ec.Insert([]etre.Entity{{"x": 1}})
+	require.Error(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Nil(t, gotAttempts)
+
+	// Delete is retried only if the query matches an exact revision
+	calls = 0
+	_, err = ec.Delete("x=y")
+	require.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	gotAttempts = nil
+	_, err = ec.Delete("_id=abc,_rev=3")
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []int{1, 2}, gotAttempts)
+
+	// Retries are exhausted
+	calls = 0
+	failures = 10
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.Error(t, err)
+	assert.Equal(t, 4, calls) // 1 try + 3 retries
+}
+
 // //////////////////////////////////////////////////////////////////////////
 // Query
 // //////////////////////////////////////////////////////////////////////////
@@ -194,6 +782,29 @@ func TestQueryHandledError(t *testing.T) {
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), respError.Type)
 	assert.Nil(t, got)
+
+	// The API error is wrapped for errors.Is and errors.As
+	respError = &etre.Error{
+		Type:    "db-query",
+		Message: "this is a fake error",
+	}
+	_, err = ec.Query("any=thing", etre.QueryFilter{})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, etre.ErrDBError)
+	assert.NotErrorIs(t, err, etre.ErrInvalidQuery)
+	var etreErr etre.Error
+	require.ErrorAs(t, err, &etreErr)
+	assert.Equal(t, *respError, etreErr)
+
+	// Server query timeout is distinct from client timeout
+	respError = &etre.Error{
+		Type:    "db-query-timeout",
+		Message: "context deadline exceeded",
+	}
+	_, err = ec.Query("any=thing", etre.QueryFilter{})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, etre.ErrQueryTimeout)
+	assert.NotErrorIs(t, err, etre.ErrClientTimeout)
 }
 
 func TestQueryUnhandledError(t *testing.T) {
@@ -212,455 +823,1048 @@ func TestQueryUnhandledError(t *testing.T) {
 	assert.Nil(t, got)
 }
 
-// //////////////////////////////////////////////////////////////////////////
-// Get
-// //////////////////////////////////////////////////////////////////////////
-func TestGetOK(t *testing.T) {
+func TestServerError(t *testing.T) {
+	// An unhandled error returns the raw response, capped, as a *ServerError
+	body := "panic: runtime error: invalid memory address"
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(body))
+	}))
+	defer sts.Close()
+
+	ec := etre.NewEntityClient("node", sts.URL, http.DefaultClient)
+	_, err := ec.Query("any=thing", etre.QueryFilter{})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, etre.ErrServerError)
+	var se *etre.ServerError
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, etre.ServerError{HTTPStatus: http.StatusBadGateway, Body: body}, *se)
+	assert.Contains(t, err.Error(), body)
+
+	body = strings.Repeat("x", etre.SERVER_ERROR_MAX_BODY+1)
+	_, err = ec.Get("abc")
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, body[:etre.SERVER_ERROR_MAX_BODY], se.Body)
+	assert.True(t, se.Truncated)
+
+	// A handled error is not a ServerError
+	body = `{"type":"db-query","message":"fake error"}`
+	_, err = ec.Query("any=thing", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrDBError)
+	assert.NotErrorIs(t, err, etre.ErrServerError)
+}
+
+func TestQueryInvalidDistinct(t *testing.T) {
+	// Distinct requires exactly one return label, so client returns an error
+	// without making a request
 	setup(t)
+	respData = []etre.Entity{}
 
-	// Set global vars used by httptest.Server
-	respData = etre.Entity{
-		"_id":      "abc",
-		"hostname": "localhost",
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	for _, rl := range [][]string{nil, {"x", "y"}} {
+		filter := etre.QueryFilter{ReturnLabels: rl, Distinct: true}
+		_, err := ec.Query("x=y", filter)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Distinct")
+		_, err = ec.Count("x=y", filter)
+		require.Error(t, err)
+		_, err = ec.Stream(context.Background(), "x=y", filter)
+		require.Error(t, err)
 	}
+	assert.Empty(t, gotPath)
 
-	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	_, err := ec.Query("x=y", etre.QueryFilter{ReturnLabels: []string{"x"}, Distinct: true})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&labels=x&distinct", gotQuery)
+}
 
-	// Normal get that returns status code 200 and respData
-	ctx := testContext()
-	got, err := ec.WithContext(ctx).Get("abc")
+func TestDistinctValues(t *testing.T) {
+	var gotQuery url.Values
+	dts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query()
+		w.Write([]byte(`[{"dc":"east"},{"dc":"west"},{"dc":3}]`))
+	}))
+	defer dts.Close()
+	ec := etre.NewEntityClient("node", dts.URL, http.DefaultClient)
+
+	values, err := ec.DistinctValues("dc", "", etre.QueryFilter{Limit: 10})
 	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"east", "west", float64(3)}, values)
+	assert.Equal(t, "dc", gotQuery.Get("query")) // all entities with the label
+	assert.Equal(t, "dc", gotQuery.Get("labels"))
+	assert.True(t, gotQuery.Has("distinct"))
+	assert.Equal(t, "10", gotQuery.Get("limit"))
 
-	// Verify call and response
-	assert.Equal(t, "GET", gotMethod)
-	assert.Equal(t, etre.API_ROOT+"/entity/node/abc", gotPath)
-	assert.Equal(t, got, respData)
-	assert.Equal(t, ctx, httpRT.gotCtx)
+	_, err = ec.DistinctValues("dc", "env=prod", etre.QueryFilter{ReturnLabels: []string{"dc"}})
+	require.NoError(t, err)
+	assert.Equal(t, "env=prod", gotQuery.Get("query"))
+
+	_, err = ec.DistinctValues("dc", "", etre.QueryFilter{ReturnLabels: []string{"env"}})
+	assert.Error(t, err)
+	_, err = ec.DistinctValues("", "", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNoLabel)
 }
 
-func TestGetHandledError(t *testing.T) {
-	// Test that client returns error on API error and no entity
-	setup(t)
+func TestQueryTypes(t *testing.T) {
+	// Fake API returns one entity per type, except type "bad" fails
+	mts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entityType := strings.TrimPrefix(r.URL.Path, etre.API_ROOT+"/entities/")
+		if entityType == "bad" {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(etre.Error{Type: "db-query", Message: "fake error"})
+			return
+		}
+		json.NewEncoder(w).Encode([]etre.Entity{{"_type": entityType, "x": r.URL.Query().Get("query")}})
+	}))
+	defer mts.Close()
 
-	// Set global vars used by httptest.Server
-	respStatusCode = http.StatusInternalServerError
-	respError = &etre.Error{
-		Type:    "fake_error",
-		Message: "this is a fake error",
+	ec := etre.NewEntityClients([]string{"host", "svc", "bad"}, etre.EntityClientConfig{
+		Addr:       mts.URL,
+		HTTPClient: http.DefaultClient,
+	})
+	assert.Equal(t, "svc", ec["svc"].EntityType())
+
+	got, err := ec.QueryTypes(context.Background(), []string{"host", "svc"}, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	expect := map[string][]etre.Entity{
+		"host": {{"_type": "host", "x": "x=y"}},
+		"svc":  {{"_type": "svc", "x": "x=y"}},
 	}
+	assert.Equal(t, expect, got)
 
-	ec := etre.NewEntityClient("node", ts.URL, httpClient)
-	got, err := ec.Get("abc")
+	// Partial failure: all types (empty list), "bad" fails, unknown type
+	got, err = ec.QueryTypes(context.Background(), nil, "x=y", etre.QueryFilter{})
 	require.Error(t, err)
-	assert.Contains(t, err.Error(), respError.Type)
-	assert.Nil(t, got)
+	assert.ErrorIs(t, err, etre.ErrDBError)
+	assert.Contains(t, err.Error(), "bad: ")
+	assert.Equal(t, expect, got)
+
+	_, err = ec.QueryTypes(context.Background(), []string{"host", "nope"}, "x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrTypeMismatch)
 }
 
-func TestGetUnhandledError(t *testing.T) {
-	// Like TestGetHandledError above, but simulating a more severe error,
-	// like a panic, that makes the API _not_ return an etre.Error. The client
-	// should handle this and still return an error.
+func TestQueryLimitOffset(t *testing.T) {
 	setup(t)
-
-	// Set global vars used by httptest.Server
-	respStatusCode = http.StatusInternalServerError
+	respData = []etre.Entity{}
 
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
-	got, err := ec.Get("abc")
-	require.Error(t, err)
-	assert.Contains(t, err.Error(), "no response")
-	assert.Nil(t, got)
+
+	// Zero values are not sent
+	_, err := ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y", gotQuery)
+
+	_, err = ec.Query("x=y", etre.QueryFilter{Limit: 100, Offset: 200})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&limit=100&offset=200", gotQuery)
 }
 
-func TestGetNotFound(t *testing.T) {
-	// Like TestGetHandledError above, but simulating a more severe error,
-	// like a panic, that makes the API _not_ return an etre.Error. The client
-	// should handle this and still return an error.
+func TestQuerySort(t *testing.T) {
 	setup(t)
-
-	// Set global vars used by httptest.Server
-	respStatusCode = http.StatusNotFound
+	respData = []etre.Entity{}
 
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
-	got, err := ec.Get("abc")
-	require.Error(t, err)
-	assert.Contains(t, err.Error(), "not found")
-	assert.Nil(t, got)
+	_, err := ec.Query("x=y", etre.QueryFilter{Sort: []string{"hostname", "-_rev"}, Limit: 10})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&sort=hostname,-_rev&limit=10", gotQuery)
 }
 
-// //////////////////////////////////////////////////////////////////////////
-// Insert
-// //////////////////////////////////////////////////////////////////////////
+func TestQueryPageSize(t *testing.T) {
+	entities := []etre.Entity{{"_id": "a"}, {"_id": "b"}, {"_id": "c"}, {"_id": "d"}, {"_id": "e"}}
+	var gotQueries []string
+	var onPage func(offset int)
+	qts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := url.QueryUnescape(r.URL.RawQuery)
+		gotQueries = append(gotQueries, q)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		page := []etre.Entity{}
+		for i := offset; i < offset+limit && i < len(entities); i++ {
+			page = append(page, entities[i])
+		}
+		if onPage != nil {
+			onPage(offset)
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer qts.Close()
+
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:    "node",
+		Addr:          qts.URL,
+		HTTPClient:    http.DefaultClient,
+		QueryPageSize: 2,
+	})
+	got, err := ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, entities, got)
+	assert.Equal(t, []string{
+		"query=x=y&sort=_id&limit=2",
+		"query=x=y&sort=_id&limit=2&offset=2",
+		"query=x=y&sort=_id&limit=2&offset=4",
+	}, gotQueries)
+
+	// Insert before the next page shifts entity b into it, but it's returned once
+	gotQueries = nil
+	onPage = func(offset int) {
+		if offset == 0 {
+			entities = append([]etre.Entity{{"_id": "0"}}, entities...)
+		}
+	}
+	got, err = ec.Query("x=y", etre.QueryFilter{Sort: []string{"host"}})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"_id": "a"}, {"_id": "b"}, {"_id": "c"}, {"_id": "d"}, {"_id": "e"}}, got)
+	assert.Equal(t, "query=x=y&sort=host&limit=2", gotQueries[0])
 
-func TestInsertOK(t *testing.T) {
+	// Filter limit disables paging
+	onPage = nil
+	gotQueries = nil
+	got, err = ec.Query("x=y", etre.QueryFilter{Limit: 3})
+	require.NoError(t, err)
+	assert.Len(t, got, 3)
+	assert.Equal(t, []string{"query=x=y&limit=3"}, gotQueries)
+}
+
+func TestDefaultQueryFilter(t *testing.T) {
 	setup(t)
+	respData = []etre.Entity{}
 
-	// Set global vars used by httptest.Server
-	respData = etre.WriteResult{
-		Writes: []etre.Write{
-			{
-				EntityId: "abc",
-				URI:      "http://localhost/entity/abc",
-			},
-		},
-	}
-	respStatusCode = http.StatusCreated
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:         "node",
+		Addr:               ts.URL,
+		HTTPClient:         httpClient,
+		DefaultQueryFilter: etre.QueryDefaults{ReturnLabels: []string{"host", "zone"}, Limit: 10},
+	})
+	_, err := ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&labels=host,zone&limit=10", gotQuery)
 
-	// New etre.Client
-	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	// Per-call fields override defaults
+	_, err = ec.Query("x=y", etre.QueryFilter{ReturnLabels: []string{"host", "zone", "rack"}, Offset: 20})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&labels=host,zone,rack&limit=10&offset=20", gotQuery)
 
-	// Normal insert that returns status code 201 and a write result
-	entities := []etre.Entity{
-		{
-			"foo": "bar",
-		},
-	}
-	ctx := testContext()
-	got, err := ec.WithContext(ctx).Insert(entities)
+	// Empty, non-nil slice overrides default with all labels
+	_, err = ec.Query("x=y", etre.QueryFilter{ReturnLabels: []string{}, Limit: 1})
 	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&limit=1", gotQuery)
 
-	// Verify call and response
-	assert.Equal(t, "POST", gotMethod)
-	assert.Equal(t, etre.API_ROOT+"/entities/node", gotPath)
-	assert.Empty(t, gotQuery)
-	assert.Equal(t, respData, got)
-	assert.Equal(t, ctx, httpRT.gotCtx)
+	// Stream uses the defaults, too
+	it, err := ec.Stream(context.Background(), "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.False(t, it.Next())
+	assert.Equal(t, "query=x=y&labels=host,zone&sort=_id&limit=10", gotQuery)
 }
 
-func TestInsertAPIError(t *testing.T) {
-	// API should return error in WriteResult.Error
+func TestQuerySinceRev(t *testing.T) {
 	setup(t)
+	respData = []etre.Entity{}
 
-	// Set global vars used by httptest.Server
-	respStatusCode = http.StatusInternalServerError
-	respData = etre.WriteResult{
-		Error: &etre.Error{
-			Type:    "fake_error",
-			Message: "this is a fake error",
-		},
-	}
-
-	// Get error on insert
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
-	entities := []etre.Entity{
-		{
-			"foo": "bar",
-		},
-	}
-	got, err := ec.Insert(entities)
+	_, err := ec.Query("x=y", etre.QueryFilter{SinceRev: 5, Sort: []string{"_rev"}, Limit: 10})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y,_rev>5&sort=_rev&limit=10", gotQuery)
+
+	respData = 1
+	_, err = ec.Count("x=y", etre.QueryFilter{SinceRev: 5})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y,_rev>5", gotQuery)
+
+	// Query with a _rev predicate would match nothing, so error without a request
+	gotQuery = ""
+	_, err = ec.Query("x=y,_rev<3", etre.QueryFilter{SinceRev: 5})
+	assert.ErrorIs(t, err, etre.ErrInvalidQuery)
+	_, err = ec.Count("_rev=7", etre.QueryFilter{SinceRev: 5})
+	assert.ErrorIs(t, err, etre.ErrInvalidQuery)
+	assert.Empty(t, gotQuery)
+	respData = []etre.Entity{}
+	_, err = ec.Query("x=y,_rev<3", etre.QueryFilter{})
 	require.NoError(t, err)
-	assert.Equal(t, respData, got)
 }
 
-func TestInsertUnhandledError(t *testing.T) {
-	// If API crashes or some unhandled error occurs, there's no WriteResult,
-	// but client should handle this and still return an error
+func TestQueryLabelPaths(t *testing.T) {
 	setup(t)
-
-	// Set global vars used by httptest.Server
-	respStatusCode = http.StatusInternalServerError
-	respData = nil // error ^, but no resp data
+	respData = []etre.Entity{{"metadata": map[string]interface{}{"region": "east"}}}
 
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
-	entities := []etre.Entity{{"foo": "bar"}}
-	wr, err := ec.Insert(entities)
-	require.Error(t, err)
-	assert.Contains(t, err.Error(), "no response")
-	assert.Zero(t, wr)
+	got, err := ec.Query("x=y", etre.QueryFilter{ReturnLabels: []string{"metadata.region"}})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&labels=metadata.region", gotQuery)
+	require.Len(t, got, 1)
+	region, ok := got[0].GetPath("metadata.region")
+	assert.True(t, ok)
+	assert.Equal(t, "east", region)
+
+	// Duplicate paths are removed, even with Distinct
+	_, err = ec.Query("x=y", etre.QueryFilter{ReturnLabels: []string{"metadata.region", "host", "metadata.region"}})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&labels=metadata.region,host", gotQuery)
+	_, err = ec.Query("x=y", etre.QueryFilter{ReturnLabels: []string{"host", "host"}, Distinct: true})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&labels=host&distinct", gotQuery)
+
+	// Overlapping paths are an error, not sent
+	gotQuery = ""
+	_, err = ec.Query("x=y", etre.QueryFilter{ReturnLabels: []string{"metadata", "metadata.region"}})
+	assert.Error(t, err)
+	assert.Empty(t, gotQuery)
 }
 
-func TestInsertNoEntityError(t *testing.T) {
+func TestQueryDeleted(t *testing.T) {
 	setup(t)
+	respData = []etre.Entity{{"_id": "a", "_rev": int64(3), "_deleted": true}}
 
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	got, err := ec.Query("x=y", etre.QueryFilter{IncludeDeleted: true, Limit: 10})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&limit=10&deleted=include", gotQuery)
+	require.Len(t, got, 1)
+	assert.True(t, got[0].IsDeleted())
 
-	// A zero length slice of entities should return ErrNoEntity
-	entities := []etre.Entity{}
-	got, err := ec.Insert(entities)
-	assert.ErrorIs(t, err, etre.ErrNoEntity)
-	assert.Nil(t, got.Writes)
-}
+	_, err = ec.Query("x=y", etre.QueryFilter{IncludeDeleted: true, OnlyDeleted: true})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&deleted=only", gotQuery)
 
-// //////////////////////////////////////////////////////////////////////////
-// Update
-// //////////////////////////////////////////////////////////////////////////
+	respData = 1
+	_, err = ec.Count("x=y", etre.QueryFilter{OnlyDeleted: true})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&deleted=only", gotQuery)
 
-func TestUpdateOK(t *testing.T) {
-	setup(t)
+	// Not sent by default
+	respData = []etre.Entity{}
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y", gotQuery)
+}
 
-	// Set global vars used by httptest.Server
-	respData = etre.WriteResult{
-		Writes: []etre.Write{
-			{
-				URI: "http://localhost/entity/abc",
-				Diff: map[string]interface{}{
-					"foo": "foo",
-				},
-			},
-		},
-	}
+func TestQueryConsistency(t *testing.T) {
+	setup(t)
+	respData = []etre.Entity{}
 
-	// New etre.Client
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	_, err := ec.Query("x=y", etre.QueryFilter{Consistency: etre.CONSISTENCY_STRONG, Limit: 10})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&limit=10&consistency=strong", gotQuery)
 
-	// Normal update that returns status code 200 and a write result
-	entity := etre.Entity{
-		"foo": "bar", // patch foo:foo -> for:bar
-	}
-	ctx := testContext()
-	got, err := ec.WithContext(ctx).Update("foo=bar", entity)
+	respData = 1
+	_, err = ec.Count("x=y", etre.QueryFilter{Consistency: etre.CONSISTENCY_EVENTUAL})
 	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&consistency=eventual", gotQuery)
 
-	// Verify call and response
-	assert.Equal(t, "PUT", gotMethod)
-	assert.Equal(t, etre.API_ROOT+"/entities/node", gotPath)
-	assert.Equal(t, "query=foo=bar", gotQuery)
-	assert.Equal(t, respData, got)
-	assert.Equal(t, ctx, httpRT.gotCtx)
+	respData = etre.Entity{"_id": "a"}
+	_, err = ec.GetById("a", etre.QueryFilter{Consistency: etre.CONSISTENCY_READ_YOUR_WRITES})
+	require.NoError(t, err)
+	assert.Equal(t, "consistency=read-your-writes", gotQuery)
+
+	// Not sent by default
+	respData = []etre.Entity{}
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y", gotQuery)
+
+	// Invalid value is an error without a request
+	gotQuery = ""
+	_, err = ec.Query("x=y", etre.QueryFilter{Consistency: "linearizable"})
+	assert.Error(t, err)
+	_, err = ec.GetById("a", etre.QueryFilter{Consistency: "linearizable"})
+	assert.Error(t, err)
+	assert.Equal(t, "", gotQuery)
 }
 
-func TestUpdateAPIError(t *testing.T) {
+func TestGetByIds(t *testing.T) {
 	setup(t)
-
-	// Set global vars used by httptest.Server
-	respError = &etre.Error{
-		Type:    "fake_error",
-		Message: "this is a fake error",
+	respData = []etre.Entity{
+		{"_id": "a", "host": "x"},
+		{"_id": "b", "host": "y"},
 	}
-	respStatusCode = http.StatusInternalServerError
 
-	// Get error on update
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
-	entity := etre.Entity{
-		"foo": "bar",
+	got, err := ec.GetByIds([]string{"a", "b", "c"}, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "query=_id in (a,b,c)", gotQuery)
+	assert.Equal(t, map[string]etre.Entity{
+		"a": {"_id": "a", "host": "x"},
+		"b": {"_id": "b", "host": "y"},
+	}, got)
+
+	// _id is needed for the map but not returned if not in ReturnLabels
+	got, err = ec.GetByIds([]string{"a", "b"}, etre.QueryFilter{ReturnLabels: []string{"host"}, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "query=_id in (a,b)&labels=_id,host", gotQuery)
+	assert.Equal(t, map[string]etre.Entity{"a": {"host": "x"}, "b": {"host": "y"}}, got)
+
+	// Consistency is sent, including from DefaultQueryFilter, like GetById
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:         "node",
+		Addr:               ts.URL,
+		HTTPClient:         httpClient,
+		DefaultQueryFilter: etre.QueryDefaults{Consistency: etre.CONSISTENCY_STRONG},
+	})
+	_, err = ec.GetByIds([]string{"a", "b"}, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "query=_id in (a,b)&consistency=strong", gotQuery)
+
+	// Entity without _id is an error, not a panic
+	respData = []etre.Entity{{"host": "x"}}
+	_, err = ec.GetByIds([]string{"a"}, etre.QueryFilter{})
+	assert.Error(t, err)
+
+	_, err = ec.GetByIds(nil, etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNoEntity)
+	_, err = ec.GetByIds([]string{"a", ""}, etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrIdNotSet)
+}
+
+func TestAggregate(t *testing.T) {
+	var gotPath, gotRawQuery string
+	ats := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotRawQuery, _ = url.QueryUnescape(r.URL.RawQuery)
+		w.Write([]byte(`[{"group":{"dc":"east","zone":null},"count":2},{"group":{"dc":"west","zone":1},"count":1}]`))
+	}))
+	defer ats.Close()
+
+	ec := etre.NewEntityClient("node", ats.URL, httpClient)
+	got, err := ec.Aggregate("x=y", []string{"dc", "zone"}, etre.QueryFilter{Limit: 5, Offset: 1, SinceRev: 2})
+	require.NoError(t, err)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/aggregate", gotPath)
+	assert.Equal(t, "query=x=y,_rev>2&group=dc,zone&limit=5&offset=1", gotRawQuery)
+	expect := []etre.GroupResult{
+		{Group: etre.Entity{"dc": "east", "zone": nil}, Count: 2},
+		{Group: etre.Entity{"dc": "west", "zone": float64(1)}, Count: 1},
 	}
-	got, err := ec.Update("foo=bar", entity)
-	require.Error(t, err)
+	assert.Equal(t, expect, got)
 
-	// The etre.Error.Message should bubble up
-	assert.Contains(t, err.Error(), respError.Message)
+	// Errors without a request
+	gotPath = ""
+	_, err = ec.Aggregate("", []string{"dc"}, etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+	_, err = ec.Aggregate("x=y", nil, etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNoLabel)
+	_, err = ec.Aggregate("x=y", []string{"dc", "a.b"}, etre.QueryFilter{})
+	assert.Error(t, err)
+	_, err = ec.Aggregate("x=y", []string{"dc", "dc"}, etre.QueryFilter{})
+	assert.EqualError(t, err, "duplicate group-by label: dc")
+	assert.Empty(t, gotPath)
+}
 
-	// There should not be any entities returned
-	assert.Nil(t, got.Writes)
+func TestJSONNumbers(t *testing.T) {
+	var body string
+	ets := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", etre.CONTENT_TYPE_JSON)
+		w.Write([]byte(body))
+	}))
+	defer ets.Close()
+
+	body = `[{"_id":"a","_rev":3,"x":5,"y":1.5,"z":[1,{"a":2}]}]`
+	config := etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       ets.URL,
+		HTTPClient: httpClient,
+	}
+	ec := etre.NewEntityClientWithConfig(config)
+	got, err := ec.Query("x", etre.QueryFilter{})
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, int64(3), got[0]["_rev"])
+	assert.Equal(t, float64(5), got[0]["x"])
+
+	config.JSONNumbers = etre.JSON_NUMBERS_INT64
+	ec = etre.NewEntityClientWithConfig(config)
+	got, err = ec.Query("x", etre.QueryFilter{})
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, int64(3), got[0]["_rev"])
+	assert.Equal(t, int64(5), got[0]["x"])
+	assert.Equal(t, 1.5, got[0]["y"])
+	assert.Equal(t, []interface{}{int64(1), map[string]interface{}{"a": int64(2)}}, got[0]["z"])
+
+	// Other clients and Entity.UnmarshalJSON are not affected
+	var e etre.Entity
+	require.NoError(t, json.Unmarshal([]byte(`{"x":5}`), &e))
+	assert.Equal(t, float64(5), e["x"])
+
+	config.JSONNumbers = etre.JSON_NUMBERS_JSON_NUMBER
+	ec = etre.NewEntityClientWithConfig(config)
+	body = `{"_id":"a","_rev":3,"x":5}`
+	entity, err := ec.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), entity["_rev"])
+	assert.Equal(t, json.Number("5"), entity["x"])
+
+	body = `[{"group":{"x":5},"count":2}]`
+	groups, err := ec.Aggregate("x", []string{"x"}, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.GroupResult{{Group: etre.Entity{"x": json.Number("5")}, Count: 2}}, groups)
 }
 
-func TestUpdateNoEntityError(t *testing.T) {
-	setup(t)
+func TestExplain(t *testing.T) {
+	var gotPath, gotRawQuery string
+	ets := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotRawQuery, _ = url.QueryUnescape(r.URL.RawQuery)
+		w.Write([]byte(`{"stage":"IXSCAN","index":"x_1","keysExamined":3,"docsExamined":3,"returned":2,"timeMs":1}`))
+	}))
+	defer ets.Close()
 
-	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	ec := etre.NewEntityClient("node", ets.URL, httpClient)
+	got, err := ec.Explain("x=y", etre.QueryFilter{Sort: []string{"-z"}, Limit: 5, SinceRev: 2})
+	require.NoError(t, err)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/explain", gotPath)
+	assert.Equal(t, "query=x=y,_rev>2&sort=-z&limit=5", gotRawQuery)
+	expect := etre.QueryPlan{Stage: "IXSCAN", Index: "x_1", KeysExamined: 3, DocsExamined: 3, Returned: 2, TimeMs: 1}
+	assert.Equal(t, expect, got)
 
-	// A zero length slice of entities should return ErrNoEntity
-	entity := etre.Entity{}
-	got, err := ec.Update("foo=bar", entity)
-	assert.ErrorIs(t, err, etre.ErrNoEntity)
-	assert.Nil(t, got.Writes)
+	// Errors without a request
+	gotPath = ""
+	_, err = ec.Explain("", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+	assert.Empty(t, gotPath)
 }
 
-// //////////////////////////////////////////////////////////////////////////
-// UpdateOne
-// //////////////////////////////////////////////////////////////////////////
+func TestQueryTimeout(t *testing.T) {
+	var gotHeader []string
+	qts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = append(gotHeader, r.Header.Get(etre.QUERY_TIMEOUT_HEADER))
+		if strings.HasSuffix(r.URL.Path, "/count") {
+			w.Write([]byte("0"))
+		} else {
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer qts.Close()
 
-func TestUpdateOneOK(t *testing.T) {
-	// Same at TestUpdateOK, just calling UpdateOne instead which is just
-	// a convenience func for Update.
-	setup(t)
+	// Zero = no header
+	ec := etre.NewEntityClient("node", qts.URL, httpClient)
+	_, err := ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	_, err = ec.Query("x=y", etre.QueryFilter{Timeout: 1500 * time.Millisecond})
+	require.NoError(t, err)
+	_, err = ec.Count("x=y", etre.QueryFilter{Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", "1.5s", "5s"}, gotHeader)
+
+	// Filter timeout overrides client default for only that query
+	gotHeader = nil
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:   "node",
+		Addr:         qts.URL,
+		HTTPClient:   httpClient,
+		QueryTimeout: 2 * time.Second,
+	})
+	_, err = ec.Query("x=y", etre.QueryFilter{Timeout: time.Second})
+	require.NoError(t, err)
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1s", "2s"}, gotHeader)
+}
 
-	respData = etre.WriteResult{
-		Writes: []etre.Write{
-			{
-				EntityId: "abc",
-				URI:      "http://localhost/entity/abc",
-				Diff: map[string]interface{}{
-					"foo": "foo",
-				},
-			},
-		},
+func TestStream(t *testing.T) {
+	// Fake API pages through 5 entities, failing at failOffset
+	all := []etre.Entity{{"x": "1"}, {"x": "2"}, {"x": "3"}, {"x": "4"}, {"x": "5"}}
+	failOffset := -1
+	var gotQueries []string
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := url.QueryUnescape(r.URL.RawQuery)
+		gotQueries = append(gotQueries, q)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		if offset == failOffset {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"type":"db-error","message":"fake error"}`))
+			return
+		}
+		end := offset + limit
+		if end > len(all) {
+			end = len(all)
+		}
+		json.NewEncoder(w).Encode(all[offset:end])
+	}))
+	defer sts.Close()
+
+	ec := etre.NewEntityClient("node", sts.URL, httpClient)
+	it, err := ec.Stream(context.Background(), "x", etre.QueryFilter{Limit: 2})
+	require.NoError(t, err)
+	assert.Nil(t, it.Entity())
+	var got []etre.Entity
+	for it.Next() {
+		got = append(got, it.Entity())
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, all, got)
+	assert.Nil(t, it.Entity())
+	assert.False(t, it.Next())
+	expect := []string{
+		"query=x&sort=_id&limit=2",
+		"query=x&sort=_id&limit=2&offset=2",
+		"query=x&sort=_id&limit=2&offset=4",
 	}
+	assert.Equal(t, expect, gotQueries)
 
-	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	// Error on a later page: partial results and Err
+	failOffset = 2
+	it, err = ec.Stream(context.Background(), "x", etre.QueryFilter{Limit: 2})
+	require.NoError(t, err)
+	got = nil
+	for it.Next() {
+		got = append(got, it.Entity())
+	}
+	assert.Error(t, it.Err())
+	assert.Equal(t, all[0:2], got)
+
+	// Error on first page is returned by Stream
+	failOffset = 0
+	_, err = ec.Stream(context.Background(), "x", etre.QueryFilter{Limit: 2})
+	assert.Error(t, err)
+
+	// Context cancelled: stops
+	failOffset = -1
+	ctx, cancel := context.WithCancel(context.Background())
+	it, err = ec.Stream(ctx, "x", etre.QueryFilter{Limit: 2})
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	cancel()
+	assert.False(t, it.Next())
+	assert.ErrorIs(t, it.Err(), context.Canceled)
 
-	entity := etre.Entity{
-		"foo": "bar", // patch foo:foo -> for:bar
+	_, err = ec.Stream(context.Background(), "", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+}
+
+func TestStreamNDJSON(t *testing.T) {
+	// Fake API streams NDJSON, gzipped if accepted, unless ndjson is false
+	all := []etre.Entity{{"x": "1", "_rev": int64(1)}, {"x": "2"}, {"x": "3"}}
+	ndjson := true
+	var gotQuery, gotAccept string
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery, _ = url.QueryUnescape(r.URL.RawQuery)
+		gotAccept = r.Header.Get("Accept")
+		if !ndjson {
+			json.NewEncoder(w).Encode(all)
+			return
+		}
+		w.Header().Set("Content-Type", etre.CONTENT_TYPE_NDJSON)
+		w.Header().Set("Content-Encoding", "gzip")
+		gzw := gzip.NewWriter(w)
+		defer gzw.Close()
+		enc := json.NewEncoder(gzw)
+		for _, e := range all {
+			enc.Encode(e)
+		}
+	}))
+	defer sts.Close()
+
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:   "node",
+		Addr:         sts.URL,
+		HTTPClient:   http.DefaultClient,
+		StreamNDJSON: true,
+	})
+	stream := func() []etre.Entity {
+		it, err := ec.Stream(context.Background(), "x", etre.QueryFilter{Limit: 2, Offset: 1})
+		require.NoError(t, err)
+		var got []etre.Entity
+		for it.Next() {
+			got = append(got, it.Entity())
+		}
+		require.NoError(t, it.Err())
+		return got
 	}
-	got, err := ec.UpdateOne("abc", entity)
+
+	// One request, Limit ignored
+	assert.Equal(t, all, stream())
+	assert.Equal(t, "query=x&sort=_id&offset=1", gotQuery)
+	assert.Equal(t, etre.CONTENT_TYPE_NDJSON+", "+etre.CONTENT_TYPE_JSON+";q=0.9", gotAccept)
+
+	// Close stops the iterator early
+	it, err := ec.Stream(context.Background(), "x", etre.QueryFilter{})
 	require.NoError(t, err)
-	assert.Equal(t, "PUT", gotMethod)
-	assert.Equal(t, etre.API_ROOT+"/entity/node/abc", gotPath)
-	assert.Empty(t, gotQuery)
-	assert.Equal(t, respData, got)
+	require.True(t, it.Next())
+	require.NoError(t, it.Close())
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+
+	// API doesn't support NDJSON: JSON array
+	ndjson = false
+	assert.Equal(t, all, stream())
+
+	// Other requests don't accept NDJSON
+	_, err = ec.Query("x", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.NotContains(t, gotAccept, etre.CONTENT_TYPE_NDJSON)
+}
+
+func TestCount(t *testing.T) {
+	setup(t)
+	respData = 3
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	ctx := testContext()
+	got, err := ec.WithContext(ctx).Count("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), got)
+	assert.Equal(t, "GET", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/count", gotPath)
+	assert.Equal(t, "query=x=y", gotQuery)
+	assert.Equal(t, ctx, httpRT.gotCtx)
+
+	_, err = ec.Count("x=y", etre.QueryFilter{ReturnLabels: []string{"x"}, Distinct: true})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&labels=x&distinct", gotQuery)
+
+	_, err = ec.Count("", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
 }
 
 // //////////////////////////////////////////////////////////////////////////
-// Delete
+// Get
 // //////////////////////////////////////////////////////////////////////////
-
-func TestDeleteOK(t *testing.T) {
+func TestGetOK(t *testing.T) {
 	setup(t)
 
 	// Set global vars used by httptest.Server
-	respData = etre.WriteResult{
-		Writes: []etre.Write{
-			{
-				EntityId: "abc",
-				URI:      "http://localhost/entity/abc",
-				Diff: map[string]interface{}{
-					"foo": "foo",
-				},
-			},
-		},
+	respData = etre.Entity{
+		"_id":      "abc",
+		"hostname": "localhost",
 	}
 
-	// New etre.Client
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
 
-	// Normal delete that returns status code 200 and a write result
-	query := "foo=bar"
+	// Normal get that returns status code 200 and respData
 	ctx := testContext()
-	got, err := ec.WithContext(ctx).Delete(query)
+	got, err := ec.WithContext(ctx).Get("abc")
 	require.NoError(t, err)
 
 	// Verify call and response
-	assert.Equal(t, "DELETE", gotMethod)
-	assert.Equal(t, etre.API_ROOT+"/entities/node", gotPath)
-	assert.Equal(t, "query="+query, gotQuery)
-	assert.Equal(t, respData, got)
+	assert.Equal(t, "GET", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entity/node/abc", gotPath)
+	assert.Equal(t, got, respData)
 	assert.Equal(t, ctx, httpRT.gotCtx)
 }
 
-func TestDeleteWithSet(t *testing.T) {
+func TestGetHandledError(t *testing.T) {
+	// Test that client returns error on API error and no entity
 	setup(t)
 
 	// Set global vars used by httptest.Server
-	respData = etre.WriteResult{
-		Writes: []etre.Write{
-			{
-				EntityId: "abc",
-				URI:      "http://localhost/entity/abc",
-				Diff: map[string]interface{}{
-					"foo": "foo",
-				},
-			},
-		},
+	respStatusCode = http.StatusInternalServerError
+	respError = &etre.Error{
+		Type:    "fake_error",
+		Message: "this is a fake error",
 	}
 
-	// New etre.Client
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	got, err := ec.Get("abc")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), respError.Type)
+	assert.Nil(t, got)
+}
 
-	set := etre.Set{
-		Id:   "setid",
-		Op:   "setop",
-		Size: 3,
-	}
-	ec = ec.WithSet(set)
+func TestGetUnhandledError(t *testing.T) {
+	// Like TestGetHandledError above, but simulating a more severe error,
+	// like a panic, that makes the API _not_ return an etre.Error. The client
+	// should handle this and still return an error.
+	setup(t)
 
-	// Normal delete that returns status code 200 and a write result
-	query := "foo=bar"
-	got, err := ec.Delete(query)
-	require.NoError(t, err)
+	// Set global vars used by httptest.Server
+	respStatusCode = http.StatusInternalServerError
 
-	// Verify call and response
-	assert.Equal(t, "DELETE", gotMethod)
-	assert.Equal(t, etre.API_ROOT+"/entities/node", gotPath)
-	assert.Equal(t, "query="+query+"&setId=setid&setOp=setop&setSize=3", gotQuery)
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	got, err := ec.Get("abc")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no response")
+	assert.Nil(t, got)
+}
+
+func TestGetNotFound(t *testing.T) {
+	// Like TestGetHandledError above, but simulating a more severe error,
+	// like a panic, that makes the API _not_ return an etre.Error. The client
+	// should handle this and still return an error.
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respStatusCode = http.StatusNotFound
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	got, err := ec.Get("abc")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not found")
+	assert.Nil(t, got)
+}
+
+func TestGetById(t *testing.T) {
+	setup(t)
+	respData = etre.Entity{"_id": "abc", "hostname": "local"}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	got, err := ec.GetById("abc", etre.QueryFilter{ReturnLabels: []string{"_id", "hostname"}})
+	require.NoError(t, err)
+	assert.Equal(t, "GET", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entity/node/abc", gotPath)
+	assert.Equal(t, "labels=_id,hostname", gotQuery)
 	assert.Equal(t, respData, got)
+
+	// No filter = all labels, like Get
+	_, err = ec.GetById("abc", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, gotQuery)
+
+	setup(t)
+	respStatusCode = http.StatusNotFound
+	got, err = ec.GetById("abc", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrEntityNotFound)
+	assert.Nil(t, got)
+
+	_, err = ec.GetById("", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrIdNotSet)
 }
 
 // //////////////////////////////////////////////////////////////////////////
-// DeleteOne
+// Insert
 // //////////////////////////////////////////////////////////////////////////
 
-func TestDeleteOneOK(t *testing.T) {
-	// Same test as DeleteOK, just using the DeleteOne convenience function instead
+func TestInsertOK(t *testing.T) {
 	setup(t)
 
+	// Set global vars used by httptest.Server
 	respData = etre.WriteResult{
 		Writes: []etre.Write{
 			{
 				EntityId: "abc",
 				URI:      "http://localhost/entity/abc",
-				Diff: map[string]interface{}{
-					"foo": "foo",
-				},
 			},
 		},
 	}
+	respStatusCode = http.StatusCreated
 
+	// New etre.Client
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
 
+	// Normal insert that returns status code 201 and a write result
+	entities := []etre.Entity{
+		{
+			"foo": "bar",
+		},
+	}
 	ctx := testContext()
-	got, err := ec.WithContext(ctx).DeleteOne("abc")
+	got, err := ec.WithContext(ctx).Insert(entities)
 	require.NoError(t, err)
 
-	assert.Equal(t, "DELETE", gotMethod)
-	assert.Equal(t, etre.API_ROOT+"/entity/node/abc", gotPath)
+	// Verify call and response
+	assert.Equal(t, "POST", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node", gotPath)
 	assert.Empty(t, gotQuery)
 	assert.Equal(t, respData, got)
 	assert.Equal(t, ctx, httpRT.gotCtx)
 }
 
-func TestDeleteOneWithSet(t *testing.T) {
-	// With a set up, the query should contain the set op params
+func TestBaseURL(t *testing.T) {
+	bts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"writes":[{"entityId":"abc","uri":"http://127.0.0.1:3848` + etre.API_ROOT + `/entity/abc"}]}`))
+	}))
+	defer bts.Close()
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       bts.URL,
+		HTTPClient: http.DefaultClient,
+		BaseURL:    "https://etre.example.com",
+	})
+	wr, err := ec.Insert([]etre.Entity{{"x": "y"}})
+	require.NoError(t, err)
+	require.Len(t, wr.Writes, 1)
+	assert.Equal(t, "https://etre.example.com"+etre.API_ROOT+"/entity/abc", wr.Writes[0].URI)
+}
+
+func TestInsertAPIError(t *testing.T) {
+	// API should return error in WriteResult.Error
 	setup(t)
 
+	// Set global vars used by httptest.Server
+	respStatusCode = http.StatusInternalServerError
 	respData = etre.WriteResult{
-		Writes: []etre.Write{
-			{
-				EntityId: "abc",
-				URI:      "http://localhost/entity/abc",
-				Diff: map[string]interface{}{
-					"foo": "foo",
-				},
-			},
+		Error: &etre.Error{
+			Type:    "fake_error",
+			Message: "this is a fake error",
 		},
 	}
 
+	// Get error on insert
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
-
-	set := etre.Set{
-		Id:   "setid",
-		Op:   "setop",
-		Size: 2,
+	entities := []etre.Entity{
+		{
+			"foo": "bar",
+		},
 	}
-	ec = ec.WithSet(set)
-
-	got, err := ec.DeleteOne("abc")
+	got, err := ec.Insert(entities)
 	require.NoError(t, err)
-	assert.Equal(t, "DELETE", gotMethod)
-	assert.Equal(t, etre.API_ROOT+"/entity/node/abc", gotPath)
-	assert.Equal(t, "setId=setid&setOp=setop&setSize=2", gotQuery)
 	assert.Equal(t, respData, got)
 }
 
-// //////////////////////////////////////////////////////////////////////////
-// Labels and DeleteLabel
-// //////////////////////////////////////////////////////////////////////////
-
-func TestLabelsOK(t *testing.T) {
+func TestInsertUnhandledError(t *testing.T) {
+	// If API crashes or some unhandled error occurs, there's no WriteResult,
+	// but client should handle this and still return an error
 	setup(t)
 
 	// Set global vars used by httptest.Server
-	respData = []string{"foo", "bar"}
+	respStatusCode = http.StatusInternalServerError
+	respData = nil // error ^, but no resp data
 
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	entities := []etre.Entity{{"foo": "bar"}}
+	wr, err := ec.Insert(entities)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no response")
+	assert.Zero(t, wr)
+}
 
-	ctx := testContext()
-	got, err := ec.WithContext(ctx).Labels("abc")
+func TestInsertNoEntityError(t *testing.T) {
+	setup(t)
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	// A zero length slice of entities should return ErrNoEntity
+	entities := []etre.Entity{}
+	got, err := ec.Insert(entities)
+	assert.ErrorIs(t, err, etre.ErrNoEntity)
+	assert.Nil(t, got.Writes)
+}
+
+func TestInvalidLabelError(t *testing.T) {
+	setup(t)
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	// Invalid labels are rejected before sending the request
+	_, err := ec.Insert([]etre.Entity{{"x": 1}, {"a.b": 1}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "entity 1")
+	assert.Contains(t, err.Error(), "a.b")
+	_, err = ec.Update("x=y", etre.Entity{"_foo": 1})
+	assert.Error(t, err)
+	_, err = ec.UpdateOne("abc", etre.Entity{"$set": 1})
+	assert.Error(t, err)
+	_, err = ec.UpdateIfRev(etre.Entity{"_id": "abc", "": 1}, 1)
+	assert.Error(t, err)
+	assert.Empty(t, gotMethod, "request sent")
+}
+
+func TestInvalidValueError(t *testing.T) {
+	setup(t)
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	// Values that can't be encoded are rejected before sending the request
+	_, err := ec.Insert([]etre.Entity{{"x": 1}, {"y": []interface{}{1, func() {}}}})
+	assert.EqualError(t, err, "entity 1: label y[1] has invalid value type func()")
+	_, err = ec.Update("x=y", etre.Entity{"y": make(chan int)})
+	assert.EqualError(t, err, "label y has invalid value type chan int")
+	_, err = ec.UpdateOne("abc", etre.Entity{"y": complex(1, 2)})
+	assert.Error(t, err)
+	_, err = ec.UpdateIfRev(etre.Entity{"_id": "abc", "y": map[string]interface{}{"z": math.NaN()}}, 1)
+	assert.EqualError(t, err, "label y.z has invalid value NaN (float64)")
+	assert.Empty(t, gotMethod, "request sent")
+}
+
+func TestTypeMismatchError(t *testing.T) {
+	setup(t)
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	// Every entity is checked before sending the request, annotated with index
+	_, err := ec.Insert([]etre.Entity{{"x": 1}, {"_type": "node", "x": 2}, {"_type": "rack", "x": 3}})
+	assert.ErrorIs(t, err, etre.ErrTypeMismatch)
+	assert.Contains(t, err.Error(), "entity 2: _type rack")
+	_, err = ec.Insert([]etre.Entity{{"_type": 1, "x": 1}})
+	assert.ErrorIs(t, err, etre.ErrTypeMismatch)
+	assert.Contains(t, err.Error(), "entity 0")
+	_, err = ec.Update("x=y", etre.Entity{"_type": "rack", "x": 1})
+	assert.ErrorIs(t, err, etre.ErrTypeMismatch)
+	_, err = ec.UpdateOne("abc", etre.Entity{"_type": "rack", "x": 1})
+	assert.ErrorIs(t, err, etre.ErrTypeMismatch)
+	_, err = ec.UpdateIfRev(etre.Entity{"_id": "abc", "_type": "rack", "x": 1}, 1)
+	assert.ErrorIs(t, err, etre.ErrTypeMismatch)
+	assert.Empty(t, gotMethod, "request sent")
+
+	// Matching _type is not sent because the API sets it; caller's entities
+	// are not modified
+	respStatusCode = http.StatusCreated
+	respData = etre.WriteResult{Writes: []etre.Write{{EntityId: "a"}, {EntityId: "b"}}}
+	entities := []etre.Entity{{"x": 1}, {"_type": "node", "x": 2}}
+	_, err = ec.Insert(entities)
 	require.NoError(t, err)
-	assert.Equal(t, "GET", gotMethod)
-	assert.Equal(t, etre.API_ROOT+"/entity/node/abc/labels", gotPath)
-	assert.Empty(t, gotQuery)
-	assert.Equal(t, respData, got)
-	assert.Equal(t, ctx, httpRT.gotCtx)
+	assert.JSONEq(t, `[{"x":1},{"x":2}]`, string(gotBody))
+	assert.Equal(t, etre.Entity{"_type": "node", "x": 2}, entities[1])
+
+	respStatusCode = http.StatusOK
+	respData = etre.WriteResult{Writes: []etre.Write{{EntityId: "abc"}}}
+	_, err = ec.UpdateOne("abc", etre.Entity{"_type": "node", "x": 3})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"x":3}`, string(gotBody))
 }
 
-func TestDeleteLabelOK(t *testing.T) {
+func TestInsertBatch(t *testing.T) {
+	setup(t)
+
+	respData = etre.WriteResult{
+		Writes: []etre.Write{{EntityId: "abc"}},
+	}
+	respStatusCode = http.StatusCreated
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	// 5 entities in batches of 2 = 3 requests, the last with 1 entity
+	entities := []etre.Entity{{"x": 1}, {"x": 2}, {"x": 3}, {"x": 4}, {"x": 5}}
+	got, err := ec.InsertBatch(entities, 2)
+	require.NoError(t, err)
+	assert.Len(t, got, 3)
+	assert.Equal(t, "POST", gotMethod)
+	var gotEntities []etre.Entity
+	require.NoError(t, json.Unmarshal(gotBody, &gotEntities))
+	assert.Len(t, gotEntities, 1)
+
+	// Zero batch size = DEFAULT_INSERT_BATCH_SIZE, so only 1 request
+	got, err = ec.InsertBatch(entities, 0)
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+
+	// Stop on first batch with WriteResult.Error
+	setup(t)
+	respStatusCode = http.StatusBadRequest
+	respData = etre.WriteResult{
+		Writes: []etre.Write{{EntityId: "abc"}},
+		Error: &etre.Error{
+			Type:    "fake_error",
+			Message: "this is a fake error",
+		},
+	}
+	got, err = ec.InsertBatch(entities, 2)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "batch 1 of 3")
+	assert.Contains(t, err.Error(), "entity 1 failed")
+	require.Len(t, got, 1)
+	assert.Equal(t, respData, got[0])
+	var etreErr etre.Error
+	require.ErrorAs(t, err, &etreErr)
+	assert.Equal(t, "fake_error", etreErr.Type)
+
+	_, err = ec.InsertBatch(nil, 2)
+	assert.ErrorIs(t, err, etre.ErrNoEntity)
+}
+
+// //////////////////////////////////////////////////////////////////////////
+// Update
+// //////////////////////////////////////////////////////////////////////////
+
+func TestUpdateOK(t *testing.T) {
 	setup(t)
 
+	// Set global vars used by httptest.Server
 	respData = etre.WriteResult{
 		Writes: []etre.Write{
 			{
-				EntityId: "abc",
-				URI:      "http://localhost/entity/abc",
+				URI: "http://localhost/entity/abc",
 				Diff: map[string]interface{}{
 					"foo": "foo",
 				},
@@ -668,227 +1872,2591 @@ func TestDeleteLabelOK(t *testing.T) {
 		},
 	}
 
+	// New etre.Client
 	ec := etre.NewEntityClient("node", ts.URL, httpClient)
 
+	// Normal update that returns status code 200 and a write result
+	entity := etre.Entity{
+		"foo": "bar", // patch foo:foo -> for:bar
+	}
 	ctx := testContext()
-	got, err := ec.WithContext(ctx).DeleteLabel("abc", "foo")
+	got, err := ec.WithContext(ctx).Update("foo=bar", entity)
 	require.NoError(t, err)
-	assert.Equal(t, "DELETE", gotMethod)
-	assert.Equal(t, etre.API_ROOT+"/entity/node/abc/labels/foo", gotPath)
-	assert.Empty(t, gotQuery)
+
+	// Verify call and response
+	assert.Equal(t, "PUT", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node", gotPath)
+	assert.Equal(t, "query=foo=bar", gotQuery)
 	assert.Equal(t, respData, got)
 	assert.Equal(t, ctx, httpRT.gotCtx)
 }
 
+func TestUpdateMany(t *testing.T) {
+	setup(t)
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{EntityId: "abc", Diff: etre.Entity{"_id": "abc", "env": "dev"}},
+			{EntityId: "def", Diff: etre.Entity{"_id": "def", "env": "staging"}},
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	got, err := ec.UpdateMany("region=us-east", etre.Entity{"env": "prod"}, etre.QueryFilter{Timeout: time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, "PUT", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node", gotPath)
+	assert.Equal(t, "query=region=us-east", gotQuery)
+	assert.Equal(t, respData, got)
+
+	// Invalid query, patch, or filter: no request
+	gotMethod = ""
+	_, err = ec.UpdateMany("", etre.Entity{"env": "prod"}, etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+	for _, ml := range []string{"_id", "_type", "_rev", "_deleted"} {
+		_, err = ec.UpdateMany("region=us-east", etre.Entity{"env": "prod", ml: "x"}, etre.QueryFilter{})
+		assert.Error(t, err, ml)
+	}
+	_, err = ec.UpdateMany("region=us-east", etre.Entity{}, etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNoEntity)
+	_, err = ec.UpdateMany("region=us-east", etre.Entity{"env": "prod"}, etre.QueryFilter{Limit: 10})
+	assert.Error(t, err)
+	assert.Empty(t, gotMethod)
+}
+
+func TestUpdateArrayOps(t *testing.T) {
+	setup(t)
+	respStatusCode = http.StatusOK
+	respData = etre.WriteResult{Writes: []etre.Write{{EntityId: "abc"}}}
+
+	// Array operators are sent as label values
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	_, err := ec.UpdateOne("abc", etre.Entity{"env": "prod"}.AddToSet("tags", "a", "b").Pull("old", "c"))
+	require.NoError(t, err)
+	assert.Equal(t, "PUT", gotMethod)
+	assert.JSONEq(t, `{"env":"prod","tags":{"$addToSet":["a","b"]},"old":{"$pull":["c"]}}`, string(gotBody))
+}
+
+func TestUpdateIncrement(t *testing.T) {
+	setup(t)
+	respStatusCode = http.StatusOK
+	respData = etre.WriteResult{Writes: []etre.Write{{EntityId: "abc"}}}
+
+	// Counter operator is sent as a label value
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	_, err := ec.Update("zone=east", etre.Entity{"status": "restarted"}.Increment("restarts", 1))
+	require.NoError(t, err)
+	assert.Equal(t, "PUT", gotMethod)
+	assert.JSONEq(t, `{"status":"restarted","restarts":{"$inc":1}}`, string(gotBody))
+}
+
+func TestUpdateAPIError(t *testing.T) {
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respError = &etre.Error{
+		Type:    "fake_error",
+		Message: "this is a fake error",
+	}
+	respStatusCode = http.StatusInternalServerError
+
+	// Get error on update
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	entity := etre.Entity{
+		"foo": "bar",
+	}
+	got, err := ec.Update("foo=bar", entity)
+	require.Error(t, err)
+
+	// The etre.Error.Message should bubble up
+	assert.Contains(t, err.Error(), respError.Message)
+
+	// There should not be any entities returned
+	assert.Nil(t, got.Writes)
+}
+
+func TestUpdateNoEntityError(t *testing.T) {
+	setup(t)
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	// A zero length slice of entities should return ErrNoEntity
+	entity := etre.Entity{}
+	got, err := ec.Update("foo=bar", entity)
+	assert.ErrorIs(t, err, etre.ErrNoEntity)
+	assert.Nil(t, got.Writes)
+}
+
 // //////////////////////////////////////////////////////////////////////////
-// CDC
+// UpdateOne
+// //////////////////////////////////////////////////////////////////////////
+
+func TestUpdateOneOK(t *testing.T) {
+	// Same at TestUpdateOK, just calling UpdateOne instead which is just
+	// a convenience func for Update.
+	setup(t)
+
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+				Diff: map[string]interface{}{
+					"foo": "foo",
+				},
+			},
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	entity := etre.Entity{
+		"foo": "bar", // patch foo:foo -> for:bar
+	}
+	got, err := ec.UpdateOne("abc", entity)
+	require.NoError(t, err)
+	assert.Equal(t, "PUT", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entity/node/abc", gotPath)
+	assert.Empty(t, gotQuery)
+	assert.Equal(t, respData, got)
+}
+
+func TestUpdateIfRev(t *testing.T) {
+	setup(t)
+
+	respData = etre.WriteResult{
+		Writes: []etre.Write{{EntityId: "abc", Diff: etre.Entity{"foo": "foo"}}},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	// Meta-labels aren't sent, so an entity from Get can be passed back
+	entity := etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(3), "foo": "bar"}
+	got, err := ec.UpdateIfRev(entity, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "PUT", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entity/node/abc", gotPath)
+	assert.Equal(t, "rev=3", gotQuery)
+	assert.Equal(t, `{"foo":"bar"}`, string(gotBody))
+	assert.Equal(t, etre.Write{EntityId: "abc", Diff: etre.Entity{"foo": "foo"}}, got)
+
+	// Conflict: error has the current rev
+	respStatusCode = http.StatusConflict
+	respData = etre.WriteResult{
+		Error: &etre.Error{Type: "rev-conflict", Message: "entity _rev is 4, expected 3", EntityId: "abc", Rev: 4},
+	}
+	_, err = ec.UpdateIfRev(entity, 3)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, etre.ErrRevConflict)
+	var etreErr etre.Error
+	require.ErrorAs(t, err, &etreErr)
+	assert.Equal(t, int64(4), etreErr.Rev)
+
+	// Other errors are not conflicts
+	respStatusCode = http.StatusNotFound
+	respData = etre.WriteResult{Error: &etre.Error{Type: "entity-not-found", Message: "entity not found"}}
+	_, err = ec.UpdateIfRev(entity, 3)
+	assert.ErrorIs(t, err, etre.ErrEntityNotFound)
+	assert.NotErrorIs(t, err, etre.ErrRevConflict)
+
+	_, err = ec.UpdateIfRev(etre.Entity{"foo": "bar"}, 3)
+	assert.ErrorIs(t, err, etre.ErrIdNotSet)
+	_, err = ec.UpdateIfRev(etre.Entity{"_id": "abc", "_rev": int64(3)}, 3)
+	assert.ErrorIs(t, err, etre.ErrNoEntity)
+}
+
+func TestMutateById(t *testing.T) {
+	// Fake API with one entity whose _rev is changed concurrently conflicts times
+	rev, conflicts := 0, 0
+	var gotRequests []string
+	mts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRequests = append(gotRequests, r.Method+" "+r.URL.RawQuery)
+		switch r.Method {
+		case "GET":
+			json.NewEncoder(w).Encode(etre.Entity{"_id": "abc", "_type": "node", "_rev": rev, "n": rev})
+		case "PUT":
+			if conflicts > 0 {
+				conflicts--
+				rev++
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(etre.WriteResult{
+					Error: &etre.Error{Type: "rev-conflict", Message: "entity _rev changed", EntityId: "abc", Rev: int64(rev)},
+				})
+				return
+			}
+			rev++
+			json.NewEncoder(w).Encode(etre.WriteResult{Writes: []etre.Write{{EntityId: "abc", Diff: etre.Entity{"n": rev - 1}}}})
+		}
+	}))
+	defer mts.Close()
+
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:     "node",
+		Addr:           mts.URL,
+		HTTPClient:     http.DefaultClient,
+		MutateMaxTries: 2,
+	})
+	var gotEntities []etre.Entity
+	incr := func(e etre.Entity) (etre.Entity, error) {
+		gotEntities = append(gotEntities, e)
+		n, _ := e.Int("n")
+		return etre.Entity{"n": n + 1}, nil
+	}
+
+	// Conflict: re-read and try again
+	conflicts = 1
+	w, err := ec.MutateById(context.Background(), "abc", incr)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", w.EntityId)
+	assert.Equal(t, []string{"GET ", "PUT rev=0", "GET ", "PUT rev=1"}, gotRequests)
+	require.Len(t, gotEntities, 2)
+	assert.Equal(t, int64(1), gotEntities[1].Rev()) // fresh read
+
+	// Conflict on every try: give up
+	gotRequests = nil
+	conflicts = 2
+	_, err = ec.MutateById(context.Background(), "abc", incr)
+	assert.ErrorIs(t, err, etre.ErrRevConflict)
+	assert.Len(t, gotRequests, 4)
+
+	// mutate error or nil: no update
+	gotRequests = nil
+	mutateErr := errors.New("mutate error")
+	_, err = ec.MutateById(context.Background(), "abc", func(etre.Entity) (etre.Entity, error) { return nil, mutateErr })
+	assert.ErrorIs(t, err, mutateErr)
+	w, err = ec.MutateById(context.Background(), "abc", func(etre.Entity) (etre.Entity, error) { return nil, nil })
+	require.NoError(t, err)
+	assert.Equal(t, etre.Write{EntityId: "abc"}, w)
+	assert.Equal(t, []string{"GET ", "GET "}, gotRequests)
+
+	_, err = ec.MutateById(context.Background(), "abc", func(etre.Entity) (etre.Entity, error) { return etre.Entity{"_id": "xyz", "n": 1}, nil })
+	assert.Error(t, err)
+	_, err = ec.MutateById(context.Background(), "", incr)
+	assert.ErrorIs(t, err, etre.ErrIdNotSet)
+}
+
+// //////////////////////////////////////////////////////////////////////////
+// Upsert
+// //////////////////////////////////////////////////////////////////////////
+
+func TestUpsert(t *testing.T) {
+	// Fake API with one entity that's inserted, updated, or changed concurrently
+	var exists, many bool
+	var rev, conflicts, dupes int
+	var gotQueries []string
+	uts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("query")
+		gotQueries = append(gotQueries, r.Method+" "+q)
+		switch r.Method {
+		case "GET":
+			switch {
+			case many:
+				w.Write([]byte(`[{"_id":"abc","_rev":0},{"_id":"def","_rev":0}]`))
+			case exists:
+				fmt.Fprintf(w, `[{"_id":"abc","_rev":%d}]`, rev)
+			default:
+				w.Write([]byte("[]"))
+			}
+		case "POST":
+			exists = true
+			if dupes > 0 {
+				dupes--
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"writes":[],"error":{"type":"duplicate-entity","message":"duplicate"}}`))
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"writes":[{"entityId":"abc"}]}`))
+		case "PUT":
+			if conflicts > 0 {
+				conflicts--
+				rev++ // changed by another client
+			}
+			if q != fmt.Sprintf("_id=abc,_rev=%d", rev) {
+				w.Write([]byte(`{"writes":[]}`))
+				return
+			}
+			rev++
+			w.Write([]byte(`{"writes":[{"entityId":"abc","diff":{"x":"old"}}]}`))
+		}
+	}))
+	defer uts.Close()
+
+	ec := etre.NewEntityClient("node", uts.URL, httpClient)
+	entity := etre.Entity{"hostname": "local", "x": "new"}
+
+	// Not found: inserted
+	got, err := ec.Upsert("hostname", entity)
+	require.NoError(t, err)
+	assert.Equal(t, etre.Write{EntityId: "abc", Inserted: true}, got)
+	assert.Equal(t, []string{"GET hostname=local", "POST "}, gotQueries)
+
+	// Found: updated if _rev matches
+	gotQueries = nil
+	got, err = ec.Upsert("hostname", entity)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", got.EntityId)
+	assert.False(t, got.Inserted)
+	assert.Equal(t, etre.Entity{"x": "old"}, got.Diff)
+	assert.Equal(t, []string{"GET hostname=local", "PUT _id=abc,_rev=0"}, gotQueries)
+
+	// _rev changed concurrently: re-read and try again
+	gotQueries = nil
+	conflicts = 1
+	got, err = ec.Upsert("hostname", entity)
+	require.NoError(t, err)
+	assert.False(t, got.Inserted)
+	assert.Equal(t, []string{"GET hostname=local", "PUT _id=abc,_rev=1", "GET hostname=local", "PUT _id=abc,_rev=2"}, gotQueries)
+
+	// Inserted concurrently: update it
+	gotQueries = nil
+	exists = false
+	dupes = 1
+	got, err = ec.Upsert("hostname", entity)
+	require.NoError(t, err)
+	assert.False(t, got.Inserted)
+	assert.Equal(t, []string{"GET hostname=local", "POST ", "GET hostname=local", "PUT _id=abc,_rev=3"}, gotQueries)
+
+	// Changed on every try: give up
+	conflicts = etre.UPSERT_MAX_TRIES
+	_, err = ec.Upsert("hostname", entity)
+	assert.Error(t, err)
+
+	// Label not unique
+	gotQueries = nil
+	many = true
+	_, err = ec.Upsert("hostname", entity)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"GET hostname=local"}, gotQueries)
+
+	// Invalid entity or label
+	_, err = ec.Upsert("hostname", etre.Entity{"_id": "abc", "hostname": "local"})
+	assert.ErrorIs(t, err, etre.ErrIdSet)
+	_, err = ec.Upsert("hostname", etre.Entity{"hostname": 1})
+	assert.Error(t, err)
+	_, err = ec.Upsert("hostname", etre.Entity{"x": "y"})
+	assert.Error(t, err)
+
+	// The read isn't served from the query cache, so it sees the insert
+	exists, many, rev = false, false, 0
+	gotQueries = nil
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:    "node",
+		Addr:          uts.URL,
+		HTTPClient:    httpClient,
+		QueryCacheTTL: time.Minute,
+	})
+	got, err = ec.Upsert("hostname", entity)
+	require.NoError(t, err)
+	assert.True(t, got.Inserted)
+	got, err = ec.Upsert("hostname", entity)
+	require.NoError(t, err)
+	assert.False(t, got.Inserted)
+	assert.Equal(t, []string{"GET hostname=local", "POST ", "GET hostname=local", "PUT _id=abc,_rev=0"}, gotQueries)
+
+	// The value is quoted, so a comma doesn't split the query
+	gotQueries = nil
+	_, err = ec.Upsert("hostname", etre.Entity{"hostname": "a,b"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{`GET hostname="a,b"`, "PUT _id=abc,_rev=1"}, gotQueries)
+}
+
+// //////////////////////////////////////////////////////////////////////////
+// Delete
 // //////////////////////////////////////////////////////////////////////////
 
-func TestCDCClient(t *testing.T) {
-	debug := false // Ryan's Rule #9
+func TestDeleteOK(t *testing.T) {
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+				Diff: map[string]interface{}{
+					"foo": "foo",
+				},
+			},
+		},
+	}
+
+	// New etre.Client
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	// Normal delete that returns status code 200 and a write result
+	query := "foo=bar"
+	ctx := testContext()
+	got, err := ec.WithContext(ctx).Delete(query)
+	require.NoError(t, err)
+
+	// Verify call and response
+	assert.Equal(t, "DELETE", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node", gotPath)
+	assert.Equal(t, "query="+query, gotQuery)
+	assert.Equal(t, respData, got)
+	assert.Equal(t, ctx, httpRT.gotCtx)
+}
+
+func TestDeleteByQuery(t *testing.T) {
+	// Fake API deletes at most limit of the remaining entities
+	remaining := 5
+	var gotQueries []string
+	dts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := url.QueryUnescape(r.URL.RawQuery)
+		gotQueries = append(gotQueries, q)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		n := remaining
+		if limit > 0 && limit < n {
+			n = limit
+		}
+		wr := etre.WriteResult{Writes: []etre.Write{}}
+		for i := 0; i < n; i++ {
+			wr.Writes = append(wr.Writes, etre.Write{EntityId: strconv.Itoa(remaining)})
+			remaining--
+		}
+		json.NewEncoder(w).Encode(wr)
+	}))
+	defer dts.Close()
+
+	ec := etre.NewEntityClient("node", dts.URL, httpClient)
+	got, err := ec.DeleteByQuery("x=y", etre.QueryFilter{Limit: 2})
+	require.NoError(t, err)
+	assert.Nil(t, got.Error)
+	var ids []string
+	for _, w := range got.Writes {
+		ids = append(ids, w.EntityId)
+	}
+	assert.Equal(t, []string{"5", "4", "3", "2", "1"}, ids)
+	assert.Equal(t, []string{
+		"query=x=y&limit=2",
+		"query=x=y&limit=2",
+		"query=x=y&limit=2", // deleted 1 < 2, done
+	}, gotQueries)
+
+	// No limit: one request, like Delete
+	remaining = 3
+	gotQueries = nil
+	got, err = ec.DeleteByQuery("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Len(t, got.Writes, 3)
+	assert.Equal(t, []string{"query=x=y"}, gotQueries)
+
+	_, err = ec.DeleteByQuery("", etre.QueryFilter{Limit: 2})
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+}
+
+func TestWriteOptionsDryRun(t *testing.T) {
+	setup(t)
+	respData = etre.WriteResult{
+		Writes: []etre.Write{{EntityId: "abc", Diff: etre.Entity{"_id": "abc", "foo": "old"}}},
+		DryRun: true,
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient).WithWriteOptions(etre.WriteOptions{DryRun: true})
+	got, err := ec.Update("a=b", etre.Entity{"foo": "new"})
+	require.NoError(t, err)
+	assert.Equal(t, "PUT", gotMethod)
+	assert.Equal(t, "query=a=b&dryRun=true", gotQuery)
+	assert.True(t, got.DryRun)
+	assert.Equal(t, respData, got)
+
+	_, err = ec.DeleteOne("abc")
+	require.NoError(t, err)
+	assert.Equal(t, "DELETE", gotMethod)
+	assert.Equal(t, "dryRun=true", gotQuery)
+
+	// DeleteByQuery makes one request for all, ignoring limit
+	_, err = ec.DeleteByQuery("a=b", etre.QueryFilter{Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "query=a=b&dryRun=true", gotQuery)
+
+	// Insert and upsert not supported
+	gotMethod = ""
+	_, err = ec.Insert([]etre.Entity{{"foo": "bar"}})
+	assert.ErrorIs(t, err, etre.ErrDryRunInsert)
+	_, err = ec.Upsert("foo", etre.Entity{"foo": "bar"})
+	assert.ErrorIs(t, err, etre.ErrDryRunInsert)
+	assert.Empty(t, gotMethod)
+}
+
+func TestWriteOptionsUpdateMode(t *testing.T) {
+	setup(t)
+	respData = etre.WriteResult{
+		Writes: []etre.Write{{EntityId: "abc", Diff: etre.Entity{"_id": "abc", "foo": "old", "bar": "removed"}}},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient).WithWriteOptions(etre.WriteOptions{UpdateMode: etre.UPDATE_MODE_REPLACE})
+	got, err := ec.Update("a=b", etre.Entity{"foo": "new"})
+	require.NoError(t, err)
+	assert.Equal(t, "PUT", gotMethod)
+	assert.Equal(t, "query=a=b&updateMode=replace", gotQuery)
+	assert.Equal(t, respData, got)
+
+	_, err = ec.UpdateOne("abc", etre.Entity{"foo": "new"})
+	require.NoError(t, err)
+	assert.Equal(t, "updateMode=replace", gotQuery)
+
+	// Other writes ignore it
+	respData = etre.WriteResult{Writes: []etre.Write{{EntityId: "abc"}}}
+	_, err = ec.DeleteOne("abc")
+	require.NoError(t, err)
+	assert.Equal(t, "DELETE", gotMethod)
+	assert.Empty(t, gotQuery)
+
+	// Invalid mode is an error without a request
+	gotMethod = ""
+	ec = ec.WithWriteOptions(etre.WriteOptions{UpdateMode: "patch"})
+	_, err = ec.Update("a=b", etre.Entity{"foo": "new"})
+	assert.EqualError(t, err, "invalid WriteOptions.UpdateMode: patch; valid modes: merge, replace")
+	assert.Empty(t, gotMethod)
+}
+
+func TestWriteWarnings(t *testing.T) {
+	setup(t)
+	respData = etre.WriteResult{
+		Writes:   []etre.Write{{EntityId: "abc"}},
+		Warnings: []string{"label env is deprecated", "value of cores coerced to int"},
+	}
+
+	// Warnings are decoded but not an error
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	got, err := ec.UpdateOne("abc", etre.Entity{"env": "prod"})
+	require.NoError(t, err)
+	assert.Equal(t, respData, got)
+	assert.NoError(t, got.Err())
+
+	// DeleteByIds returns the warnings of all writes
+	got, err = ec.DeleteByIds([]string{"abc", "def"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"label env is deprecated", "value of cores coerced to int", "label env is deprecated", "value of cores coerced to int"}, got.Warnings)
+
+	// Older servers don't send warnings
+	respData = etre.WriteResult{Writes: []etre.Write{{EntityId: "abc"}}}
+	got, err = ec.DeleteOne("abc")
+	require.NoError(t, err)
+	assert.Nil(t, got.Warnings)
+}
+
+func TestDeleteWithSet(t *testing.T) {
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+				Diff: map[string]interface{}{
+					"foo": "foo",
+				},
+			},
+		},
+	}
+
+	// New etre.Client
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	set := etre.Set{
+		Id:   "setid",
+		Op:   "setop",
+		Size: 3,
+	}
+	ec = ec.WithSet(set)
+
+	// Normal delete that returns status code 200 and a write result
+	query := "foo=bar"
+	got, err := ec.Delete(query)
+	require.NoError(t, err)
+
+	// Verify call and response
+	assert.Equal(t, "DELETE", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node", gotPath)
+	assert.Equal(t, "query="+query+"&setId=setid&setOp=setop&setSize=3", gotQuery)
+	assert.Equal(t, respData, got)
+}
+
+// //////////////////////////////////////////////////////////////////////////
+// DeleteOne
+// //////////////////////////////////////////////////////////////////////////
+
+func TestDeleteOneOK(t *testing.T) {
+	// Same test as DeleteOK, just using the DeleteOne convenience function instead
+	setup(t)
+
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+				Diff: map[string]interface{}{
+					"foo": "foo",
+				},
+			},
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	ctx := testContext()
+	got, err := ec.WithContext(ctx).DeleteOne("abc")
+	require.NoError(t, err)
+
+	assert.Equal(t, "DELETE", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entity/node/abc", gotPath)
+	assert.Empty(t, gotQuery)
+	assert.Equal(t, respData, got)
+	assert.Equal(t, ctx, httpRT.gotCtx)
+}
+
+func TestDeleteOneWithSet(t *testing.T) {
+	// With a set up, the query should contain the set op params
+	setup(t)
+
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+				Diff: map[string]interface{}{
+					"foo": "foo",
+				},
+			},
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	set := etre.Set{
+		Id:   "setid",
+		Op:   "setop",
+		Size: 2,
+	}
+	ec = ec.WithSet(set)
+
+	got, err := ec.DeleteOne("abc")
+	require.NoError(t, err)
+	assert.Equal(t, "DELETE", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entity/node/abc", gotPath)
+	assert.Equal(t, "setId=setid&setOp=setop&setSize=2", gotQuery)
+	assert.Equal(t, respData, got)
+}
+
+// //////////////////////////////////////////////////////////////////////////
+// Labels and DeleteLabel
+// //////////////////////////////////////////////////////////////////////////
+
+func TestLabelsOK(t *testing.T) {
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respData = []string{"foo", "bar"}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	ctx := testContext()
+	got, err := ec.WithContext(ctx).Labels("abc")
+	require.NoError(t, err)
+	assert.Equal(t, "GET", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entity/node/abc/labels", gotPath)
+	assert.Empty(t, gotQuery)
+	assert.Equal(t, respData, got)
+	assert.Equal(t, ctx, httpRT.gotCtx)
+}
+
+func TestDeleteLabelOK(t *testing.T) {
+	setup(t)
+
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+				Diff: map[string]interface{}{
+					"foo": "foo",
+				},
+			},
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	ctx := testContext()
+	got, err := ec.WithContext(ctx).DeleteLabel("abc", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "DELETE", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entity/node/abc/labels/foo", gotPath)
+	assert.Empty(t, gotQuery)
+	assert.Equal(t, respData, got)
+	assert.Equal(t, ctx, httpRT.gotCtx)
+}
+
+type observation struct {
+	op  string
+	d   time.Duration
+	err error
+}
+
+type testObserver struct {
+	sync.Mutex
+	got []observation
+}
+
+func (o *testObserver) ObserveRequest(op string, d time.Duration, err error) {
+	o.Lock()
+	defer o.Unlock()
+	o.got = append(o.got, observation{op, d, err})
+}
+
+func TestAllLabels(t *testing.T) {
+	var gotPath string
+	requests := 0
+	lts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		requests++
+		w.Write([]byte(`["_id","_rev","_type","host"]`))
+	}))
+	defer lts.Close()
+
+	// No cache by default
+	ec := etre.NewEntityClient("node", lts.URL, http.DefaultClient)
+	labels, err := ec.AllLabels()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"_id", "_rev", "_type", "host"}, labels)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/labels", gotPath)
+	_, err = ec.AllLabels()
+	require.NoError(t, err)
+	assert.Equal(t, 2, requests)
+
+	// With LabelsCacheTTL, copies share the cache until it expires
+	requests = 0
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:     "node",
+		Addr:           lts.URL,
+		HTTPClient:     http.DefaultClient,
+		LabelsCacheTTL: 100 * time.Millisecond,
+	})
+	labels, err = ec.AllLabels()
+	require.NoError(t, err)
+	labels[0] = "modified" // caller can't modify the cached labels
+	labels, err = ec.WithContext(context.Background()).AllLabels()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"_id", "_rev", "_type", "host"}, labels)
+	assert.Equal(t, 1, requests)
+
+	time.Sleep(150 * time.Millisecond)
+	_, err = ec.AllLabels()
+	require.NoError(t, err)
+	assert.Equal(t, 2, requests)
+}
+
+func TestObserver(t *testing.T) {
+	ots := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/count"):
+			w.Write([]byte("3"))
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, etre.API_ROOT+"/entity/"):
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == "GET":
+			time.Sleep(5 * time.Millisecond)
+			w.Write([]byte("[]"))
+		case r.Method == "PUT":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(etre.WriteResult{Error: &etre.Error{Type: "db-update", Message: "fake error"}})
+		default:
+			w.Write([]byte(`{"writes":[{"id":"abc"}]}`))
+		}
+	}))
+
+	obs := &testObserver{}
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       ots.URL,
+		HTTPClient: http.DefaultClient,
+		Observer:   obs,
+	})
+	ec.Query("x=y", etre.QueryFilter{})
+	ec.Count("x=y", etre.QueryFilter{})
+	ec.Get("abc")
+	ec.Insert([]etre.Entity{{"x": "y"}})
+	ec.Update("x=y", etre.Entity{"x": "z"})
+	ec.DeleteLabel("abc", "x")
+	ots.Close()
+	ec.Delete("x=y") // network error
+
+	var ops []string
+	for _, o := range obs.got {
+		ops = append(ops, o.op)
+	}
+	assert.Equal(t, []string{"query", "count", "get", "insert", "update", "delete-label", "delete"}, ops)
+	assert.GreaterOrEqual(t, obs.got[0].d, 5*time.Millisecond)
+	assert.NoError(t, obs.got[0].err)
+	assert.NoError(t, obs.got[1].err)
+	assert.ErrorIs(t, obs.got[2].err, etre.ErrEntityNotFound)
+	assert.NoError(t, obs.got[3].err)
+	assert.ErrorIs(t, obs.got[4].err, etre.ErrDBError)
+	assert.NoError(t, obs.got[5].err)
+	assert.Error(t, obs.got[6].err)
+}
+
+type spanKey struct{}
+
+type testTracer struct {
+	started []string
+	ended   []error
+}
+
+func (tr *testTracer) Start(ctx context.Context, op string) (context.Context, func(error)) {
+	parent, _ := ctx.Value(spanKey{}).(string)
+	tr.started = append(tr.started, parent+"/"+op)
+	return context.WithValue(ctx, spanKey{}, "span-"+op), func(err error) { tr.ended = append(tr.ended, err) }
+}
+
+func (tr *testTracer) Inject(ctx context.Context, header http.Header) {
+	header.Set("traceparent", ctx.Value(spanKey{}).(string))
+}
+
+func TestTracer(t *testing.T) {
+	var gotHeader []string
+	tts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = append(gotHeader, r.Header.Get("traceparent"))
+		if r.Method == "GET" {
+			w.Write([]byte("[]"))
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(etre.WriteResult{Error: &etre.Error{Type: "db-delete", Message: "fake error"}})
+		}
+	}))
+	defer tts.Close()
+
+	tr := &testTracer{}
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       tts.URL,
+		HTTPClient: http.DefaultClient,
+		Tracer:     tr,
+	})
+
+	// Span is a child of the span in the call context
+	ctx := context.WithValue(context.Background(), spanKey{}, "parent")
+	_, err := ec.QueryContext(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	wr, err := ec.Delete("x=y")
+	require.NoError(t, err)
+	require.Error(t, wr.Err())
+
+	assert.Equal(t, []string{"parent/query", "/delete"}, tr.started)
+	assert.Equal(t, []string{"span-query", "span-delete"}, gotHeader)
+	require.Len(t, tr.ended, 2)
+	assert.NoError(t, tr.ended[0])
+	assert.ErrorIs(t, tr.ended[1], etre.ErrDBError)
+}
+
+type testLimiter struct {
+	n   int
+	err error
+}
+
+func (l *testLimiter) Wait(ctx context.Context) error {
+	l.n++
+	return l.err
+}
+
+type circuitObserver struct {
+	testObserver
+	states []etre.CircuitState
+}
+
+func (o *circuitObserver) ObserveCircuit(state etre.CircuitState) {
+	o.Lock()
+	defer o.Unlock()
+	o.states = append(o.states, state)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	var reqs atomic.Int32
+	cts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs.Add(1)
+		if s := int(status.Load()); s != http.StatusOK {
+			w.WriteHeader(s)
+			json.NewEncoder(w).Encode(etre.Error{Type: "db-read", Message: "fake error"})
+			return
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer cts.Close()
+
+	obs := &circuitObserver{}
+	ecs := etre.NewEntityClients([]string{"node", "rack"}, etre.EntityClientConfig{
+		Addr:           cts.URL,
+		HTTPClient:     http.DefaultClient,
+		Retry:          5, // not retried when open
+		Observer:       obs,
+		CircuitBreaker: etre.CircuitBreaker{Failures: 2, Cooldown: 50 * time.Millisecond},
+	})
+	ec := ecs["node"]
+
+	// First call: first try and retry fail, which opens the circuit, so no more retries
+	_, err := ec.Query("x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrCircuitOpen)
+	assert.Equal(t, int32(2), reqs.Load())
+
+	// Open: fail fast without a request, for all clients and copies
+	_, err = ec.WithTrace("a=b").Query("x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrCircuitOpen)
+	_, err = ecs["rack"].Query("x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrCircuitOpen)
+	assert.Equal(t, int32(2), reqs.Load())
+
+	// Half-open probe fails: open again
+	time.Sleep(60 * time.Millisecond)
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrCircuitOpen)
+	assert.Equal(t, int32(3), reqs.Load())
+
+	// Half-open probe succeeds: closed
+	status.Store(http.StatusOK)
+	time.Sleep(60 * time.Millisecond)
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), reqs.Load())
+
+	// API client errors are not failures
+	status.Store(http.StatusBadRequest)
+	for i := 0; i < 3; i++ {
+		_, err = ec.Query("x=y", etre.QueryFilter{})
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, etre.ErrCircuitOpen)
+	}
+
+	expect := []etre.CircuitState{etre.CIRCUIT_OPEN, etre.CIRCUIT_HALF_OPEN, etre.CIRCUIT_OPEN, etre.CIRCUIT_HALF_OPEN, etre.CIRCUIT_CLOSED}
+	assert.Equal(t, expect, obs.states)
+
+	// Disabled by default
+	status.Store(http.StatusServiceUnavailable)
+	ec = etre.NewEntityClient("node", cts.URL, http.DefaultClient)
+	for i := 0; i < 3; i++ {
+		_, err = ec.Query("x=y", etre.QueryFilter{})
+		assert.NotErrorIs(t, err, etre.ErrCircuitOpen)
+	}
+}
+
+// fakeClock is an etre.Clock that advances step on every call to Now.
+type fakeClock struct {
+	sync.Mutex
+	t     time.Time
+	step  time.Duration
+	waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	t := c.t
+	c.t = c.t.Add(c.step)
+	return t
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// After advances the clock by d, without waiting, and saves d in waits.
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Sleep(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.waits = append(c.waits, d)
+	c.t = c.t.Add(d)
+}
+
+func TestClock(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	cts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := int(status.Load()); s != http.StatusOK {
+			w.WriteHeader(s)
+			json.NewEncoder(w).Encode(etre.Error{Type: "db-read", Message: "fake error"})
+			return
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer cts.Close()
+
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:     "node",
+		Addr:           cts.URL,
+		HTTPClient:     http.DefaultClient,
+		CircuitBreaker: etre.CircuitBreaker{Failures: 1, Cooldown: time.Hour},
+		Clock:          clock,
+	})
+
+	// Failure opens the circuit for the cooldown, in clock time
+	_, err := ec.Query("x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrDBError)
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrCircuitOpen)
+
+	// After the cooldown, the probe succeeds
+	clock.Add(time.Hour)
+	status.Store(http.StatusOK)
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+
+	// Latency is in clock steps: request sent, written, then response read
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       cts.URL,
+		HTTPClient: http.DefaultClient,
+		Clock:      &fakeClock{t: time.Unix(1700000000, 0), step: 10 * time.Millisecond},
+	})
+	var lat etre.Latency
+	_, err = ec.WithLatency(&lat).Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, etre.Latency{Send: 10, Recv: 10, RTT: 20}, lat)
+	assert.Equal(t, 20*time.Millisecond, ec.Stats().RTT)
+
+	// Waits between retries are in clock time, so hours take no real time
+	status.Store(http.StatusServiceUnavailable)
+	clock = &fakeClock{t: time.Unix(1700000000, 0)}
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       cts.URL,
+		HTTPClient: http.DefaultClient,
+		Retry:      2,
+		RetryWait:  time.Hour,
+		Clock:      clock,
+	})
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrDBError)
+	assert.Equal(t, []time.Duration{time.Hour, time.Hour}, clock.waits)
+
+	clock = &fakeClock{t: time.Unix(1700000000, 0)}
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:  "node",
+		Addr:        cts.URL,
+		HTTPClient:  http.DefaultClient,
+		RetryPolicy: etre.RetryPolicy{MaxRetries: 2, BaseDelay: time.Hour, MaxDelay: time.Hour},
+		Clock:       clock,
+	})
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrDBError)
+	require.Len(t, clock.waits, 2)
+	for _, d := range clock.waits {
+		assert.GreaterOrEqual(t, d, 30*time.Minute) // jittered between d/2 and d
+		assert.LessOrEqual(t, d, time.Hour)
+	}
+
+	// Rate limit waits are in clock time: one step
+	status.Store(http.StatusOK)
+	var rateLimitWait time.Duration
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:   "node",
+		Addr:         cts.URL,
+		HTTPClient:   http.DefaultClient,
+		QueryLimiter: &testLimiter{},
+		OnRateLimit:  func(method string, wait time.Duration) { rateLimitWait = wait },
+		Clock:        &fakeClock{t: time.Unix(1700000000, 0), step: time.Minute},
+	})
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, rateLimitWait)
+}
+
+func TestRateLimiter(t *testing.T) {
+	lts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte("[]"))
+		} else {
+			w.Write([]byte(`{"writes":[{"id":"abc"}]}`))
+		}
+	}))
+	defer lts.Close()
+
+	// Reads wait on QueryLimiter, writes on WriteLimiter
+	ql := &testLimiter{}
+	wl := &testLimiter{}
+	var waits []string
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:   "node",
+		Addr:         lts.URL,
+		HTTPClient:   http.DefaultClient,
+		QueryLimiter: ql,
+		WriteLimiter: wl,
+		OnRateLimit: func(method string, wait time.Duration) {
+			waits = append(waits, method)
+		},
+	})
+	_, err := ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	_, err = ec.Insert([]etre.Entity{{"x": "y"}})
+	require.NoError(t, err)
+	_, err = ec.Delete("x=y")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ql.n)
+	assert.Equal(t, 2, wl.n)
+	assert.Equal(t, []string{"GET", "POST", "DELETE"}, waits)
+
+	// Limiter error fails the request before it's sent
+	ql.err = fmt.Errorf("limited")
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "limited")
+
+	// NewRateLimiter spaces requests evenly: 3 requests at 50/s take at least 40ms
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:   "node",
+		Addr:         lts.URL,
+		HTTPClient:   http.DefaultClient,
+		QueryLimiter: etre.NewRateLimiter(50),
+	})
+	t0 := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err = ec.Query("x=y", etre.QueryFilter{})
+		require.NoError(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(t0), 40*time.Millisecond)
+
+	// Waiting respects the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ec.QueryContext(ctx, "x=y", etre.QueryFilter{})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Slot of a request canceled while waiting is released: at 5/s, the first
+	// request isn't limited, the next 5 are canceled while waiting, and the last
+	// waits for the second slot (200ms), not the seventh (1.2s)
+	limiter := etre.NewRateLimiter(5)
+	require.NoError(t, limiter.Wait(context.Background()))
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() { time.Sleep(10 * time.Millisecond); cancel() }()
+		assert.ErrorIs(t, limiter.Wait(ctx), context.Canceled)
+		cancel()
+	}
+	t0 = time.Now()
+	require.NoError(t, limiter.Wait(context.Background()))
+	assert.Less(t, time.Since(t0), 500*time.Millisecond)
+}
+
+// //////////////////////////////////////////////////////////////////////////
+// CDC
+// //////////////////////////////////////////////////////////////////////////
+
+func TestCDCClient(t *testing.T) {
+	debug := false // Ryan's Rule #9
+
+	// Setup a websocket handler to handle the initial low-level ws connection
+	// and do the Etre CDC feed start sequence: client send start control and
+	// waits to receive start control ack. After started, flow is synchronous
+	// so test can send/receive (mostly send) on wsConn which will be read by
+	// client and, if it's a CDC event, sent to the events chan returned by Start.
+	connChan := make(chan bool)
+	var wsConn *websocket.Conn
+	var gotStart map[string]interface{}
+	startAck := map[string]interface{}{
+		"control": "start",
+	}
+	wsHandler := func(w http.ResponseWriter, r *http.Request) {
+		var upgrader = websocket.Upgrader{}
+		var err error
+		wsConn, err = upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer wsConn.Close()
+		err = wsConn.ReadJSON(&gotStart)
+		require.NoError(t, err)
+		err = wsConn.WriteJSON(startAck)
+		require.NoError(t, err)
+		connChan <- true
+		<-connChan
+	}
+	ts = httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer ts.Close()
+	defer close(connChan)
+
+	// Start client
+	url, _ := url.Parse(ts.URL)
+	ec := etre.NewCDCClient("ws://"+url.Host, nil, 10, debug)
+	defer ec.Stop()
+
+	startTs := time.Now()
+	events, err := ec.Start(startTs)
+	require.NoError(t, err)
+
+	// Wait for wsHandler ^ to do start sequence
+	select {
+	case <-connChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for wsHandler to ack start sequence")
+	}
+
+	//
+	// Client is connected to wsConn (via wsHandler), waiting to receive from us.
+	// At this point, communicate is synchronous: cdc feed (us) -> client. Client
+	// only sends in response to control:ping.
+	//
+
+	// Start should be idempotent
+	events2, err2 := ec.Start(startTs)
+	assert.NoError(t, err2)
+	assert.Equal(t, events, events2, "Start did not return same events chan, expected same one")
+
+	// Verify client sent correct start control message
+
+	// Need to marshal and unmarshal this because startTs: startTs will be
+	// a time.Time type but startTs recv'ed is a string and startTs.String()
+	// is slightly different than the JSON-mashaled time string. So only
+	// way to be consistent is to cmp json marshaled to json marshaled.
+	v := map[string]interface{}{
+		"control": "start",
+		"startTs": startTs.UnixNano() / int64(time.Millisecond),
+	}
+	bytes, _ := json.Marshal(v)
+	var expectStart map[string]interface{}
+	json.Unmarshal(bytes, &expectStart)
+	assert.Equal(t, expectStart, gotStart)
+
+	// First, let's send the client a CDC event and make sure it sends via the
+	// events chan it returned from Start()
+	sentEvent := etre.CDCEvent{
+		Id:         "xyz",
+		Ts:         1001,
+		Op:         "i", // insert
+		Caller:     "ryan",
+		EntityId:   "abc",
+		EntityType: "node",
+		Old:        nil,
+		New: &etre.Entity{
+			"_id": "abc",
+			"foo": "bar",
+		},
+	}
+	if err := wsConn.WriteJSON(sentEvent); err != nil {
+		t.Fatal(err)
+		return
+	}
+	var gotEvent etre.CDCEvent
+	select {
+	case gotEvent = <-events:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout receiving event from client chan")
+	}
+
+	// The event we got should be the event we sent--that's the whole point!
+	assert.Equal(t, sentEvent, gotEvent)
+
+	//
+	// Send client a ping control message (server -> client ping)
+	//
+
+	ping := map[string]interface{}{
+		"control": "ping",
+		"srcTs":   startTs.UnixNano(),
+	}
+	if err := wsConn.WriteJSON(ping); err != nil {
+		t.Fatal(err)
+		return
+	}
+	var pong map[string]interface{}
+	if err := wsConn.ReadJSON(&pong); err != nil {
+		t.Fatal(err)
+		return
+	}
+	assert.Equal(t, "pong", pong["control"])
+
+	ts, ok := pong["dstTs"]
+	require.True(t, ok, "dstTs not set in ping reply, expected a UnixNano value")
+	assert.True(t, int64(ts.(float64)) > startTs.UnixNano(), "got ts %v <= sent ts %d, expected it to be greater", ts, startTs.UnixNano())
+
+	//
+	// Ping server (client -> server ping)
+	//
+
+	// Recv ping, wait 101ms, send pong
+	waitForPing := make(chan struct{})
+	go func() {
+		var ping map[string]interface{}
+		var err error
+
+		err = wsConn.ReadJSON(&ping)
+		require.NoError(t, err)
+
+		time.Sleep(101 * time.Millisecond)
+		ping["control"] = "pong"
+		ping["dstTs"] = time.Now().UnixNano()
+		err = wsConn.WriteJSON(ping)
+		require.NoError(t, err)
+
+		close(waitForPing)
+	}()
+
+	lag := ec.Ping(time.Duration(1 * time.Second))
+
+	// lag.Recv is almost always <1ms because it's the time from calling
+	// Ping to wsConn.ReadJSON in the gorountine above. Since that's local
+	// it's microseconds. But the time.Sleep in the goroutine creates an
+	// artificial Send and RTT lag.
+	assert.False(t, lag.Send < 101 || lag.RTT < 101, "got zero lag, exected > 100ms values: %#v", lag)
+
+	<-waitForPing
+
+	//
+	// Send client an error
+	//
+
+	// This should cause the client to close the connection, which we can detect
+	// by trying to read, which should return an error
+	errorMsg := map[string]interface{}{
+		"control": "error",
+		"error":   "fake error",
+	}
+	err = wsConn.WriteJSON(errorMsg)
+	require.NoError(t, err)
+
+	// Give client a few milliseconds to shutdown
+	time.Sleep(500 * time.Millisecond)
+	var rand map[string]interface{} // shouldn't read random data
+	err = wsConn.ReadJSON(&rand)
+	require.Error(t, err)
+
+	// The client should save the error ^ and return it
+	gotError := ec.Error().Error()
+	assert.Contains(t, gotError, "fake error")
+}
+
+func TestWithContext(t *testing.T) {
+	ctx1 := context.Background()
+	ctx2 := context.WithValue(ctx1, "key", "value")
+
+	// client w/o context should return context.Background()
+	client1 := etre.NewEntityClient("node", ts.URL, httpClient)
+	require.NotNil(t, client1.Context())
+	assert.Equal(t, ctx1, client1.Context())
+
+	// set the context. should not change client1's context
+	client2 := client1.WithContext(ctx2)
+	assert.Equal(t, ctx2, client2.Context())
+	assert.Equal(t, ctx1, client1.Context())
+}
+
+func testContext() context.Context {
+	return context.WithValue(context.Background(), "key", "test-context-"+time.Now().String())
+}
+
+type rt struct {
+	gotCtx context.Context
+}
+
+func (t *rt) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.gotCtx = r.Context()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestCDCClientReconnect(t *testing.T) {
+	// The ws handler sends a different set of events on each connection, then
+	// closes the connection (except the last) which should make the client
+	// reconnect and resume from the Ts of the last event it received. On resume,
+	// the API sends events with that Ts again, so event "b" is sent twice but
+	// the client should receive it once.
+	conns := [][]etre.CDCEvent{
+		{{Id: "a", Ts: 100}, {Id: "b", Ts: 200}},
+		{{Id: "b", Ts: 200}, {Id: "c", Ts: 200}, {Id: "d", Ts: 300}},
+		{{Id: "d", Ts: 300}, {Id: "e", Ts: 400}},
+	}
+	gotStartTs := make(chan int64, len(conns))
+	var connNo int32
+	wsHandler := func(w http.ResponseWriter, r *http.Request) {
+		var upgrader = websocket.Upgrader{}
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer wsConn.Close()
+		var start map[string]interface{}
+		require.NoError(t, wsConn.ReadJSON(&start))
+		gotStartTs <- int64(start["startTs"].(float64))
+		require.NoError(t, wsConn.WriteJSON(map[string]interface{}{"control": "start"}))
+		n := int(atomic.AddInt32(&connNo, 1))
+		for _, e := range conns[n-1] {
+			require.NoError(t, wsConn.WriteJSON(e))
+		}
+		if n < len(conns) {
+			return // disconnect client
+		}
+		wsConn.ReadMessage() // wait for client to close
+	}
+	cdcts := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer cdcts.Close()
+
+	url, _ := url.Parse(cdcts.URL)
+	ec := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:          "ws://" + url.Host,
+		BufferSize:    10,
+		ReconnectWait: 10 * time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := ec.StartContext(ctx, 50)
+	require.NoError(t, err)
+
+	gotIds := []string{}
+	timeout := time.After(2 * time.Second)
+	for len(gotIds) < 5 {
+		select {
+		case e := <-events:
+			gotIds = append(gotIds, e.Id)
+		case <-timeout:
+			t.Fatalf("timeout waiting for events, got %v", gotIds)
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, gotIds)
+	assert.Equal(t, int64(50), <-gotStartTs)
+	assert.Equal(t, int64(200), <-gotStartTs)
+	assert.Equal(t, int64(300), <-gotStartTs)
+
+	// Cancelling the context stops the feed: chans closed, no error
+	cancel()
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok, "received event after context cancelled")
+	case <-time.After(2 * time.Second):
+		t.Fatal("feed chan not closed after context cancelled")
+	}
+	_, ok := <-ec.Errors()
+	assert.False(t, ok, "received error after context cancelled")
+	assert.NoError(t, ec.Error())
+}
+
+func TestCDCClientFatalError(t *testing.T) {
+	// Data that's not a CDC event or control message is fatal: the client
+	// does not reconnect, and the error is sent on the Errors chan
+	wsHandler := func(w http.ResponseWriter, r *http.Request) {
+		var upgrader = websocket.Upgrader{}
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer wsConn.Close()
+		var start map[string]interface{}
+		require.NoError(t, wsConn.ReadJSON(&start))
+		require.NoError(t, wsConn.WriteJSON(map[string]interface{}{"control": "start"}))
+		require.NoError(t, wsConn.WriteJSON(map[string]interface{}{"foo": "bar"}))
+		wsConn.ReadMessage()
+	}
+	cdcts := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer cdcts.Close()
+
+	url, _ := url.Parse(cdcts.URL)
+	ec := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:          "ws://" + url.Host,
+		ReconnectWait: 10 * time.Millisecond,
+	})
+	defer ec.Stop()
+	events, err := ec.StartContext(context.Background(), 0)
+	require.NoError(t, err)
+
+	select {
+	case err := <-ec.Errors():
+		assert.ErrorIs(t, err, etre.ErrBadData)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for error")
+	}
+	_, ok := <-events
+	assert.False(t, ok, "feed chan not closed on fatal error")
+	assert.ErrorIs(t, ec.Error(), etre.ErrBadData)
+}
+
+func TestCDCClientDrain(t *testing.T) {
+	// The ws handler sends all events at once, then waits for the client to
+	// close, so most events are in transit when the client drains
+	sent := []etre.CDCEvent{{Id: "a", Ts: 1}, {Id: "b", Ts: 2}, {Id: "c", Ts: 3}, {Id: "d", Ts: 4}}
+	gotClose := make(chan error, 2)
+	wsHandler := func(w http.ResponseWriter, r *http.Request) {
+		var upgrader = websocket.Upgrader{}
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer wsConn.Close()
+		var start map[string]interface{}
+		require.NoError(t, wsConn.ReadJSON(&start))
+		require.NoError(t, wsConn.WriteJSON(map[string]interface{}{"control": "start"}))
+		for _, e := range sent {
+			require.NoError(t, wsConn.WriteJSON(e))
+		}
+		_, _, err = wsConn.ReadMessage() // replies to close
+		gotClose <- err
+	}
+	cdcts := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer cdcts.Close()
+
+	url, _ := url.Parse(cdcts.URL)
+	ec := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:          "ws://" + url.Host,
+		BufferSize:    1,
+		ReconnectWait: 10 * time.Millisecond,
+	})
+	events, err := ec.StartContext(context.Background(), 0)
+	require.NoError(t, err)
+
+	// Drain while the consumer hasn't received any events: it receives every
+	// event, then the feed chan is closed
+	drainErr := make(chan error, 1)
+	go func() { drainErr <- ec.Drain(context.Background()) }()
+	select {
+	case err := <-gotClose:
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for API to receive close")
+	}
+	gotIds := []string{}
+	for e := range events {
+		gotIds = append(gotIds, e.Id)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d"}, gotIds)
+	select {
+	case err := <-drainErr:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for Drain to return")
+	}
+	assert.NoError(t, ec.Error())
+	assert.NoError(t, ec.Drain(context.Background())) // not started
+
+	// Consumer doesn't receive, so draining takes longer than the ctx deadline
+	events, err = ec.StartContext(context.Background(), 0)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = ec.Drain(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	for range events {
+	}
+}
+
+func TestCDCClientReplay(t *testing.T) {
+	// Stored events, plus one the API shouldn't return (Ts 999) to test that
+	// the client excludes events outside the range
+	stored := []etre.CDCEvent{
+		{Id: "a", Ts: 50},
+		{Id: "b", Ts: 100},
+		{Id: "c", Ts: 150},
+		{Id: "d", Ts: 250},
+		{Id: "e", Ts: 300},
+		{Id: "f", Ts: 301},
+	}
+	var mux sync.Mutex
+	gotRanges := []string{}
+	rts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, etre.API_ROOT+"/changes/events", r.URL.Path)
+		since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		until, _ := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+		mux.Lock()
+		gotRanges = append(gotRanges, fmt.Sprintf("%d-%d", since, until))
+		mux.Unlock()
+		events := []etre.CDCEvent{}
+		for _, e := range stored {
+			if e.Ts >= since && e.Ts < until {
+				events = append(events, e)
+			}
+		}
+		if since == 200 {
+			events = append(events, etre.CDCEvent{Id: "x", Ts: 999})
+		}
+		json.NewEncoder(w).Encode(events)
+	}))
+	defer rts.Close()
+
+	url, _ := url.Parse(rts.URL)
+	ec := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:         "ws://" + url.Host,
+		ReplayWindow: 100 * time.Millisecond, // Ts range 100
+	})
+	events, err := ec.Replay(context.Background(), 100, 300)
+	require.NoError(t, err)
+	gotIds := []string{}
+	for e := range events {
+		gotIds = append(gotIds, e.Id)
+	}
+	assert.Equal(t, []string{"b", "c", "d", "e"}, gotIds)
+	assert.Equal(t, []string{"100-200", "200-300", "300-301"}, gotRanges)
+	assert.NoError(t, ec.Error())
+
+	// Invalid range
+	_, err = ec.Replay(context.Background(), 300, 100)
+	assert.Error(t, err)
+
+	// Cancelling the context closes the channel before the range is exhausted
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err = ec.Replay(ctx, 1, 1000)
+	require.NoError(t, err)
+	e := <-events
+	assert.Equal(t, "a", e.Id)
+	cancel()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("replay chan not closed after context cancelled")
+		}
+	}
+}
+
+func TestCDCClientReplayError(t *testing.T) {
+	// An API error on the first range is returned by Replay; on a later range,
+	// the channel is closed early and Error returns it
+	rts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("since") == "1" {
+			w.WriteHeader(http.StatusNotImplemented)
+			json.NewEncoder(w).Encode(etre.Error{Type: "cdc-disabled", Message: "CDC disabled"})
+			return
+		}
+		if r.URL.Query().Get("since") == "10" {
+			json.NewEncoder(w).Encode([]etre.CDCEvent{{Id: "a", Ts: 10}})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer rts.Close()
+
+	url, _ := url.Parse(rts.URL)
+	ec := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:         "ws://" + url.Host,
+		ReplayWindow: 100 * time.Millisecond,
+	})
+	_, err := ec.Replay(context.Background(), 1, 1000)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cdc-disabled")
+
+	events, err := ec.Replay(context.Background(), 10, 1000)
+	require.NoError(t, err)
+	gotIds := []string{}
+	for e := range events {
+		gotIds = append(gotIds, e.Id)
+	}
+	assert.Equal(t, []string{"a"}, gotIds)
+	assert.Error(t, ec.Error())
+}
+
+func TestDeleteByIds(t *testing.T) {
+	var gotPaths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPaths = append(gotPaths, r.Method+" "+r.URL.Path)
+		id := path.Base(r.URL.Path)
+		var wr etre.WriteResult
+		switch id {
+		case "gone":
+			w.WriteHeader(http.StatusNotFound)
+			wr.Error = &etre.Error{Type: "entity-not-found", EntityId: id, HTTPStatus: http.StatusNotFound}
+		case "bad":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			wr.Error = &etre.Error{Type: "db-delete", Message: "db down", EntityId: id, HTTPStatus: http.StatusServiceUnavailable}
+		default:
+			wr.Writes = []etre.Write{{EntityId: id, Diff: etre.Entity{"_id": id}}}
+		}
+		json.NewEncoder(w).Encode(wr)
+	}))
+	defer ts.Close()
+	ec := etre.NewEntityClient("node", ts.URL, &http.Client{})
+
+	// Stops on first error by default
+	wr, err := ec.DeleteByIds([]string{"a", "gone", "c"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"DELETE /api/v1/entity/node/a", "DELETE /api/v1/entity/node/gone"}, gotPaths)
+	require.Len(t, wr.Writes, 1)
+	assert.Equal(t, "a", wr.Writes[0].EntityId)
+	require.Error(t, wr.Err())
+	assert.ErrorIs(t, wr.Err(), etre.ErrEntityNotFound)
+	require.Len(t, wr.Errors, 1)
+	assert.ErrorIs(t, wr.Errors["gone"], etre.ErrEntityNotFound)
+
+	// Continue on error tries all IDs, and ignore not found skips already deleted
+	gotPaths = nil
+	wr, err = ec.WithWriteOptions(etre.WriteOptions{ContinueOnError: true, IgnoreNotFound: true}).DeleteByIds([]string{"a", "gone", "bad", "c"})
+	require.NoError(t, err)
+	assert.Len(t, gotPaths, 4)
+	require.Len(t, wr.Writes, 2)
+	assert.Equal(t, "a", wr.Writes[0].EntityId)
+	assert.Equal(t, "c", wr.Writes[1].EntityId)
+	assert.ErrorIs(t, wr.Err(), etre.ErrDBError)
+	require.Len(t, wr.Errors, 1)
+	assert.Equal(t, "db-delete", wr.Errors["bad"].Type)
+
+	_, err = ec.DeleteByIds(nil)
+	assert.ErrorIs(t, err, etre.ErrNoEntity)
+	_, err = ec.DeleteByIds([]string{"a", ""})
+	assert.ErrorIs(t, err, etre.ErrIdNotSet)
+}
+
+func TestSetGenerator(t *testing.T) {
+	var gotQueries []url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQueries = append(gotQueries, r.URL.Query())
+		json.NewEncoder(w).Encode(etre.WriteResult{Writes: []etre.Write{{EntityId: "a"}}})
+	}))
+	defer ts.Close()
+	var gotOps []string
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       ts.URL,
+		HTTPClient: http.DefaultClient,
+		SetGenerator: func(op string, n int) etre.Set {
+			gotOps = append(gotOps, op)
+			return etre.NewSet(op, n)
+		},
+	})
+	entities := []etre.Entity{{"x": "1"}, {"x": "2"}, {"x": "3"}}
+
+	// Insert more than one entity is a set
+	_, err := ec.Insert(entities)
+	require.NoError(t, err)
+	require.Len(t, gotQueries, 1)
+	assert.Len(t, gotQueries[0].Get("setId"), 36) // UUID
+	assert.Equal(t, "insert", gotQueries[0].Get("setOp"))
+	assert.Equal(t, "3", gotQueries[0].Get("setSize"))
+
+	// One set per batch, and one set for all DeleteByIds requests
+	gotQueries = nil
+	_, err = ec.InsertBatch(append(entities, etre.Entity{"x": "4"}), 2)
+	require.NoError(t, err)
+	_, err = ec.DeleteByIds([]string{"a", "b"})
+	require.NoError(t, err)
+	require.Len(t, gotQueries, 4)
+	assert.NotEqual(t, gotQueries[0].Get("setId"), gotQueries[1].Get("setId"))
+	assert.Equal(t, "2", gotQueries[0].Get("setSize"))
+	assert.Equal(t, "2", gotQueries[1].Get("setSize"))
+	assert.Equal(t, gotQueries[2].Get("setId"), gotQueries[3].Get("setId"))
+	assert.NotEqual(t, gotQueries[0].Get("setId"), gotQueries[2].Get("setId"))
+	assert.Equal(t, "delete", gotQueries[3].Get("setOp"))
+	assert.Equal(t, "2", gotQueries[3].Get("setSize"))
+	assert.Equal(t, []string{"insert", "insert", "insert", "delete"}, gotOps)
+
+	// Batch of one entity isn't a set
+	gotQueries = nil
+	_, err = ec.InsertBatch(entities, 2)
+	require.NoError(t, err)
+	require.Len(t, gotQueries, 2)
+	assert.Equal(t, "2", gotQueries[0].Get("setSize"))
+	assert.Empty(t, gotQueries[1].Get("setId"))
+
+	// Not for one entity, writes by query, or a client with a Set
+	gotQueries = nil
+	gotOps = nil
+	_, err = ec.Insert(entities[:1])
+	require.NoError(t, err)
+	_, err = ec.Update("x=y", etre.Entity{"x": "z"})
+	require.NoError(t, err)
+	_, err = ec.WithSet(etre.Set{Id: "s", Op: "mine", Size: 3}).Insert(entities)
+	require.NoError(t, err)
+	require.Len(t, gotQueries, 3)
+	assert.Empty(t, gotQueries[0].Get("setId"))
+	assert.Empty(t, gotQueries[1].Get("setId"))
+	assert.Equal(t, "s", gotQueries[2].Get("setId"))
+	assert.Empty(t, gotOps)
+
+	// Set labels are all or nothing
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:   "node",
+		Addr:         ts.URL,
+		HTTPClient:   http.DefaultClient,
+		SetGenerator: func(op string, n int) etre.Set { return etre.Set{Id: "s", Size: n} },
+	})
+	gotQueries = nil
+	_, err = ec.Insert(entities)
+	assert.EqualError(t, err, "invalid Set from SetGenerator: {Id:s Op: Size:3}: Id and Op must be set, and Size must be 3")
+	assert.Empty(t, gotQueries)
+}
+
+func TestInsertStream(t *testing.T) {
+	var gotContentType string
+	var gotEntities []etre.Entity
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotContentType = r.Header.Get("Content-Type")
+		http.NewResponseController(w).EnableFullDuplex()
+		w.Header().Set("Content-Type", etre.CONTENT_TYPE_NDJSON)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		dec := json.NewDecoder(r.Body)
+		enc := json.NewEncoder(w)
+		for i := 0; ; i++ {
+			var e etre.Entity
+			if err := dec.Decode(&e); err != nil {
+				return
+			}
+			gotEntities = append(gotEntities, e)
+			wr := etre.Write{Index: i}
+			if e["host"] == "dupe" {
+				wr.Error = &etre.Error{Type: "duplicate-entity"}
+			} else {
+				wr.EntityId = fmt.Sprintf("id%d", i)
+				wr.URI = "http://api" + etre.API_ROOT + "/entity/" + wr.EntityId
+			}
+			enc.Encode(wr)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       ts.URL,
+		HTTPClient: &http.Client{},
+		BaseURL:    "https://proxy",
+	})
+	entities := make(chan etre.Entity)
+	results, err := ec.InsertStream(context.Background(), entities)
+	require.NoError(t, err)
+	go func() {
+		entities <- etre.Entity{"host": "a"}
+		entities <- etre.Entity{"host": math.NaN()} // invalid, not sent
+		entities <- etre.Entity{"host": "dupe"}
+		entities <- etre.Entity{"host": "b"}
+		close(entities)
+	}()
+	got := []etre.Write{}
+	for w := range results {
+		got = append(got, w)
+	}
+	assert.Equal(t, etre.CONTENT_TYPE_NDJSON, gotContentType)
+	assert.Equal(t, []etre.Entity{{"host": "a"}, {"host": "dupe"}, {"host": "b"}}, gotEntities)
+	require.Len(t, got, 4)
+	for i, w := range got {
+		assert.Equal(t, i, w.Index) // in input order
+	}
+	assert.Equal(t, etre.Write{Index: 0, EntityId: "id0", URI: "https://proxy" + etre.API_ROOT + "/entity/id0"}, got[0])
+	assert.ErrorIs(t, got[1].Err(), etre.ErrInvalidContent)
+	assert.ErrorIs(t, got[2].Err(), etre.ErrDuplicateEntity)
+	assert.Equal(t, "id2", got[3].EntityId) // API line 2
+	assert.NoError(t, got[3].Err())
+
+	// Entities that are not valid first and last: still in order, before the end
+	entities = make(chan etre.Entity)
+	results, err = ec.InsertStream(context.Background(), entities)
+	require.NoError(t, err)
+	go func() {
+		entities <- etre.Entity{"host": math.NaN()}
+		entities <- etre.Entity{"host": "c"}
+		entities <- etre.Entity{"host": math.Inf(1)}
+		close(entities)
+	}()
+	got = got[:0]
+	for w := range results {
+		got = append(got, w)
+	}
+	require.Len(t, got, 3)
+	for i, w := range got {
+		assert.Equal(t, i, w.Index)
+	}
+	assert.ErrorIs(t, got[0].Err(), etre.ErrInvalidContent)
+	assert.NoError(t, got[1].Err())
+	assert.ErrorIs(t, got[2].Err(), etre.ErrInvalidContent)
+
+	// Cancelling ctx stops the stream
+	ctx, cancel := context.WithCancel(context.Background())
+	entities = make(chan etre.Entity)
+	results, err = ec.InsertStream(ctx, entities)
+	require.NoError(t, err)
+	entities <- etre.Entity{"host": "c"}
+	w := <-results
+	assert.Equal(t, 0, w.Index)
+	cancel()
+	for w := range results {
+		assert.Equal(t, -1, w.Index)
+		assert.Error(t, w.Err())
+	}
+
+	// Dry run not supported
+	_, err = ec.WithWriteOptions(etre.WriteOptions{DryRun: true}).InsertStream(context.Background(), entities)
+	assert.ErrorIs(t, err, etre.ErrDryRunInsert)
+}
+
+func TestMiddleware(t *testing.T) {
+	var gotAuth, gotVersion string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotVersion = r.Header.Get(etre.VERSION_HEADER)
+		json.NewEncoder(w).Encode([]etre.Entity{{"_id": "abc"}})
+	}))
+	defer ts.Close()
+
+	var calls []string
+	middleware := func(name string) etre.Middleware {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return etre.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				calls = append(calls, name+" "+req.Header.Get(etre.VERSION_HEADER))
+				req = req.Clone(req.Context())
+				req.Header.Set("Authorization", "Bearer "+name)
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	httpClient := &http.Client{}
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       ts.URL,
+		HTTPClient: httpClient,
+		Middleware: []etre.Middleware{middleware("outer"), middleware("inner")},
+	})
+	_, err := ec.WithTrace("a=b").Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+
+	// First middleware gets the request first, after the client sets its headers
+	assert.Equal(t, []string{"outer " + etre.VERSION, "inner " + etre.VERSION}, calls)
+	assert.Equal(t, "Bearer inner", gotAuth)
+	assert.Equal(t, etre.VERSION, gotVersion)
+	assert.Nil(t, httpClient.Transport, "HTTPClient modified")
+}
+
+type tokenProvider struct {
+	token       string
+	err         error
+	invalidated []string
+}
+
+func (p *tokenProvider) Token(ctx context.Context) (string, error) {
+	return p.token, p.err
+}
+
+type tokenRefresher struct {
+	*tokenProvider
+}
+
+func (p tokenRefresher) InvalidateToken(token string) {
+	p.invalidated = append(p.invalidated, token)
+	p.token = "new"
+}
+
+func TestTokenProvider(t *testing.T) {
+	var gotAuth []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = append(gotAuth, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Bearer new" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(etre.WriteResult{Writes: []etre.Write{{EntityId: "abc"}}})
+	}))
+	defer ts.Close()
 
-	// Setup a websocket handler to handle the initial low-level ws connection
-	// and do the Etre CDC feed start sequence: client send start control and
-	// waits to receive start control ack. After started, flow is synchronous
-	// so test can send/receive (mostly send) on wsConn which will be read by
-	// client and, if it's a CDC event, sent to the events chan returned by Start.
-	connChan := make(chan bool)
-	var wsConn *websocket.Conn
-	var gotStart map[string]interface{}
-	startAck := map[string]interface{}{
-		"control": "start",
-	}
+	// Refresher: invalidate and retry once with new token, with the same payload
+	tp := &tokenProvider{token: "old"}
+	obs := &testObserver{}
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:    "node",
+		Addr:          ts.URL,
+		HTTPClient:    &http.Client{},
+		Headers:       map[string]string{"Authorization": "Basic abc"},
+		TokenProvider: tokenRefresher{tp},
+		Observer:      obs,
+	})
+	wr, err := ec.Insert([]etre.Entity{{"x": "y"}})
+	require.NoError(t, err)
+	assert.Equal(t, "abc", wr.Writes[0].EntityId)
+	assert.Equal(t, []string{"Bearer old", "Bearer new"}, gotAuth)
+	assert.Equal(t, []string{"old"}, tp.invalidated)
+
+	// Both requests are recorded: the rejected one as an error
+	stats := ec.Stats()
+	assert.Equal(t, int64(2), stats.Requests)
+	assert.Equal(t, int64(2), stats.Responses)
+	assert.Equal(t, int64(1), stats.Errors)
+	require.Len(t, obs.got, 2)
+	assert.Error(t, obs.got[0].err)
+	assert.NoError(t, obs.got[1].err)
+
+	// Not a refresher: 401 is returned
+	gotAuth = nil
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:    "node",
+		Addr:          ts.URL,
+		HTTPClient:    &http.Client{},
+		TokenProvider: &tokenProvider{token: "old"},
+	})
+	_, err = ec.Get("abc")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"Bearer old"}, gotAuth)
+
+	// Token error fails the request without sending it
+	gotAuth = nil
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:    "node",
+		Addr:          ts.URL,
+		HTTPClient:    &http.Client{},
+		TokenProvider: &tokenProvider{err: fmt.Errorf("expired")},
+	})
+	_, err = ec.Get("abc")
+	assert.ErrorContains(t, err, "TokenProvider: expired")
+	assert.Empty(t, gotAuth)
+}
+
+func TestEntityClientClose(t *testing.T) {
+	var reqs int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs++
+		json.NewEncoder(w).Encode([]etre.Entity{{"_id": "abc"}})
+	}))
+	defer ts.Close()
+
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       ts.URL,
+		HTTPClient: &http.Client{},
+		Retry:      2,
+	})
+	ec2 := ec.WithTrace("a=b")
+	_, err := ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, reqs)
+
+	// Close closes the client and its copies, without retrying or sending requests
+	require.NoError(t, ec.Close())
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrClientClosed)
+	_, err = ec2.Query("x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrClientClosed)
+	_, err = ec.WithSet(etre.Set{Id: "1", Op: "a", Size: 1}).Insert([]etre.Entity{{"x": "y"}})
+	assert.ErrorIs(t, err, etre.ErrClientClosed)
+	assert.Equal(t, 1, reqs)
+
+	require.NoError(t, ec.Close()) // safe to call again
+
+	// Clients with the same http.Client are not closed
+	ecs := etre.NewEntityClients([]string{"node", "rack"}, etre.EntityClientConfig{Addr: ts.URL, HTTPClient: &http.Client{}})
+	require.NoError(t, ecs["node"].Close())
+	_, err = ecs["rack"].Query("x=y", etre.QueryFilter{})
+	assert.NoError(t, err)
+
+	// Idle connections of the caller's http.Client, which can be shared, are not closed
+	rt := &closeRecorder{RoundTripper: http.DefaultTransport}
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       ts.URL,
+		HTTPClient: &http.Client{Transport: rt},
+	})
+	require.NoError(t, ec.Close())
+	assert.Zero(t, rt.closed)
+}
+
+// closeRecorder is an http.RoundTripper that counts CloseIdleConnections calls.
+type closeRecorder struct {
+	http.RoundTripper
+	closed int
+}
+
+func (r *closeRecorder) CloseIdleConnections() {
+	r.closed++
+}
+
+func TestCDCClientClose(t *testing.T) {
 	wsHandler := func(w http.ResponseWriter, r *http.Request) {
 		var upgrader = websocket.Upgrader{}
-		var err error
-		wsConn, err = upgrader.Upgrade(w, r, nil)
+		wsConn, err := upgrader.Upgrade(w, r, nil)
 		require.NoError(t, err)
 		defer wsConn.Close()
-		err = wsConn.ReadJSON(&gotStart)
-		require.NoError(t, err)
-		err = wsConn.WriteJSON(startAck)
-		require.NoError(t, err)
-		connChan <- true
-		<-connChan
+		var start map[string]interface{}
+		require.NoError(t, wsConn.ReadJSON(&start))
+		require.NoError(t, wsConn.WriteJSON(map[string]interface{}{"control": "start"}))
+		wsConn.ReadMessage() // wait for close
 	}
-	ts = httptest.NewServer(http.HandlerFunc(wsHandler))
-	defer ts.Close()
-	defer close(connChan)
-
-	// Start client
-	url, _ := url.Parse(ts.URL)
-	ec := etre.NewCDCClient("ws://"+url.Host, nil, 10, debug)
-	defer ec.Stop()
+	cdcts := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer cdcts.Close()
 
-	startTs := time.Now()
-	events, err := ec.Start(startTs)
+	url, _ := url.Parse(cdcts.URL)
+	ec := etre.NewCDCClientWithConfig(etre.CDCClientConfig{Addr: "ws://" + url.Host})
+	events, err := ec.StartContext(context.Background(), 0)
 	require.NoError(t, err)
 
-	// Wait for wsHandler ^ to do start sequence
+	// Close stops the feed and returns after the feed chan is closed
+	require.NoError(t, ec.Close())
 	select {
-	case <-connChan:
-	case <-time.After(2 * time.Second):
-		t.Fatal("timeout waiting for wsHandler to ack start sequence")
+	case _, ok := <-events:
+		assert.False(t, ok, "feed chan not closed")
+	default:
+		t.Fatal("feed chan not closed when Close returned")
 	}
 
-	//
-	// Client is connected to wsConn (via wsHandler), waiting to receive from us.
-	// At this point, communicate is synchronous: cdc feed (us) -> client. Client
-	// only sends in response to control:ping.
-	//
+	_, err = ec.StartContext(context.Background(), 0)
+	assert.ErrorIs(t, err, etre.ErrClientClosed)
+	_, err = ec.Start(time.Time{})
+	assert.ErrorIs(t, err, etre.ErrClientClosed)
+	_, err = ec.Replay(context.Background(), 1, 2)
+	assert.ErrorIs(t, err, etre.ErrClientClosed)
+	assert.NoError(t, ec.Close()) // safe to call again
+
+	// Not started
+	ec = etre.NewCDCClientWithConfig(etre.CDCClientConfig{Addr: "ws://" + url.Host})
+	assert.NoError(t, ec.Close())
+	_, err = ec.StartContext(context.Background(), 0)
+	assert.ErrorIs(t, err, etre.ErrClientClosed)
+}
 
-	// Start should be idempotent
-	events2, err2 := ec.Start(startTs)
-	assert.NoError(t, err2)
-	assert.Equal(t, events, events2, "Start did not return same events chan, expected same one")
+type testLogger struct {
+	msgs []string
+}
 
-	// Verify client sent correct start control message
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+}
 
-	// Need to marshal and unmarshal this because startTs: startTs will be
-	// a time.Time type but startTs recv'ed is a string and startTs.String()
-	// is slightly different than the JSON-mashaled time string. So only
-	// way to be consistent is to cmp json marshaled to json marshaled.
-	v := map[string]interface{}{
-		"control": "start",
-		"startTs": startTs.UnixNano() / int64(time.Millisecond),
-	}
-	bytes, _ := json.Marshal(v)
-	var expectStart map[string]interface{}
-	json.Unmarshal(bytes, &expectStart)
-	assert.Equal(t, expectStart, gotStart)
+func TestLogger(t *testing.T) {
+	lts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer lts.Close()
 
-	// First, let's send the client a CDC event and make sure it sends via the
-	// events chan it returned from Start()
-	sentEvent := etre.CDCEvent{
-		Id:         "xyz",
-		Ts:         1001,
-		Op:         "i", // insert
-		Caller:     "ryan",
-		EntityId:   "abc",
+	// Debug output goes to the client logger, prefixed with file:line
+	logger := &testLogger{}
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
 		EntityType: "node",
-		Old:        nil,
-		New: &etre.Entity{
-			"_id": "abc",
-			"foo": "bar",
-		},
-	}
-	if err := wsConn.WriteJSON(sentEvent); err != nil {
-		t.Fatal(err)
-		return
-	}
-	var gotEvent etre.CDCEvent
-	select {
-	case gotEvent = <-events:
-	case <-time.After(2 * time.Second):
-		t.Fatal("timeout receiving event from client chan")
-	}
-
-	// The event we got should be the event we sent--that's the whole point!
-	assert.Equal(t, sentEvent, gotEvent)
-
-	//
-	// Send client a ping control message (server -> client ping)
-	//
-
-	ping := map[string]interface{}{
-		"control": "ping",
-		"srcTs":   startTs.UnixNano(),
-	}
-	if err := wsConn.WriteJSON(ping); err != nil {
-		t.Fatal(err)
-		return
-	}
-	var pong map[string]interface{}
-	if err := wsConn.ReadJSON(&pong); err != nil {
-		t.Fatal(err)
-		return
-	}
-	assert.Equal(t, "pong", pong["control"])
+		Addr:       lts.URL,
+		HTTPClient: http.DefaultClient,
+		Debug:      true,
+		Logger:     logger,
+	})
+	defer func() { etre.DebugEnabled = false }()
+	_, err := ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	require.NotEmpty(t, logger.msgs)
+	assert.Contains(t, logger.msgs[0], "entity_client.go:")
+	assert.Contains(t, logger.msgs[0], "query='x=y'")
+
+	// Debug disabled: nothing logged
+	etre.DebugEnabled = false
+	logger = &testLogger{}
+	ec = etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       lts.URL,
+		HTTPClient: http.DefaultClient,
+		Logger:     logger,
+	})
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, logger.msgs)
+}
 
-	ts, ok := pong["dstTs"]
-	require.True(t, ok, "dstTs not set in ping reply, expected a UnixNano value")
-	assert.True(t, int64(ts.(float64)) > startTs.UnixNano(), "got ts %v <= sent ts %d, expected it to be greater", ts, startTs.UnixNano())
+type cacheObserver struct {
+	testObserver
+	hits []bool
+}
 
-	//
-	// Ping server (client -> server ping)
-	//
+func (o *cacheObserver) ObserveCache(op string, hit bool) {
+	o.Lock()
+	defer o.Unlock()
+	o.hits = append(o.hits, hit)
+}
 
-	// Recv ping, wait 101ms, send pong
-	waitForPing := make(chan struct{})
-	go func() {
-		var ping map[string]interface{}
-		var err error
+func TestQueryCache(t *testing.T) {
+	resp := `[{"_id":"abc","x":"y"}]`
+	var gotIfNoneMatch []string
+	qts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inm := r.Header.Get("If-None-Match")
+		gotIfNoneMatch = append(gotIfNoneMatch, inm)
+		etag := `"` + r.URL.Query().Get("query") + `"`
+		w.Header().Set("ETag", etag)
+		if inm == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(resp))
+	}))
+	defer qts.Close()
+
+	obs := &cacheObserver{}
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:     "node",
+		Addr:           qts.URL,
+		HTTPClient:     http.DefaultClient,
+		QueryCacheSize: 1,
+		Observer:       obs,
+	})
+	expect := []etre.Entity{{"_id": "abc", "x": "y"}}
+
+	// Miss, then hit returns a copy of the cached result
+	got, err := ec.Query("a", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, expect, got)
+	got[0]["x"] = "modified"
+	got, err = ec.WithContext(context.Background()).Query("a", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, expect, got)
 
-		err = wsConn.ReadJSON(&ping)
+	// Different filter is a different query, and the cache size is 1, so query
+	// "a" was removed
+	_, err = ec.Query("a", etre.QueryFilter{Limit: 1})
+	require.NoError(t, err)
+	_, err = ec.Query("a", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", `"a"`, "", ""}, gotIfNoneMatch)
+	assert.Equal(t, []bool{false, true, false, false}, obs.hits)
+	assert.Len(t, obs.got, 4)
+
+	// No cache by default
+	gotIfNoneMatch = nil
+	ec = etre.NewEntityClient("node", qts.URL, http.DefaultClient)
+	for i := 0; i < 2; i++ {
+		_, err = ec.Query("a", etre.QueryFilter{})
 		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"", ""}, gotIfNoneMatch)
+}
 
-		time.Sleep(101 * time.Millisecond)
-		ping["control"] = "pong"
-		ping["dstTs"] = time.Now().UnixNano()
-		err = wsConn.WriteJSON(ping)
+func TestQueryCacheTTL(t *testing.T) {
+	var gotQueries []string
+	etag := ""
+	qts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQueries = append(gotQueries, r.URL.Query().Get("query"))
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Write([]byte(`[{"_id":"abc"}]`))
+	}))
+	defer qts.Close()
+
+	obs := &cacheObserver{}
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:    "node",
+		Addr:          qts.URL,
+		HTTPClient:    http.DefaultClient,
+		QueryCacheTTL: 50 * time.Millisecond,
+		Observer:      obs,
+	})
+	expect := []etre.Entity{{"_id": "abc"}}
+
+	// Miss, then hits without a request, even without an ETag
+	for i := 0; i < 3; i++ {
+		got, err := ec.Query("env=prod", etre.QueryFilter{})
 		require.NoError(t, err)
+		assert.Equal(t, expect, got)
+	}
+	_, err := ec.Query("env=dev", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"env=prod", "env=dev"}, gotQueries)
+	assert.Equal(t, []bool{false, true, true, false}, obs.hits)
+	assert.Len(t, obs.got, 2)
 
-		close(waitForPing)
-	}()
-
-	lag := ec.Ping(time.Duration(1 * time.Second))
-
-	// lag.Recv is almost always <1ms because it's the time from calling
-	// Ping to wsConn.ReadJSON in the gorountine above. Since that's local
-	// it's microseconds. But the time.Sleep in the goroutine creates an
-	// artificial Send and RTT lag.
-	assert.False(t, lag.Send < 101 || lag.RTT < 101, "got zero lag, exected > 100ms values: %#v", lag)
-
-	<-waitForPing
+	// Invalidate by query pattern
+	n, err := ec.InvalidateQueryCache("env=p*")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = ec.Query("env=prod", etre.QueryFilter{})
+	require.NoError(t, err)
+	_, err = ec.Query("env=dev", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"env=prod", "env=dev", "env=prod"}, gotQueries)
 
-	//
-	// Send client an error
-	//
+	_, err = ec.InvalidateQueryCache("[")
+	assert.ErrorIs(t, err, path.ErrBadPattern)
+	n, err = ec.InvalidateQueryCache("")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
 
-	// This should cause the client to close the connection, which we can detect
-	// by trying to read, which should return an error
-	errorMsg := map[string]interface{}{
-		"control": "error",
-		"error":   "fake error",
+	// After the TTL, the result is revalidated by ETag
+	etag = `"1"`
+	_, err = ec.Query("env=prod", etre.QueryFilter{})
+	require.NoError(t, err)
+	time.Sleep(60 * time.Millisecond)
+	gotQueries = nil
+	obs.hits = nil
+	got, err := ec.Query("env=prod", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, expect, got)
+	_, err = ec.Query("env=prod", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"env=prod"}, gotQueries)
+	assert.Equal(t, []bool{true, true}, obs.hits) // 304, then within TTL again
+
+	// Strong and read-your-writes reads ignore the TTL: always a request
+	for _, c := range []string{etre.CONSISTENCY_STRONG, etre.CONSISTENCY_READ_YOUR_WRITES} {
+		gotQueries = nil
+		for i := 0; i < 2; i++ {
+			got, err = ec.Query("env=prod", etre.QueryFilter{Consistency: c})
+			require.NoError(t, err)
+			assert.Equal(t, expect, got)
+		}
+		assert.Equal(t, []string{"env=prod", "env=prod"}, gotQueries, c)
 	}
-	err = wsConn.WriteJSON(errorMsg)
+
+	// Disabled cache
+	n, err = etre.NewEntityClient("node", qts.URL, http.DefaultClient).InvalidateQueryCache("")
 	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
 
-	// Give client a few milliseconds to shutdown
-	time.Sleep(500 * time.Millisecond)
-	var rand map[string]interface{} // shouldn't read random data
-	err = wsConn.ReadJSON(&rand)
-	require.Error(t, err)
+func TestClientSchema(t *testing.T) {
+	var gotMethod string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		json.NewEncoder(w).Encode(etre.WriteResult{Writes: []etre.Write{{EntityId: "abc"}}})
+	}))
+	defer ts.Close()
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "host",
+		Addr:       ts.URL,
+		HTTPClient: http.DefaultClient,
+		Schema:     &etre.Schema{Required: map[string]etre.LabelType{"hostname": etre.LABEL_TYPE_STRING, "cores": etre.LABEL_TYPE_INT}, Optional: map[string]etre.LabelType{"up": etre.LABEL_TYPE_BOOL, "tags": etre.LABEL_TYPE_ANY}},
+	})
+
+	// Insert requires every required label
+	_, err := ec.Insert([]etre.Entity{{"hostname": "a", "cores": 1}, {"hostname": "b"}})
+	var schemaErr *etre.SchemaError
+	require.ErrorAs(t, err, &schemaErr)
+	assert.Equal(t, "entity 1: entity does not match schema: label cores not set", err.Error())
+	assert.Empty(t, gotMethod) // not sent
+
+	// Update checks only the labels in the patch
+	_, err = ec.UpdateOne("abc", etre.Entity{"up": false})
+	require.NoError(t, err)
+	assert.Equal(t, "PUT", gotMethod)
+	gotMethod = ""
+	_, err = ec.UpdateOne("abc", etre.Entity{"up": "no"})
+	assert.ErrorAs(t, err, &schemaErr)
+	assert.Empty(t, gotMethod)
+
+	// Operators are checked by the type of the value they set
+	ops := []struct {
+		patch     etre.Entity
+		violation string
+	}{
+		{etre.Entity{}.Increment("cores", 1), ""},
+		{etre.Entity{}.Increment("hostname", 1), "label hostname: $inc result is not string"},
+		{etre.Entity{}.AddToSet("tags", "x"), ""},
+		{etre.Entity{}.AddToSet("hostname", "x"), "label hostname: $addToSet result is not string"},
+		{etre.Entity{}.Pull("tags", "x"), ""},
+		{etre.Entity{}.Pull("up", true), "label up: $pull result is not bool"},
+	}
+	for _, op := range ops {
+		gotMethod = ""
+		_, err = ec.UpdateOne("abc", op.patch)
+		if op.violation == "" {
+			require.NoError(t, err, op.patch)
+			assert.Equal(t, "PUT", gotMethod)
+			continue
+		}
+		require.ErrorAs(t, err, &schemaErr, op.patch)
+		assert.Equal(t, []string{op.violation}, schemaErr.Violations)
+		assert.Empty(t, gotMethod)
+	}
+	gotMethod = ""
 
-	// The client should save the error ^ and return it
-	gotError := ec.Error().Error()
-	assert.Contains(t, gotError, "fake error")
+	// Unless the patch replaces the entity
+	_, err = ec.WithWriteOptions(etre.WriteOptions{UpdateMode: etre.UPDATE_MODE_REPLACE}).UpdateOne("abc", etre.Entity{"up": false})
+	require.ErrorAs(t, err, &schemaErr)
+	assert.Len(t, schemaErr.Violations, 2)
+	assert.Empty(t, gotMethod)
 }
 
-func TestWithContext(t *testing.T) {
-	ctx1 := context.Background()
-	ctx2 := context.WithValue(ctx1, "key", "value")
+func TestBatchQuery(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		q := r.URL.Query().Get("query")
+		if q == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(etre.Error{Type: "invalid-query", Message: "bad query"})
+			return
+		}
+		json.NewEncoder(w).Encode([]etre.Entity{{"_id": q}})
+	}))
+	defer ts.Close()
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:            "node",
+		Addr:                  ts.URL,
+		HTTPClient:            http.DefaultClient,
+		BatchQueryConcurrency: 2,
+	})
+
+	// Results in input order, errors per request
+	requests := []etre.QueryRequest{{Query: "a"}, {Query: "bad"}, {Query: "c"}, {Query: ""}, {Query: "e"}}
+	got, err := ec.BatchQuery(context.Background(), requests)
+	require.NoError(t, err)
+	require.Len(t, got, 5)
+	assert.Equal(t, []etre.Entity{{"_id": "a"}}, got[0].Entities)
+	assert.ErrorIs(t, got[1].Err, etre.ErrInvalidQuery)
+	assert.Nil(t, got[1].Entities)
+	assert.Equal(t, []etre.Entity{{"_id": "c"}}, got[2].Entities)
+	assert.ErrorIs(t, got[3].Err, etre.ErrNoQuery)
+	assert.Equal(t, []etre.Entity{{"_id": "e"}}, got[4].Entities)
+	assert.Equal(t, 2, maxRunning)
+
+	// Latency isn't saved because queries run concurrently
+	var lat etre.Latency
+	_, err = ec.WithLatency(&lat).BatchQuery(context.Background(), []etre.QueryRequest{{Query: "a"}, {Query: "b"}})
+	require.NoError(t, err)
+	assert.Equal(t, etre.Latency{}, lat)
 
-	// client w/o context should return context.Background()
-	client1 := etre.NewEntityClient("node", ts.URL, httpClient)
-	require.NotNil(t, client1.Context())
-	assert.Equal(t, ctx1, client1.Context())
+	// Context deadline for all queries: queries not run have ctx.Err()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	got, err = ec.BatchQuery(ctx, []etre.QueryRequest{{Query: "a"}, {Query: "b"}, {Query: "c"}, {Query: "d"}, {Query: "e"}, {Query: "f"}})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, got, 6)
+	assert.ErrorIs(t, got[5].Err, context.DeadlineExceeded)
 
-	// set the context. should not change client1's context
-	client2 := client1.WithContext(ctx2)
-	assert.Equal(t, ctx2, client2.Context())
-	assert.Equal(t, ctx1, client1.Context())
+	_, err = ec.BatchQuery(context.Background(), nil)
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
 }
 
-func testContext() context.Context {
-	return context.WithValue(context.Background(), "key", "test-context-"+time.Now().String())
+func TestClientStats(t *testing.T) {
+	var sleep time.Duration
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(sleep)
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			json.NewEncoder(w).Encode(etre.Error{Type: "db-query", Message: "failed"})
+			return
+		}
+		json.NewEncoder(w).Encode([]etre.Entity{})
+	}))
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:         "node",
+		Addr:               ts.URL,
+		HTTPClient:         http.DefaultClient,
+		LatencyEMAAlpha:    0.5,
+		LatencyEMASendRecv: true,
+	})
+	assert.Equal(t, etre.ClientStats{}, ec.Stats())
+
+	// First response sets the EMA, then each response has half the weight
+	sleep = 40 * time.Millisecond
+	_, err := ec.Query("x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	got := ec.Stats()
+	assert.Equal(t, int64(1), got.Requests)
+	assert.Equal(t, int64(1), got.Responses)
+	assert.Zero(t, got.Errors)
+	assert.GreaterOrEqual(t, got.RTT, 40*time.Millisecond)
+	assert.Equal(t, got.RTT, got.Send+got.Recv)
+	first := got.RTT
+
+	sleep = 0
+	_, err = ec.WithSet(etre.Set{Id: "s", Op: "o", Size: 1}).Query("x=y", etre.QueryFilter{}) // copies share stats
+	require.NoError(t, err)
+	got = ec.Stats()
+	assert.Equal(t, int64(2), got.Requests)
+	assert.Less(t, got.RTT, first)
+	assert.GreaterOrEqual(t, got.RTT, first/2)
+
+	// API errors are responses and errors
+	status = http.StatusInternalServerError
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.Error(t, err)
+	got = ec.Stats()
+	assert.Equal(t, int64(3), got.Requests)
+	assert.Equal(t, int64(3), got.Responses)
+	assert.Equal(t, int64(1), got.Errors)
+
+	// Network errors are only errors
+	ts.Close()
+	rtt := got.RTT
+	_, err = ec.Query("x=y", etre.QueryFilter{})
+	require.Error(t, err)
+	got = ec.Stats()
+	assert.Equal(t, int64(4), got.Requests)
+	assert.Equal(t, int64(3), got.Responses)
+	assert.Equal(t, int64(2), got.Errors)
+	assert.Equal(t, rtt, got.RTT)
 }
 
-type rt struct {
-	gotCtx context.Context
-}
+func TestInsertIdempotencyKey(t *testing.T) {
+	var gotKeys []string
+	fail := 0 // number of requests to fail
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKeys = append(gotKeys, r.Header.Get(etre.IDEMPOTENCY_KEY_HEADER))
+		if fail > 0 {
+			fail--
+			w.WriteHeader(http.StatusServiceUnavailable) // no response, like a proxy timeout
+			return
+		}
+		if len(gotKeys) > 1 {
+			w.Header().Set(etre.IDEMPOTENT_REPLAY_HEADER, "true")
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(etre.WriteResult{Writes: []etre.Write{{EntityId: "abc"}}})
+	}))
+	defer ts.Close()
+	cfg := etre.EntityClientConfig{
+		EntityType:  "node",
+		Addr:        ts.URL,
+		HTTPClient:  http.DefaultClient,
+		RetryPolicy: etre.RetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond},
+	}
 
-func (t *rt) RoundTrip(r *http.Request) (*http.Response, error) {
-	t.gotCtx = r.Context()
-	return http.DefaultTransport.RoundTrip(r)
+	// No key: insert is not retried and no key is sent
+	ec := etre.NewEntityClientWithConfig(cfg)
+	fail = 1
+	_, err := ec.Insert([]etre.Entity{{"a": "1"}})
+	require.Error(t, err)
+	assert.Equal(t, []string{""}, gotKeys)
+
+	// Key from context: insert isn't retried without RetryInserts
+	gotKeys = nil
+	fail = 1
+	_, err = ec.InsertContext(etre.WithIdempotencyKey(context.Background(), "k1"), []etre.Entity{{"a": "1"}})
+	require.Error(t, err)
+	assert.Equal(t, []string{"k1"}, gotKeys)
+
+	// With RetryInserts, insert is retried with the same key
+	cfg.RetryPolicy.RetryInserts = true
+	ec = etre.NewEntityClientWithConfig(cfg)
+	gotKeys = nil
+	fail = 1
+	wr, err := ec.InsertContext(etre.WithIdempotencyKey(context.Background(), "k1"), []etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	require.NoError(t, wr.Err())
+	assert.Equal(t, []string{"k1", "k1"}, gotKeys)
+	assert.True(t, wr.Replayed)
+
+	// Batches get the key with the batch number
+	gotKeys = nil
+	_, err = ec.InsertBatchContext(etre.WithIdempotencyKey(context.Background(), "k2"), []etre.Entity{{"a": "1"}, {"a": "2"}}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k2-1", "k2-2"}, gotKeys)
+
+	// IdempotentInserts generates a key per insert, the same on every try
+	cfg.IdempotentInserts = true
+	ec = etre.NewEntityClientWithConfig(cfg)
+	gotKeys = nil
+	fail = 1
+	_, err = ec.Insert([]etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	_, err = ec.Insert([]etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+	require.Len(t, gotKeys, 3)
+	assert.NotEmpty(t, gotKeys[0])
+	assert.Equal(t, gotKeys[0], gotKeys[1])
+	assert.NotEqual(t, gotKeys[0], gotKeys[2])
+
+	// IdempotentInserts doesn't enable retries
+	cfg.RetryPolicy.RetryInserts = false
+	ec = etre.NewEntityClientWithConfig(cfg)
+	gotKeys = nil
+	fail = 1
+	_, err = ec.Insert([]etre.Entity{{"a": "1"}})
+	require.Error(t, err)
+	require.Len(t, gotKeys, 1)
+	assert.NotEmpty(t, gotKeys[0])
 }
@@ -29,6 +29,8 @@ const (
 	DEFAULT_QUERY_PROFILE_SAMPLE_RATE      = 0.2
 	DEFAULT_QUERY_PROFILE_REPORT_THRESHOLD = "500ms"
 	DEFAULT_BATCH_SIZE                     = 5000
+	DEFAULT_IDEMPOTENCY_WINDOW             = "10m"
+	DEFAULT_IDEMPOTENCY_MAX_KEYS           = 100000
 )
 
 const CDC_COLLECTION = "cdc"
@@ -42,7 +44,9 @@ func Default() Config {
 			BatchSize: DEFAULT_BATCH_SIZE,
 		},
 		Server: ServerConfig{
-			Addr: DEFAULT_ADDR,
+			Addr:               DEFAULT_ADDR,
+			IdempotencyWindow:  DEFAULT_IDEMPOTENCY_WINDOW,
+			IdempotencyMaxKeys: DEFAULT_IDEMPOTENCY_MAX_KEYS,
 		},
 		Datasource: DatasourceConfig{
 			URL:            DEFAULT_DATASOURCE_URL,
@@ -229,6 +233,21 @@ type ServerConfig struct {
 	TLSCert string `yaml:"tls_cert"`
 	TLSKey  string `yaml:"tls_key"`
 	TLSCA   string `yaml:"tls_ca"`
+
+	// IdempotencyWindow is how long the server remembers the result of an insert
+	// with an idempotency key (etre.IDEMPOTENCY_KEY_HEADER), starting when the
+	// insert is received. A retry with the same key and entities in the window
+	// returns the saved result instead of inserting the entities again; after the
+	// window, it inserts them again. It should be longer than the total time a
+	// client retries an insert. Results are saved in memory, per server instance.
+	// "0" disables idempotency keys: the header is ignored.
+	IdempotencyWindow string `yaml:"idempotency_window"`
+
+	// IdempotencyMaxKeys is the maximum number of idempotency keys saved per server
+	// instance. If there are more keys in the window, the oldest are forgotten
+	// early, so a retry with one of them inserts the entities again. Zero is the
+	// default: DEFAULT_IDEMPOTENCY_MAX_KEYS.
+	IdempotencyMaxKeys int `yaml:"idempotency_max_keys"`
 }
 
 type SecurityConfig struct {
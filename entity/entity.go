@@ -4,6 +4,7 @@ package entity
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/square/etre"
 	"github.com/square/etre/query"
@@ -38,6 +39,18 @@ type WriteOp struct {
 	SetOp   string // optional
 	SetId   string // optional
 	SetSize int    // optional
+
+	// DryRun makes update and delete ops return diffs of the entities that would
+	// be changed without changing them or writing CDC events. Insert ops do not
+	// support it.
+	DryRun bool // optional
+
+	// Replace makes update ops remove labels, except metalabels, that are not
+	// in the patch, so the entity has only the patched labels. Insert and delete
+	// ops ignore it.
+	Replace bool // optional
+
+	RequestId string // optional, from etre.REQUEST_ID_HEADER, set in CDC events
 }
 
 // Map of Kubernetes Selection Operator to mongoDB Operator.
@@ -62,6 +75,13 @@ func Filter(q query.Query) bson.M {
 			filter[p.Label] = bson.M{"$exists": true}
 		case "notexists":
 			filter[p.Label] = bson.M{"$exists": false}
+		case "isnull":
+			// Not {label: null}, which matches missing labels, too
+			filter[p.Label] = bson.M{"$type": "null"}
+		case "=~":
+			filter[p.Label] = primitive.Regex{Pattern: p.Value.(string)}
+		case "!~":
+			filter[p.Label] = bson.M{"$not": primitive.Regex{Pattern: p.Value.(string)}}
 		default:
 			if p.Label == etre.META_LABEL_ID {
 				switch p.Value.(type) {
@@ -80,6 +100,15 @@ func Filter(q query.Query) bson.M {
 				default:
 					panic(fmt.Sprintf("invalid _id value type: %T", p.Value))
 				}
+			} else if v, ok := p.Value.(string); ok && p.Label == etre.META_LABEL_REV {
+				// Query values are strings, but _rev is stored as an int64, so
+				// "_rev=3" would never match without conversion
+				rev, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					filter[p.Label] = bson.M{operatorMap[p.Operator]: p.Value}
+				} else {
+					filter[p.Label] = bson.M{operatorMap[p.Operator]: rev}
+				}
 			} else {
 				filter[p.Label] = bson.M{operatorMap[p.Operator]: p.Value}
 			}
@@ -88,6 +117,29 @@ func Filter(q query.Query) bson.M {
 	return filter
 }
 
+// Sort translates etre.QueryFilter.Sort labels into a mongo-driver sort parameter.
+// A label prefixed with "-" sorts descending. If _id is not sorted on, it's added
+// last to break ties so that paging with skip and limit is stable.
+func Sort(labels []string) bson.D {
+	sort := bson.D{}
+	hasId := false
+	for _, label := range labels {
+		order := 1
+		if label[0] == '-' {
+			label = label[1:]
+			order = -1
+		}
+		if label == etre.META_LABEL_ID {
+			hasId = true
+		}
+		sort = append(sort, bson.E{Key: label, Value: order})
+	}
+	if !hasId {
+		sort = append(sort, bson.E{Key: etre.META_LABEL_ID, Value: 1})
+	}
+	return sort
+}
+
 const dupeKeyCode = 11000
 
 func IsDupeKeyError(err error) error {
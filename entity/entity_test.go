@@ -0,0 +1,70 @@
+// Copyright 2017-2020, Square, Inc.
+
+package entity_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/square/etre/entity"
+	"github.com/square/etre/query"
+)
+
+func TestSort(t *testing.T) {
+	// _id is appended to break ties
+	got := entity.Sort([]string{"hostname", "-_rev"})
+	expect := bson.D{
+		{Key: "hostname", Value: 1},
+		{Key: "_rev", Value: -1},
+		{Key: "_id", Value: 1},
+	}
+	assert.Equal(t, expect, got)
+
+	// Unless already sorted on
+	got = entity.Sort([]string{"-_id"})
+	expect = bson.D{
+		{Key: "_id", Value: -1},
+	}
+	assert.Equal(t, expect, got)
+}
+
+func TestFilterRev(t *testing.T) {
+	// _rev is stored as an int64, so query values must be too
+	q, err := query.Translate("_rev=3,x=3")
+	assert.NoError(t, err)
+	expect := bson.M{
+		"_rev": bson.M{"$eq": int64(3)},
+		"x":    bson.M{"$eq": "3"},
+	}
+	assert.Equal(t, expect, entity.Filter(q))
+
+	// Like QueryFilter.SinceRev. Comparison values are already numbers, which
+	// MongoDB compares across number types.
+	q, err = query.Translate("x=3,_rev>5")
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"$gt": 5}, entity.Filter(q)["_rev"])
+}
+
+func TestFilterRegex(t *testing.T) {
+	q, err := query.Translate(`host=~^web-,env!~"(?i)^prod$"`)
+	assert.NoError(t, err)
+	expect := bson.M{
+		"host": primitive.Regex{Pattern: "^web-"},
+		"env":  bson.M{"$not": primitive.Regex{Pattern: "(?i)^prod$"}},
+	}
+	assert.Equal(t, expect, entity.Filter(q))
+}
+
+func TestFilterExistsNull(t *testing.T) {
+	q, err := query.Translate("a,!b,c isnull")
+	assert.NoError(t, err)
+	expect := bson.M{
+		"a": bson.M{"$exists": true},
+		"b": bson.M{"$exists": false},
+		"c": bson.M{"$type": "null"},
+	}
+	assert.Equal(t, expect, entity.Filter(q))
+}
@@ -4,12 +4,16 @@ package entity
 
 import (
 	"context"
+	"errors"
+	"sort"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 
 	"github.com/square/etre"
 	"github.com/square/etre/cdc"
@@ -23,11 +27,19 @@ type Store interface {
 
 	ReadEntities(string, query.Query, etre.QueryFilter) ([]etre.Entity, error)
 
+	CountEntities(string, query.Query, etre.QueryFilter) (int64, error)
+
+	AggregateEntities(string, query.Query, []string, etre.QueryFilter) ([]etre.GroupResult, error)
+
+	ExplainEntities(string, query.Query, etre.QueryFilter) (etre.QueryPlan, error)
+
+	ReadLabels(string) ([]string, error)
+
 	CreateEntities(WriteOp, []etre.Entity) ([]string, error)
 
 	UpdateEntities(WriteOp, query.Query, etre.Entity) ([]etre.Entity, error)
 
-	DeleteEntities(WriteOp, query.Query) ([]etre.Entity, error)
+	DeleteEntities(WriteOp, query.Query, int) ([]etre.Entity, error)
 
 	DeleteLabel(WriteOp, string) (etre.Entity, error)
 }
@@ -62,15 +74,30 @@ func (s store) ReadEntities(entityType string, q query.Query, f etre.QueryFilter
 	if !ok {
 		panic("invalid entity type passed to ReadEntities: " + entityType)
 	}
+	c, err := readColl(c, f.Consistency)
+	if err != nil {
+		return nil, s.dbError(err, "db-query")
+	}
 
 	// Distinct optimizaiton: unique values for the one return label. For example,
 	// "es -u node.metacluster zone=pd" returns a list of unique metacluster names.
 	// This is 10x faster than "es node.metacluster zone=pd | sort -u".
 	if len(f.ReturnLabels) == 1 && f.Distinct {
-		values, err := c.Distinct(s.ctx, f.ReturnLabels[0], Filter(q))
+		values, err := c.Distinct(s.ctx, f.ReturnLabels[0], readFilter(q, f))
 		if err != nil {
 			return nil, s.dbError(err, "db-read-distinct")
 		}
+		// MongoDB distinct doesn't support skip and limit, so page the values
+		if f.Offset > 0 {
+			if f.Offset >= len(values) {
+				values = nil
+			} else {
+				values = values[f.Offset:]
+			}
+		}
+		if f.Limit > 0 && f.Limit < len(values) {
+			values = values[:f.Limit]
+		}
 		entities := make([]etre.Entity, len(values))
 		for i, v := range values {
 			entities[i] = etre.Entity{f.ReturnLabels[0]: v}
@@ -92,9 +119,18 @@ func (s store) ReadEntities(entityType string, q query.Query, f etre.QueryFilter
 		}
 	}
 
-	// Set batch size and projection
+	// Set batch size, projection, sort, and paging
 	opts := options.Find().SetProjection(p).SetBatchSize(int32(s.config.BatchSize))
-	cursor, err := c.Find(s.ctx, Filter(q), opts)
+	if len(f.Sort) > 0 {
+		opts.SetSort(Sort(f.Sort))
+	}
+	if f.Offset > 0 {
+		opts.SetSkip(int64(f.Offset))
+	}
+	if f.Limit > 0 {
+		opts.SetLimit(int64(f.Limit))
+	}
+	cursor, err := c.Find(s.ctx, readFilter(q, f), opts)
 	if err != nil {
 		return nil, s.dbError(err, "db-query")
 	}
@@ -105,6 +141,237 @@ func (s store) ReadEntities(entityType string, q query.Query, f etre.QueryFilter
 	return entities, nil
 }
 
+// CountEntities returns the number of entities that match the query, or the
+// number of distinct values if f.Distinct is true. Other filter options, like
+// Limit and Offset, are ignored.
+func (s store) CountEntities(entityType string, q query.Query, f etre.QueryFilter) (int64, error) {
+	c, ok := s.coll[entityType]
+	if !ok {
+		panic("invalid entity type passed to CountEntities: " + entityType)
+	}
+	c, err := readColl(c, f.Consistency)
+	if err != nil {
+		return 0, s.dbError(err, "db-count")
+	}
+	if len(f.ReturnLabels) == 1 && f.Distinct {
+		values, err := c.Distinct(s.ctx, f.ReturnLabels[0], readFilter(q, f))
+		if err != nil {
+			return 0, s.dbError(err, "db-read-distinct")
+		}
+		return int64(len(values)), nil
+	}
+	n, err := c.CountDocuments(s.ctx, readFilter(q, f))
+	if err != nil {
+		return 0, s.dbError(err, "db-count")
+	}
+	return n, nil
+}
+
+// AggregateEntities groups the entities that match the query by the values of
+// the groupBy labels and returns the groups sorted by those values. Entities
+// without a label are grouped by a nil value for it. Limit and Offset page the
+// groups; other filter options are ignored.
+func (s store) AggregateEntities(entityType string, q query.Query, groupBy []string, f etre.QueryFilter) ([]etre.GroupResult, error) {
+	c, ok := s.coll[entityType]
+	if !ok {
+		panic("invalid entity type passed to AggregateEntities: " + entityType)
+	}
+	c, err := readColl(c, f.Consistency)
+	if err != nil {
+		return nil, s.dbError(err, "db-aggregate")
+	}
+	// $ifNull groups missing and null values together, else missing labels are
+	// omitted from _id, which is a different group than null
+	id := bson.D{}
+	for _, label := range groupBy {
+		id = append(id, bson.E{Key: label, Value: bson.M{"$ifNull": bson.A{"$" + label, nil}}})
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: readFilter(q, f)}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: id}, {Key: "count", Value: bson.M{"$sum": 1}}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	if f.Offset > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: f.Offset}})
+	}
+	if f.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: f.Limit}})
+	}
+	cursor, err := c.Aggregate(s.ctx, pipeline)
+	if err != nil {
+		return nil, s.dbError(err, "db-aggregate")
+	}
+	var res []struct {
+		Group bson.M `bson:"_id"`
+		Count int64  `bson:"count"`
+	}
+	if err := cursor.All(s.ctx, &res); err != nil {
+		return nil, s.dbError(err, "db-read-cursor")
+	}
+	groups := make([]etre.GroupResult, len(res))
+	for i := range res {
+		groups[i] = etre.GroupResult{Group: etre.Entity(res[i].Group), Count: res[i].Count}
+	}
+	return groups, nil
+}
+
+// ExplainEntities returns the execution plan and stats of the find that
+// ReadEntities runs for the query: filter, sort, skip, and limit. The query is
+// executed to measure it (explain verbosity executionStats), but entities are
+// not returned. Explain runs on the primary, so f.Consistency is ignored.
+// Distinct is not supported.
+func (s store) ExplainEntities(entityType string, q query.Query, f etre.QueryFilter) (etre.QueryPlan, error) {
+	c, ok := s.coll[entityType]
+	if !ok {
+		panic("invalid entity type passed to ExplainEntities: " + entityType)
+	}
+	find := bson.D{
+		{Key: "find", Value: c.Name()},
+		{Key: "filter", Value: readFilter(q, f)},
+	}
+	if len(f.Sort) > 0 {
+		find = append(find, bson.E{Key: "sort", Value: Sort(f.Sort)})
+	}
+	if f.Offset > 0 {
+		find = append(find, bson.E{Key: "skip", Value: int64(f.Offset)})
+	}
+	if f.Limit > 0 {
+		find = append(find, bson.E{Key: "limit", Value: int64(f.Limit)})
+	}
+	cmd := bson.D{
+		{Key: "explain", Value: find},
+		{Key: "verbosity", Value: "executionStats"},
+	}
+	var res struct {
+		QueryPlanner struct {
+			WinningPlan explainStage `bson:"winningPlan"`
+		} `bson:"queryPlanner"`
+		ExecutionStats struct {
+			NReturned           int64 `bson:"nReturned"`
+			ExecutionTimeMillis int64 `bson:"executionTimeMillis"`
+			TotalKeysExamined   int64 `bson:"totalKeysExamined"`
+			TotalDocsExamined   int64 `bson:"totalDocsExamined"`
+		} `bson:"executionStats"`
+	}
+	if err := c.Database().RunCommand(s.ctx, cmd).Decode(&res); err != nil {
+		return etre.QueryPlan{}, s.dbError(err, "db-explain")
+	}
+	stage, index := res.QueryPlanner.WinningPlan.access()
+	return etre.QueryPlan{
+		Stage:        stage,
+		Index:        index,
+		KeysExamined: res.ExecutionStats.TotalKeysExamined,
+		DocsExamined: res.ExecutionStats.TotalDocsExamined,
+		Returned:     res.ExecutionStats.NReturned,
+		TimeMs:       res.ExecutionStats.ExecutionTimeMillis,
+	}, nil
+}
+
+// explainStage is a stage of a MongoDB explain winning plan, which is a tree
+// of stages from the output stage (root) to the access stage (leaf).
+type explainStage struct {
+	Stage       string         `bson:"stage"`
+	IndexName   string         `bson:"indexName"`
+	InputStage  *explainStage  `bson:"inputStage"`
+	InputStages []explainStage `bson:"inputStages"` // OR, etc.
+	QueryPlan   *explainStage  `bson:"queryPlan"`   // MongoDB 7.0+ slot-based execution
+}
+
+// access returns the stage of the first leaf, like IXSCAN or COLLSCAN, and the
+// first index name from the root to that leaf, if any.
+func (e explainStage) access() (stage, index string) {
+	for {
+		if e.QueryPlan != nil {
+			e = *e.QueryPlan
+			continue
+		}
+		if index == "" {
+			index = e.IndexName
+		}
+		switch {
+		case e.InputStage != nil:
+			e = *e.InputStage
+		case len(e.InputStages) > 0:
+			e = e.InputStages[0]
+		default:
+			return e.Stage, index
+		}
+	}
+}
+
+// readColl returns the collection with the read preference and read concern of
+// the consistency (see etre.QueryFilter.Consistency), or c if it's empty, which
+// uses those of the datasource URL.
+func readColl(c *mongo.Collection, consistency string) (*mongo.Collection, error) {
+	opts := options.Collection()
+	switch consistency {
+	case "":
+		return c, nil
+	case etre.CONSISTENCY_EVENTUAL:
+		opts.SetReadPreference(readpref.SecondaryPreferred()).SetReadConcern(readconcern.Local())
+	case etre.CONSISTENCY_READ_YOUR_WRITES:
+		opts.SetReadPreference(readpref.Primary()).SetReadConcern(readconcern.Local())
+	case etre.CONSISTENCY_STRONG:
+		opts.SetReadPreference(readpref.Primary()).SetReadConcern(readconcern.Majority())
+	default:
+		return nil, etre.ValidateConsistency(consistency)
+	}
+	return c.Clone(opts)
+}
+
+// readFilter returns the filter for the query of a read, which matches tombstones
+// (entities with meta-label _deleted true) only if f.IncludeDeleted or OnlyDeleted
+// is set: all entities or only tombstones, respectively.
+func readFilter(q query.Query, f etre.QueryFilter) bson.M {
+	filter := Filter(q)
+	var deleted interface{}
+	switch {
+	case f.OnlyDeleted:
+		deleted = true
+	case f.IncludeDeleted:
+		return filter
+	default:
+		deleted = bson.M{"$ne": true}
+	}
+	if _, ok := filter[etre.META_LABEL_DELETED]; ok {
+		// Query has a _deleted predicate, so both must match
+		return bson.M{"$and": bson.A{filter, bson.M{etre.META_LABEL_DELETED: deleted}}}
+	}
+	filter[etre.META_LABEL_DELETED] = deleted
+	return filter
+}
+
+// ReadLabels returns the distinct label names of all entities of the type,
+// including meta-labels, sorted. It aggregates every entity, so it's slow for
+// many entities.
+func (s store) ReadLabels(entityType string) ([]string, error) {
+	c, ok := s.coll[entityType]
+	if !ok {
+		panic("invalid entity type passed to ReadLabels: " + entityType)
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$project", Value: bson.M{"kv": bson.M{"$objectToArray": "$$ROOT"}}}},
+		{{Key: "$unwind", Value: "$kv"}},
+		{{Key: "$group", Value: bson.M{"_id": "$kv.k"}}},
+	}
+	cursor, err := c.Aggregate(s.ctx, pipeline)
+	if err != nil {
+		return nil, s.dbError(err, "db-read-labels")
+	}
+	var res []struct {
+		Label string `bson:"_id"`
+	}
+	if err := cursor.All(s.ctx, &res); err != nil {
+		return nil, s.dbError(err, "db-read-cursor")
+	}
+	labels := make([]string, len(res))
+	for i := range res {
+		labels[i] = res[i].Label
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
+
 // CreateEntities inserts many entities into DB. This method allows for partial
 // success and failure which means the return value and error are _not_
 // mutually exclusive. Caller should check and handle both.
@@ -143,7 +410,7 @@ func (s store) CreateEntities(wo WriteOp, entities []etre.Entity) ([]string, err
 
 		// Create a CDC event.
 		cp := cdcPartial{
-			op:  "i",
+			op:  etre.CDC_OP_INSERT,
 			id:  id,
 			new: &entities[i],
 			old: nil,
@@ -187,12 +454,7 @@ func (s store) UpdateEntities(wo WriteOp, q query.Query, patch etre.Entity) ([]e
 	// diffs is a slice made up of a diff for each doc updated
 	diffs := []etre.Entity{}
 
-	updates := bson.M{
-		"$set": patch,
-		"$inc": bson.M{
-			"_rev": 1, // increment the revision
-		},
-	}
+	updates := updateDoc(patch)
 
 	p := bson.M{"_id": 1, "_type": 1, "_rev": 1}
 	for label := range patch {
@@ -205,17 +467,46 @@ func (s store) UpdateEntities(wo WriteOp, q query.Query, patch etre.Entity) ([]e
 		if err := cursor.Decode(&nextId); err != nil {
 			return diffs, s.dbError(err, "db-cursor-decode")
 		}
-		uq, _ := query.Translate("_id=" + nextId["_id"].Hex())
+		// Re-apply the query with the _id so the update is atomic: if the entity
+		// changed since the find (e.g. query "_id=abc,_rev=3"), it's not updated,
+		// but the other matching entities are
+		filter := Filter(q)
+		filter["_id"] = nextId["_id"]
 
 		var orig etre.Entity
-		err := c.FindOneAndUpdate(s.ctx, Filter(uq), updates, opts).Decode(&orig)
-		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				break
+		if wo.Replace {
+			orig, err = s.replaceEntity(c, filter, patch, p, wo.DryRun)
+			if err != nil {
+				return diffs, err
+			}
+			if orig == nil {
+				continue
+			}
+			diffs = append(diffs, orig)
+			if wo.DryRun {
+				continue
+			}
+		} else if wo.DryRun {
+			// Same diff (original values of patched labels), but no update or CDC event
+			err := c.FindOne(s.ctx, filter, options.FindOne().SetProjection(p)).Decode(&orig)
+			if err != nil {
+				if err == mongo.ErrNoDocuments {
+					continue
+				}
+				return diffs, s.dbError(err, "db-query")
+			}
+			diffs = append(diffs, orig)
+			continue
+		} else {
+			err := c.FindOneAndUpdate(s.ctx, filter, updates, opts).Decode(&orig)
+			if err != nil {
+				if err == mongo.ErrNoDocuments {
+					continue
+				}
+				return diffs, s.dbError(err, "db-update")
 			}
-			return diffs, s.dbError(err, "db-update")
+			diffs = append(diffs, orig)
 		}
-		diffs = append(diffs, orig)
 
 		old := etre.Entity{}
 		for k, v := range orig {
@@ -225,12 +516,13 @@ func (s store) UpdateEntities(wo WriteOp, q query.Query, patch etre.Entity) ([]e
 			old[k] = v
 		}
 
+		applied := opsApplied(patch, orig)
 		cp := cdcPartial{
-			op:  "u",
+			op:  etre.CDC_OP_UPDATE,
 			id:  orig["_id"].(primitive.ObjectID),
 			rev: orig.Rev() + 1,
 			old: &old,
-			new: &patch,
+			new: &applied,
 		}
 		if err := s.cdcWrite(patch, wo, cp); err != nil {
 			return diffs, err
@@ -244,6 +536,142 @@ func (s store) UpdateEntities(wo WriteOp, q query.Query, patch etre.Entity) ([]e
 	return diffs, nil
 }
 
+// updateDoc returns the MongoDB update document for the patch: $set for labels,
+// $addToSet or $pull for labels with array operators (see etre.ArrayOp), and
+// $inc for labels with counter operators (see etre.IncrementOp), so the arrays
+// and counters are updated atomically.
+func updateDoc(patch etre.Entity) bson.M {
+	set := bson.M{}
+	addToSet := bson.M{}
+	pull := bson.M{}
+	inc := bson.M{
+		"_rev": 1, // increment the revision
+	}
+	for label, v := range patch {
+		if delta, ok := etre.IncrementOp(v); ok {
+			inc[label] = delta
+			continue
+		}
+		op, values, ok := etre.ArrayOp(v)
+		switch {
+		case ok && op == etre.ARRAY_OP_ADD_TO_SET:
+			addToSet[label] = bson.M{"$each": values}
+		case ok && op == etre.ARRAY_OP_PULL:
+			pull[label] = bson.M{"$in": values}
+		default:
+			set[label] = v
+		}
+	}
+	updates := bson.M{
+		"$inc": inc,
+	}
+	if len(set) > 0 {
+		updates["$set"] = set
+	}
+	if len(addToSet) > 0 {
+		updates["$addToSet"] = addToSet
+	}
+	if len(pull) > 0 {
+		updates["$pull"] = pull
+	}
+	return updates
+}
+
+// opsApplied returns the patch with array and counter operators replaced by the
+// values that result from applying them to orig, the entity before the update,
+// for the CDC event; or patch if it has no operators. A label that's not set and
+// not changed by its operator (pull) is not in the returned entity.
+func opsApplied(patch, orig etre.Entity) etre.Entity {
+	var applied etre.Entity
+	for label, v := range patch {
+		if delta, ok := etre.IncrementOp(v); ok {
+			if applied == nil {
+				applied = patch.Without()
+			}
+			applied[label], _ = etre.ApplyIncrement(orig[label], delta)
+			continue
+		}
+		op, values, ok := etre.ArrayOp(v)
+		if !ok {
+			continue
+		}
+		if applied == nil {
+			applied = patch.Without()
+		}
+		arr, _ := etre.ApplyArrayOp(orig[label], op, values)
+		if arr == nil {
+			delete(applied, label)
+			continue
+		}
+		applied[label] = arr
+	}
+	if applied == nil {
+		return patch
+	}
+	return applied
+}
+
+// replaceEntity sets the patch labels and unsets all other labels, except
+// metalabels, of the entity matching filter, unless dryRun is true, and returns
+// the diff: the original values of the labels in projection p and the removed
+// labels. It returns nil if no entity matches filter. The update is conditional
+// on the _rev that was read so labels set concurrently are not removed without
+// being in the diff (and CDC event); it's retried a few times if the entity
+// changes between the read and the update.
+func (s store) replaceEntity(c *mongo.Collection, filter bson.M, patch etre.Entity, p bson.M, dryRun bool) (etre.Entity, error) {
+	for tries := 0; tries < 3; tries++ {
+		var cur etre.Entity
+		if err := c.FindOne(s.ctx, filter).Decode(&cur); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, nil
+			}
+			return nil, s.dbError(err, "db-query")
+		}
+		orig := etre.Entity{}
+		unset := bson.M{}
+		for label, v := range cur {
+			if _, ok := p[label]; ok {
+				orig[label] = v
+			} else if !etre.IsMetalabel(label) {
+				orig[label] = v
+				unset[label] = ""
+			}
+		}
+		if dryRun {
+			return orig, nil
+		}
+
+		updates := bson.M{
+			"$set": patch,
+			"$inc": bson.M{
+				"_rev": 1, // increment the revision
+			},
+		}
+		if len(unset) > 0 {
+			updates["$unset"] = unset
+		}
+		revFilter := bson.M{}
+		for k, v := range filter {
+			revFilter[k] = v
+		}
+		revFilter["_rev"] = cur["_rev"]
+		res, err := c.UpdateOne(s.ctx, revFilter, updates)
+		if err != nil {
+			return nil, s.dbError(err, "db-update")
+		}
+		if res.MatchedCount == 1 {
+			return orig, nil
+		}
+		// Entity changed since read, so read it again
+	}
+	id, _ := filter["_id"].(primitive.ObjectID)
+	return nil, DbError{
+		Err:      errors.New("entity changed during replace update, retry the update"),
+		Type:     "db-update",
+		EntityId: id.Hex(),
+	}
+}
+
 // DeleteEntities queries the db and deletes all Entity matching that query.
 // This method allows for partial success and failure which means the return
 // value and error are _not_ mutually exclusive. Caller should check and handle
@@ -252,14 +680,33 @@ func (s store) UpdateEntities(wo WriteOp, q query.Query, patch etre.Entity) ([]e
 // Returns a slice of successfully deleted entities an error if there is one.
 // For example, if 4 entities were supposed to be deleted and 3 are ok and the
 // 4th fails, a slice with 3 deleted entities and an error will be returned.
-func (s store) DeleteEntities(wo WriteOp, q query.Query) ([]etre.Entity, error) {
+//
+// If limit is greater than zero, at most limit entities are deleted, so callers
+// can delete many entities in batches.
+func (s store) DeleteEntities(wo WriteOp, q query.Query, limit int) ([]etre.Entity, error) {
 	c, ok := s.coll[wo.EntityType]
 	if !ok {
 		panic("invalid entity type passed to DeleteEntities: " + wo.EntityType)
 	}
 
 	deleted := []etre.Entity{}
-	for {
+	if wo.DryRun {
+		// Return the entities that would be deleted
+		fopts := options.Find()
+		if limit > 0 {
+			fopts.SetLimit(int64(limit))
+		}
+		cursor, err := c.Find(s.ctx, Filter(q), fopts)
+		if err != nil {
+			return nil, s.dbError(err, "db-query")
+		}
+		defer cursor.Close(s.ctx)
+		if err := cursor.All(s.ctx, &deleted); err != nil {
+			return nil, s.dbError(err, "db-cursor-decode")
+		}
+		return deleted, nil
+	}
+	for limit <= 0 || len(deleted) < limit {
 		var old etre.Entity
 		err := c.FindOneAndDelete(s.ctx, Filter(q)).Decode(&old)
 		if err != nil {
@@ -270,7 +717,7 @@ func (s store) DeleteEntities(wo WriteOp, q query.Query) ([]etre.Entity, error)
 		}
 		deleted = append(deleted, old)
 		ce := cdcPartial{
-			op:  "d",
+			op:  etre.CDC_OP_DELETE,
 			id:  old["_id"].(primitive.ObjectID),
 			old: &old,
 			new: nil,
@@ -297,8 +744,17 @@ func (s store) DeleteLabel(wo WriteOp, label string) (etre.Entity, error) {
 		"$unset": bson.M{label: ""}, // removes label, Mongo expects "" (see $unset docs)
 		"$inc":   bson.M{"_rev": 1}, // increment the revision
 	}
+	projection := bson.M{"_id": 1, "_type": 1, "_rev": 1, label: 1}
+	if wo.DryRun {
+		var old etre.Entity
+		err := c.FindOne(s.ctx, filter, options.FindOne().SetProjection(projection)).Decode(&old)
+		if err != nil {
+			return nil, s.dbError(err, "db-query")
+		}
+		return old, nil
+	}
 	opts := options.FindOneAndUpdate().
-		SetProjection(bson.M{"_id": 1, "_type": 1, "_rev": 1, label: 1}).
+		SetProjection(projection).
 		SetReturnDocument(options.Before)
 	var old etre.Entity
 	err := c.FindOneAndUpdate(s.ctx, filter, update, opts).Decode(&old)
@@ -326,7 +782,7 @@ func (s store) DeleteLabel(wo WriteOp, label string) (etre.Entity, error) {
 	}
 
 	cp := cdcPartial{
-		op:  "u",
+		op:  etre.CDC_OP_UPDATE,
 		id:  old["_id"].(primitive.ObjectID),
 		new: &new,
 		old: &old,
@@ -379,6 +835,8 @@ func (s store) cdcWrite(e etre.Entity, wo WriteOp, cp cdcPartial) error {
 		Op:     cp.op,
 		Caller: wo.Caller,
 
+		RequestId: wo.RequestId,
+
 		EntityId:   cp.id.Hex(),
 		EntityType: wo.EntityType,
 		EntityRev:  cp.rev,
@@ -94,7 +94,7 @@ func docs(entities []etre.Entity) []interface{} {
 // --------------------------------------------------------------------------
 
 func TestReadEntitiesWithAllOperators(t *testing.T) {
-	// Test all operators: in, notin, =, ==, !=, (has) y, (does not have) !foo, <, >
+	// Test all operators: in, notin, =, ==, !=, (has) y, (does not have) !foo, <, >, =~, !~
 	// All values are set such that it only matches the first test node to make
 	// testing easier and ensure we don't match the other entities.
 	store := setup(t, &mock.CDCStore{})
@@ -108,6 +108,9 @@ func TestReadEntitiesWithAllOperators(t *testing.T) {
 		"!bar",
 		"z > 1",
 		"z < 10",
+		"y =~ ^a",
+		"y !~ b",
+		`y =~ "(?i)^A$"`,
 	}
 	expect := []etre.Entity{testNodes[0]}
 	for _, qs := range queries {
@@ -219,6 +222,151 @@ func TestReadEntitiesFilterReturnMetalabels(t *testing.T) {
 	assert.Equal(t, expect, actual)
 }
 
+func TestReadEntitiesFilterSort(t *testing.T) {
+	// Test that etre.QueryFilter{Sort: ...} orders entities by each label in
+	// order, and that Limit and Offset page the sorted entities. The 2nd and 3rd
+	// test nodes have y=b, so sorting by y descending ties them; x breaks the tie.
+	store := setup(t, &mock.CDCStore{})
+	q, err := query.Translate("y") // all test nodes have label "y"
+	require.NoError(t, err)
+
+	f := etre.QueryFilter{
+		ReturnLabels: []string{"x"},
+		Sort:         []string{"-y", "-x"},
+	}
+	got, err := store.ReadEntities(entityType, q, f)
+	require.NoError(t, err)
+	expect := []etre.Entity{
+		{"x": int64(6)},
+		{"x": int64(4)},
+		{"x": int64(2)},
+	}
+	assert.Equal(t, expect, got)
+
+	f.Limit = 1
+	f.Offset = 1
+	got, err = store.ReadEntities(entityType, q, f)
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"x": int64(4)}}, got)
+}
+
+func TestReadEntitiesConsistency(t *testing.T) {
+	// Every consistency reads the same entities from a single-node test db
+	store := setup(t, &mock.CDCStore{})
+	q, err := query.Translate("y")
+	require.NoError(t, err)
+	for _, c := range []string{"", etre.CONSISTENCY_EVENTUAL, etre.CONSISTENCY_READ_YOUR_WRITES, etre.CONSISTENCY_STRONG} {
+		actual, err := store.ReadEntities(entityType, q, etre.QueryFilter{Consistency: c})
+		require.NoError(t, err, c)
+		assert.Len(t, actual, 3, c)
+
+		n, err := store.CountEntities(entityType, q, etre.QueryFilter{Consistency: c})
+		require.NoError(t, err, c)
+		assert.Equal(t, int64(3), n, c)
+	}
+
+	_, err = store.ReadEntities(entityType, q, etre.QueryFilter{Consistency: "linearizable"})
+	assert.Error(t, err)
+}
+
+func TestReadEntitiesDeleted(t *testing.T) {
+	// Tombstones (_deleted true) are returned only with IncludeDeleted or OnlyDeleted
+	store := setup(t, &mock.CDCStore{})
+	_, err := coll[entityType].UpdateOne(context.TODO(), bson.M{"_id": testNodes[0]["_id"]}, bson.M{"$set": bson.M{"_deleted": true}})
+	require.NoError(t, err)
+	q, err := query.Translate("y")
+	require.NoError(t, err)
+
+	actual, err := store.ReadEntities(entityType, q, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, testNodes[1:], actual)
+
+	n, err := store.CountEntities(entityType, q, etre.QueryFilter{IncludeDeleted: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	actual, err = store.ReadEntities(entityType, q, etre.QueryFilter{OnlyDeleted: true, ReturnLabels: []string{"x"}})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"x": int64(2)}}, actual)
+}
+
+func TestCountEntities(t *testing.T) {
+	store := setup(t, &mock.CDCStore{})
+	q, err := query.Translate("y") // all test nodes have label "y"
+	require.NoError(t, err)
+
+	n, err := store.CountEntities(entityType, q, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	// 2 distinct values: y=a and y=b
+	n, err = store.CountEntities(entityType, q, etre.QueryFilter{ReturnLabels: []string{"y"}, Distinct: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	q, err = query.Translate("y=y")
+	require.NoError(t, err)
+	n, err = store.CountEntities(entityType, q, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestAggregateEntities(t *testing.T) {
+	store := setup(t, &mock.CDCStore{})
+	q, err := query.Translate("y") // all test nodes have label "y"
+	require.NoError(t, err)
+
+	// Only the first node has label "z"
+	groups, err := store.AggregateEntities(entityType, q, []string{"y", "z"}, etre.QueryFilter{})
+	require.NoError(t, err)
+	expect := []etre.GroupResult{
+		{Group: etre.Entity{"y": "a", "z": int64(9)}, Count: 1},
+		{Group: etre.Entity{"y": "b", "z": nil}, Count: 2},
+	}
+	assert.Equal(t, expect, groups)
+
+	groups, err = store.AggregateEntities(entityType, q, []string{"y"}, etre.QueryFilter{Offset: 1, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.GroupResult{{Group: etre.Entity{"y": "b"}, Count: 2}}, groups)
+
+	q, err = query.Translate("y=y")
+	require.NoError(t, err)
+	groups, err = store.AggregateEntities(entityType, q, []string{"y"}, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, groups)
+}
+
+func TestExplainEntities(t *testing.T) {
+	store := setup(t, &mock.CDCStore{})
+
+	// Unique index on "x" (see setup)
+	q, err := query.Translate("x>3")
+	require.NoError(t, err)
+	plan, err := store.ExplainEntities(entityType, q, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "IXSCAN", plan.Stage)
+	assert.Equal(t, "x_1", plan.Index)
+	assert.Equal(t, int64(2), plan.KeysExamined)
+	assert.Equal(t, int64(2), plan.DocsExamined)
+	assert.Equal(t, int64(2), plan.Returned)
+
+	// No index on "y"
+	q, err = query.Translate("y=b")
+	require.NoError(t, err)
+	plan, err = store.ExplainEntities(entityType, q, etre.QueryFilter{Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "COLLSCAN", plan.Stage)
+	assert.Equal(t, "", plan.Index)
+	assert.Equal(t, int64(1), plan.Returned)
+}
+
+func TestReadLabels(t *testing.T) {
+	store := setup(t, &mock.CDCStore{})
+	labels, err := store.ReadLabels(entityType)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"_id", "_rev", "_type", "bar", "foo", "x", "y", "z"}, labels)
+}
+
 // --------------------------------------------------------------------------
 // Create
 // --------------------------------------------------------------------------
@@ -606,6 +754,205 @@ func TestUpdateEntitiesDuplicate(t *testing.T) {
 	assert.Empty(t, gotEvents)
 }
 
+func TestUpdateEntitiesDryRun(t *testing.T) {
+	// Dry run returns the same diffs but does not update or write CDC events
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	q, err := query.Translate("y=b")
+	require.NoError(t, err)
+	dryRun := wo
+	dryRun.DryRun = true
+	gotDiffs, err := store.UpdateEntities(dryRun, q, etre.Entity{"y": "c"})
+	require.NoError(t, err)
+	expectDiffs := []etre.Entity{
+		{"_id": testNodes[1]["_id"], "_type": entityType, "_rev": int64(0), "y": "b"},
+		{"_id": testNodes[2]["_id"], "_type": entityType, "_rev": int64(0), "y": "b"},
+	}
+	assert.ElementsMatch(t, expectDiffs, gotDiffs)
+	assert.Empty(t, gotEvents)
+
+	got, err := store.ReadEntities(entityType, q, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Len(t, got, 2, "entities updated on dry run")
+}
+
+func TestUpdateEntitiesReplace(t *testing.T) {
+	// Replace removes labels, except metalabels, not in the patch, and the diffs
+	// have the removed labels
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	q, err := query.Translate("y=b")
+	require.NoError(t, err)
+	replace := wo
+	replace.Replace = true
+	replace.DryRun = true
+	gotDiffs, err := store.UpdateEntities(replace, q, etre.Entity{"y": "c"})
+	require.NoError(t, err)
+	expectDiffs := []etre.Entity{
+		{"_id": testNodes[1]["_id"], "_type": entityType, "_rev": int64(0), "x": int64(4), "y": "b", "bar": ""},
+		{"_id": testNodes[2]["_id"], "_type": entityType, "_rev": int64(0), "x": int64(6), "y": "b", "bar": ""},
+	}
+	assert.ElementsMatch(t, expectDiffs, gotDiffs)
+	assert.Empty(t, gotEvents)
+
+	replace.DryRun = false
+	gotDiffs, err = store.UpdateEntities(replace, q, etre.Entity{"y": "c"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, expectDiffs, gotDiffs)
+	assert.Len(t, gotEvents, 2)
+
+	q, err = query.Translate("y=c")
+	require.NoError(t, err)
+	got, err := store.ReadEntities(entityType, q, etre.QueryFilter{})
+	require.NoError(t, err)
+	expect := []etre.Entity{
+		{"_id": testNodes[1]["_id"], "_type": entityType, "_rev": int64(1), "y": "c"},
+		{"_id": testNodes[2]["_id"], "_type": entityType, "_rev": int64(1), "y": "c"},
+	}
+	assert.ElementsMatch(t, expect, got)
+}
+
+func TestUpdateEntitiesConcurrentChange(t *testing.T) {
+	// If a matching entity changes so it no longer matches during the update,
+	// it's not updated, but the other matching entities are. The CDC write for
+	// the first entity changes another entity, which is not updated yet, so it
+	// no longer matches the query.
+	for _, replace := range []bool{false, true} {
+		var changed interface{}
+		gotEvents := []etre.CDCEvent{}
+		cdcm := &mock.CDCStore{
+			WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+				gotEvents = append(gotEvents, e)
+				if changed != nil {
+					return nil
+				}
+				changed = testNodes[1]["_id"]
+				if e.EntityId == testNodes[1]["_id"].(primitive.ObjectID).Hex() {
+					changed = testNodes[2]["_id"]
+				}
+				_, err := coll[entityType].UpdateOne(ctx, bson.M{"_id": changed}, bson.M{"$set": bson.M{"x": int64(1)}})
+				return err
+			},
+		}
+		store := setup(t, cdcm)
+		if replace {
+			// Replace removes x, which has a unique index
+			_, err := coll[entityType].Indexes().DropAll(context.TODO())
+			require.NoError(t, err)
+		}
+
+		q, err := query.Translate("x>1")
+		require.NoError(t, err)
+		w := wo
+		w.Replace = replace
+		gotDiffs, err := store.UpdateEntities(w, q, etre.Entity{"y": "c"})
+		require.NoError(t, err)
+		assert.Len(t, gotDiffs, 2, "replace=%t", replace)
+		assert.Len(t, gotEvents, 2, "replace=%t", replace)
+
+		q, err = query.Translate("y=c")
+		require.NoError(t, err)
+		got, err := store.ReadEntities(entityType, q, etre.QueryFilter{})
+		require.NoError(t, err)
+		require.Len(t, got, 2, "replace=%t", replace)
+		for _, e := range got {
+			assert.NotEqual(t, changed, e["_id"])
+		}
+	}
+}
+
+func TestUpdateEntitiesArrayOps(t *testing.T) {
+	// Array operators add and remove array values with $addToSet and $pull, and
+	// the CDC event has the resulting array, not the operator
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	q, err := query.Translate("y=b")
+	require.NoError(t, err)
+	_, err = store.UpdateEntities(wo, q, etre.Entity{}.AddToSet("tags", "a", "b"))
+	require.NoError(t, err)
+	gotDiffs, err := store.UpdateEntities(wo, q, etre.Entity{"bar": "c"}.AddToSet("tags", "b", "c").Pull("tags2", "x"))
+	require.NoError(t, err)
+	require.Len(t, gotDiffs, 2)
+	assert.ElementsMatch(t, []interface{}{"a", "b"}, gotDiffs[0]["tags"])
+	require.Len(t, gotEvents, 4)
+	assert.Equal(t, etre.Entity{"tags": []interface{}{"a", "b"}}, *gotEvents[0].New)
+	assert.Equal(t, etre.Entity{"bar": "c", "tags": []interface{}{"a", "b", "c"}}, *gotEvents[2].New)
+
+	_, err = store.UpdateEntities(wo, q, etre.Entity{}.Pull("tags", "a"))
+	require.NoError(t, err)
+	got, err := store.ReadEntities(entityType, q, etre.QueryFilter{})
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	for _, e := range got {
+		assert.ElementsMatch(t, []interface{}{"b", "c"}, e["tags"])
+		assert.Equal(t, "c", e["bar"])
+		assert.False(t, e.Has("tags2"))
+		assert.Equal(t, int64(3), e.Rev())
+	}
+
+	// Label not an array
+	_, err = store.UpdateEntities(wo, q, etre.Entity{}.AddToSet("y", "c"))
+	assert.Error(t, err)
+}
+
+func TestUpdateEntitiesIncrement(t *testing.T) {
+	// Counter operator increments with $inc, setting the label if not set, and
+	// the CDC event has the incremented value, not the operator
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	q, err := query.Translate("y=b")
+	require.NoError(t, err)
+	_, err = store.UpdateEntities(wo, q, etre.Entity{}.Increment("n", 2))
+	require.NoError(t, err)
+	gotDiffs, err := store.UpdateEntities(wo, q, etre.Entity{"bar": "c"}.Increment("n", -5))
+	require.NoError(t, err)
+	require.Len(t, gotDiffs, 2)
+	assert.Equal(t, int64(2), gotDiffs[0]["n"])
+	require.Len(t, gotEvents, 4)
+	assert.Equal(t, etre.Entity{"n": int64(2)}, *gotEvents[0].New)
+	assert.Equal(t, etre.Entity{"bar": "c", "n": int64(-3)}, *gotEvents[2].New)
+
+	got, err := store.ReadEntities(entityType, q, etre.QueryFilter{})
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	for _, e := range got {
+		assert.Equal(t, int64(-3), e["n"])
+		assert.Equal(t, int64(2), e.Rev())
+	}
+
+	// Label not an integer
+	_, err = store.UpdateEntities(wo, q, etre.Entity{}.Increment("y", 1))
+	assert.Error(t, err)
+}
+
 // --------------------------------------------------------------------------
 // Delete
 // --------------------------------------------------------------------------
@@ -624,7 +971,7 @@ func TestDeleteEntities(t *testing.T) {
 	q, err := query.Translate("y == a")
 	require.NoError(t, err)
 
-	gotOld, err := store.DeleteEntities(wo, q)
+	gotOld, err := store.DeleteEntities(wo, q, 0)
 	require.NoError(t, err)
 	assert.Equal(t, testNodes[:1], gotOld)
 
@@ -632,7 +979,7 @@ func TestDeleteEntities(t *testing.T) {
 	q, err = query.Translate("y == b")
 	require.NoError(t, err)
 
-	gotOld, err = store.DeleteEntities(wo, q)
+	gotOld, err = store.DeleteEntities(wo, q, 0)
 	require.NoError(t, err)
 	assert.Equal(t, testNodes[1:], gotOld)
 
@@ -672,6 +1019,55 @@ func TestDeleteEntities(t *testing.T) {
 	assert.Equal(t, expectEvent, gotEvents)
 }
 
+func TestDeleteEntitiesLimit(t *testing.T) {
+	store := setup(t, &mock.CDCStore{})
+
+	// Match last two test nodes, but delete only one per call
+	q, err := query.Translate("y == b")
+	require.NoError(t, err)
+
+	gotOld, err := store.DeleteEntities(wo, q, 1)
+	require.NoError(t, err)
+	assert.Len(t, gotOld, 1)
+
+	gotOld, err = store.DeleteEntities(wo, q, 1)
+	require.NoError(t, err)
+	assert.Len(t, gotOld, 1)
+
+	gotOld, err = store.DeleteEntities(wo, q, 1)
+	require.NoError(t, err)
+	assert.Empty(t, gotOld)
+}
+
+func TestDeleteEntitiesDryRun(t *testing.T) {
+	// Dry run returns the entities that would be deleted but does not delete them
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	q, err := query.Translate("y == b")
+	require.NoError(t, err)
+	dryRun := wo
+	dryRun.DryRun = true
+	gotOld, err := store.DeleteEntities(dryRun, q, 0)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []etre.Entity{testNodes[1], testNodes[2]}, gotOld)
+	assert.Empty(t, gotEvents)
+
+	gotOld, err = store.DeleteEntities(dryRun, q, 1)
+	require.NoError(t, err)
+	assert.Len(t, gotOld, 1)
+
+	got, err := store.ReadEntities(entityType, q, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Len(t, got, 2, "entities deleted on dry run")
+}
+
 // --------------------------------------------------------------------------
 // Delete Label
 // --------------------------------------------------------------------------
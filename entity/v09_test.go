@@ -212,7 +212,7 @@ func TestV09DeleteEntities(t *testing.T) {
 	q, err := query.Translate("x == a")
 	require.NoError(t, err)
 
-	gotOld, err := store.DeleteEntities(wo, q)
+	gotOld, err := store.DeleteEntities(wo, q, 0)
 	require.NoError(t, err)
 	assert.Equal(t, v09testNodes_int32[:1], gotOld)
 
@@ -220,7 +220,7 @@ func TestV09DeleteEntities(t *testing.T) {
 	q, err = query.Translate("x in (b,c)")
 	require.NoError(t, err)
 
-	gotOld, err = store.DeleteEntities(wo, q)
+	gotOld, err = store.DeleteEntities(wo, q, 0)
 	require.NoError(t, err)
 	assert.Equal(t, v09testNodes_int32[1:], gotOld)
 
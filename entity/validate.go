@@ -77,7 +77,7 @@ func (v validator) Entities(entities []etre.Entity, op byte) error {
 					Type: "empty-string-label",
 				}
 			}
-			if strings.IndexAny(label, " \t") != -1 {
+			if strings.ContainsAny(label, etre.LABEL_WHITESPACE) {
 				return ValidationError{
 					Err:  fmt.Errorf("label cannot have whitesspace: '%s' (entity index %d)", label, i),
 					Type: "label-has-whitespace",
@@ -86,7 +86,7 @@ func (v validator) Entities(entities []etre.Entity, op byte) error {
 			switch op {
 			case VALIDATE_ON_CREATE:
 				// User cannot set these metalabels on create
-				for _, ml := range []string{"_id", "_type", "_rev", "_ts"} {
+				for _, ml := range []string{"_id", "_type", "_rev", "_ts", "_deleted"} {
 					if label != ml {
 						continue
 					}
@@ -116,15 +116,52 @@ func (v validator) Entities(entities []etre.Entity, op byte) error {
 			if val == nil {
 				continue
 			}
+
+			// Array operators, like {"$addToSet": ["a", "b"]}, are allowed only on
+			// update, with values of the same types as label values
+			if aop, values, ok := etre.ArrayOp(val); ok {
+				if op != VALIDATE_ON_UPDATE {
+					return ValidationError{
+						Err:  fmt.Errorf("array operator %s for key %s is only allowed on patch (entity index %d)", aop, label, i),
+						Type: "invalid-array-op",
+					}
+				}
+				for j, av := range values {
+					if f, ok := av.(float64); ok {
+						values[j] = int(f)
+						continue
+					}
+					if !validValue(av) {
+						return ValidationError{
+							Err:  fmt.Errorf("invalid value type %T in array operator %s for key %v (value: %v); valid types: string, int, bool (entity index %d)", av, aop, label, av, i),
+							Type: "invalid-value-type",
+						}
+					}
+				}
+				continue
+			}
+
+			// Counter operators, like {"$inc": 1}, are allowed only on update, with
+			// an integer delta
+			if delta, ok := etre.IncrementOp(val); ok {
+				if op != VALIDATE_ON_UPDATE {
+					return ValidationError{
+						Err:  fmt.Errorf("counter operator %s for key %s is only allowed on patch (entity index %d)", etre.COUNTER_OP_INC, label, i),
+						Type: "invalid-counter-op",
+					}
+				}
+				entities[i][label] = map[string]interface{}{etre.COUNTER_OP_INC: delta}
+				continue
+			}
+
 			if reflect.TypeOf(val).Kind() == reflect.Float64 {
 				entities[i][label] = int(val.(float64))
 			} else {
 				// Values in entity must be of type string or int. This is because the query
 				// language we use only supports querying by string or int. See more at:
-				// github.com/square/etre/query
-				k := reflect.TypeOf(val).Kind()
-				valid := k == reflect.String || k == reflect.Int || k == reflect.Bool
-				if !valid {
+				// github.com/square/etre/query. Int64 is from etre.Entity.UnmarshalJSON
+				// which decodes integer meta-labels like _setSize as int64.
+				if !validValue(val) {
 					return ValidationError{
 						Err:  fmt.Errorf("invalid value type %s for key %v (value: %v); valid types: string, int, bool (entity index %d)", reflect.TypeOf(val), label, val, i),
 						Type: "invalid-value-type",
@@ -136,6 +173,16 @@ func (v validator) Entities(entities []etre.Entity, op byte) error {
 	return nil
 }
 
+// validValue returns true if val is a string, int, or bool, the types that the
+// query language supports.
+func validValue(val interface{}) bool {
+	if val == nil {
+		return false
+	}
+	k := reflect.TypeOf(val).Kind()
+	return k == reflect.String || k == reflect.Int || k == reflect.Int64 || k == reflect.Bool
+}
+
 func (v validator) WriteOp(wo WriteOp) error {
 	if err := v.EntityType(wo.EntityType); err != nil {
 		return err
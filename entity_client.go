@@ -4,16 +4,34 @@ package etre
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/square/etre/query"
 )
 
 // EntityClient represents a entity type-specific client. No interface method has
@@ -23,27 +41,197 @@ type EntityClient interface {
 	// Query returns entities that match the query and pass the filter.
 	Query(query string, filter QueryFilter) ([]Entity, error)
 
+	// Count returns the number of entities that match the query without returning
+	// the entities. If filter.Distinct is true, it returns the number of distinct
+	// values of the one label in filter.ReturnLabels. Other filter options, except
+	// Timeout, are ignored.
+	Count(query string, filter QueryFilter) (int64, error)
+
+	// DistinctValues returns the distinct values of the label of entities that match
+	// the query, like Query with filter.Distinct. If query is empty, it's all entities
+	// with the label. filter.Limit and Offset page the values, for example to cap how
+	// many are returned. filter.ReturnLabels must be empty or only the label, and
+	// filter.Sort is ignored. Values are decoded from JSON (see JSONNumbers in
+	// EntityClientConfig), so a number is a float64 by default, not a string.
+	DistinctValues(label, query string, filter QueryFilter) ([]interface{}, error)
+
+	// Aggregate groups entities that match the query by the values of the groupBy
+	// labels and returns the groups, sorted by those values, with the number of
+	// entities in each. The server does the aggregation, so entities are not
+	// returned. Entities without a groupBy label are grouped by a nil value for it.
+	// filter.Limit and Offset page the groups; other filter options, except Timeout
+	// and SinceRev, are ignored. Values are decoded from JSON (see JSONNumbers in
+	// EntityClientConfig). If groupBy is empty, it returns ErrNoLabel.
+	Aggregate(query string, groupBy []string, filter QueryFilter) ([]GroupResult, error)
+
+	// Explain returns the execution plan of the query (see QueryPlan): the index
+	// used, if any, the number of documents examined, and the execution time, to
+	// find slow queries that need an index. The server executes the query but
+	// doesn't return the entities. filter.Sort, Limit, Offset, and SinceRev are
+	// explained like Query; filter.Distinct is an error that matches
+	// ErrInvalidQuery; other filter options, except Timeout, are ignored.
+	// Servers before v0.12 don't support it.
+	Explain(query string, filter QueryFilter) (QueryPlan, error)
+
+	// BatchQuery runs the queries concurrently, at most EntityClientConfig.BatchQueryConcurrency
+	// (DEFAULT_BATCH_QUERY_CONCURRENCY if zero) at a time, and returns one QueryResponse
+	// per request in input order. Each query is like QueryContext (with retries,
+	// cache, and so on), and its error is returned in its QueryResponse, so one
+	// failed query doesn't fail the others. ctx is used for every query: if it's
+	// cancelled or its deadline is exceeded, queries not yet run are not sent, their
+	// QueryResponse has ctx.Err(), and BatchQuery returns ctx.Err() with the responses.
+	// Otherwise, the error is nil. If requests is empty, it returns ErrNoQuery. The
+	// Latency from WithLatency is not saved because the queries run concurrently.
+	BatchQuery(ctx context.Context, requests []QueryRequest) ([]QueryResponse, error)
+
+	// Stream returns an iterator over entities that match the query and pass the
+	// filter. Unlike Query, it reads one page of filter.Limit entities at a time
+	// (DEFAULT_STREAM_PAGE_SIZE if zero), starting at filter.Offset, so memory use
+	// is constant. If filter.Sort is not set, entities are sorted by _id for stable
+	// paging. Paging is not a snapshot: entities written during the stream can be
+	// skipped or returned twice. The first page is read before returning, so an
+	// invalid query is returned as an error. Cancelling ctx stops the iterator.
+	// With EntityClientConfig.StreamNDJSON, it makes one request instead of paging.
+	Stream(ctx context.Context, query string, filter QueryFilter) (*EntityIterator, error)
+
 	// Get returns a single entity by internal ID.
 	Get(id string) (Entity, error)
 
+	// GetById is like Get but returns only the labels in filter.ReturnLabels, if
+	// set. Other filter options, except Timeout and Consistency, are ignored. If no
+	// entity has the ID, it returns ErrEntityNotFound.
+	GetById(id string, filter QueryFilter) (Entity, error)
+
+	// GetByIds returns the entities with the given internal IDs in one request (a
+	// query "_id in (...)"), keyed by ID. IDs that don't match an entity are not
+	// in the map; that's not an error. Like GetById, only the labels in
+	// filter.ReturnLabels are returned, if set, and other filter options, except
+	// Timeout and Consistency, are ignored. Like Query, it's served from the
+	// QueryCacheTTL cache unless Consistency is CONSISTENCY_STRONG or
+	// CONSISTENCY_READ_YOUR_WRITES. The IDs are sent in the URL, so a very long
+	// list of IDs can exceed the server request size limit; split it into smaller
+	// lists. If ids is empty, it returns ErrNoEntity.
+	GetByIds(ids []string, filter QueryFilter) (map[string]Entity, error)
+
 	// Insert is a bulk operation that creates the given entities.
 	Insert([]Entity) (WriteResult, error)
 
+	// InsertStream inserts entities from the channel in one request, streaming
+	// them to the API as newline-delimited JSON (NDJSON) as they're received, and
+	// returns a channel of the result of each entity as the API inserts it, so
+	// memory use is constant no matter how many entities are inserted. Close the
+	// entities channel to end the request; the results channel is closed after
+	// the last result. Each Write has Index, the position (from 0) of the entity
+	// in the input, and Writes are in input order. If an entity fails, its Write
+	// has the Error, and the next entities are still inserted. An entity that's
+	// not valid (see ValidateLabel and Entity.ValidateValues) is not sent, and
+	// its Write has an "invalid-content" Error. If the stream fails, like the query timeout or cancelling ctx, the
+	// last Write has Index -1 and the Error; entities without a result were not
+	// inserted, or maybe inserted if sent before the failure. The request is not
+	// retried. Results are read on a goroutine that blocks until each is received,
+	// so read the results until the channel is closed. The API must support NDJSON
+	// inserts (v0.12 or newer); older versions return an invalid-content error.
+	InsertStream(ctx context.Context, entities <-chan Entity) (<-chan Write, error)
+
+	// InsertBatch is like Insert but sends the entities in batches of batchSize
+	// entities, one request per batch, and returns one WriteResult per batch. If
+	// batchSize is zero, DEFAULT_INSERT_BATCH_SIZE is used. It stops on the first
+	// batch that fails, which is the last WriteResult returned, and returns an error
+	// with the batch number. Batches before the failed batch were inserted.
+	InsertBatch(entities []Entity, batchSize int) ([]WriteResult, error)
+
 	// Update is a bulk operation that patches entities that match the query.
+	// To add or remove array values without replacing the array, use array
+	// operators in the patch: see Entity.AddToSet and Entity.Pull. To increment
+	// an integer label, like a counter, use Entity.Increment.
 	Update(query string, patch Entity) (WriteResult, error)
 
+	// UpdateMany is like Update but the patch cannot contain _id, _type, _rev, or
+	// _deleted, and filter.Timeout sets the server-side query timeout. Other filter
+	// options are not supported and return an error. The server applies the patch
+	// to all matching entities in one request, and the WriteResult has a Write with
+	// the Diff (previous values of the patched labels) for each updated entity.
+	UpdateMany(query string, patch Entity, filter QueryFilter) (WriteResult, error)
+
 	// UpdateOne patches the given entity by internal ID.
 	UpdateOne(id string, patch Entity) (WriteResult, error)
 
+	// UpdateIfRev patches the given entity by internal ID only if its current _rev
+	// is expectedRev. The entity must have an _id; other meta-labels (_type and
+	// _rev) are ignored, so an entity from Get or Query can be modified and passed
+	// back. If the revision differs, it returns an Error for which errors.Is(err,
+	// ErrRevConflict) is true, and Error.Rev is the current revision. Re-read the
+	// entity and try again. This makes read-modify-write loops safe.
+	UpdateIfRev(entity Entity, expectedRev int64) (Write, error)
+
+	// MutateById is a read-modify-write loop: it gets the entity by internal ID,
+	// calls mutate with it, and updates the entity with the returned entity by
+	// UpdateIfRev with the _rev that was read. If the entity changed concurrently
+	// (ErrRevConflict), it tries again with a fresh read, up to
+	// EntityClientConfig.MutateMaxTries times, so mutate must be safe to call more
+	// than once. Like UpdateIfRev, the returned entity is a patch: labels removed
+	// from it are not deleted. If mutate returns an error, MutateById returns it
+	// without updating. If mutate returns nil, nothing is updated and the Write
+	// has only EntityId. If the entity doesn't exist, it returns ErrEntityNotFound.
+	MutateById(ctx context.Context, id string, mutate func(Entity) (Entity, error)) (Write, error)
+
+	// Upsert inserts the entity if no entity has the same value for uniqueLabel,
+	// else it updates (patches) the one entity that does. The value of uniqueLabel
+	// must be a string, and the entity must not have an _id. The update matches the
+	// _rev of the entity, so if another client changes the entity (or inserts it)
+	// concurrently, Upsert re-reads and tries again, up to UPSERT_MAX_TRIES times.
+	// The returned Write has EntityId set, and Inserted is true if the entity
+	// was inserted. If more than one entity has the uniqueLabel value, it returns
+	// an error and makes no changes.
+	Upsert(uniqueLabel string, entity Entity) (Write, error)
+
 	// Delete is a bulk operation that removes all entities that match the query.
 	Delete(query string) (WriteResult, error)
 
+	// DeleteByQuery is like Delete but, if filter.Limit is greater than zero, the
+	// server deletes at most filter.Limit matching entities per request, and the
+	// client repeats the request until fewer are deleted. This keeps each request
+	// short (within the query timeout) when deleting many entities. The returned
+	// WriteResult has the writes (deleted entity IDs) of all requests. It stops on
+	// the first WriteResult.Error. Other filter options, except Timeout, are ignored.
+	DeleteByQuery(query string, filter QueryFilter) (WriteResult, error)
+
 	// DeleteOne removes the given entity by internal ID.
 	DeleteOne(id string) (WriteResult, error)
 
+	// DeleteByIds removes the given entities by internal ID, one request per ID.
+	// The returned WriteResult has the writes (deleted entity IDs), and the first
+	// WriteResult.Error, if any, with the error of each ID that failed in
+	// WriteResult.Errors. By default, it stops on the first error, like other
+	// bulk writes. With WriteOptions.ContinueOnError, it tries every ID. With
+	// WriteOptions.IgnoreNotFound, an ID that doesn't match an entity (already
+	// deleted) is not an error. A request error, like ErrClientTimeout, stops it
+	// and is returned with the WriteResult so far. If ids is empty, it returns
+	// ErrNoEntity.
+	DeleteByIds(ids []string) (WriteResult, error)
+
 	// Labels returns all labels on the given entity by internal ID.
 	Labels(id string) ([]string, error)
 
+	// History returns the CDC events of the entity by internal ID in EntityRev
+	// order, ascending: from the insert (rev 0) through the latest revision, or
+	// the delete if the entity was deleted. If limit is greater than zero, it
+	// returns only the most recent limit events. It can be used as an audit log
+	// of the entity, but it depends on CDC retention on the server: events older
+	// than the retention are not returned, so the first event might not be the
+	// insert, and an entity with no events returns an empty slice, not an error.
+	// If CDC is disabled on the server, it returns an error that matches
+	// ErrCDCDisabled. Servers before v0.12 don't support it. The server doesn't
+	// create the CDC index that History needs, {entityType: 1, entityId: 1,
+	// entityRev: -1}; without it, every call scans the CDC collection.
+	History(id string, limit int) ([]CDCEvent, error)
+
+	// AllLabels returns the distinct label names used by all entities of the client's
+	// entity type, sorted. It includes meta-labels, like _id; use IsMetalabel to
+	// exclude them. The server reads every entity, so use EntityClientConfig.LabelsCacheTTL
+	// to cache the result when calling it often, like for query autocomplete.
+	AllLabels() ([]string, error)
+
 	// DeleteLabel removes the given label from the given entity by internal ID.
 	// Labels should be stable, long-lived. Consequently, there's no bulk label delete.
 	DeleteLabel(id string, label string) (WriteResult, error)
@@ -51,6 +239,40 @@ type EntityClient interface {
 	// EntityType returns the entity type of the client.
 	EntityType() string
 
+	// Ping returns nil if the Etre server is up and its version is compatible with
+	// the client VERSION. If not compatible, the error wraps ErrVersionMismatch.
+	// Call it at startup to detect client and server version skew. See ServerVersion.
+	Ping() error
+
+	// ServerVersion returns the Etre server version.
+	ServerVersion() (string, error)
+
+	// Stats returns the client's request stats since it was created: the number
+	// of requests and errors, and the exponential moving average (EMA) RTT of
+	// responses, like Latency (see WithLatency) but a duration. Every request
+	// is counted, including each retry, and copies of the client (like WithSet)
+	// share the stats. It's cheap, so it's always on, for example to derive an
+	// adaptive timeout from RTT. See EntityClientConfig.LatencyEMAAlpha.
+	Stats() ClientStats
+
+	// InvalidateQueryCache removes cached query results (see EntityClientConfig.QueryCacheSize
+	// and QueryCacheTTL) for queries that match the pattern, a path.Match pattern like
+	// "env=*", and returns the number removed. The query is matched as passed to Query,
+	// without the filter, so all filters of a matching query are removed. An empty
+	// pattern removes all results. It returns 0 if the cache is not enabled, and
+	// path.ErrBadPattern if the pattern is malformed.
+	InvalidateQueryCache(pattern string) (int, error)
+
+	// Close closes the client and its copies (e.g. from WithContext): then,
+	// requests return ErrClientClosed. A closed client cannot be reused; make a
+	// new one. Requests in progress are not aborted; cancel their context for that.
+	// It closes idle connections only of a transport that the client made (for
+	// EntityClientConfig TLSConfig or connection pool settings), not of the
+	// caller's http.Client, which can be shared. Clients from NewEntityClients
+	// share a transport, so closing one closes idle connections for all, but the
+	// others can still be used. It's safe to call more than once.
+	Close() error
+
 	// WithSet returns a new EntityClient that uses the given Set for all write operations.
 	// The Set cannot be removed. Therefore, when the set is complete, discard the new
 	// EntityClient (let its reference count become zero). On insert, the given Set is added
@@ -64,17 +286,67 @@ type EntityClient interface {
 	// WithTrace returns a new EntityClient that sends the trace string with every request
 	// for server-side metrics. The trace string is a comma-separated list of key=value
 	// pairs like: app=foo,host=bar. Invalid trace values are silently ignored by the server.
+	// The string is sent as-is, so its keys keep their order. Values from ContextWithTrace
+	// replace values of the same keys in place, and other keys are appended.
 	WithTrace(string) EntityClient
 
+	// WithTraceContext is like WithTrace but the trace is a TraceContext, which is
+	// serialized in a stable format. To override or add trace values for one call,
+	// use ContextWithTrace and a Context method like QueryContext.
+	WithTraceContext(TraceContext) EntityClient
+
 	// WithContext returns a new EntityClient that attaches the context to every request.
 	WithContext(ctx context.Context) EntityClient
 
+	// WithLatency returns a new EntityClient that saves the latency of every request
+	// in lat. Send is the time to write the request, Recv is the time from then until
+	// the response is read, and RTT is the total. If a request is retried, lat is
+	// the latency of the last try. lat is not safe for concurrent use, so use the
+	// new EntityClient in only one goroutine, or make one per request.
+	WithLatency(lat *Latency) EntityClient
+
+	// WithWriteOptions returns a new EntityClient that uses the given WriteOptions
+	// for all write operations. For example, to preview an update without changing
+	// entities, call ec.WithWriteOptions(WriteOptions{DryRun: true}).Update(q, patch)
+	// and check Write.Diff in the returned WriteResult.
+	WithWriteOptions(WriteOptions) EntityClient
+
 	// Context returns the EntityClient's context. To change the context, use
 	// WithContext.
 	//
 	// The returned context is always non-nil; it defaults to the
 	// background context.
 	Context() context.Context
+
+	// QueryContext, GetContext, and so on are like their non-context counterparts
+	// but use the given context for the request instead of the EntityClient's
+	// context. If the context is cancelled or its deadline is exceeded, the request
+	// is aborted, no retries are made, and the returned error wraps ctx.Err().
+	QueryContext(ctx context.Context, query string, filter QueryFilter) ([]Entity, error)
+	CountContext(ctx context.Context, query string, filter QueryFilter) (int64, error)
+	DistinctValuesContext(ctx context.Context, label, query string, filter QueryFilter) ([]interface{}, error)
+	AggregateContext(ctx context.Context, query string, groupBy []string, filter QueryFilter) ([]GroupResult, error)
+	ExplainContext(ctx context.Context, query string, filter QueryFilter) (QueryPlan, error)
+	GetContext(ctx context.Context, id string) (Entity, error)
+	GetByIdContext(ctx context.Context, id string, filter QueryFilter) (Entity, error)
+	GetByIdsContext(ctx context.Context, ids []string, filter QueryFilter) (map[string]Entity, error)
+	InsertContext(ctx context.Context, entities []Entity) (WriteResult, error)
+	InsertBatchContext(ctx context.Context, entities []Entity, batchSize int) ([]WriteResult, error)
+	UpdateContext(ctx context.Context, query string, patch Entity) (WriteResult, error)
+	UpdateManyContext(ctx context.Context, query string, patch Entity, filter QueryFilter) (WriteResult, error)
+	UpdateOneContext(ctx context.Context, id string, patch Entity) (WriteResult, error)
+	UpdateIfRevContext(ctx context.Context, entity Entity, expectedRev int64) (Write, error)
+	UpsertContext(ctx context.Context, uniqueLabel string, entity Entity) (Write, error)
+	DeleteContext(ctx context.Context, query string) (WriteResult, error)
+	DeleteByQueryContext(ctx context.Context, query string, filter QueryFilter) (WriteResult, error)
+	DeleteOneContext(ctx context.Context, id string) (WriteResult, error)
+	DeleteByIdsContext(ctx context.Context, ids []string) (WriteResult, error)
+	LabelsContext(ctx context.Context, id string) ([]string, error)
+	HistoryContext(ctx context.Context, id string, limit int) ([]CDCEvent, error)
+	AllLabelsContext(ctx context.Context) ([]string, error)
+	DeleteLabelContext(ctx context.Context, id string, label string) (WriteResult, error)
+	PingContext(ctx context.Context) error
+	ServerVersionContext(ctx context.Context) (string, error)
 }
 
 // EntityClientConfig represents required and optional configuration for an EntityClient.
@@ -88,6 +360,614 @@ type EntityClientConfig struct {
 	RetryLogging bool          // log error on retry to stderr
 	QueryTimeout time.Duration // timeout passed to API via etre.QUERY_TIMEOUT_HEADER
 	Debug        bool
+	Logger       Logger       // optional debug logger (default: global Debug)
+	Trace        TraceContext // optional trace sent with every request (see WithTraceContext)
+
+	// TLSConfig is an optional TLS config for https://, like client certificates
+	// for mTLS, a custom CA, ServerName for SNI, or InsecureSkipVerify for testing.
+	// See NewTLSConfig. It's set on a copy of the HTTPClient transport, or the
+	// default transport if HTTPClient or its Transport is nil, so the given
+	// HTTPClient is not modified. If HTTPClient.Transport is not an *http.Transport,
+	// TLSConfig is not used: set it on the custom transport instead.
+	TLSConfig *tls.Config
+
+	// MaxIdleConns, MaxIdleConnsPerHost, and IdleConnTimeout tune connection pooling
+	// and keep-alive: see the same http.Transport fields. Like TLSConfig, they're
+	// set on a copy of the HTTPClient transport, which is shared by all requests made
+	// by the client and its copies (e.g. from WithContext). A zero value keeps the
+	// transport value. The default transport keeps only 2 idle connections per host,
+	// so increase MaxIdleConnsPerHost if the client makes many concurrent requests.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// Middleware wraps the transport of a copy of HTTPClient (the default transport
+	// if nil), after TLSConfig and connection pool options are set, so every request
+	// made by the client and its copies goes through it, including retries. The first
+	// middleware is the outermost: it gets each request first. The client sets its
+	// headers (like VERSION_HEADER and Headers) before sending the request, so the
+	// middleware can read and change them, like adding an Authorization header or
+	// signing the request. A middleware that wraps the transport in a new type hides
+	// its CloseIdleConnections method, so Close doesn't close idle connections
+	// unless the new type implements it, too.
+	Middleware []Middleware
+
+	// RetryPolicy retries idempotent operations with backoff. If set (MaxRetries > 0),
+	// it's used instead of Retry and RetryWait.
+	RetryPolicy RetryPolicy
+
+	// QueryLimiter and WriteLimiter are optional rate limiters for reads (Query,
+	// Count, Get, and Labels) and writes (Insert, Update, and Delete). Every request,
+	// including retries, waits on the limiter before it's sent. The same limiter can
+	// be used for both. See RateLimiter and NewRateLimiter.
+	QueryLimiter RateLimiter
+	WriteLimiter RateLimiter
+
+	// OnRateLimit is called after a request waited on a limiter with the request
+	// method and how long it waited, which can be zero.
+	OnRateLimit func(method string, wait time.Duration)
+
+	// CircuitBreaker fails requests fast with ErrCircuitOpen while the API is
+	// failing. See CircuitBreaker. The default, zero value, is no circuit breaker.
+	CircuitBreaker CircuitBreaker
+
+	// LatencyEMAAlpha is the weight, greater than 0 and at most 1, of the latest
+	// response in the EMA latencies returned by Stats: higher values follow
+	// changes faster, lower values smooth out spikes. The default, zero, is
+	// DEFAULT_LATENCY_EMA_ALPHA.
+	LatencyEMAAlpha float64
+
+	// LatencyEMASendRecv makes Stats average Send and Recv, too, not only RTT.
+	// Like WithLatency, it traces every request to measure when the request was
+	// written, which adds an httptrace.ClientTrace to the request context.
+	LatencyEMASendRecv bool
+
+	// Observer is an optional Observer called after every request, for client-side
+	// metrics like request counts, error rates, and latency histograms.
+	Observer Observer
+
+	// Tracer is an optional Tracer that starts a client span for every request
+	// and injects the span context into the request headers, for distributed tracing.
+	Tracer Tracer
+
+	// DefaultQueryFilter is merged with the QueryFilter of every read (Query, Count,
+	// DistinctValues, Aggregate, Stream, GetById, and GetByIds), so a policy like
+	// a standard ReturnLabels projection doesn't have to be repeated on every call.
+	// Fields set in the per-call filter override the defaults; see QueryDefaults.
+	// Writes (UpdateMany and DeleteByQuery) don't use it.
+	DefaultQueryFilter QueryDefaults
+
+	// QueryPageSize makes Query read all entities in pages of this many, one request
+	// per page, and return them in one slice, so each request is small and quick
+	// for the server. It's used only if filter.Limit is zero (all entities). Like
+	// Stream, entities are sorted by _id if filter.Sort is not set, and paging is
+	// best-effort, not a snapshot: an entity inserted or deleted during the query
+	// can shift the next page, so an entity can be skipped. An entity shifted into
+	// the next page twice is returned once, if filter.ReturnLabels includes _id.
+	// The default, zero, reads all entities in one request.
+	QueryPageSize int
+
+	// BatchQueryConcurrency is the maximum number of queries that BatchQuery runs
+	// at a time. The default, zero, is DEFAULT_BATCH_QUERY_CONCURRENCY. Queries
+	// share HTTPClient, so increase MaxIdleConnsPerHost of its transport (default
+	// 2) to reuse connections if this is greater.
+	BatchQueryConcurrency int
+
+	// TokenProvider is an optional TokenProvider called before every request,
+	// including retries, to set header Authorization: Bearer <token>. It replaces
+	// an Authorization header in Headers. If it implements TokenRefresher and the
+	// API (or an auth proxy) returns 401 Unauthorized, the client invalidates the
+	// token and sends the request once more with a new token.
+	TokenProvider TokenProvider
+
+	// SetGenerator makes every write of more than one entity a set in the CDC
+	// feed (see WithSet) without calling WithSet: Insert with more than one entity,
+	// and DeleteByIds with more than one ID, call it and use the returned Set.
+	// InsertBatch calls it for each batch, so each batch is its own set, because
+	// batches before a failed batch are inserted and a set spanning batches would
+	// be incomplete. Use NewSet for a set with a random ID. Set labels are all or
+	// nothing, and the set size must be the number of entities, so writes by query
+	// (Update, UpdateMany, Delete, DeleteByQuery) are not made a set because the
+	// number isn't known before the write; use WithSet for those. InsertStream is
+	// not made a set either. A client with a Set from WithSet doesn't call it.
+	SetGenerator SetGenerator
+
+	// Schema is an optional Schema checked before every insert and update, so an
+	// entity that doesn't conform is not sent and the write returns the
+	// *SchemaError (see Entity.ValidateSchema). Inserts must have every required
+	// label. Updates are partial, so only the types of the labels in the patch are
+	// checked, unless WriteOptions.UpdateMode is UPDATE_MODE_REPLACE. In
+	// InsertStream, an entity that doesn't conform has an "invalid-content" Error.
+	Schema *Schema
+
+	// CompressRequests gzips request payloads (entities for Insert and Update) that
+	// are at least this many bytes and sends header Content-Encoding: gzip. Small
+	// payloads aren't worth compressing, so a few kilobytes is a reasonable value.
+	// The default, zero, does not compress requests.
+	CompressRequests int
+
+	// DisableCompression disables gzip response compression. By default, the client
+	// sends header Accept-Encoding: gzip and decompresses gzip responses, which the
+	// API sends for queries. Like Latency, Observer and Tracer durations exclude the
+	// time to compress the request and decompress the response.
+	DisableCompression bool
+
+	// LabelsCacheTTL caches the result of AllLabels for this long. The cache is
+	// shared by the client and its copies (e.g. from WithContext). The default,
+	// zero, does not cache.
+	LabelsCacheTTL time.Duration
+
+	// QueryCacheSize caches the results of this many queries by ETag. When the
+	// same query (with the same filter) is repeated, the client sends header
+	// If-None-Match with the ETag of the cached result, and if the API returns
+	// 304 Not Modified, Query returns a copy of the cached result without the API
+	// sending it again. The API still executes the query, so this saves bandwidth,
+	// not database time; it's for polling the same queries, like dashboards. When
+	// the cache is full, the oldest query is removed. The cache is shared by the
+	// client and its copies (e.g. from WithContext). If Observer is a CacheObserver,
+	// it observes cache hits and misses. The default, zero, does not cache.
+	QueryCacheSize int
+
+	// QueryCacheTTL returns a cached query result without a request for this long
+	// after it's read or revalidated (304 Not Modified), so polling the same query
+	// saves database time, too, if results can be stale for the TTL. Results
+	// without an ETag are cached, too. After the TTL, the result is revalidated by
+	// ETag (see QueryCacheSize). If QueryCacheSize is zero, DEFAULT_QUERY_CACHE_SIZE
+	// queries are cached. Writes don't invalidate the cache; use InvalidateQueryCache.
+	// Queries with QueryFilter.Consistency CONSISTENCY_STRONG or
+	// CONSISTENCY_READ_YOUR_WRITES ignore the TTL: they're always requested.
+	// The default, zero, does not cache without a request.
+	QueryCacheTTL time.Duration
+
+	// BaseURL is the externally-reachable Etre address, like "https://etre.example.com"
+	// or, with a path prefix, "https://proxy.example.com/etre". If set, the client
+	// rewrites Write.URI in every WriteResult with Write.ResolveURI(BaseURL), so
+	// URIs are reachable when the server address differs. Addr is not used because
+	// it can be an internal address.
+	BaseURL string
+
+	// ResponseFormat is the preferred response encoding: RESPONSE_FORMAT_JSON
+	// (default) or RESPONSE_FORMAT_BSON. BSON preserves number types (int32, int64,
+	// and float64) that JSON decodes as float64 (see JSONNumbers), but it's opt-in
+	// because callers might expect JSON number types. The client sends it in header
+	// Accept and decodes the response by its Content-Type, so it falls back to JSON
+	// if the API doesn't support BSON. Only Query and Get responses (entities) can
+	// be BSON; all other responses are JSON.
+	ResponseFormat string
+
+	// JSONNumbers determines how numbers in entities in JSON responses are decoded,
+	// other than integer meta-labels, which are always int64: JSON_NUMBERS_FLOAT64
+	// (default), JSON_NUMBERS_INT64, or JSON_NUMBERS_JSON_NUMBER. It applies to
+	// Query, Stream, Get, GetByIds, DistinctValues, and Aggregate responses.
+	JSONNumbers int
+
+	// GenerateRequestIds makes the client send a new request ID (see NewRequestId)
+	// with every request, including each retry, that doesn't have one from
+	// WithRequestId. WriteResult.RequestId is the ID of the request that returned
+	// it. The default, false, sends only request IDs from WithRequestId.
+	GenerateRequestIds bool
+
+	// IdempotentInserts makes the client generate an idempotency key (see
+	// WithIdempotencyKey) for each Insert and InsertBatch batch that doesn't have
+	// one. The key is generated per call, not per try: every retry sends the same
+	// key. It doesn't enable retries; set RetryPolicy.RetryInserts for that. The
+	// server dedupes retries only in memory, per server instance, and within its
+	// idempotency window, so a retry can still insert duplicate entities.
+	IdempotentInserts bool
+
+	// MaxResponseBytes limits the size of API responses. If a response is larger,
+	// the request fails with an error that wraps ErrResponseTooLarge, and it's not
+	// retried. The limit applies to the response body as received, before gzip
+	// decompression, and to the decompressed body. The default, zero, is no limit.
+	MaxResponseBytes int64
+
+	// MutateMaxTries is the maximum number of read-modify-write tries by MutateById.
+	// The default, zero, is MUTATE_MAX_TRIES.
+	MutateMaxTries int
+
+	// StreamNDJSON makes Stream request all matching entities, starting at
+	// filter.Offset, in one request as newline-delimited JSON (NDJSON), one entity
+	// per line, and decode one entity at a time as the iterator advances, so memory
+	// use is constant and the first entities are returned before the API sends the
+	// last. filter.Limit is ignored. Unlike paging, the API reads all entities at
+	// once, so an entity is returned once. If the API doesn't support NDJSON, it
+	// returns all entities as a JSON array, which is decoded at once, so memory
+	// use is not constant. MaxResponseBytes does not apply to NDJSON responses,
+	// and Observer, Tracer, and Latency durations end when the response starts.
+	StreamNDJSON bool
+
+	// UserAgent is sent in header User-Agent with every request to identify the
+	// calling app in server logs, like "my-app/1.2". The default is DEFAULT_USER_AGENT.
+	UserAgent string
+
+	// Headers are sent with every request, like a header for a proxy. They cannot
+	// override headers set by the client: headers prefixed X-Etre- are ignored,
+	// and standard headers that the client sets, like Content-Type and User-Agent
+	// (see UserAgent), replace the values in Headers.
+	Headers map[string]string
+
+	// Clock is the time source for client-side timing: Latency, Stats, Observer
+	// and Tracer durations, the CircuitBreaker cooldown, and the LabelsCacheTTL and
+	// QueryCacheTTL expirations, the waits between retries (RetryWait and
+	// RetryPolicy backoff) and whether the next retry is before the context
+	// deadline, and the rate limit waits passed to OnRateLimit. It's for tests
+	// that need deterministic time, so most callers should not set it. Context
+	// deadlines and the rate limiters themselves use real time. The default is
+	// the system clock.
+	Clock Clock
+}
+
+// Clock is a time source. See EntityClientConfig.Clock and CDCClientConfig.Clock.
+// Its methods are like the time functions of the same names, and they must be
+// safe for concurrent use.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// systemClock is the default Clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+// Observer observes EntityClient requests. ObserveRequest is called after every
+// request, including each retry, with the operation, the round-trip time (the same
+// as Latency.RTT), and the error, if any. The error is a network error or, if the
+// API returned an error, the same error returned by the EntityClient method (e.g.
+// errors.Is(err, ErrDBError) works). The op is one of: query, count, get, labels,
+// status, insert, update, delete, delete-label. ObserveRequest must be safe for
+// concurrent use and should not block.
+//
+// Observer decouples the client from metrics packages. For example, an Observer
+// can increment a Prometheus counter by op and error, and observe the duration
+// in a histogram by op.
+type Observer interface {
+	ObserveRequest(op string, duration time.Duration, err error)
+}
+
+// CacheObserver is an Observer that also observes the query cache (see
+// EntityClientConfig.QueryCacheSize). If EntityClientConfig.Observer implements
+// it, ObserveCache is called after every cached query that succeeds with the op
+// (query) and hit, which is true if the cached result was returned: because it
+// was within EntityClientConfig.QueryCacheTTL (no request), or because the API
+// returned 304 Not Modified. Like ObserveRequest, it must be safe for
+// concurrent use and should not block.
+type CacheObserver interface {
+	Observer
+	ObserveCache(op string, hit bool)
+}
+
+// Tracer traces EntityClient requests, like an OpenTelemetry tracer and propagator.
+// It's an interface so that the etre package does not depend on OpenTelemetry.
+// For every request, including each retry, the client calls Start with the request
+// context (from a Context method like QueryContext, or WithContext) and the op
+// (see Observer), then Inject with the returned context, then sends the request,
+// then calls the returned end func with the error, if any (see Observer).
+//
+// With OpenTelemetry, Start calls tracer.Start(ctx, "etre."+op) with span kind
+// client, and end records the error and ends the span. Inject calls
+// otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+// to send the W3C traceparent header.
+type Tracer interface {
+	Start(ctx context.Context, op string) (context.Context, func(err error))
+	Inject(ctx context.Context, header http.Header)
+}
+
+// TokenProvider returns the current bearer token for EntityClientConfig.TokenProvider.
+// The implementation caches and refreshes the token, like an OAuth2 token source,
+// so Token should be fast when the cached token is valid. An error fails the request.
+// Token must be safe for concurrent use.
+type TokenProvider interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// TokenRefresher is a TokenProvider that can invalidate a token that the API
+// rejected (HTTP 401 Unauthorized), so the next call to Token returns a new one.
+// InvalidateToken is called with the rejected token; it should be ignored if the
+// provider already has a different token, which another request refreshed.
+type TokenRefresher interface {
+	TokenProvider
+	InvalidateToken(token string)
+}
+
+// Middleware wraps an http.RoundTripper to add behavior to every request made by
+// an EntityClient (see EntityClientConfig.Middleware), like refreshing auth tokens
+// or logging. A RoundTripper must not change the request it's given (see
+// http.RoundTripper), so clone it to set headers:
+//
+//	func auth(next http.RoundTripper) http.RoundTripper {
+//		return etre.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+//			req = req.Clone(req.Context())
+//			req.Header.Set("Authorization", "Bearer "+token())
+//			return next.RoundTrip(req)
+//		})
+//	}
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc is an http.RoundTripper func, like http.HandlerFunc, to make
+// a Middleware.
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls f(req).
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// RateLimiter limits the rate of client requests. Wait blocks until a request is
+// allowed or the context is done. It's implemented by *rate.Limiter from package
+// golang.org/x/time/rate, or use NewRateLimiter for a simple requests-per-second limit.
+type RateLimiter interface {
+	Wait(ctx context.Context) error
+}
+
+// NewRateLimiter returns a RateLimiter that allows perSecond requests per second,
+// evenly spaced (no bursts). It's safe for use by multiple clients and goroutines.
+func NewRateLimiter(perSecond int) RateLimiter {
+	if perSecond <= 0 {
+		panic("etre.NewRateLimiter: perSecond must be greater than zero")
+	}
+	return &rateLimiter{
+		interval: time.Second / time.Duration(perSecond),
+	}
+}
+
+type rateLimiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time // next allowed request
+}
+
+func (r *rateLimiter) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	if deadline, ok := ctx.Deadline(); ok && now.Add(wait).After(deadline) {
+		r.mu.Unlock()
+		return context.DeadlineExceeded
+	}
+	r.next = r.next.Add(r.interval) // reserve the slot
+	r.mu.Unlock()
+	if wait == 0 {
+		return nil
+	}
+
+	// Release the slot if the request isn't sent (ctx done while waiting), else
+	// canceled requests push back every later request
+	sent := false
+	defer func() {
+		if !sent {
+			r.release()
+		}
+	}()
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		sent = true
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release returns a slot reserved by Wait that wasn't used, so the next request
+// can have it.
+func (r *rateLimiter) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next = r.next.Add(-r.interval)
+}
+
+// CircuitBreaker stops the client sending requests while the API is failing, so
+// callers fail fast instead of waiting on requests that will time out. After
+// Failures consecutive failed requests, the circuit opens: requests, including
+// retries, return ErrCircuitOpen without being sent. After Cooldown, the circuit
+// is half-open: one request is sent to probe the API while others return
+// ErrCircuitOpen. If the probe succeeds, the circuit closes and requests are sent
+// again, else it opens for another Cooldown.
+//
+// A failed request is a network error, including ErrClientTimeout, or an HTTP
+// 5xx response. API client errors (HTTP 4xx) are not failures because the API is
+// up, and requests aborted by the caller (context cancelled) are not counted.
+//
+// The circuit is shared by the client and its copies (e.g. from WithContext), and
+// by the clients from NewEntityClients. If EntityClientConfig.Observer is a
+// CircuitObserver, it observes every change of circuit state.
+type CircuitBreaker struct {
+	Failures int           // consecutive failures that open the circuit; zero disables the breaker
+	Cooldown time.Duration // time open before a probe; default: DEFAULT_CIRCUIT_COOLDOWN
+}
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState string
+
+const (
+	CIRCUIT_CLOSED    CircuitState = "closed"    // requests are sent
+	CIRCUIT_OPEN      CircuitState = "open"      // requests return ErrCircuitOpen
+	CIRCUIT_HALF_OPEN CircuitState = "half-open" // one probe request is sent
+)
+
+const DEFAULT_CIRCUIT_COOLDOWN = 10 * time.Second
+
+// CircuitObserver is an Observer that also observes the circuit breaker (see
+// EntityClientConfig.CircuitBreaker). If EntityClientConfig.Observer implements
+// it, ObserveCircuit is called with the new state every time the state changes.
+// Like ObserveRequest, it must be safe for concurrent use and should not block.
+type CircuitObserver interface {
+	Observer
+	ObserveCircuit(state CircuitState)
+}
+
+// circuitBreaker implements CircuitBreaker. It's a pointer in entityClient so
+// that copies share it.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+	observer CircuitObserver // optional
+	clock    Clock
+	mu       sync.Mutex
+	state    CircuitState
+	n        int       // consecutive failures
+	probeAt  time.Time // when open, time to go half-open
+	probing  bool      // when half-open, probe request sent
+}
+
+func newCircuitBreaker(cb CircuitBreaker, o Observer, clock Clock) *circuitBreaker {
+	if cb.Failures <= 0 {
+		return nil
+	}
+	if cb.Cooldown <= 0 {
+		cb.Cooldown = DEFAULT_CIRCUIT_COOLDOWN
+	}
+	co, _ := o.(CircuitObserver)
+	return &circuitBreaker{
+		failures: cb.Failures,
+		cooldown: cb.Cooldown,
+		observer: co,
+		clock:    clock,
+		state:    CIRCUIT_CLOSED,
+	}
+}
+
+// allow returns ErrCircuitOpen if the request must not be sent. If it returns
+// nil, the caller must call done or cancel after the request.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	switch b.state {
+	case CIRCUIT_OPEN:
+		if b.clock.Now().Before(b.probeAt) {
+			b.mu.Unlock()
+			return ErrCircuitOpen
+		}
+		b.state = CIRCUIT_HALF_OPEN
+		b.probing = true
+		b.mu.Unlock()
+		b.observe(CIRCUIT_HALF_OPEN)
+		return nil
+	case CIRCUIT_HALF_OPEN:
+		if b.probing {
+			b.mu.Unlock()
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+// done records the result of an allowed request.
+func (b *circuitBreaker) done(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	prev := b.state
+	b.probing = false
+	if failed {
+		b.n++
+		if b.state == CIRCUIT_HALF_OPEN || b.n >= b.failures {
+			b.state = CIRCUIT_OPEN
+			b.probeAt = b.clock.Now().Add(b.cooldown)
+		}
+	} else {
+		b.n = 0
+		b.state = CIRCUIT_CLOSED
+	}
+	state := b.state
+	b.mu.Unlock()
+	if state != prev {
+		b.observe(state)
+	}
+}
+
+// cancel releases an allowed request that was not sent or was aborted by the
+// caller, so its result is unknown.
+func (b *circuitBreaker) cancel() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) observe(state CircuitState) {
+	if b.observer != nil {
+		b.observer.ObserveCircuit(state)
+	}
+}
+
+// RetryPolicy retries idempotent operations on network errors and HTTP 5xx responses
+// with jittered exponential backoff: the first retry waits up to BaseDelay, and each
+// retry after that waits up to twice as long as the previous, but not more than MaxDelay.
+// Idempotent operations are Query, Get, Labels, and Update and Delete with a query that
+// matches an exact revision (e.g. "_id=abc,_rev=3"), which can only succeed once.
+// Other writes are not retried, except Insert if RetryInserts is true.
+//
+// Retries stop when the request context is cancelled or its deadline would be
+// exceeded before the next retry.
+type RetryPolicy struct {
+	MaxRetries int           // retries after first try; zero disables the policy
+	BaseDelay  time.Duration // default: 100ms
+	MaxDelay   time.Duration // default: 10s
+
+	// RetryInserts retries Insert. Inserts are not idempotent: if the server
+	// inserted the entities but the client did not receive the response, a
+	// retry inserts duplicate entities (or fails on a unique index), unless the
+	// insert has an idempotency key (see WithIdempotencyKey) and the retry goes
+	// to the same server instance within its idempotency window.
+	RetryInserts bool
+
+	// OnRetry is called before each retry with the number of attempts made so
+	// far, the error from the last attempt, and the wait before the next attempt.
+	OnRetry func(attempts int, err error, wait time.Duration)
+}
+
+const (
+	DEFAULT_INSERT_BATCH_SIZE       = 1000
+	INSERT_STREAM_BUFFER            = 1000 // entities sent by InsertStream before API results
+	DEFAULT_STREAM_PAGE_SIZE        = 1000
+	DEFAULT_QUERY_CACHE_SIZE        = 100 // if only EntityClientConfig.QueryCacheTTL is set
+	DEFAULT_BATCH_QUERY_CONCURRENCY = 4
+	DEFAULT_LATENCY_EMA_ALPHA       = 0.2
+	DEFAULT_RETRY_BASE_DELAY        = 100 * time.Millisecond
+	DEFAULT_RETRY_MAX_DELAY         = 10 * time.Second
+	UPSERT_MAX_TRIES                = 3
+	MUTATE_MAX_TRIES                = 3
+	DEFAULT_USER_AGENT              = "etre-go/" + VERSION
+)
+
+// backoff returns the jittered wait before the given retry, where 1 is the first retry.
+func (p RetryPolicy) backoff(retryNo int) time.Duration {
+	base := p.BaseDelay
+	if base <= 0 {
+		base = DEFAULT_RETRY_BASE_DELAY
+	}
+	max := p.MaxDelay
+	if max <= 0 {
+		max = DEFAULT_RETRY_MAX_DELAY
+	}
+	d := base
+	for i := 1; i < retryNo && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	// Wait between d/2 and d so that many clients don't retry in lockstep
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
 
 // EntityClients represents type-specific entity clients keyed on user-defined const
@@ -107,18 +987,204 @@ type EntityClientConfig struct {
 // Using EntityClients and const entity types is optional but helps avoid typos.
 type EntityClients map[string]EntityClient
 
+// QueryTypes queries the entity types concurrently and returns matching entities
+// grouped by type. If entityTypes is empty, all types in the map are queried. On
+// partial failure, it returns the results of the types that succeeded and an error
+// that joins the errors of the types that failed, each prefixed with the type;
+// use errors.Is to check for a specific error. An entity type not in the map is
+// an error (ErrTypeMismatch), as is an entity with a different _type.
+func (ec EntityClients) QueryTypes(ctx context.Context, entityTypes []string, query string, filter QueryFilter) (map[string][]Entity, error) {
+	if len(entityTypes) == 0 {
+		for entityType := range ec {
+			entityTypes = append(entityTypes, entityType)
+		}
+		sort.Strings(entityTypes) // deterministic error order
+	}
+
+	type result struct {
+		entities []Entity
+		err      error
+	}
+	results := make([]result, len(entityTypes))
+	var wg sync.WaitGroup
+	for i, entityType := range entityTypes {
+		c, ok := ec[entityType]
+		if !ok {
+			results[i].err = fmt.Errorf("%s: no client for entity type: %w", entityType, ErrTypeMismatch)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, entityType string, c EntityClient) {
+			defer wg.Done()
+			entities, err := c.QueryContext(ctx, query, filter)
+			if err != nil {
+				results[i].err = fmt.Errorf("%s: %w", entityType, err)
+				return
+			}
+			for _, e := range entities {
+				if t, ok := e.TypeOK(); ok && t != entityType {
+					results[i].err = fmt.Errorf("%s: entity has _type %s: %w", entityType, t, ErrTypeMismatch)
+					return
+				}
+			}
+			results[i].entities = entities
+		}(i, entityType, c)
+	}
+	wg.Wait()
+
+	entities := map[string][]Entity{}
+	var errs []error
+	for i, entityType := range entityTypes {
+		if results[i].err != nil {
+			errs = append(errs, results[i].err)
+			continue
+		}
+		entities[entityType] = results[i].entities
+	}
+	return entities, errors.Join(errs...)
+}
+
 // Internal implementation of EntityClient interface using http.Client. See NewEntityClient.
 type entityClient struct {
-	entityType       string
-	addr             string
-	httpClient       *http.Client
-	set              Set
-	traceHeaderValue string
-	retry            uint
-	retryWait        time.Duration
-	retryLogging     bool
-	queryTimeout     time.Duration
-	ctx              context.Context
+	entityType    string
+	addr          string
+	httpClient    *http.Client
+	transport     *http.Transport // made by the client, so Close closes its idle connections
+	set           Set
+	trace         TraceContext
+	traceStr      string // WithTrace string, sent as-is
+	retry         uint
+	retryWait     time.Duration
+	retryLogging  bool
+	queryTimeout  time.Duration
+	retryPolicy   RetryPolicy
+	ctx           context.Context
+	latency       *Latency
+	logger        Logger
+	dbg           bool
+	queryLimiter  RateLimiter
+	writeLimiter  RateLimiter
+	onRateLimit   func(string, time.Duration)
+	breaker       *circuitBreaker
+	writeOpts     WriteOptions
+	observer      Observer
+	tracer        Tracer
+	compressMin   int
+	noCompress    bool
+	labelsCache   *labelsCache
+	baseURL       string
+	bsonResp      bool // ResponseFormat is RESPONSE_FORMAT_BSON
+	jsonNumbers   int
+	genReqIds     bool
+	maxResp       int64
+	queryCache    *queryCache
+	ifNoneMatch   string // set only by QueryContext
+	idemKey       string // set only by InsertContext
+	idemInserts   bool
+	mutateTries   int
+	userAgent     string
+	headers       http.Header
+	closed        *atomic.Bool // shared by copies
+	stats         *clientStats // shared by copies
+	ndjson        bool         // StreamNDJSON
+	tokens        TokenProvider
+	setGen        SetGenerator
+	schema        *Schema
+	defaultFilter QueryDefaults
+	queryPage     int       // QueryPageSize
+	batchQueries  int       // BatchQueryConcurrency
+	tokenRetry    bool      // set only by do: retrying with a new token after 401
+	stream        bool      // set only by streamNDJSON: do returns NDJSON body unread
+	body          io.Reader // set only by InsertStream: do sends it as NDJSON request body
+	clock         Clock     // nil for system clock, see now
+}
+
+// labelsCache caches AllLabels. It's a pointer in entityClient so that copies
+// share it.
+type labelsCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	labels  []string
+	expires time.Time
+}
+
+// clientStats implements Stats. It's a pointer in entityClient so that copies
+// share it.
+type clientStats struct {
+	alpha    float64
+	sendRecv bool // LatencyEMASendRecv
+	mu       sync.Mutex
+	stats    ClientStats
+}
+
+// queryCache caches query results by ETag and, if ttl is set, for ttl. It's a
+// pointer in entityClient so that copies share it. The oldest entry is first
+// in keys.
+type queryCache struct {
+	size    int
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]queryCacheEntry
+	keys    []string
+}
+
+type queryCacheEntry struct {
+	query    string // as passed to Query, for InvalidateQueryCache
+	etag     string
+	entities []Entity
+	expires  time.Time // zero if no ttl
+}
+
+func newQueryCache(size int, ttl time.Duration) *queryCache {
+	if size <= 0 {
+		if ttl <= 0 {
+			return nil
+		}
+		size = DEFAULT_QUERY_CACHE_SIZE
+	}
+	return &queryCache{size: size, ttl: ttl, entries: map[string]queryCacheEntry{}}
+}
+
+func (qc *queryCache) get(key string) (queryCacheEntry, bool) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	e, ok := qc.entries[key]
+	return e, ok
+}
+
+func (qc *queryCache) put(key string, e queryCacheEntry) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	if _, ok := qc.entries[key]; !ok {
+		if len(qc.keys) >= qc.size {
+			delete(qc.entries, qc.keys[0])
+			qc.keys = qc.keys[1:]
+		}
+		qc.keys = append(qc.keys, key)
+	}
+	qc.entries[key] = e
+}
+
+// invalidate removes the entries of queries that match the pattern, or all
+// entries if pattern is empty, and returns the number removed.
+func (qc *queryCache) invalidate(pattern string) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, err
+	}
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	keys := qc.keys[:0]
+	n := 0
+	for _, key := range qc.keys {
+		if match, _ := path.Match(pattern, qc.entries[key].query); pattern == "" || match {
+			delete(qc.entries, key)
+			n++
+			continue
+		}
+		keys = append(keys, key)
+	}
+	qc.keys = keys
+	return n, nil
 }
 
 // NewEntityClient creates a new type-specific Etre API client that makes requests
@@ -131,21 +1197,284 @@ func NewEntityClient(entityType, addr string, httpClient *http.Client) EntityCli
 		entityType: entityType,
 		addr:       addr,
 		httpClient: httpClient,
+		closed:     &atomic.Bool{},
+		stats:      newClientStats(0, false),
 	}
 	return c
 }
 
 func NewEntityClientWithConfig(c EntityClientConfig) EntityClient {
+	httpClient, transport := c.newHTTPClient()
+	client := newEntityClient(c, httpClient)
+	client.transport = transport
+	return client
+}
+
+// NewEntityClients creates an EntityClients map with a client for each entity type
+// configured by c, except c.EntityType is ignored. The clients share one http.Client
+// and transport, so they share connections to the Etre server, and they share the
+// CircuitBreaker circuit, if any. See EntityClients.QueryTypes.
+func NewEntityClients(entityTypes []string, c EntityClientConfig) EntityClients {
+	httpClient, transport := c.newHTTPClient()
+	breaker := newCircuitBreaker(c.CircuitBreaker, c.Observer, c.clock()) // shared, like httpClient
+	ec := EntityClients{}
+	for _, entityType := range entityTypes {
+		c.EntityType = entityType
+		client := newEntityClient(c, httpClient)
+		client.transport = transport
+		client.breaker = breaker
+		ec[entityType] = client
+	}
+	return ec
+}
+
+func newEntityClient(c EntityClientConfig, httpClient *http.Client) entityClient {
 	DebugEnabled = c.Debug
 	return entityClient{
-		entityType:   c.EntityType,
-		addr:         c.Addr,
-		httpClient:   c.HTTPClient,
-		retry:        c.Retry,
-		retryWait:    c.RetryWait,
-		retryLogging: c.RetryLogging,
-		queryTimeout: c.QueryTimeout,
+		entityType:    c.EntityType,
+		addr:          c.Addr,
+		httpClient:    httpClient,
+		retry:         c.Retry,
+		retryWait:     c.RetryWait,
+		retryLogging:  c.RetryLogging,
+		queryTimeout:  c.QueryTimeout,
+		retryPolicy:   c.RetryPolicy,
+		logger:        c.Logger,
+		dbg:           c.Debug,
+		trace:         c.Trace,
+		queryLimiter:  c.QueryLimiter,
+		writeLimiter:  c.WriteLimiter,
+		onRateLimit:   c.OnRateLimit,
+		breaker:       newCircuitBreaker(c.CircuitBreaker, c.Observer, c.clock()),
+		observer:      c.Observer,
+		tracer:        c.Tracer,
+		compressMin:   c.CompressRequests,
+		noCompress:    c.DisableCompression,
+		labelsCache:   newLabelsCache(c.LabelsCacheTTL),
+		baseURL:       c.BaseURL,
+		bsonResp:      c.ResponseFormat == RESPONSE_FORMAT_BSON,
+		jsonNumbers:   c.JSONNumbers,
+		genReqIds:     c.GenerateRequestIds,
+		idemInserts:   c.IdempotentInserts,
+		maxResp:       c.MaxResponseBytes,
+		queryCache:    newQueryCache(c.QueryCacheSize, c.QueryCacheTTL),
+		mutateTries:   c.MutateMaxTries,
+		userAgent:     c.UserAgent,
+		headers:       customHeaders(c.Headers),
+		ndjson:        c.StreamNDJSON,
+		tokens:        c.TokenProvider,
+		setGen:        c.SetGenerator,
+		schema:        c.Schema,
+		defaultFilter: c.DefaultQueryFilter,
+		queryPage:     c.QueryPageSize,
+		batchQueries:  c.BatchQueryConcurrency,
+		closed:        &atomic.Bool{},
+		stats:         newClientStats(c.LatencyEMAAlpha, c.LatencyEMASendRecv),
+		clock:         c.Clock,
+	}
+}
+
+// clock returns Clock or, if not set, the system clock.
+func (c EntityClientConfig) clock() Clock {
+	if c.Clock == nil {
+		return systemClock{}
+	}
+	return c.Clock
+}
+
+// now returns the current time from the client clock.
+func (c entityClient) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
+
+// after returns a channel that receives after d, like time.After, in Clock time.
+func (c entityClient) after(d time.Duration) <-chan time.Time {
+	if c.clock == nil {
+		return time.After(d)
+	}
+	return c.clock.After(d)
+}
+
+// customHeaders returns EntityClientConfig.Headers without X-Etre- headers,
+// which are reserved for the client.
+func customHeaders(h map[string]string) http.Header {
+	if len(h) == 0 {
+		return nil
+	}
+	headers := http.Header{}
+	for k, v := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(k), "X-Etre-") {
+			continue
+		}
+		headers.Set(k, v)
+	}
+	return headers
+}
+
+func newClientStats(alpha float64, sendRecv bool) *clientStats {
+	if alpha <= 0 || alpha > 1 {
+		alpha = DEFAULT_LATENCY_EMA_ALPHA
+	}
+	return &clientStats{alpha: alpha, sendRecv: sendRecv}
+}
+
+// observe counts a request and, if it has a response, adds its latency to the
+// EMAs. Send and recv are added only if sendRecv is true and they're measured,
+// which they're not for NDJSON streams. The first response sets the EMAs.
+func (s *clientStats) observe(resp bool, rtt, send, recv time.Duration, err bool) {
+	if s == nil {
+		return // zero value entityClient
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Requests++
+	if err {
+		s.stats.Errors++
+	}
+	if !resp {
+		return
+	}
+	ema := func(avg, d time.Duration) time.Duration {
+		if s.stats.Responses == 0 {
+			return d
+		}
+		return time.Duration(s.alpha*float64(d) + (1-s.alpha)*float64(avg))
+	}
+	s.stats.RTT = ema(s.stats.RTT, rtt)
+	if s.sendRecv && (send > 0 || recv > 0) {
+		s.stats.Send = ema(s.stats.Send, send)
+		s.stats.Recv = ema(s.stats.Recv, recv)
+	}
+	s.stats.Responses++
+}
+
+func (c entityClient) Stats() ClientStats {
+	if c.stats == nil {
+		return ClientStats{}
+	}
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+	return c.stats.stats
+}
+
+func newLabelsCache(ttl time.Duration) *labelsCache {
+	if ttl <= 0 {
+		return nil
 	}
+	return &labelsCache{ttl: ttl}
+}
+
+// newHTTPClient returns HTTPClient or, if TLS or connection pool options are set,
+// a copy with those options set on a copy of its transport. Then, if Middleware
+// is set, it returns a copy with the transport wrapped by the middleware.
+func (c EntityClientConfig) newHTTPClient() (*http.Client, *http.Transport) {
+	httpClient := c.HTTPClient
+	var transport *http.Transport
+	if c.TLSConfig != nil || c.MaxIdleConns > 0 || c.MaxIdleConnsPerHost > 0 || c.IdleConnTimeout > 0 {
+		httpClient, transport = withTransport(httpClient, func(t *http.Transport) {
+			if c.TLSConfig != nil {
+				t.TLSClientConfig = c.TLSConfig
+			}
+			if c.MaxIdleConns > 0 {
+				t.MaxIdleConns = c.MaxIdleConns
+			}
+			if c.MaxIdleConnsPerHost > 0 {
+				t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+			}
+			if c.IdleConnTimeout > 0 {
+				t.IdleConnTimeout = c.IdleConnTimeout
+			}
+		})
+	}
+	if len(c.Middleware) > 0 {
+		var cp http.Client
+		if httpClient != nil {
+			cp = *httpClient
+		}
+		rt := cp.Transport
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		for i := len(c.Middleware) - 1; i >= 0; i-- {
+			rt = c.Middleware[i](rt)
+		}
+		cp.Transport = rt
+		httpClient = &cp
+	}
+	return httpClient, transport
+}
+
+// withTransport returns a copy of httpClient with a copy of its transport modified
+// by set, and the copy of the transport, if possible. Else, it returns httpClient
+// and nil.
+func withTransport(httpClient *http.Client, set func(*http.Transport)) (*http.Client, *http.Transport) {
+	var cp http.Client
+	if httpClient != nil {
+		cp = *httpClient
+	}
+	var t *http.Transport
+	switch rt := cp.Transport.(type) {
+	case nil:
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		t = rt.Clone()
+	default:
+		return httpClient, nil // custom transport, caller must configure it
+	}
+	set(t)
+	cp.Transport = t
+	return &cp, t
+}
+
+// NewTLSConfig returns a TLS config for EntityClientConfig.TLSConfig and
+// CDCClientConfig.TLSConfig. certFile and keyFile are the client certificate
+// and key for mTLS, and caFile is the CA bundle to verify the server. Each is
+// optional, but certFile and keyFile must be both set or both empty. To set
+// ServerName or InsecureSkipVerify, set them on the returned config.
+func NewTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("TLS cert and key must both be set: cert=%s key=%s", certFile, keyFile)
+	}
+	tlsConfig := &tls.Config{}
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no PEM certificates in TLS CA file %s", caFile)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// autoSet returns a copy of c with the Set from the SetGenerator for a write of
+// n entities, if c has a SetGenerator, n > 1, and c doesn't have a Set.
+func (c entityClient) autoSet(op string, n int) (entityClient, error) {
+	if c.setGen == nil || n < 2 || c.set.Size > 0 {
+		return c, nil
+	}
+	set := c.setGen(op, n)
+	if set.Id == "" && set.Op == "" {
+		return c, nil // SetGenerator returned no set
+	}
+	if set.Id == "" || set.Op == "" || set.Size != n {
+		return c, fmt.Errorf("invalid Set from SetGenerator: %+v: Id and Op must be set, and Size must be %d", set, n)
+	}
+	c.set = set // copy on write
+	return c, nil
 }
 
 func (c entityClient) WithSet(set Set) EntityClient {
@@ -157,33 +1486,1425 @@ func (c entityClient) WithSet(set Set) EntityClient {
 
 func (c entityClient) WithTrace(trace string) EntityClient {
 	new := c
-	new.traceHeaderValue = trace
+	new.trace = ParseTraceContext(trace)
+	new.traceStr = trace
 	return new
 }
 
-func (c entityClient) WithContext(ctx context.Context) EntityClient {
-	new := c
-	new.ctx = ctx
-	return new
+func (c entityClient) WithTraceContext(trace TraceContext) EntityClient {
+	new := c
+	new.trace = trace
+	new.traceStr = ""
+	return new
+}
+
+func (c entityClient) WithContext(ctx context.Context) EntityClient {
+	new := c
+	new.ctx = ctx
+	return new
+}
+
+func (c entityClient) WithLatency(lat *Latency) EntityClient {
+	new := c
+	new.latency = lat
+	return new
+}
+
+func (c entityClient) WithWriteOptions(opts WriteOptions) EntityClient {
+	new := c
+	new.writeOpts = opts
+	return new
+}
+
+func (c entityClient) Query(query string, filter QueryFilter) ([]Entity, error) {
+	return c.QueryContext(c.Context(), query, filter)
+}
+
+func (c entityClient) QueryContext(ctx context.Context, query string, filter QueryFilter) ([]Entity, error) {
+	filter = filter.withDefaults(c.defaultFilter)
+	if c.queryPage > 0 && filter.Limit == 0 {
+		return c.queryPages(ctx, query, filter)
+	}
+	return c.doQuery(ctx, query, filter)
+}
+
+// queryPages implements QueryContext with EntityClientConfig.QueryPageSize.
+func (c entityClient) queryPages(ctx context.Context, query string, filter QueryFilter) ([]Entity, error) {
+	if len(filter.Sort) == 0 {
+		filter.Sort = []string{META_LABEL_ID} // stable paging, like Stream
+	}
+	filter.Limit = c.queryPage
+	var all []Entity
+	seen := map[string]bool{}
+	for {
+		page, err := c.doQuery(ctx, query, filter)
+		if err != nil {
+			return nil, err
+		}
+		if all == nil && len(page) < filter.Limit {
+			return page, nil // one page, same as without paging
+		}
+		for _, e := range page {
+			if id, ok := e.IdOK(); ok {
+				if seen[id] {
+					continue // shifted into this page by an insert
+				}
+				seen[id] = true
+			}
+			all = append(all, e)
+		}
+		if len(page) < filter.Limit {
+			return all, nil
+		}
+		filter.Offset += len(page)
+	}
+}
+
+// doQuery implements QueryContext without EntityClientConfig.DefaultQueryFilter,
+// for methods that already applied it.
+func (c entityClient) doQuery(ctx context.Context, query string, filter QueryFilter) ([]Entity, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	if query == "" {
+		return nil, ErrNoQuery
+	}
+	c.debug("query='%s', filter=%+v", query, filter)
+	if err := validateFilter(query, filter); err != nil {
+		return nil, err
+	}
+	if filter.Timeout > 0 {
+		c.queryTimeout = filter.Timeout // copy on write
+	}
+	path := c.queryPath(query, filter)
+
+	// Return the cached result if it hasn't expired, else send its ETag, if any.
+	// The path is the cache key because it encodes the query and filter. Strong
+	// and read-your-writes reads must see the latest data, so they're never
+	// served from the cache without a request: they only revalidate by ETag.
+	useTTL := filter.Consistency != CONSISTENCY_STRONG && filter.Consistency != CONSISTENCY_READ_YOUR_WRITES
+	var cached queryCacheEntry
+	if c.queryCache != nil {
+		cached, _ = c.queryCache.get(path)
+		if useTTL && c.now().Before(cached.expires) {
+			if co, ok := c.observer.(CacheObserver); ok {
+				co.ObserveCache("query", true)
+			}
+			return CloneAll(cached.entities), nil
+		}
+		c.ifNoneMatch = cached.etag // copy on write
+	}
+
+	var entities []Entity
+	var etag string
+	notModified := false
+	err := c.apiRetry(true, func() (bool, error) {
+		resp, bytes, err := c.do("GET", path, nil)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode == http.StatusNotModified && cached.etag != "" {
+			notModified = true
+			return true, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp, bytes)
+		}
+		etag = resp.Header.Get("ETag")
+		if isBSON(resp) {
+			entities, err = decodeBSON(bytes)
+			return err == nil, err
+		}
+		if len(bytes) > 0 {
+			if err := unmarshalJSON(bytes, &entities, c.jsonNumbers); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	if err != nil || c.queryCache == nil {
+		return entities, err
+	}
+	if co, ok := c.observer.(CacheObserver); ok {
+		co.ObserveCache("query", notModified)
+	}
+	var expires time.Time
+	if c.queryCache.ttl > 0 && useTTL {
+		expires = c.now().Add(c.queryCache.ttl)
+	}
+	if notModified {
+		cached.expires = expires
+		c.queryCache.put(path, cached)
+		return CloneAll(cached.entities), nil
+	}
+	if etag != "" || !expires.IsZero() {
+		c.queryCache.put(path, queryCacheEntry{query: query, etag: etag, entities: CloneAll(entities), expires: expires})
+	}
+	return entities, nil
+}
+
+// queryPath returns the GET /entities endpoint for the query and filter.
+func (c entityClient) queryPath(query string, filter QueryFilter) string {
+	query = sinceRevQuery(query, filter)
+	path := "/entities/" + c.entityType + "?query=" + url.QueryEscape(query) // always escape the query
+	if len(filter.ReturnLabels) > 0 {
+		rl := strings.Join(UniqueLabels(filter.ReturnLabels), ",")
+		path += "&labels=" + rl
+	}
+	if filter.Distinct {
+		path += "&distinct"
+	}
+	if len(filter.Sort) > 0 {
+		path += "&sort=" + strings.Join(filter.Sort, ",")
+	}
+	if filter.Limit > 0 {
+		path += "&limit=" + strconv.Itoa(filter.Limit)
+	}
+	if filter.Offset > 0 {
+		path += "&offset=" + strconv.Itoa(filter.Offset)
+	}
+	return path + deletedParam(filter) + consistencyParam(filter)
+}
+
+func (c entityClient) Count(query string, filter QueryFilter) (int64, error) {
+	return c.CountContext(c.Context(), query, filter)
+}
+
+func (c entityClient) CountContext(ctx context.Context, query string, filter QueryFilter) (int64, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	filter = filter.withDefaults(c.defaultFilter)
+	if query == "" {
+		return 0, ErrNoQuery
+	}
+	c.debug("query='%s', filter=%+v", query, filter)
+	if err := validateFilter(query, filter); err != nil {
+		return 0, err
+	}
+	if filter.Timeout > 0 {
+		c.queryTimeout = filter.Timeout // copy on write
+	}
+	query = sinceRevQuery(query, filter)
+
+	path := "/entities/" + c.entityType + "/count?query=" + url.QueryEscape(query) // always escape the query
+	if len(filter.ReturnLabels) > 0 {
+		path += "&labels=" + strings.Join(UniqueLabels(filter.ReturnLabels), ",")
+	}
+	if filter.Distinct {
+		path += "&distinct"
+	}
+	path += deletedParam(filter) + consistencyParam(filter)
+
+	var n int64
+	err := c.apiRetry(true, func() (bool, error) {
+		resp, bytes, err := c.do("GET", path, nil)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp, bytes)
+		}
+		if err := json.Unmarshal(bytes, &n); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	return n, err
+}
+
+func (c entityClient) DistinctValues(label, query string, filter QueryFilter) ([]interface{}, error) {
+	return c.DistinctValuesContext(c.Context(), label, query, filter)
+}
+
+func (c entityClient) DistinctValuesContext(ctx context.Context, label, query string, filter QueryFilter) ([]interface{}, error) {
+	return distinctValues(c.doQuery, ctx, label, query, filter.withDefaults(c.defaultFilter))
+}
+
+func (c entityClient) BatchQuery(ctx context.Context, requests []QueryRequest) ([]QueryResponse, error) {
+	// Queries run concurrently, and the Latency from WithLatency is not safe for
+	// concurrent use, so don't save latency
+	c.latency = nil // copy on write
+	return batchQuery(c.QueryContext, ctx, requests, c.batchQueries)
+}
+
+// batchQuery implements BatchQuery with queryFunc, at most concurrency (or
+// DEFAULT_BATCH_QUERY_CONCURRENCY) queries at a time.
+func batchQuery(queryFunc func(context.Context, string, QueryFilter) ([]Entity, error),
+	ctx context.Context, requests []QueryRequest, concurrency int) ([]QueryResponse, error) {
+	if len(requests) == 0 {
+		return nil, ErrNoQuery
+	}
+	if concurrency <= 0 {
+		concurrency = DEFAULT_BATCH_QUERY_CONCURRENCY
+	}
+	responses := make([]QueryResponse, len(requests))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, req := range requests {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			for j := i; j < len(requests); j++ {
+				responses[j].Err = ctx.Err()
+			}
+			wg.Wait()
+			return responses, ctx.Err()
+		}
+		wg.Add(1)
+		go func(i int, req QueryRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			responses[i].Entities, responses[i].Err = queryFunc(ctx, req.Query, req.Filter)
+		}(i, req)
+	}
+	wg.Wait()
+	return responses, ctx.Err()
+}
+
+// distinctValues implements DistinctValues with the query func of an EntityClient.
+func distinctValues(queryFunc func(context.Context, string, QueryFilter) ([]Entity, error),
+	ctx context.Context, label, query string, filter QueryFilter) ([]interface{}, error) {
+	if label == "" {
+		return nil, ErrNoLabel
+	}
+	if len(filter.ReturnLabels) > 1 || (len(filter.ReturnLabels) == 1 && filter.ReturnLabels[0] != label) {
+		return nil, fmt.Errorf("invalid QueryFilter: ReturnLabels must be empty or only label %s: %v", label, filter.ReturnLabels)
+	}
+	if query == "" {
+		query = label // all entities with the label
+	}
+	filter.ReturnLabels = []string{label}
+	filter.Distinct = true
+	filter.Sort = nil
+	entities, err := queryFunc(ctx, query, filter)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, 0, len(entities))
+	for _, e := range entities {
+		if v, ok := e[label]; ok {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+func (c entityClient) Aggregate(query string, groupBy []string, filter QueryFilter) ([]GroupResult, error) {
+	return c.AggregateContext(c.Context(), query, groupBy, filter)
+}
+
+func (c entityClient) AggregateContext(ctx context.Context, query string, groupBy []string, filter QueryFilter) ([]GroupResult, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	filter = filter.withDefaults(c.defaultFilter)
+	if query == "" {
+		return nil, ErrNoQuery
+	}
+	if err := validateGroupBy(groupBy); err != nil {
+		return nil, err
+	}
+	c.debug("query='%s', groupBy=%v, filter=%+v", query, groupBy, filter)
+	if err := validateFilter(query, filter); err != nil {
+		return nil, err
+	}
+	if filter.Timeout > 0 {
+		c.queryTimeout = filter.Timeout // copy on write
+	}
+	query = sinceRevQuery(query, filter)
+
+	path := "/entities/" + c.entityType + "/aggregate?query=" + url.QueryEscape(query) + // always escape the query
+		"&group=" + url.QueryEscape(strings.Join(groupBy, ","))
+	if filter.Limit > 0 {
+		path += "&limit=" + strconv.Itoa(filter.Limit)
+	}
+	if filter.Offset > 0 {
+		path += "&offset=" + strconv.Itoa(filter.Offset)
+	}
+	path += deletedParam(filter) + consistencyParam(filter)
+
+	var groups []GroupResult
+	err := c.apiRetry(true, func() (bool, error) {
+		resp, bytes, err := c.do("GET", path, nil)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp, bytes)
+		}
+		groups = nil
+		if err := unmarshalJSON(bytes, &groups, c.jsonNumbers); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	return groups, err
+}
+
+func (c entityClient) Explain(query string, filter QueryFilter) (QueryPlan, error) {
+	return c.ExplainContext(c.Context(), query, filter)
+}
+
+func (c entityClient) ExplainContext(ctx context.Context, query string, filter QueryFilter) (QueryPlan, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	filter = filter.withDefaults(c.defaultFilter)
+	if query == "" {
+		return QueryPlan{}, ErrNoQuery
+	}
+	c.debug("query='%s', filter=%+v", query, filter)
+	if err := validateFilter(query, filter); err != nil {
+		return QueryPlan{}, err
+	}
+	if filter.Timeout > 0 {
+		c.queryTimeout = filter.Timeout // copy on write
+	}
+	path := c.queryPath(query, filter)
+	path = "/entities/" + c.entityType + "/explain" + strings.TrimPrefix(path, "/entities/"+c.entityType)
+
+	var plan QueryPlan
+	err := c.apiRetry(true, func() (bool, error) {
+		resp, bytes, err := c.do("GET", path, nil)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp, bytes)
+		}
+		plan = QueryPlan{} // reset on retry
+		if err := json.Unmarshal(bytes, &plan); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	return plan, err
+}
+
+// validateGroupBy returns ErrNoLabel if groupBy is empty, else an error for the
+// first invalid or duplicate label.
+func validateGroupBy(groupBy []string) error {
+	if len(groupBy) == 0 {
+		return ErrNoLabel
+	}
+	seen := map[string]bool{}
+	for _, label := range groupBy {
+		if err := ValidateLabel(label); err != nil {
+			return err
+		}
+		if seen[label] {
+			return fmt.Errorf("duplicate group-by label: %s", label)
+		}
+		seen[label] = true
+	}
+	return nil
+}
+
+func (c entityClient) Stream(ctx context.Context, query string, filter QueryFilter) (*EntityIterator, error) {
+	if query == "" {
+		return nil, ErrNoQuery
+	}
+	filter = filter.withDefaults(c.defaultFilter)
+	if filter.Limit <= 0 {
+		filter.Limit = DEFAULT_STREAM_PAGE_SIZE
+	}
+	if len(filter.Sort) == 0 {
+		filter.Sort = []string{META_LABEL_ID}
+	}
+	if c.ndjson {
+		return c.streamNDJSON(ctx, query, filter)
+	}
+	it := &EntityIterator{
+		ctx: ctx,
+		read: func(offset int) ([]Entity, error) {
+			f := filter
+			f.Offset = offset
+			return c.doQuery(ctx, query, f)
+		},
+		pageSize: filter.Limit,
+		offset:   filter.Offset,
+	}
+	if err := it.readPage(); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// streamNDJSON implements Stream with EntityClientConfig.StreamNDJSON.
+func (c entityClient) streamNDJSON(ctx context.Context, query string, filter QueryFilter) (*EntityIterator, error) {
+	c.ctx = ctx     // copy on write, like WithContext
+	c.stream = true // copy on write
+	c.debug("stream query='%s', filter=%+v", query, filter)
+	if err := validateFilter(query, filter); err != nil {
+		return nil, err
+	}
+	if filter.Timeout > 0 {
+		c.queryTimeout = filter.Timeout // copy on write
+	}
+	filter.Limit = 0
+	path := c.queryPath(query, filter)
+
+	var it *EntityIterator
+	err := c.apiRetry(true, func() (bool, error) {
+		resp, bytes, err := c.do("GET", path, nil)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp, bytes)
+		}
+		if isNDJSON(resp) {
+			// do returned the body unread; the iterator reads and closes it
+			var r io.Reader = resp.Body
+			if resp.Header.Get("Content-Encoding") == "gzip" {
+				if r, err = gzip.NewReader(resp.Body); err != nil {
+					resp.Body.Close()
+					return false, fmt.Errorf("gzip: %s", err)
+				}
+			}
+			it = &EntityIterator{ctx: ctx, dec: json.NewDecoder(r), body: resp.Body, numbers: c.jsonNumbers}
+			return true, nil
+		}
+		// API doesn't support NDJSON: all entities in one response
+		var entities []Entity
+		if isBSON(resp) {
+			entities, err = decodeBSON(bytes)
+			if err != nil {
+				return false, err
+			}
+		} else if len(bytes) > 0 {
+			if err := unmarshalJSON(bytes, &entities, c.jsonNumbers); err != nil {
+				return false, err
+			}
+		}
+		it = &EntityIterator{ctx: ctx, page: entities, last: true}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// EntityIterator iterates over entities returned by EntityClient.Stream. It is
+// not safe for concurrent use. Call Next until it returns false, then check Err:
+//
+//	it, err := ec.Stream(ctx, "x=y", etre.QueryFilter{})
+//	if err != nil { ... }
+//	for it.Next() {
+//		e := it.Entity()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type EntityIterator struct {
+	ctx      context.Context
+	read     func(offset int) ([]Entity, error)
+	pageSize int
+	offset   int      // of next page
+	page     []Entity // current page
+	i        int      // index of next entity in page
+	entity   Entity
+	last     bool // current page is the last page
+	err      error
+
+	// NDJSON response (see EntityClientConfig.StreamNDJSON) instead of pages
+	dec     *json.Decoder
+	body    io.Closer
+	numbers int // EntityClientConfig.JSONNumbers
+}
+
+// NewEntityIterator returns an EntityIterator over the given entities. It is used
+// for testing, like MockEntityClient.StreamFunc.
+func NewEntityIterator(entities []Entity) *EntityIterator {
+	return &EntityIterator{ctx: context.Background(), page: entities, last: true}
+}
+
+// Next advances to the next entity, which is returned by Entity. It returns false
+// when there are no more entities, on error, or if the context is cancelled.
+func (it *EntityIterator) Next() bool {
+	it.entity = nil
+	if it.err != nil {
+		return false
+	}
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		it.Close()
+		return false
+	}
+	if it.dec != nil {
+		var raw json.RawMessage
+		if err := it.dec.Decode(&raw); err != nil {
+			if err != io.EOF {
+				it.err = fmt.Errorf("decoding NDJSON response: %w", err)
+			}
+			it.Close()
+			return false
+		}
+		var e Entity
+		if err := unmarshalJSON(raw, &e, it.numbers); err != nil {
+			it.err = fmt.Errorf("decoding NDJSON response: %w", err)
+			it.Close()
+			return false
+		}
+		it.entity = e
+		return true
+	}
+	if it.i == len(it.page) {
+		if it.last {
+			return false
+		}
+		if err := it.readPage(); err != nil {
+			it.err = err
+			return false
+		}
+		if len(it.page) == 0 {
+			return false
+		}
+	}
+	it.entity = it.page[it.i]
+	it.i++
+	return true
+}
+
+// Entity returns the current entity. It is nil before the first call to Next and
+// after Next returns false.
+func (it *EntityIterator) Entity() Entity {
+	return it.entity
+}
+
+// Err returns the error that stopped the iterator, or nil when all entities were
+// read. If not nil, the entities read before the error are partial results.
+func (it *EntityIterator) Err() error {
+	return it.err
+}
+
+// Close stops the iterator, so Next returns false. Call it if not calling Next
+// until it returns false, to close the NDJSON response, if any (see
+// EntityClientConfig.StreamNDJSON). It's safe to call more than once.
+func (it *EntityIterator) Close() error {
+	it.page = nil
+	it.i = 0
+	it.last = true
+	it.dec = nil
+	if it.body == nil {
+		return nil
+	}
+	err := it.body.Close()
+	it.body = nil
+	return err
+}
+
+func (it *EntityIterator) readPage() error {
+	page, err := it.read(it.offset)
+	if err != nil {
+		return err
+	}
+	it.page = page
+	it.i = 0
+	it.offset += len(page)
+	it.last = len(page) < it.pageSize // short page = no more entities
+	return nil
+}
+
+func (c entityClient) Get(id string) (Entity, error) {
+	return c.GetContext(c.Context(), id)
+}
+
+func (c entityClient) GetContext(ctx context.Context, id string) (Entity, error) {
+	return c.GetByIdContext(ctx, id, QueryFilter{})
+}
+
+func (c entityClient) GetById(id string, filter QueryFilter) (Entity, error) {
+	return c.GetByIdContext(c.Context(), id, filter)
+}
+
+func (c entityClient) GetByIdContext(ctx context.Context, id string, filter QueryFilter) (Entity, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	filter = filter.withDefaults(c.defaultFilter)
+	if id == "" {
+		return nil, ErrIdNotSet
+	}
+	if filter.Timeout > 0 {
+		c.queryTimeout = filter.Timeout // copy on write
+	}
+	if err := ValidateConsistency(filter.Consistency); err != nil {
+		return nil, fmt.Errorf("invalid QueryFilter: %s", err)
+	}
+	path := "/entity/" + c.entityType + "/" + url.PathEscape(id)
+	if len(filter.ReturnLabels) > 0 {
+		path += "?labels=" + strings.Join(UniqueLabels(filter.ReturnLabels), ",")
+	}
+	if filter.Consistency != "" {
+		if len(filter.ReturnLabels) > 0 {
+			path += consistencyParam(filter)
+		} else {
+			path += "?consistency=" + filter.Consistency
+		}
+	}
+	var entity Entity
+	err := c.apiRetry(true, func() (bool, error) {
+		resp, bytes, err := c.do("GET", path, nil)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp, bytes)
+		}
+		if isBSON(resp) {
+			entities, err := decodeBSON(bytes)
+			if err != nil {
+				return false, err
+			}
+			if len(entities) != 1 {
+				return false, fmt.Errorf("API returned %d entities, expected 1", len(entities))
+			}
+			entity = entities[0]
+			return true, nil
+		}
+		if len(bytes) > 0 {
+			if err := unmarshalJSON(bytes, &entity, c.jsonNumbers); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	return entity, err
+}
+
+func (c entityClient) GetByIds(ids []string, filter QueryFilter) (map[string]Entity, error) {
+	return c.GetByIdsContext(c.Context(), ids, filter)
+}
+
+func (c entityClient) GetByIdsContext(ctx context.Context, ids []string, filter QueryFilter) (map[string]Entity, error) {
+	return getByIds(c.doQuery, ctx, ids, filter.withDefaults(c.defaultFilter))
+}
+
+// getByIds implements GetByIds with the query func of an EntityClient.
+func getByIds(queryFunc func(context.Context, string, QueryFilter) ([]Entity, error),
+	ctx context.Context, ids []string, filter QueryFilter) (map[string]Entity, error) {
+	if len(ids) == 0 {
+		return nil, ErrNoEntity
+	}
+	for _, id := range ids {
+		if id == "" {
+			return nil, ErrIdNotSet
+		}
+	}
+	// _id is needed to key the map, so it's returned and removed if not requested
+	f := QueryFilter{Timeout: filter.Timeout, Consistency: filter.Consistency}
+	removeId := false
+	if len(filter.ReturnLabels) > 0 {
+		f.ReturnLabels = filter.ReturnLabels
+		if !matchAny(filter.ReturnLabels, META_LABEL_ID) {
+			f.ReturnLabels = append([]string{META_LABEL_ID}, filter.ReturnLabels...)
+			removeId = true
+		}
+	}
+	q, err := QueryBuilder{}.In(META_LABEL_ID, ids...).Build()
+	if err != nil {
+		return nil, err
+	}
+	entities, err := queryFunc(ctx, q, f)
+	if err != nil {
+		return nil, err
+	}
+	byId := make(map[string]Entity, len(entities))
+	for _, e := range entities {
+		id, ok := e.IdOK()
+		if !ok {
+			return nil, fmt.Errorf("API returned an entity without %s: %v", META_LABEL_ID, e)
+		}
+		if removeId {
+			delete(e, META_LABEL_ID)
+		}
+		byId[id] = e
+	}
+	return byId, nil
+}
+
+func (c entityClient) Insert(entities []Entity) (WriteResult, error) {
+	return c.InsertContext(c.Context(), entities)
+}
+
+func (c entityClient) InsertContext(ctx context.Context, entities []Entity) (WriteResult, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	if len(entities) == 0 {
+		return WriteResult{}, ErrNoEntity
+	}
+	if c.writeOpts.DryRun {
+		return WriteResult{}, ErrDryRunInsert
+	}
+	entities, err := checkTypes(c.entityType, entities...)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	if err := validateEntities(entities...); err != nil {
+		return WriteResult{}, err
+	}
+	if err := c.validateSchema(false, entities...); err != nil {
+		return WriteResult{}, err
+	}
+	c, err = c.autoSet("insert", len(entities))
+	if err != nil {
+		return WriteResult{}, err
+	}
+	// Send the same idempotency key on every try, so the API doesn't insert
+	// the entities again on retry
+	c.idemKey = IdempotencyKey(ctx) // copy on write
+	if c.idemKey == "" && c.idemInserts {
+		c.idemKey = NewRequestId()
+	}
+	// Let API validate the new entities. Currently, they cannot contain _id,
+	// for example, but let the API be the single source of truth.
+	return c.write(entities, 1, "POST", "/entities/"+c.entityType, c.retryPolicy.RetryInserts)
+}
+
+func (c entityClient) InsertStream(ctx context.Context, entities <-chan Entity) (<-chan Write, error) {
+	if c.writeOpts.DryRun {
+		return nil, ErrDryRunInsert
+	}
+	reqCtx, cancel := context.WithCancel(ctx)
+	c.ctx = reqCtx  // copy on write, like WithContext
+	c.stream = true // copy on write
+	endpoint := "/entities/" + c.entityType
+	if c.set.Size > 0 {
+		endpoint += fmt.Sprintf("?setId=%s&setOp=%s&setSize=%d", c.set.Id, c.set.Op, c.set.Size)
+	}
+
+	// Entities are written to the request body as they're received. The API
+	// replies one Write per entity sent, in order, so sent has the input index
+	// of each entity, in order, to set Write.Index. Entities that are not valid
+	// are in sent, too, with the error, so the reader emits all Writes in order.
+	pr, pw := io.Pipe()
+	c.body = pr // copy on write
+	results := make(chan Write)
+	sent := make(chan streamEntity, INSERT_STREAM_BUFFER)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		defer close(sent)
+		for i := 0; ; i++ {
+			var e Entity
+			var ok bool
+			select {
+			case e, ok = <-entities:
+			case <-reqCtx.Done():
+				pw.CloseWithError(reqCtx.Err())
+				return
+			}
+			if !ok {
+				pw.Close() // end of request
+				return
+			}
+			var line []byte
+			checked, err := checkTypes(c.entityType, e)
+			if err == nil {
+				e = checked[0]
+				line, err = json.Marshal(e)
+			}
+			if err == nil {
+				err = validateEntities(e)
+			}
+			if err == nil {
+				err = c.validateSchema(false, e)
+			}
+			select {
+			case sent <- streamEntity{index: i, err: err}: // before the API can reply
+			case <-reqCtx.Done():
+				pw.CloseWithError(reqCtx.Err())
+				return
+			}
+			if err != nil {
+				continue // not sent
+			}
+			if _, err := pw.Write(append(line, '\n')); err != nil {
+				return // request failed or aborted, reported by reader
+			}
+		}
+	}()
+	// stop stops the request and waits for the writer
+	stop := func(err error) {
+		cancel()
+		pr.CloseWithError(err)
+		<-writerDone
+	}
+
+	c.debug("insert stream")
+	resp, bytes, err := c.do("POST", endpoint, nil)
+	if err == nil && (resp.StatusCode != http.StatusOK || !isNDJSON(resp)) {
+		if resp.StatusCode == http.StatusOK {
+			err = fmt.Errorf("API response is not NDJSON (Content-Type: %s)", resp.Header.Get("Content-Type"))
+		} else {
+			_, err = readError(resp, bytes)
+		}
+	}
+	if err != nil {
+		stop(err)
+		return nil, err
+	}
+
+	// The API replies are decoded on their own goroutine so that the reader
+	// can emit the Writes of entities that are not valid while it waits for
+	// the next reply. replies is closed after the last reply: EOF or Index -1.
+	replies := make(chan Write)
+	go func() {
+		defer close(replies)
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var w Write
+			if err := dec.Decode(&w); err != nil {
+				if err == io.EOF {
+					return
+				}
+				if ctxErr := reqCtx.Err(); ctxErr != nil {
+					err = fmt.Errorf("request aborted: %w", ctxErr)
+				} else {
+					err = fmt.Errorf("decoding NDJSON response: %w", err)
+				}
+				w = Write{Index: -1, Error: &Error{Message: err.Error(), Type: "stream-error"}}
+			}
+			select {
+			case replies <- w:
+			case <-reqCtx.Done():
+				return // reader stopped
+			}
+			if w.Index == -1 {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(results) // after stop, so the writer is done
+		defer stop(io.ErrClosedPipe)
+		defer resp.Body.Close()
+		emit := func(w Write) bool {
+			select {
+			case results <- w:
+				return true
+			case <-ctx.Done():
+				return false // caller stopped reading
+			}
+		}
+		invalid := func(se streamEntity) Write {
+			return Write{Index: se.index, Error: &Error{Message: se.err.Error(), Type: "invalid-content", HTTPStatus: http.StatusBadRequest}}
+		}
+		// next is the next entity from sent, or nil if it's not received yet.
+		// A valid entity is held in next until its reply, which blocks sent.
+		var next *streamEntity
+		in := sent // nil while next is held
+		for {
+			select {
+			case se, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				if se.err != nil {
+					if !emit(invalid(se)) {
+						return
+					}
+					continue
+				}
+				next, in = &se, nil
+			case w, ok := <-replies:
+				if !ok {
+					// API done: the rest of sent are entities that are not valid
+					cancel() // writer might wait for entities if the API ended early
+					for se := range sent {
+						if se.err != nil && !emit(invalid(se)) {
+							return
+						}
+					}
+					return
+				}
+				if w.Index >= 0 {
+					// The entity is in sent before the API can reply, so this
+					// doesn't block, but emit the Writes of entities not valid first
+					for next == nil {
+						se, ok := <-sent
+						if !ok {
+							return // can't happen: reply without an entity
+						}
+						if se.err != nil {
+							if !emit(invalid(se)) {
+								return
+							}
+							continue
+						}
+						next = &se
+					}
+					w.Index, next, in = next.index, nil, sent
+					if c.baseURL != "" && w.URI != "" {
+						w.URI = w.ResolveURI(c.baseURL)
+					}
+				}
+				if !emit(w) || w.Index == -1 {
+					return
+				}
+			}
+		}
+	}()
+	return results, nil
+}
+
+// streamEntity is an entity read by InsertStream: its input index and, if it's
+// not valid and not sent, the error.
+type streamEntity struct {
+	index int
+	err   error
+}
+
+func (c entityClient) InsertBatch(entities []Entity, batchSize int) ([]WriteResult, error) {
+	return c.InsertBatchContext(c.Context(), entities, batchSize)
+}
+
+func (c entityClient) InsertBatchContext(ctx context.Context, entities []Entity, batchSize int) ([]WriteResult, error) {
+	if len(entities) == 0 {
+		return nil, ErrNoEntity
+	}
+	if batchSize <= 0 {
+		batchSize = DEFAULT_INSERT_BATCH_SIZE
+	}
+	key := IdempotencyKey(ctx)
+	nBatches := (len(entities) + batchSize - 1) / batchSize
+	results := make([]WriteResult, 0, nBatches)
+	for i := 0; i < nBatches; i++ {
+		start := i * batchSize
+		end := start + batchSize
+		if end > len(entities) {
+			end = len(entities)
+		}
+		c.debug("insert batch %d of %d: entities %d-%d", i+1, nBatches, start, end-1)
+		batchCtx := ctx
+		if key != "" {
+			batchCtx = WithIdempotencyKey(ctx, fmt.Sprintf("%s-%d", key, i+1))
+		}
+		wr, err := c.InsertContext(batchCtx, entities[start:end])
+		results = append(results, wr)
+		if err != nil {
+			return results, fmt.Errorf("insert batch %d of %d (entities %d-%d): %w", i+1, nBatches, start, end-1, err)
+		}
+		if err := wr.Err(); err != nil {
+			// len(wr.Writes) = index of failed entity in the batch
+			return results, fmt.Errorf("insert batch %d of %d (entities %d-%d): entity %d failed: %w",
+				i+1, nBatches, start, end-1, start+len(wr.Writes), err)
+		}
+	}
+	return results, nil
+}
+
+func (c entityClient) Update(query string, patch Entity) (WriteResult, error) {
+	return c.UpdateContext(c.Context(), query, patch)
+}
+
+func (c entityClient) UpdateContext(ctx context.Context, query string, patch Entity) (WriteResult, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	if query == "" {
+		return WriteResult{}, ErrNoQuery
+	}
+	c.debug("query='%s', patch=%+v", query, patch)
+	idempotent := matchesRev(query)
+	query = url.QueryEscape(query) // always escape the query
+	if len(patch) == 0 {
+		return WriteResult{}, ErrNoEntity
+	}
+	checked, err := checkTypes(c.entityType, patch)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	patch = checked[0]
+	if err := validateEntities(patch); err != nil {
+		return WriteResult{}, err
+	}
+	if err := c.validateSchema(true, patch); err != nil {
+		return WriteResult{}, err
+	}
+	// Let API return error if patch contains (meta)labels that cannot be updated,
+	// e.g. _id. Currently, the API does not allow any metalabels in the patch.
+	return c.write(patch, -1, "PUT", "/entities/"+c.entityType+"?query="+query, idempotent)
+}
+
+func (c entityClient) UpdateMany(query string, patch Entity, filter QueryFilter) (WriteResult, error) {
+	return c.UpdateManyContext(c.Context(), query, patch, filter)
+}
+
+func (c entityClient) UpdateManyContext(ctx context.Context, query string, patch Entity, filter QueryFilter) (WriteResult, error) {
+	if query == "" {
+		return WriteResult{}, ErrNoQuery
+	}
+	for _, ml := range []string{META_LABEL_ID, META_LABEL_TYPE, META_LABEL_REV, META_LABEL_DELETED} {
+		if patch.Has(ml) {
+			return WriteResult{}, fmt.Errorf("patch cannot set meta-label %s", ml)
+		}
+	}
+	if filter.Limit > 0 || filter.Offset > 0 || len(filter.Sort) > 0 || len(filter.ReturnLabels) > 0 || filter.Distinct {
+		return WriteResult{}, fmt.Errorf("invalid QueryFilter: UpdateMany supports only Timeout: %+v", filter)
+	}
+	if filter.Timeout > 0 {
+		c.queryTimeout = filter.Timeout // copy on write
+	}
+	return c.UpdateContext(ctx, query, patch)
+}
+
+func (c entityClient) UpdateOne(id string, patch Entity) (WriteResult, error) {
+	return c.UpdateOneContext(c.Context(), id, patch)
+}
+
+func (c entityClient) UpdateOneContext(ctx context.Context, id string, patch Entity) (WriteResult, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	if id == "" {
+		return WriteResult{}, ErrIdNotSet
+	}
+	c.debug("_id=%s, patch=%+v", id, patch)
+	checked, err := checkTypes(c.entityType, patch)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	patch = checked[0]
+	if err := validateEntities(patch); err != nil {
+		return WriteResult{}, err
+	}
+	if err := c.validateSchema(true, patch); err != nil {
+		return WriteResult{}, err
+	}
+	// Let API return error if patch contains (meta)labels that cannot be updated,
+	// e.g. _id. Currently, the API does not allow any metalabels in the patch.
+	wr, err := c.write(patch, 1, "PUT", "/entity/"+c.entityType+"/"+id, false)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	return wr, nil
+}
+
+func (c entityClient) UpdateIfRev(entity Entity, expectedRev int64) (Write, error) {
+	return c.UpdateIfRevContext(c.Context(), entity, expectedRev)
+}
+
+func (c entityClient) UpdateIfRevContext(ctx context.Context, entity Entity, expectedRev int64) (Write, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	id, ok := entity.IdOK()
+	if !ok {
+		return Write{}, ErrIdNotSet
+	}
+	if _, err := checkTypes(c.entityType, entity); err != nil {
+		return Write{}, err
+	}
+	patch := Entity{}
+	for k, v := range entity {
+		if k == META_LABEL_ID || k == META_LABEL_TYPE || k == META_LABEL_REV {
+			continue
+		}
+		patch[k] = v
+	}
+	if len(patch) == 0 {
+		return Write{}, ErrNoEntity
+	}
+	if err := validateEntities(patch); err != nil {
+		return Write{}, err
+	}
+	if err := c.validateSchema(true, patch); err != nil {
+		return Write{}, err
+	}
+	c.debug("_id=%s, rev=%d, patch=%+v", id, expectedRev, patch)
+	// Idempotent because, once it succeeds, the revision changes
+	endpoint := fmt.Sprintf("/entity/%s/%s?rev=%d", c.entityType, id, expectedRev)
+	wr, err := c.write(patch, 1, "PUT", endpoint, true)
+	if err != nil {
+		return Write{}, err
+	}
+	if err := wr.Err(); err != nil {
+		return Write{}, err // rev-conflict or other API error
+	}
+	if len(wr.Writes) == 0 {
+		return Write{}, fmt.Errorf("Server error: no write and no error returned")
+	}
+	return wr.Writes[0], nil
+}
+
+func (c entityClient) MutateById(ctx context.Context, id string, mutate func(Entity) (Entity, error)) (Write, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	return mutateById(ctx, c, id, mutate, c.mutateTries)
+}
+
+// mutateById implements EntityClient.MutateById for any client, which is why it
+// uses only the Context methods of ec.
+func mutateById(ctx context.Context, ec EntityClient, id string, mutate func(Entity) (Entity, error), maxTries int) (Write, error) {
+	if id == "" {
+		return Write{}, ErrIdNotSet
+	}
+	if maxTries <= 0 {
+		maxTries = MUTATE_MAX_TRIES
+	}
+	var err error
+	for tryNo := 0; tryNo < maxTries; tryNo++ {
+		var e, patch Entity
+		e, err = ec.GetByIdContext(ctx, id, QueryFilter{})
+		if err != nil {
+			return Write{}, err
+		}
+		rev := e.Rev()
+		if patch, err = mutate(e); err != nil {
+			return Write{}, err
+		}
+		if patch == nil {
+			return Write{EntityId: id}, nil
+		}
+		if pid, ok := patch.IdOK(); ok && pid != id {
+			return Write{}, fmt.Errorf("mutate returned entity with _id %s, expected %s", pid, id)
+		}
+		patch = patch.Without(META_LABEL_ID, META_LABEL_TYPE, META_LABEL_REV) // copy, not the caller's map
+		patch[META_LABEL_ID] = id
+		var w Write
+		w, err = ec.UpdateIfRevContext(ctx, patch, rev)
+		if err == nil {
+			return w, nil
+		}
+		if !errors.Is(err, ErrRevConflict) {
+			return Write{}, err
+		}
+	}
+	return Write{}, fmt.Errorf("mutate %s: entity changed concurrently on all %d tries: %w", id, maxTries, err)
+}
+
+func (c entityClient) Upsert(uniqueLabel string, entity Entity) (Write, error) {
+	return c.UpsertContext(c.Context(), uniqueLabel, entity)
+}
+
+func (c entityClient) UpsertContext(ctx context.Context, uniqueLabel string, entity Entity) (Write, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	if len(entity) == 0 {
+		return Write{}, ErrNoEntity
+	}
+	if entity.Has(META_LABEL_ID) {
+		return Write{}, ErrIdSet
+	}
+	if c.writeOpts.DryRun {
+		return Write{}, ErrDryRunInsert // might insert, and can't update a dry-run insert
+	}
+	// Query values are strings, so the label value must be too
+	val, ok := entity[uniqueLabel].(string)
+	if !ok || val == "" {
+		return Write{}, fmt.Errorf("entity label %s is not set or not a string: %T", uniqueLabel, entity[uniqueLabel])
+	}
+	q, err := QueryBuilder{}.Equal(uniqueLabel, val).Build() // quotes the value, like "a,b"
+	if err != nil {
+		return Write{}, err
+	}
+	c.debug("upsert query='%s', entity=%+v", q, entity)
+
+	// Read-your-writes so the read sees the previous try's write and, like all
+	// consistency-sensitive reads, isn't served from the QueryCacheTTL cache
+	f := QueryFilter{ReturnLabels: []string{META_LABEL_ID, META_LABEL_REV}, Consistency: CONSISTENCY_READ_YOUR_WRITES}
+	for tryNo := 1; tryNo <= UPSERT_MAX_TRIES; tryNo++ {
+		found, err := c.QueryContext(ctx, q, f)
+		if err != nil {
+			return Write{}, err
+		}
+		switch len(found) {
+		case 0:
+			wr, err := c.InsertContext(ctx, []Entity{entity})
+			if err != nil {
+				return Write{}, err
+			}
+			if wr.Error != nil {
+				if errors.Is(wr.Err(), ErrDuplicateEntity) {
+					c.debug("upsert try %d: inserted concurrently: %s", tryNo, wr.Error.Message)
+					continue // another client inserted it; try to update it
+				}
+				return Write{}, wr.Err()
+			}
+			w := wr.Writes[0]
+			w.Inserted = true
+			return w, nil
+		case 1:
+			match := fmt.Sprintf("%s=%s,%s=%d", META_LABEL_ID, found[0].Id(), META_LABEL_REV, found[0].Rev())
+			wr, err := c.UpdateContext(ctx, match, entity)
+			if err != nil {
+				return Write{}, err
+			}
+			if err := wr.Err(); err != nil {
+				return Write{}, err
+			}
+			if len(wr.Writes) == 0 {
+				c.debug("upsert try %d: _rev changed or entity deleted concurrently", tryNo)
+				continue // re-read the current _rev
+			}
+			return wr.Writes[0], nil
+		default:
+			return Write{}, fmt.Errorf("%d %s entities match %s: label %s is not unique", len(found), c.entityType, q, uniqueLabel)
+		}
+	}
+	return Write{}, fmt.Errorf("upsert %s: entity changed concurrently on all %d tries", q, UPSERT_MAX_TRIES)
+}
+
+func (c entityClient) Delete(query string) (WriteResult, error) {
+	return c.DeleteContext(c.Context(), query)
+}
+
+func (c entityClient) DeleteContext(ctx context.Context, query string) (WriteResult, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	if query == "" {
+		return WriteResult{}, ErrNoQuery
+	}
+	c.debug("query='%s'", query)
+	idempotent := matchesRev(query)
+	query = url.QueryEscape(query) // always escape the query
+	return c.write(nil, -1, "DELETE", "/entities/"+c.entityType+"?query="+query, idempotent)
+}
+
+func (c entityClient) DeleteByQuery(query string, filter QueryFilter) (WriteResult, error) {
+	return c.DeleteByQueryContext(c.Context(), query, filter)
+}
+
+func (c entityClient) DeleteByQueryContext(ctx context.Context, query string, filter QueryFilter) (WriteResult, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	if query == "" {
+		return WriteResult{}, ErrNoQuery // never delete all entities
+	}
+	if filter.Timeout > 0 {
+		c.queryTimeout = filter.Timeout // copy on write
+	}
+	if filter.Limit <= 0 || c.writeOpts.DryRun {
+		return c.DeleteContext(ctx, query)
+	}
+	c.debug("query='%s', limit=%d", query, filter.Limit)
+	idempotent := matchesRev(query)
+	endpoint := "/entities/" + c.entityType + "?query=" + url.QueryEscape(query) + "&limit=" + strconv.Itoa(filter.Limit)
+	var all WriteResult
+	for batchNo := 1; ; batchNo++ {
+		wr, err := c.write(nil, -1, "DELETE", endpoint, idempotent)
+		all.Writes = append(all.Writes, wr.Writes...)
+		if err != nil {
+			return all, err
+		}
+		if wr.Error != nil {
+			all.Error = wr.Error
+			return all, nil
+		}
+		c.debug("delete batch %d: %d deleted", batchNo, len(wr.Writes))
+		if len(wr.Writes) < filter.Limit {
+			return all, nil // no more matching entities
+		}
+	}
+}
+
+func (c entityClient) DeleteOne(id string) (WriteResult, error) {
+	return c.DeleteOneContext(c.Context(), id)
+}
+
+func (c entityClient) DeleteOneContext(ctx context.Context, id string) (WriteResult, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	if id == "" {
+		return WriteResult{}, ErrIdNotSet
+	}
+	c.debug("_id=%s", id)
+	wr, err := c.write(nil, 1, "DELETE", "/entity/"+c.entityType+"/"+id, false)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	return wr, nil
+}
+
+func (c entityClient) DeleteByIds(ids []string) (WriteResult, error) {
+	return c.DeleteByIdsContext(c.Context(), ids)
+}
+
+func (c entityClient) DeleteByIdsContext(ctx context.Context, ids []string) (WriteResult, error) {
+	c, err := c.autoSet("delete", len(ids)) // one set for all requests
+	if err != nil {
+		return WriteResult{}, err
+	}
+	return deleteByIds(c.DeleteOneContext, ctx, ids, c.writeOpts)
+}
+
+// deleteByIds implements DeleteByIds with the DeleteOne func of an EntityClient.
+func deleteByIds(deleteOneFunc func(context.Context, string) (WriteResult, error),
+	ctx context.Context, ids []string, opts WriteOptions) (WriteResult, error) {
+	if len(ids) == 0 {
+		return WriteResult{}, ErrNoEntity
+	}
+	for _, id := range ids {
+		if id == "" {
+			return WriteResult{}, ErrIdNotSet
+		}
+	}
+	all := WriteResult{DryRun: opts.DryRun}
+	for _, id := range ids {
+		wr, err := deleteOneFunc(ctx, id)
+		all.Writes = append(all.Writes, wr.Writes...)
+		all.Warnings = append(all.Warnings, wr.Warnings...)
+		if errors.Is(err, ErrEntityNotFound) {
+			// EntityClient returns HTTP 404 as an error, the fake as WriteResult.Error
+			wr.Error = &Error{
+				Message:    "entity not found",
+				Type:       "entity-not-found",
+				EntityId:   id,
+				HTTPStatus: http.StatusNotFound,
+			}
+		} else if err != nil {
+			return all, err
+		}
+		if wr.RequestId != "" {
+			all.RequestId = wr.RequestId
+		}
+		if wr.Error == nil {
+			continue
+		}
+		if opts.IgnoreNotFound && errors.Is(*wr.Error, ErrEntityNotFound) {
+			continue
+		}
+		if all.Error == nil {
+			all.Error = wr.Error
+		}
+		if all.Errors == nil {
+			all.Errors = map[string]Error{}
+		}
+		all.Errors[id] = *wr.Error
+		if !opts.ContinueOnError {
+			break
+		}
+	}
+	return all, nil
+}
+
+func (c entityClient) Labels(id string) ([]string, error) {
+	return c.LabelsContext(c.Context(), id)
+}
+
+func (c entityClient) LabelsContext(ctx context.Context, id string) ([]string, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	if id == "" {
+		return nil, ErrIdNotSet
+	}
+
+	var labels []string
+	err := c.apiRetry(true, func() (bool, error) {
+		resp, bytes, err := c.do("GET", "/entity/"+c.entityType+"/"+id+"/labels", nil)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp, bytes)
+		}
+		if err := json.Unmarshal(bytes, &labels); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	return labels, err
+}
+
+func (c entityClient) History(id string, limit int) ([]CDCEvent, error) {
+	return c.HistoryContext(c.Context(), id, limit)
 }
 
-func (c entityClient) Query(query string, filter QueryFilter) ([]Entity, error) {
-	if query == "" {
-		return nil, ErrNoQuery
-	}
-	Debug("query='%s', filter=%+v", query, filter)
-
-	path := "/entities/" + c.entityType + "?query=" + url.QueryEscape(query) // always escape the query
-	if len(filter.ReturnLabels) > 0 {
-		rl := strings.Join(filter.ReturnLabels, ",")
-		path += "&labels=" + rl
+func (c entityClient) HistoryContext(ctx context.Context, id string, limit int) ([]CDCEvent, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	if id == "" {
+		return nil, ErrIdNotSet
 	}
-	if filter.Distinct {
-		path += "&distinct"
+	path := "/entity/" + c.entityType + "/" + url.PathEscape(id) + "/history"
+	if limit > 0 {
+		path += "?limit=" + strconv.Itoa(limit)
 	}
 
-	var entities []Entity
-	err := c.apiRetry(func() (bool, error) {
+	var events []CDCEvent
+	err := c.apiRetry(true, func() (bool, error) {
 		resp, bytes, err := c.do("GET", path, nil)
 		if err != nil {
 			return false, err
@@ -191,144 +2912,259 @@ func (c entityClient) Query(query string, filter QueryFilter) ([]Entity, error)
 		if resp.StatusCode != http.StatusOK {
 			return readError(resp, bytes)
 		}
-		if len(bytes) > 0 {
-			if err := json.Unmarshal(bytes, &entities); err != nil {
-				return false, err
-			}
+		events = []CDCEvent{} // reset on retry
+		if err := json.Unmarshal(bytes, &events); err != nil {
+			return false, err
 		}
 		return true, nil
 	})
-	return entities, err
+	return events, err
 }
 
-func (c entityClient) Get(id string) (Entity, error) {
-	if id == "" {
-		return nil, ErrIdNotSet
+func (c entityClient) AllLabels() ([]string, error) {
+	return c.AllLabelsContext(c.Context())
+}
+
+func (c entityClient) AllLabelsContext(ctx context.Context) ([]string, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	if lc := c.labelsCache; lc != nil {
+		lc.mu.Lock()
+		defer lc.mu.Unlock() // one request on cache miss, not one per caller
+		if c.now().Before(lc.expires) {
+			return append([]string{}, lc.labels...), nil
+		}
 	}
-	var entity Entity
-	err := c.apiRetry(func() (bool, error) {
-		resp, bytes, err := c.do("GET", "/entity/"+c.entityType+"/"+url.PathEscape(id), nil)
+
+	var labels []string
+	err := c.apiRetry(true, func() (bool, error) {
+		resp, bytes, err := c.do("GET", "/entities/"+c.entityType+"/labels", nil)
 		if err != nil {
 			return false, err
 		}
 		if resp.StatusCode != http.StatusOK {
 			return readError(resp, bytes)
 		}
-		if len(bytes) > 0 {
-			if err := json.Unmarshal(bytes, &entity); err != nil {
-				return false, err
-			}
+		if err := json.Unmarshal(bytes, &labels); err != nil {
+			return false, err
 		}
 		return true, nil
 	})
-	return entity, err
-}
-
-func (c entityClient) Insert(entities []Entity) (WriteResult, error) {
-	if len(entities) == 0 {
-		return WriteResult{}, ErrNoEntity
+	if err != nil {
+		return nil, err
 	}
-	// Let API validate the new entities. Currently, they cannot contain _id,
-	// for example, but let the API be the single source of truth.
-	return c.write(entities, 1, "POST", "/entities/"+c.entityType)
+	if lc := c.labelsCache; lc != nil {
+		lc.labels = append([]string{}, labels...)
+		lc.expires = c.now().Add(lc.ttl)
+	}
+	return labels, nil
 }
 
-func (c entityClient) Update(query string, patch Entity) (WriteResult, error) {
-	if query == "" {
-		return WriteResult{}, ErrNoQuery
-	}
-	Debug("query='%s', patch=%+v", query, patch)
-	query = url.QueryEscape(query) // always escape the query
-	if len(patch) == 0 {
-		return WriteResult{}, ErrNoEntity
-	}
-	// Let API return error if patch contains (meta)labels that cannot be updated,
-	// e.g. _id. Currently, the API does not allow any metalabels in the patch.
-	return c.write(patch, -1, "PUT", "/entities/"+c.entityType+"?query="+query)
+func (c entityClient) DeleteLabel(id string, label string) (WriteResult, error) {
+	return c.DeleteLabelContext(c.Context(), id, label)
 }
 
-func (c entityClient) UpdateOne(id string, patch Entity) (WriteResult, error) {
+func (c entityClient) DeleteLabelContext(ctx context.Context, id string, label string) (WriteResult, error) {
+	c.ctx = ctx // copy on write, like WithContext
 	if id == "" {
 		return WriteResult{}, ErrIdNotSet
 	}
-	Debug("_id=%s, patch=%+v", id, patch)
-	// Let API return error if patch contains (meta)labels that cannot be updated,
-	// e.g. _id. Currently, the API does not allow any metalabels in the patch.
-	wr, err := c.write(patch, 1, "PUT", "/entity/"+c.entityType+"/"+id)
+	if label == "" {
+		return WriteResult{}, ErrNoLabel
+	}
+	c.debug("_id=%s, label=%s", id, label)
+	wr, err := c.write(nil, 1, "DELETE", "/entity/"+c.entityType+"/"+id+"/labels/"+label, false)
 	if err != nil {
 		return WriteResult{}, err
 	}
 	return wr, nil
 }
 
-func (c entityClient) Delete(query string) (WriteResult, error) {
-	if query == "" {
-		return WriteResult{}, ErrNoQuery
-	}
-	Debug("query='%s'", query)
-	query = url.QueryEscape(query) // always escape the query
-	return c.write(nil, -1, "DELETE", "/entities/"+c.entityType+"?query="+query)
+func (c entityClient) EntityType() string {
+	return c.entityType
 }
 
-func (c entityClient) DeleteOne(id string) (WriteResult, error) {
-	if id == "" {
-		return WriteResult{}, ErrIdNotSet
-	}
-	Debug("_id=%s", id)
-	wr, err := c.write(nil, 1, "DELETE", "/entity/"+c.entityType+"/"+id)
+func (c entityClient) Ping() error {
+	return c.PingContext(c.Context())
+}
+
+func (c entityClient) PingContext(ctx context.Context) error {
+	version, err := c.ServerVersionContext(ctx)
 	if err != nil {
-		return WriteResult{}, err
+		return err
 	}
-	return wr, nil
+	if !CompatibleVersion(VERSION, version) {
+		return fmt.Errorf("client version %s, server version %s: %w", VERSION, version, ErrVersionMismatch)
+	}
+	return nil
 }
 
-func (c entityClient) Labels(id string) ([]string, error) {
-	if id == "" {
-		return nil, ErrIdNotSet
+func (c entityClient) Close() error {
+	if c.closed != nil {
+		c.closed.Store(true)
 	}
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
+	return nil
+}
 
-	var labels []string
-	err := c.apiRetry(func() (bool, error) {
-		resp, bytes, err := c.do("GET", "/entity/"+c.entityType+"/"+id+"/labels", nil)
+func (c entityClient) ServerVersion() (string, error) {
+	return c.ServerVersionContext(c.Context())
+}
+
+func (c entityClient) ServerVersionContext(ctx context.Context) (string, error) {
+	c.ctx = ctx // copy on write, like WithContext
+	var status map[string]string
+	err := c.apiRetry(true, func() (bool, error) {
+		resp, bytes, err := c.do("GET", "/status", nil)
 		if err != nil {
 			return false, err
 		}
 		if resp.StatusCode != http.StatusOK {
 			return readError(resp, bytes)
 		}
-		if err := json.Unmarshal(bytes, &labels); err != nil {
+		if err := json.Unmarshal(bytes, &status); err != nil {
 			return false, err
 		}
 		return true, nil
 	})
-	return labels, err
+	if err != nil {
+		return "", err
+	}
+	if status["ok"] != "yes" {
+		return "", fmt.Errorf("Server not ok: status: %v", status)
+	}
+	return status["version"], nil
 }
 
-func (c entityClient) DeleteLabel(id string, label string) (WriteResult, error) {
-	if id == "" {
-		return WriteResult{}, ErrIdNotSet
+func (c entityClient) InvalidateQueryCache(pattern string) (int, error) {
+	if c.queryCache == nil {
+		return 0, nil
 	}
-	if label == "" {
-		return WriteResult{}, ErrNoLabel
+	return c.queryCache.invalidate(pattern)
+}
+
+// --------------------------------------------------------------------------
+
+// validateFilter returns an error if the filter is invalid, before making a
+// request that the API would reject, or a request with query q that would
+// match nothing because the query has a _rev predicate and filter.SinceRev
+// adds another.
+func validateFilter(q string, filter QueryFilter) error {
+	if n := len(UniqueLabels(filter.ReturnLabels)); filter.Distinct && n != 1 {
+		return fmt.Errorf("invalid QueryFilter: Distinct requires exactly 1 ReturnLabels value, but %d specified: %v",
+			n, filter.ReturnLabels)
 	}
-	Debug("_id=%s, label=%s", id, label)
-	wr, err := c.write(nil, 1, "DELETE", "/entity/"+c.entityType+"/"+id+"/labels/"+label)
-	if err != nil {
-		return WriteResult{}, err
+	if err := ValidateLabelPaths(filter.ReturnLabels); err != nil {
+		return fmt.Errorf("invalid QueryFilter: %s", err)
 	}
-	return wr, nil
+	if err := ValidateConsistency(filter.Consistency); err != nil {
+		return fmt.Errorf("invalid QueryFilter: %s", err)
+	}
+	if filter.SinceRev > 0 {
+		// If the query is invalid, let the API return the error
+		if pq, err := query.Translate(q); err == nil {
+			for _, p := range pq.Predicates {
+				if p.Label == META_LABEL_REV {
+					return fmt.Errorf("%w: query has a %s predicate and QueryFilter.SinceRev is set", ErrInvalidQuery, META_LABEL_REV)
+				}
+			}
+		}
+	}
+	return nil
 }
 
-func (c entityClient) EntityType() string {
-	return c.entityType
+// validateUpdateMode returns an error if mode is not a WriteOptions.UpdateMode value.
+func validateUpdateMode(mode string) error {
+	switch mode {
+	case "", UPDATE_MODE_MERGE, UPDATE_MODE_REPLACE:
+		return nil
+	}
+	return fmt.Errorf("invalid WriteOptions.UpdateMode: %s; valid modes: %s, %s", mode, UPDATE_MODE_MERGE, UPDATE_MODE_REPLACE)
 }
 
-// --------------------------------------------------------------------------
+// validateEntities returns an error for the first invalid label name (see
+// ValidateLabel) or value (see ValidateValues) in the entities, in entity and
+// label order.
+func validateEntities(entities ...Entity) error {
+	for i, e := range entities {
+		var err error
+		for _, label := range e.Labels() {
+			if err = ValidateLabel(label); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = e.ValidateValues()
+		}
+		if err != nil {
+			if len(entities) > 1 {
+				return fmt.Errorf("entity %d: %w", i, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTypes returns ErrTypeMismatch, annotated with the entity index, for the
+// first entity with a _type that's not entityType, the client entity type. Entities without
+// _type are presumed to be the client entity type. The API sets _type from the
+// endpoint and doesn't allow it in writes, so a matching _type is removed: the
+// returned entities are copies without _type if any had it; the caller's are
+// not modified.
+func checkTypes(entityType string, entities ...Entity) ([]Entity, error) {
+	var out []Entity
+	for i, e := range entities {
+		v, ok := e[META_LABEL_TYPE]
+		if !ok {
+			continue
+		}
+		if t, isStr := v.(string); !isStr || t != entityType {
+			return nil, fmt.Errorf("entity %d: _type %v, client entity type %s: %w", i, v, entityType, ErrTypeMismatch)
+		}
+		if out == nil {
+			out = append(make([]Entity, 0, len(entities)), entities...)
+		}
+		out[i] = e.Without(META_LABEL_TYPE)
+	}
+	if out == nil {
+		return entities, nil
+	}
+	return out, nil
+}
+
+// validateSchema returns an error for the first entity that doesn't conform to
+// the client's Schema, if any. If patch is true, the entities are update patches,
+// which are partial unless the update mode is replace.
+func (c entityClient) validateSchema(patch bool, entities ...Entity) error {
+	if c.schema == nil {
+		return nil
+	}
+	if patch && c.writeOpts.UpdateMode == UPDATE_MODE_REPLACE {
+		patch = false
+	}
+	for i, e := range entities {
+		if err := c.schema.validate(e, patch); err != nil {
+			if len(entities) > 1 {
+				return fmt.Errorf("entity %d: %w", i, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
 
 // write sends payload via method to endpoint, expecting n successful writes.
 // If n is -1, the number of writes is variable (bulk update or delete).
-func (c entityClient) write(payload interface{}, n int, method, endpoint string) (WriteResult, error) {
+// If idempotent is true, the write can be retried by the RetryPolicy.
+func (c entityClient) write(payload interface{}, n int, method, endpoint string, idempotent bool) (WriteResult, error) {
 	var wr WriteResult
+	if method == "PUT" {
+		if err := validateUpdateMode(c.writeOpts.UpdateMode); err != nil {
+			return wr, err
+		}
+	}
 
 	// If entities (insert and update), marshal them. If not (delete), pass nil.
 	var bytes []byte
@@ -350,8 +3186,22 @@ func (c entityClient) write(payload interface{}, n int, method, endpoint string)
 			endpoint += fmt.Sprintf("?setId=%s&setOp=%s&setSize=%d", c.set.Id, c.set.Op, c.set.Size)
 		}
 	}
+	if c.writeOpts.DryRun {
+		if strings.Contains(endpoint, "?") {
+			endpoint += "&dryRun=true"
+		} else {
+			endpoint += "?dryRun=true"
+		}
+	}
+	if method == "PUT" && c.writeOpts.UpdateMode != "" {
+		if strings.Contains(endpoint, "?") {
+			endpoint += "&updateMode=" + url.QueryEscape(c.writeOpts.UpdateMode)
+		} else {
+			endpoint += "?updateMode=" + url.QueryEscape(c.writeOpts.UpdateMode)
+		}
+	}
 
-	err = c.apiRetry(func() (bool, error) {
+	err = c.apiRetry(idempotent, func() (bool, error) {
 		// Do low-level HTTP request. An erorr here is probably network not API error.
 		resp, bytes, err := c.do(method, endpoint, bytes)
 		if err != nil {
@@ -369,7 +3219,18 @@ func (c entityClient) write(payload interface{}, n int, method, endpoint string)
 		if err := json.Unmarshal(bytes, &wr); err != nil {
 			return done, fmt.Errorf("json.Unmarshal: %s", err)
 		}
-		Debug("write result: %+v", wr)
+		if wr.RequestId == "" && resp.Request != nil {
+			wr.RequestId = resp.Request.Header.Get(REQUEST_ID_HEADER) // older API doesn't return it
+		}
+		wr.Replayed = resp.Header.Get(IDEMPOTENT_REPLAY_HEADER) == "true"
+		c.debug("write result: %+v", wr)
+		if c.baseURL != "" {
+			for i := range wr.Writes {
+				if wr.Writes[i].URI != "" {
+					wr.Writes[i].URI = wr.Writes[i].ResolveURI(c.baseURL)
+				}
+			}
+		}
 		if resp.StatusCode == http.StatusNotFound {
 			return done, ErrEntityNotFound
 		}
@@ -385,15 +3246,33 @@ func (c entityClient) write(payload interface{}, n int, method, endpoint string)
 }
 
 func (c entityClient) do(method, endpoint string, payload []byte) (*http.Response, []byte, error) {
+	if c.closed != nil && c.closed.Load() {
+		return nil, nil, ErrClientClosed
+	}
+
 	// Make a complete URL: addr + API_ROOT + endpoint
 	// _CALLER MUST url.QueryEscape(query)!_ We can't escape the whole endpoint
 	// here because it'll escape /.
 	url := c.url(endpoint)
 
+	// Compress large payload, if enabled. This is before measuring latency, which
+	// is only network latency.
+	origPayload := payload // for retry with new token
+	gzipped := false
+	if payload != nil && c.compressMin > 0 && len(payload) >= c.compressMin {
+		var err error
+		if payload, err = gzipBytes(payload); err != nil {
+			return nil, nil, fmt.Errorf("gzip: %s", err)
+		}
+		gzipped = true
+	}
+
 	// Make request
 	var req *http.Request
 	var err error
-	if payload != nil {
+	if c.body != nil {
+		req, err = http.NewRequestWithContext(c.Context(), method, url, c.body)
+	} else if payload != nil {
 		buf := bytes.NewBuffer(payload)
 		req, err = http.NewRequestWithContext(c.Context(), method, url, buf)
 	} else {
@@ -403,38 +3282,430 @@ func (c entityClient) do(method, endpoint string, payload []byte) (*http.Respons
 		// So even though it's nil, request.go will attempt to read it, causing a panic.
 		req, err = http.NewRequestWithContext(c.Context(), method, url, nil)
 	}
-	if err != nil {
-		return nil, nil, fmt.Errorf("http.NewRequest: %s: %s", url, err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("http.NewRequest: %s: %s", url, err)
+	}
+	for k, v := range c.headers {
+		req.Header[k] = append([]string{}, v...) // first, so headers below replace them
+	}
+	if c.body != nil {
+		req.Header.Set("Content-Type", CONTENT_TYPE_NDJSON)
+	} else {
+		req.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+	}
+	req.Header.Set(VERSION_HEADER, VERSION)
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	} else {
+		req.Header.Set("User-Agent", DEFAULT_USER_AGENT)
+	}
+	if c.stream {
+		req.Header.Set("Accept", CONTENT_TYPE_NDJSON+", "+CONTENT_TYPE_JSON+";q=0.9")
+	} else if c.bsonResp {
+		req.Header.Set("Accept", CONTENT_TYPE_BSON+", "+CONTENT_TYPE_JSON+";q=0.9")
+	} else {
+		req.Header.Set("Accept", CONTENT_TYPE_JSON)
+	}
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	// Setting Accept-Encoding disables transparent decompression by http.Transport,
+	// so the response is decompressed below, after measuring latency
+	if c.noCompress {
+		req.Header.Set("Accept-Encoding", "identity")
+	} else {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	if c.queryTimeout > 0 {
+		req.Header.Set(QUERY_TIMEOUT_HEADER, c.queryTimeout.String())
+	}
+	if c.ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", c.ifNoneMatch)
+	}
+	if trace := c.traceHeader(); trace != "" {
+		req.Header.Set(TRACE_HEADER, trace)
+	}
+	if id := RequestId(c.Context()); id != "" {
+		req.Header.Set(REQUEST_ID_HEADER, id)
+	} else if c.genReqIds {
+		req.Header.Set(REQUEST_ID_HEADER, NewRequestId())
+	}
+	if c.idemKey != "" {
+		req.Header.Set(IDEMPOTENCY_KEY_HEADER, c.idemKey)
+	}
+	var token string
+	if c.tokens != nil {
+		if token, err = c.tokens.Token(req.Context()); err != nil {
+			return nil, nil, fmt.Errorf("TokenProvider: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	// Measure latency, if enabled. The trace changes the request context, so it's
+	// added only when needed. Stats RTT doesn't need it.
+	var t0, wrote time.Time
+	if c.latency != nil || (c.stats != nil && c.stats.sendRecv) {
+		if c.latency != nil {
+			*c.latency = Latency{}
+		}
+		trace := &httptrace.ClientTrace{
+			WroteRequest: func(httptrace.WroteRequestInfo) { wrote = c.now() },
+		}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	}
+
+	// Fail fast if the circuit breaker is open, before waiting on the rate limiter
+	if err := c.breaker.allow(); err != nil {
+		return nil, nil, err
+	}
+
+	// Wait on rate limiter, if any. This is before measuring latency because
+	// it's client-side wait, not network latency.
+	if err := c.waitRateLimit(req); err != nil {
+		c.breaker.cancel()
+		return nil, nil, err
+	}
+
+	// Start client span, if tracing. This is after the rate limit wait, like
+	// latency, so the span is only the request.
+	op := requestOp(method, endpoint)
+	end := func(error) {}
+	if c.tracer != nil {
+		var ctx context.Context
+		ctx, end = c.tracer.Start(req.Context(), op)
+		req = req.WithContext(ctx)
+		c.tracer.Inject(ctx, req.Header)
+	}
+
+	// Send request
+	c.debug("request: %+v", req)
+	t0 = c.now()
+	resp, err := c.httpClient.Do(req)
+	if err != nil && req.Context().Err() != nil {
+		c.breaker.cancel() // aborted by caller
+	} else {
+		c.breaker.done(err != nil || resp.StatusCode >= 500)
+	}
+	if err != nil {
+		c.debug("httpClient.Do() error: %v", err)
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			err = fmt.Errorf("request aborted: %w", ctxErr)
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			err = ErrClientTimeout
+		} else {
+			err = fmt.Errorf("http.Client.Do: %s", err)
+		}
+		c.stats.observe(false, 0, 0, 0, true)
+		c.observe(op, c.now().Sub(t0), err)
+		end(err)
+		return nil, nil, err
+	}
+	c.debug("response: %+v", resp)
+
+	// Token rejected: invalidate it and retry once with a new token, except
+	// InsertStream because its request body can't be sent again. The rejected
+	// request is recorded like any other error response.
+	if resp.StatusCode == http.StatusUnauthorized && c.tokens != nil && !c.tokenRetry && c.body == nil {
+		if tr, ok := c.tokens.(TokenRefresher); ok {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			t1 := c.now()
+			if wrote.IsZero() {
+				wrote = t0
+			}
+			apiErr := responseError(resp, body)
+			c.stats.observe(true, t1.Sub(t0), wrote.Sub(t0), t1.Sub(wrote), true)
+			c.observe(op, t1.Sub(t0), apiErr)
+			end(apiErr)
+			c.debug("401 Unauthorized, retrying with new token")
+			tr.InvalidateToken(token)
+			c.tokenRetry = true // copy on write
+			return c.do(method, endpoint, origPayload)
+		}
+	}
+
+	// Return NDJSON stream unread; the caller reads and closes the body
+	if c.stream && resp.StatusCode == http.StatusOK && isNDJSON(resp) {
+		t1 := c.now()
+		c.stats.observe(true, t1.Sub(t0), 0, 0, false)
+		c.observe(op, t1.Sub(t0), nil)
+		end(nil)
+		if c.latency != nil {
+			*c.latency = Latency{RTT: t1.Sub(t0).Milliseconds()}
+		}
+		return resp, nil, nil
+	}
+
+	// Read API response, at most maxResp bytes if set. Read one more byte to
+	// detect a response larger than the limit.
+	defer resp.Body.Close()
+	var r io.Reader = resp.Body
+	if c.maxResp > 0 {
+		r = io.LimitReader(resp.Body, c.maxResp+1)
+	}
+	body, err := ioutil.ReadAll(r)
+	t1 := c.now()
+	if err == nil && c.maxResp > 0 && int64(len(body)) > c.maxResp {
+		err = fmt.Errorf("%w: more than %d bytes", ErrResponseTooLarge, c.maxResp)
+	} else if err != nil {
+		err = fmt.Errorf("ioutil.ReadAll: %s", err)
+	}
+	if err != nil {
+		c.stats.observe(false, 0, 0, 0, true)
+		c.observe(op, t1.Sub(t0), err)
+		end(err)
+		return resp, nil, err
+	}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		if body, err = gunzipBytes(body, c.maxResp); err != nil {
+			if !errors.Is(err, ErrResponseTooLarge) {
+				err = fmt.Errorf("gzip: %s", err)
+			}
+			c.stats.observe(false, 0, 0, 0, true)
+			c.observe(op, t1.Sub(t0), err)
+			end(err)
+			return resp, nil, err
+		}
+	}
+	if c.observer != nil || c.tracer != nil {
+		var apiErr error
+		if resp.StatusCode >= 400 {
+			apiErr = responseError(resp, body)
+		}
+		c.observe(op, t1.Sub(t0), apiErr)
+		end(apiErr)
+	}
+	if wrote.IsZero() {
+		wrote = t0 // transport didn't trace the write (e.g. mock RoundTripper)
+	}
+	c.stats.observe(true, t1.Sub(t0), wrote.Sub(t0), t1.Sub(wrote), resp.StatusCode >= 400)
+	if c.latency != nil {
+		*c.latency = Latency{
+			Send: wrote.Sub(t0).Milliseconds(),
+			Recv: t1.Sub(wrote).Milliseconds(),
+			RTT:  t1.Sub(t0).Milliseconds(),
+		}
+		c.debug("latency: %+v", *c.latency)
+	}
+
+	return resp, body, nil
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	if _, err := gzw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gunzipBytes decompresses b. If max is greater than zero, it returns an error
+// that wraps ErrResponseTooLarge if b decompresses to more than max bytes.
+func gunzipBytes(b []byte, max int64) ([]byte, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+	if max <= 0 {
+		return ioutil.ReadAll(gzr)
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(gzr, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > max {
+		return nil, fmt.Errorf("%w: more than %d bytes decompressed", ErrResponseTooLarge, max)
+	}
+	return out, nil
+}
+
+// isBSON returns true if the response is BSON-encoded entities.
+func isBSON(resp *http.Response) bool {
+	return resp.Header.Get("Content-Type") == CONTENT_TYPE_BSON
+}
+
+func isNDJSON(resp *http.Response) bool {
+	return resp.Header.Get("Content-Type") == CONTENT_TYPE_NDJSON
+}
+
+// decodeBSON decodes concatenated BSON documents, one per entity. Embedded
+// documents and arrays are decoded as map[string]interface{} and []interface{},
+// like JSON, but numbers keep their BSON type. It returns an empty slice, not
+// nil, if there are no documents.
+func decodeBSON(data []byte) ([]Entity, error) {
+	entities := []Entity{}
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return nil, fmt.Errorf("invalid BSON response: %d trailing bytes", len(data))
+		}
+		n := int(binary.LittleEndian.Uint32(data)) // document length, including itself
+		if n < 5 || n > len(data) {
+			return nil, fmt.Errorf("invalid BSON response: document length %d, %d bytes left", n, len(data))
+		}
+		var m map[string]interface{}
+		if err := bson.Unmarshal(data[:n], &m); err != nil {
+			return nil, fmt.Errorf("bson.Unmarshal: %s", err)
+		}
+		entities = append(entities, Entity(fromBSON(m).(map[string]interface{})))
+		data = data[n:]
+	}
+	return entities, nil
+}
+
+// fromBSON converts BSON documents and arrays in v to map[string]interface{} and
+// []interface{}, and ObjectIDs to hex strings, which is how they're encoded in JSON.
+func fromBSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case primitive.ObjectID:
+		return t.Hex()
+	case map[string]interface{}:
+		for k := range t {
+			t[k] = fromBSON(t[k])
+		}
+		return t
+	case primitive.M:
+		return fromBSON(map[string]interface{}(t))
+	case primitive.D:
+		m := make(map[string]interface{}, len(t))
+		for _, e := range t {
+			m[e.Key] = fromBSON(e.Value)
+		}
+		return m
+	case primitive.A:
+		return fromBSON([]interface{}(t))
+	case []interface{}:
+		for i := range t {
+			t[i] = fromBSON(t[i])
+		}
+		return t
+	}
+	return v
+}
+
+// waitRateLimit waits on the query limiter for GET requests, else the write limiter.
+func (c entityClient) waitRateLimit(req *http.Request) error {
+	limiter := c.writeLimiter
+	if req.Method == "GET" {
+		limiter = c.queryLimiter
+	}
+	if limiter == nil {
+		return nil
+	}
+	t0 := c.now()
+	err := limiter.Wait(req.Context())
+	wait := c.now().Sub(t0)
+	c.debug("rate limit wait: %s", wait)
+	if c.onRateLimit != nil {
+		c.onRateLimit(req.Method, wait)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set(VERSION_HEADER, VERSION)
-	if c.queryTimeout > 0 {
-		req.Header.Set(QUERY_TIMEOUT_HEADER, c.queryTimeout.String())
+	if err != nil {
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return fmt.Errorf("request aborted: %w", ctxErr)
+		}
+		return fmt.Errorf("rate limiter: %w", err)
 	}
-	if c.traceHeaderValue != "" {
-		req.Header.Set(TRACE_HEADER, c.traceHeaderValue)
+	return nil
+}
+
+// observe calls the Observer, if any.
+func (c entityClient) observe(op string, d time.Duration, err error) {
+	if c.observer != nil {
+		c.observer.ObserveRequest(op, d, err)
 	}
+}
 
-	// Send request
-	Debug("request: %+v", req)
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		Debug("httpClient.Do() error: %v", err)
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			return nil, nil, ErrClientTimeout
+// requestOp returns the Observer and Tracer op for the request method and endpoint.
+func requestOp(method, endpoint string) string {
+	path, _, _ := strings.Cut(endpoint, "?")
+	var op string
+	switch method {
+	case "GET":
+		switch {
+		case strings.HasSuffix(path, "/count"):
+			op = "count"
+		case strings.HasSuffix(path, "/labels"):
+			op = "labels"
+		case path == "/status":
+			op = "status"
+		case strings.HasPrefix(path, "/entity/"):
+			op = "get"
+		default:
+			op = "query"
+		}
+	case "POST":
+		op = "insert"
+	case "PUT":
+		op = "update"
+	case "DELETE":
+		if strings.Contains(path, "/labels/") {
+			op = "delete-label"
+		} else {
+			op = "delete"
 		}
-		return nil, nil, fmt.Errorf("http.Client.Do: %s", err)
+	default:
+		op = strings.ToLower(method)
+	}
+	return op
+}
+
+// responseError returns the error for an API error response, which is a WriteResult
+// with an Error for writes, else an Error (see readError).
+func responseError(resp *http.Response, body []byte) error {
+	var wr WriteResult
+	if err := json.Unmarshal(body, &wr); err == nil && wr.Error != nil {
+		return wr.Err()
 	}
-	Debug("response: %+v", resp)
+	_, err := readError(resp, body)
+	return err
+}
 
-	// Read API response
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return resp, nil, fmt.Errorf("ioutil.ReadAll: %s", err)
+func (c entityClient) debug(msg string, v ...interface{}) {
+	if !c.dbg && !DebugEnabled {
+		return
 	}
+	debugf(c.logger, 1, msg, v...)
+}
 
-	return resp, body, nil
+// traceHeader returns the X-Etre-Trace header value: the client trace with
+// values from ContextWithTrace, if any. A WithTrace string is sent as-is, with
+// its keys in order: call values replace values of the same keys in place, and
+// other call keys are appended. Otherwise, it's TraceContext.String.
+func (c entityClient) traceHeader() string {
+	callTrace, _ := c.Context().Value(traceContextKey{}).(TraceContext)
+	if c.traceStr != "" {
+		if len(callTrace) == 0 {
+			return c.traceStr
+		}
+		add := ParseTraceContext(callTrace.String()) // only valid pairs
+		pairs := strings.Split(c.traceStr, ",")
+		for i, kv := range pairs {
+			k := strings.SplitN(kv, "=", 2)[0]
+			if v, ok := add[k]; ok {
+				pairs[i] = k + "=" + v
+				delete(add, k)
+			}
+		}
+		if len(add) > 0 {
+			pairs = append(pairs, add.String())
+		}
+		return strings.Join(pairs, ",")
+	}
+	if len(callTrace) == 0 {
+		return c.trace.String()
+	}
+	trace := TraceContext{}
+	for k, v := range c.trace {
+		trace[k] = v
+	}
+	for k, v := range callTrace {
+		trace[k] = v
+	}
+	return trace.String()
 }
 
 func (c entityClient) url(endpoint string) string {
@@ -455,47 +3726,136 @@ func readError(resp *http.Response, bytes []byte) (bool, error) {
 		return done, ErrEntityNotFound
 	}
 
-	// No response data from API, it crashed or had unhandled error
+	// Response data should be an etre.Error. If not, the API crashed or had an
+	// unhandled error, so return its raw response.
+	var errResp Error
+	err := json.Unmarshal(bytes, &errResp)
+	if resp.StatusCode >= 500 && (err != nil || errResp.Type == "" || errResp.Message == "") {
+		return done, newServerError(resp.StatusCode, bytes)
+	}
 	if len(bytes) == 0 {
 		return done, fmt.Errorf("Server error: HTTP status %d, no response (check API logs)", resp.StatusCode)
 	}
-
-	// Response data should be an etre.Error
-	var errResp Error
-	if err := json.Unmarshal(bytes, &errResp); err != nil {
+	if err != nil {
 		return done, fmt.Errorf("Server error: HTTP status %d, cannot decode response (%s): %s", resp.StatusCode, err, string(bytes))
 	}
 	if errResp.Type == "" || errResp.Message == "" {
 		return done, fmt.Errorf("Server error: HTTP status %d, unknown response: %s", resp.StatusCode, string(bytes))
 	}
 	if resp.StatusCode >= 500 {
-		return done, fmt.Errorf("Server error: %s: %s (HTTP status %d)", errResp.Type, errResp.Message, resp.StatusCode)
+		return done, apiError{
+			msg: fmt.Sprintf("Server error: %s: %s (HTTP status %d)", errResp.Type, errResp.Message, resp.StatusCode),
+			err: errResp,
+		}
 	}
-	return done, fmt.Errorf("Client error: %s: %s (HTTP status %d)", errResp.Type, errResp.Message, resp.StatusCode)
+	return done, apiError{
+		msg: fmt.Sprintf("Client error: %s: %s (HTTP status %d)", errResp.Type, errResp.Message, resp.StatusCode),
+		err: errResp,
+	}
+}
+
+// apiError is an API error response. It wraps the Error for errors.Is and errors.As.
+type apiError struct {
+	msg string
+	err Error
+}
+
+func (e apiError) Error() string { return e.msg }
+func (e apiError) Unwrap() error { return e.err }
+
+// noRetry returns true if retrying cannot fix the error.
+func noRetry(err error) bool {
+	return errors.Is(err, ErrResponseTooLarge) || errors.Is(err, ErrClientClosed) || errors.Is(err, ErrCircuitOpen)
 }
 
-func (c entityClient) apiRetry(f func() (bool, error)) error {
+// apiRetry calls f until it's done, succeeds, or the retries are exhausted.
+// If the RetryPolicy is set, f is retried only if idempotent is true; else,
+// the legacy Retry and RetryWait options apply to all operations.
+func (c entityClient) apiRetry(idempotent bool, f func() (bool, error)) error {
+	if c.retryPolicy.MaxRetries > 0 {
+		return c.policyRetry(idempotent, f)
+	}
 	tries := 1 + c.retry
 	var err error
 	var done bool
 	for tryNo := uint(1); tryNo <= tries; tryNo++ {
 		done, err = f()
-		if done {
-			return err
+		if done || noRetry(err) {
+			return err // retrying returns the same response or error
 		}
 		if err == nil {
 			return nil // success
 		}
+		ctx := c.Context()
+		if ctx.Err() != nil {
+			return err // context cancelled or deadline exceeded, don't retry
+		}
 		if tryNo < tries { // don't log or sleep on last try
 			if c.retryLogging {
 				log.Printf("Error querying Etre: %s (try %d of %d, retry in %s)", err, tryNo, tries, c.retryWait)
 			}
-			time.Sleep(c.retryWait)
+			select {
+			case <-c.after(c.retryWait):
+			case <-ctx.Done():
+				return fmt.Errorf("retry aborted: %w (last error: %s)", ctx.Err(), err)
+			}
 		}
 	}
 	return err // last error
 }
 
+func (c entityClient) policyRetry(idempotent bool, f func() (bool, error)) error {
+	tries := 1
+	if idempotent {
+		tries += c.retryPolicy.MaxRetries
+	}
+	ctx := c.Context()
+	var err error
+	var done bool
+	for tryNo := 1; tryNo <= tries; tryNo++ {
+		done, err = f()
+		if done || err == nil || noRetry(err) {
+			return err
+		}
+		if tryNo == tries || ctx.Err() != nil {
+			break
+		}
+		wait := c.retryPolicy.backoff(tryNo)
+		if deadline, ok := ctx.Deadline(); ok && c.now().Add(wait).After(deadline) {
+			break // don't sleep past the deadline only to have the retry fail
+		}
+		if c.retryPolicy.OnRetry != nil {
+			c.retryPolicy.OnRetry(tryNo, err, wait)
+		}
+		if c.retryLogging {
+			log.Printf("Error querying Etre: %s (try %d of %d, retry in %s)", err, tryNo, tries, wait)
+		}
+		select {
+		case <-c.after(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("retry aborted: %w (last error: %s)", ctx.Err(), err)
+		}
+	}
+	return err // last error
+}
+
+// matchesRev returns true if the query matches an exact revision, like
+// "_id=abc,_rev=3". A write with such a query is idempotent because, once it
+// succeeds, the revision changes (or the entity is deleted) and a retry matches
+// nothing.
+func matchesRev(q string) bool {
+	qq, err := query.Translate(q)
+	if err != nil {
+		return false // let the API return the error
+	}
+	for _, p := range qq.Predicates {
+		if p.Label == META_LABEL_REV && (p.Operator == "=" || p.Operator == "==") {
+			return true
+		}
+	}
+	return false
+}
+
 // //////////////////////////////////////////////////////////////////////////
 // Mock client
 // //////////////////////////////////////////////////////////////////////////
@@ -505,20 +3865,72 @@ func (c entityClient) apiRetry(f func() (bool, error)) error {
 // return empty slices and no error. Defining a callback function allows tests
 // to intercept, save, and inspect Client calls and simulate Etre API returns.
 type MockEntityClient struct {
-	QueryFunc       func(string, QueryFilter) ([]Entity, error)
-	GetFunc         func(string) (Entity, error)
-	InsertFunc      func([]Entity) (WriteResult, error)
-	UpdateFunc      func(query string, patch Entity) (WriteResult, error)
-	UpdateOneFunc   func(id string, patch Entity) (WriteResult, error)
-	DeleteFunc      func(query string) (WriteResult, error)
-	DeleteOneFunc   func(id string) (WriteResult, error)
-	LabelsFunc      func(id string) ([]string, error)
-	DeleteLabelFunc func(id string, label string) (WriteResult, error)
-	EntityTypeFunc  func() string
-	WithSetFunc     func(Set) EntityClient
-	WithTraceFunc   func(string) EntityClient
-	WithContextFunc func(ctx context.Context) EntityClient
-	ContextFunc     func() context.Context
+	QueryFunc            func(string, QueryFilter) ([]Entity, error)
+	CountFunc            func(string, QueryFilter) (int64, error)
+	DistinctValuesFunc   func(label, query string, filter QueryFilter) ([]interface{}, error)
+	AggregateFunc        func(query string, groupBy []string, filter QueryFilter) ([]GroupResult, error)
+	ExplainFunc          func(query string, filter QueryFilter) (QueryPlan, error)
+	BatchQueryFunc       func(ctx context.Context, requests []QueryRequest) ([]QueryResponse, error)
+	StreamFunc           func(context.Context, string, QueryFilter) (*EntityIterator, error)
+	GetFunc              func(string) (Entity, error)
+	GetByIdFunc          func(string, QueryFilter) (Entity, error)
+	GetByIdsFunc         func([]string, QueryFilter) (map[string]Entity, error)
+	InsertFunc           func([]Entity) (WriteResult, error)
+	InsertStreamFunc     func(context.Context, <-chan Entity) (<-chan Write, error)
+	UpdateFunc           func(query string, patch Entity) (WriteResult, error)
+	UpdateManyFunc       func(query string, patch Entity, filter QueryFilter) (WriteResult, error)
+	UpdateOneFunc        func(id string, patch Entity) (WriteResult, error)
+	UpdateIfRevFunc      func(entity Entity, expectedRev int64) (Write, error)
+	MutateByIdFunc       func(ctx context.Context, id string, mutate func(Entity) (Entity, error)) (Write, error)
+	UpsertFunc           func(uniqueLabel string, entity Entity) (Write, error)
+	DeleteFunc           func(query string) (WriteResult, error)
+	DeleteByQueryFunc    func(query string, filter QueryFilter) (WriteResult, error)
+	DeleteOneFunc        func(id string) (WriteResult, error)
+	DeleteByIdsFunc      func(ids []string) (WriteResult, error)
+	LabelsFunc           func(id string) ([]string, error)
+	HistoryFunc          func(id string, limit int) ([]CDCEvent, error)
+	AllLabelsFunc        func() ([]string, error)
+	DeleteLabelFunc      func(id string, label string) (WriteResult, error)
+	EntityTypeFunc       func() string
+	PingFunc             func() error
+	ServerVersionFunc    func() (string, error)
+	StatsFunc            func() ClientStats
+	CloseFunc            func() error
+	WithSetFunc          func(Set) EntityClient
+	WithTraceFunc        func(string) EntityClient
+	WithTraceContextFunc func(TraceContext) EntityClient
+	WithContextFunc      func(ctx context.Context) EntityClient
+	WithLatencyFunc      func(*Latency) EntityClient
+	WithWriteOptionsFunc func(WriteOptions) EntityClient
+	ContextFunc          func() context.Context
+
+	QueryContextFunc          func(context.Context, string, QueryFilter) ([]Entity, error)
+	CountContextFunc          func(context.Context, string, QueryFilter) (int64, error)
+	DistinctValuesContextFunc func(ctx context.Context, label, query string, filter QueryFilter) ([]interface{}, error)
+	AggregateContextFunc      func(ctx context.Context, query string, groupBy []string, filter QueryFilter) ([]GroupResult, error)
+	ExplainContextFunc        func(ctx context.Context, query string, filter QueryFilter) (QueryPlan, error)
+	GetContextFunc            func(context.Context, string) (Entity, error)
+	GetByIdContextFunc        func(context.Context, string, QueryFilter) (Entity, error)
+	GetByIdsContextFunc       func(context.Context, []string, QueryFilter) (map[string]Entity, error)
+	InsertContextFunc         func(context.Context, []Entity) (WriteResult, error)
+	InsertBatchFunc           func(entities []Entity, batchSize int) ([]WriteResult, error)
+	InsertBatchContextFunc    func(ctx context.Context, entities []Entity, batchSize int) ([]WriteResult, error)
+	UpdateContextFunc         func(ctx context.Context, query string, patch Entity) (WriteResult, error)
+	UpdateManyContextFunc     func(ctx context.Context, query string, patch Entity, filter QueryFilter) (WriteResult, error)
+	UpdateOneContextFunc      func(ctx context.Context, id string, patch Entity) (WriteResult, error)
+	UpdateIfRevContextFunc    func(ctx context.Context, entity Entity, expectedRev int64) (Write, error)
+	UpsertContextFunc         func(ctx context.Context, uniqueLabel string, entity Entity) (Write, error)
+	DeleteContextFunc         func(ctx context.Context, query string) (WriteResult, error)
+	DeleteByQueryContextFunc  func(ctx context.Context, query string, filter QueryFilter) (WriteResult, error)
+	DeleteOneContextFunc      func(ctx context.Context, id string) (WriteResult, error)
+	DeleteByIdsContextFunc    func(ctx context.Context, ids []string) (WriteResult, error)
+	LabelsContextFunc         func(ctx context.Context, id string) ([]string, error)
+	HistoryContextFunc        func(ctx context.Context, id string, limit int) ([]CDCEvent, error)
+	AllLabelsContextFunc      func(ctx context.Context) ([]string, error)
+	DeleteLabelContextFunc    func(ctx context.Context, id string, label string) (WriteResult, error)
+	PingContextFunc           func(ctx context.Context) error
+	ServerVersionContextFunc  func(ctx context.Context) (string, error)
+	InvalidateQueryCacheFunc  func(pattern string) (int, error)
 }
 
 func (c MockEntityClient) Query(query string, filter QueryFilter) ([]Entity, error) {
@@ -528,6 +3940,76 @@ func (c MockEntityClient) Query(query string, filter QueryFilter) ([]Entity, err
 	return nil, nil
 }
 
+func (c MockEntityClient) Count(query string, filter QueryFilter) (int64, error) {
+	if c.CountFunc != nil {
+		return c.CountFunc(query, filter)
+	}
+	return 0, nil
+}
+
+func (c MockEntityClient) DistinctValues(label, query string, filter QueryFilter) ([]interface{}, error) {
+	if c.DistinctValuesFunc != nil {
+		return c.DistinctValuesFunc(label, query, filter)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) CountContext(ctx context.Context, query string, filter QueryFilter) (int64, error) {
+	if c.CountContextFunc != nil {
+		return c.CountContextFunc(ctx, query, filter)
+	}
+	return 0, nil
+}
+
+func (c MockEntityClient) DistinctValuesContext(ctx context.Context, label, query string, filter QueryFilter) ([]interface{}, error) {
+	if c.DistinctValuesContextFunc != nil {
+		return c.DistinctValuesContextFunc(ctx, label, query, filter)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) Aggregate(query string, groupBy []string, filter QueryFilter) ([]GroupResult, error) {
+	if c.AggregateFunc != nil {
+		return c.AggregateFunc(query, groupBy, filter)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) AggregateContext(ctx context.Context, query string, groupBy []string, filter QueryFilter) ([]GroupResult, error) {
+	if c.AggregateContextFunc != nil {
+		return c.AggregateContextFunc(ctx, query, groupBy, filter)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) Explain(query string, filter QueryFilter) (QueryPlan, error) {
+	if c.ExplainFunc != nil {
+		return c.ExplainFunc(query, filter)
+	}
+	return QueryPlan{}, nil
+}
+
+func (c MockEntityClient) ExplainContext(ctx context.Context, query string, filter QueryFilter) (QueryPlan, error) {
+	if c.ExplainContextFunc != nil {
+		return c.ExplainContextFunc(ctx, query, filter)
+	}
+	return QueryPlan{}, nil
+}
+
+func (c MockEntityClient) BatchQuery(ctx context.Context, requests []QueryRequest) ([]QueryResponse, error) {
+	if c.BatchQueryFunc != nil {
+		return c.BatchQueryFunc(ctx, requests)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) Stream(ctx context.Context, query string, filter QueryFilter) (*EntityIterator, error) {
+	if c.StreamFunc != nil {
+		return c.StreamFunc(ctx, query, filter)
+	}
+	return NewEntityIterator(nil), nil
+}
+
 func (c MockEntityClient) Get(id string) (Entity, error) {
 	if c.GetFunc != nil {
 		return c.GetFunc(id)
@@ -535,6 +4017,20 @@ func (c MockEntityClient) Get(id string) (Entity, error) {
 	return nil, nil
 }
 
+func (c MockEntityClient) GetById(id string, filter QueryFilter) (Entity, error) {
+	if c.GetByIdFunc != nil {
+		return c.GetByIdFunc(id, filter)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) GetByIds(ids []string, filter QueryFilter) (map[string]Entity, error) {
+	if c.GetByIdsFunc != nil {
+		return c.GetByIdsFunc(ids, filter)
+	}
+	return nil, nil
+}
+
 func (c MockEntityClient) Insert(entities []Entity) (WriteResult, error) {
 	if c.InsertFunc != nil {
 		return c.InsertFunc(entities)
@@ -542,6 +4038,29 @@ func (c MockEntityClient) Insert(entities []Entity) (WriteResult, error) {
 	return WriteResult{}, nil
 }
 
+func (c MockEntityClient) InsertStream(ctx context.Context, entities <-chan Entity) (<-chan Write, error) {
+	if c.InsertStreamFunc != nil {
+		return c.InsertStreamFunc(ctx, entities)
+	}
+	results := make(chan Write)
+	close(results)
+	return results, nil
+}
+
+func (c MockEntityClient) InsertBatch(entities []Entity, batchSize int) ([]WriteResult, error) {
+	if c.InsertBatchFunc != nil {
+		return c.InsertBatchFunc(entities, batchSize)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) InsertBatchContext(ctx context.Context, entities []Entity, batchSize int) ([]WriteResult, error) {
+	if c.InsertBatchContextFunc != nil {
+		return c.InsertBatchContextFunc(ctx, entities, batchSize)
+	}
+	return nil, nil
+}
+
 func (c MockEntityClient) Update(query string, patch Entity) (WriteResult, error) {
 	if c.UpdateFunc != nil {
 		return c.UpdateFunc(query, patch)
@@ -549,6 +4068,13 @@ func (c MockEntityClient) Update(query string, patch Entity) (WriteResult, error
 	return WriteResult{}, nil
 }
 
+func (c MockEntityClient) UpdateMany(query string, patch Entity, filter QueryFilter) (WriteResult, error) {
+	if c.UpdateManyFunc != nil {
+		return c.UpdateManyFunc(query, patch, filter)
+	}
+	return WriteResult{}, nil
+}
+
 func (c MockEntityClient) UpdateOne(id string, patch Entity) (WriteResult, error) {
 	if c.UpdateOneFunc != nil {
 		return c.UpdateOneFunc(id, patch)
@@ -556,6 +4082,27 @@ func (c MockEntityClient) UpdateOne(id string, patch Entity) (WriteResult, error
 	return WriteResult{}, nil
 }
 
+func (c MockEntityClient) UpdateIfRev(entity Entity, expectedRev int64) (Write, error) {
+	if c.UpdateIfRevFunc != nil {
+		return c.UpdateIfRevFunc(entity, expectedRev)
+	}
+	return Write{}, nil
+}
+
+func (c MockEntityClient) MutateById(ctx context.Context, id string, mutate func(Entity) (Entity, error)) (Write, error) {
+	if c.MutateByIdFunc != nil {
+		return c.MutateByIdFunc(ctx, id, mutate)
+	}
+	return Write{}, nil
+}
+
+func (c MockEntityClient) Upsert(uniqueLabel string, entity Entity) (Write, error) {
+	if c.UpsertFunc != nil {
+		return c.UpsertFunc(uniqueLabel, entity)
+	}
+	return Write{}, nil
+}
+
 func (c MockEntityClient) Delete(query string) (WriteResult, error) {
 	if c.DeleteFunc != nil {
 		return c.DeleteFunc(query)
@@ -563,6 +4110,13 @@ func (c MockEntityClient) Delete(query string) (WriteResult, error) {
 	return WriteResult{}, nil
 }
 
+func (c MockEntityClient) DeleteByQuery(query string, filter QueryFilter) (WriteResult, error) {
+	if c.DeleteByQueryFunc != nil {
+		return c.DeleteByQueryFunc(query, filter)
+	}
+	return WriteResult{}, nil
+}
+
 func (c MockEntityClient) DeleteOne(id string) (WriteResult, error) {
 	if c.DeleteOneFunc != nil {
 		return c.DeleteOneFunc(id)
@@ -570,6 +4124,13 @@ func (c MockEntityClient) DeleteOne(id string) (WriteResult, error) {
 	return WriteResult{}, nil
 }
 
+func (c MockEntityClient) DeleteByIds(ids []string) (WriteResult, error) {
+	if c.DeleteByIdsFunc != nil {
+		return c.DeleteByIdsFunc(ids)
+	}
+	return WriteResult{}, nil
+}
+
 func (c MockEntityClient) Labels(id string) ([]string, error) {
 	if c.LabelsFunc != nil {
 		return c.LabelsFunc(id)
@@ -577,6 +4138,20 @@ func (c MockEntityClient) Labels(id string) ([]string, error) {
 	return nil, nil
 }
 
+func (c MockEntityClient) History(id string, limit int) ([]CDCEvent, error) {
+	if c.HistoryFunc != nil {
+		return c.HistoryFunc(id, limit)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) AllLabels() ([]string, error) {
+	if c.AllLabelsFunc != nil {
+		return c.AllLabelsFunc()
+	}
+	return nil, nil
+}
+
 func (c MockEntityClient) DeleteLabel(id string, label string) (WriteResult, error) {
 	if c.DeleteLabelFunc != nil {
 		return c.DeleteLabelFunc(id, label)
@@ -591,6 +4166,41 @@ func (c MockEntityClient) EntityType() string {
 	return ""
 }
 
+func (c MockEntityClient) Ping() error {
+	if c.PingFunc != nil {
+		return c.PingFunc()
+	}
+	return nil
+}
+
+func (c MockEntityClient) ServerVersion() (string, error) {
+	if c.ServerVersionFunc != nil {
+		return c.ServerVersionFunc()
+	}
+	return VERSION, nil
+}
+
+func (c MockEntityClient) Stats() ClientStats {
+	if c.StatsFunc != nil {
+		return c.StatsFunc()
+	}
+	return ClientStats{}
+}
+
+func (c MockEntityClient) InvalidateQueryCache(pattern string) (int, error) {
+	if c.InvalidateQueryCacheFunc != nil {
+		return c.InvalidateQueryCacheFunc(pattern)
+	}
+	return 0, nil
+}
+
+func (c MockEntityClient) Close() error {
+	if c.CloseFunc != nil {
+		return c.CloseFunc()
+	}
+	return nil
+}
+
 func (c MockEntityClient) WithSet(set Set) EntityClient {
 	if c.WithSetFunc != nil {
 		return c.WithSetFunc(set)
@@ -605,6 +4215,13 @@ func (c MockEntityClient) WithTrace(trace string) EntityClient {
 	return c
 }
 
+func (c MockEntityClient) WithTraceContext(trace TraceContext) EntityClient {
+	if c.WithTraceContextFunc != nil {
+		return c.WithTraceContextFunc(trace)
+	}
+	return c
+}
+
 func (c MockEntityClient) WithContext(ctx context.Context) EntityClient {
 	if c.WithContextFunc != nil {
 		return c.WithContextFunc(ctx)
@@ -612,9 +4229,163 @@ func (c MockEntityClient) WithContext(ctx context.Context) EntityClient {
 	return c
 }
 
+func (c MockEntityClient) WithLatency(lat *Latency) EntityClient {
+	if c.WithLatencyFunc != nil {
+		return c.WithLatencyFunc(lat)
+	}
+	return c
+}
+
+func (c MockEntityClient) WithWriteOptions(opts WriteOptions) EntityClient {
+	if c.WithWriteOptionsFunc != nil {
+		return c.WithWriteOptionsFunc(opts)
+	}
+	return c
+}
+
 func (c MockEntityClient) Context() context.Context {
 	if c.ContextFunc != nil {
 		return c.ContextFunc()
 	}
 	return context.Background()
 }
+
+func (c MockEntityClient) QueryContext(ctx context.Context, query string, filter QueryFilter) ([]Entity, error) {
+	if c.QueryContextFunc != nil {
+		return c.QueryContextFunc(ctx, query, filter)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) GetContext(ctx context.Context, id string) (Entity, error) {
+	if c.GetContextFunc != nil {
+		return c.GetContextFunc(ctx, id)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) GetByIdContext(ctx context.Context, id string, filter QueryFilter) (Entity, error) {
+	if c.GetByIdContextFunc != nil {
+		return c.GetByIdContextFunc(ctx, id, filter)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) GetByIdsContext(ctx context.Context, ids []string, filter QueryFilter) (map[string]Entity, error) {
+	if c.GetByIdsContextFunc != nil {
+		return c.GetByIdsContextFunc(ctx, ids, filter)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) InsertContext(ctx context.Context, entities []Entity) (WriteResult, error) {
+	if c.InsertContextFunc != nil {
+		return c.InsertContextFunc(ctx, entities)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) UpdateContext(ctx context.Context, query string, patch Entity) (WriteResult, error) {
+	if c.UpdateContextFunc != nil {
+		return c.UpdateContextFunc(ctx, query, patch)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) UpdateManyContext(ctx context.Context, query string, patch Entity, filter QueryFilter) (WriteResult, error) {
+	if c.UpdateManyContextFunc != nil {
+		return c.UpdateManyContextFunc(ctx, query, patch, filter)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) UpdateOneContext(ctx context.Context, id string, patch Entity) (WriteResult, error) {
+	if c.UpdateOneContextFunc != nil {
+		return c.UpdateOneContextFunc(ctx, id, patch)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) UpdateIfRevContext(ctx context.Context, entity Entity, expectedRev int64) (Write, error) {
+	if c.UpdateIfRevContextFunc != nil {
+		return c.UpdateIfRevContextFunc(ctx, entity, expectedRev)
+	}
+	return Write{}, nil
+}
+
+func (c MockEntityClient) UpsertContext(ctx context.Context, uniqueLabel string, entity Entity) (Write, error) {
+	if c.UpsertContextFunc != nil {
+		return c.UpsertContextFunc(ctx, uniqueLabel, entity)
+	}
+	return Write{}, nil
+}
+
+func (c MockEntityClient) DeleteContext(ctx context.Context, query string) (WriteResult, error) {
+	if c.DeleteContextFunc != nil {
+		return c.DeleteContextFunc(ctx, query)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) DeleteByQueryContext(ctx context.Context, query string, filter QueryFilter) (WriteResult, error) {
+	if c.DeleteByQueryContextFunc != nil {
+		return c.DeleteByQueryContextFunc(ctx, query, filter)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) DeleteOneContext(ctx context.Context, id string) (WriteResult, error) {
+	if c.DeleteOneContextFunc != nil {
+		return c.DeleteOneContextFunc(ctx, id)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) DeleteByIdsContext(ctx context.Context, ids []string) (WriteResult, error) {
+	if c.DeleteByIdsContextFunc != nil {
+		return c.DeleteByIdsContextFunc(ctx, ids)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) LabelsContext(ctx context.Context, id string) ([]string, error) {
+	if c.LabelsContextFunc != nil {
+		return c.LabelsContextFunc(ctx, id)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) HistoryContext(ctx context.Context, id string, limit int) ([]CDCEvent, error) {
+	if c.HistoryContextFunc != nil {
+		return c.HistoryContextFunc(ctx, id, limit)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) AllLabelsContext(ctx context.Context) ([]string, error) {
+	if c.AllLabelsContextFunc != nil {
+		return c.AllLabelsContextFunc(ctx)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) DeleteLabelContext(ctx context.Context, id string, label string) (WriteResult, error) {
+	if c.DeleteLabelContextFunc != nil {
+		return c.DeleteLabelContextFunc(ctx, id, label)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) PingContext(ctx context.Context) error {
+	if c.PingContextFunc != nil {
+		return c.PingContextFunc(ctx)
+	}
+	return nil
+}
+
+func (c MockEntityClient) ServerVersionContext(ctx context.Context) (string, error) {
+	if c.ServerVersionContextFunc != nil {
+		return c.ServerVersionContextFunc(ctx)
+	}
+	return VERSION, nil
+}
@@ -0,0 +1,1288 @@
+// Copyright 2026, Square, Inc.
+
+package etre
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/etre/query"
+)
+
+// FakeEntityClient is an in-memory EntityClient for testing code that uses an
+// EntityClient without an Etre server. Unlike MockEntityClient, which returns
+// whatever its funcs return, it stores entities and writes them like the API:
+// Insert sets _id, _type, and _rev (0), every update increments _rev, writes
+// return WriteResult with Write.Diff, and errors are the same values that the
+// real client returns, like ErrIdSet, ErrIdNotSet, ErrTypeMismatch, and
+// ErrEntityNotFound. Copies made by the With methods share the same entities.
+// It is safe for use by multiple goroutines.
+//
+// Queries support a subset of the query language: =, ==, !=, in, notin, exists
+// (label), notexists (!label), isnull, <, <=, >, >= on integer values, and =~,
+// !~ on string values (with Go regexp, not MongoDB). Values are compared as
+// strings, so label "n" with value 1 matches query "n=1". QueryFilter options
+// are supported, except Timeout and Consistency, which are ignored. Unique
+// labels are not enforced, so inserts never return a duplicate-entity error.
+// Inserts with an idempotency key (see WithIdempotencyKey) are deduped like the
+// API, but keys are never forgotten. Writes save CDC events for History, without
+// set fields.
+type FakeEntityClient struct {
+	entityType string
+	store      *fakeStore
+	ctx        context.Context
+	set        Set
+	writeOpts  WriteOptions
+}
+
+type fakeStore struct {
+	mu       sync.Mutex
+	entities map[string]Entity // keyed on _id
+	nextId   int
+	inserts  map[string]fakeInsert // keyed on idempotency key
+	events   []CDCEvent            // in write order, see History
+}
+
+// fakeInsert is the result of an insert with an idempotency key.
+type fakeInsert struct {
+	hash string // of the entities
+	wr   WriteResult
+}
+
+var _ EntityClient = FakeEntityClient{}
+
+// NewFakeEntityClient returns a FakeEntityClient for the entity type with no
+// entities.
+func NewFakeEntityClient(entityType string) FakeEntityClient {
+	return FakeEntityClient{
+		entityType: entityType,
+		store:      &fakeStore{entities: map[string]Entity{}, inserts: map[string]fakeInsert{}},
+	}
+}
+
+// Entities returns copies of all entities sorted by _id, which is insert order.
+func (c FakeEntityClient) Entities() []Entity {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	return c.store.sorted()
+}
+
+func (c FakeEntityClient) WithSet(set Set) EntityClient {
+	c.set = set // copy on write
+	return c
+}
+
+func (c FakeEntityClient) WithTrace(trace string) EntityClient {
+	return c // not used
+}
+
+func (c FakeEntityClient) WithTraceContext(trace TraceContext) EntityClient {
+	return c // not used
+}
+
+func (c FakeEntityClient) WithContext(ctx context.Context) EntityClient {
+	c.ctx = ctx // copy on write
+	return c
+}
+
+func (c FakeEntityClient) WithLatency(lat *Latency) EntityClient {
+	return c // no network, so latency is always zero
+}
+
+func (c FakeEntityClient) WithWriteOptions(opts WriteOptions) EntityClient {
+	c.writeOpts = opts // copy on write
+	return c
+}
+
+func (c FakeEntityClient) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+func (c FakeEntityClient) EntityType() string {
+	return c.entityType
+}
+
+func (c FakeEntityClient) Query(query string, filter QueryFilter) ([]Entity, error) {
+	return c.QueryContext(c.Context(), query, filter)
+}
+
+func (c FakeEntityClient) QueryContext(ctx context.Context, query string, filter QueryFilter) ([]Entity, error) {
+	if err := fakeAborted(ctx); err != nil {
+		return nil, err
+	}
+	if query == "" {
+		return nil, ErrNoQuery
+	}
+	if err := validateFilter(query, filter); err != nil {
+		return nil, err
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	matches, err := c.store.match(sinceRevQuery(query, filter))
+	if err != nil {
+		return nil, err
+	}
+	matches = fakeDeleted(matches, filter)
+
+	if filter.Distinct {
+		label := filter.ReturnLabels[0]
+		seen := map[string]bool{}
+		values := []Entity{}
+		for _, e := range matches {
+			v, ok := e.GetPath(label)
+			if !ok || seen[fmt.Sprint(v)] {
+				continue
+			}
+			seen[fmt.Sprint(v)] = true
+			values = append(values, Entity{label: v})
+		}
+		return fakePage(values, filter), nil
+	}
+
+	if len(filter.Sort) > 0 {
+		fakeSort(matches, filter.Sort)
+	}
+	matches = fakePage(matches, filter)
+	entities := make([]Entity, len(matches))
+	for i, e := range matches {
+		if len(filter.ReturnLabels) == 0 {
+			entities[i] = e.Clone()
+			continue
+		}
+		entities[i] = Entity{}
+		for _, label := range filter.ReturnLabels {
+			fakeProject(entities[i], e, label)
+		}
+	}
+	return entities, nil
+}
+
+func (c FakeEntityClient) Count(query string, filter QueryFilter) (int64, error) {
+	return c.CountContext(c.Context(), query, filter)
+}
+
+func (c FakeEntityClient) CountContext(ctx context.Context, query string, filter QueryFilter) (int64, error) {
+	if filter.Distinct {
+		entities, err := c.QueryContext(ctx, query, QueryFilter{ReturnLabels: filter.ReturnLabels, Distinct: true, SinceRev: filter.SinceRev,
+			IncludeDeleted: filter.IncludeDeleted, OnlyDeleted: filter.OnlyDeleted})
+		return int64(len(entities)), err
+	}
+	entities, err := c.QueryContext(ctx, query, QueryFilter{ReturnLabels: []string{META_LABEL_ID}, SinceRev: filter.SinceRev,
+		IncludeDeleted: filter.IncludeDeleted, OnlyDeleted: filter.OnlyDeleted})
+	return int64(len(entities)), err
+}
+
+func (c FakeEntityClient) DistinctValues(label, query string, filter QueryFilter) ([]interface{}, error) {
+	return c.DistinctValuesContext(c.Context(), label, query, filter)
+}
+
+func (c FakeEntityClient) DistinctValuesContext(ctx context.Context, label, query string, filter QueryFilter) ([]interface{}, error) {
+	return distinctValues(c.QueryContext, ctx, label, query, filter)
+}
+
+func (c FakeEntityClient) Aggregate(query string, groupBy []string, filter QueryFilter) ([]GroupResult, error) {
+	return c.AggregateContext(c.Context(), query, groupBy, filter)
+}
+
+func (c FakeEntityClient) AggregateContext(ctx context.Context, query string, groupBy []string, filter QueryFilter) ([]GroupResult, error) {
+	if err := validateGroupBy(groupBy); err != nil {
+		return nil, err
+	}
+	labels := append([]string{META_LABEL_ID}, groupBy...) // _id for fakeSort
+	entities, err := c.QueryContext(ctx, query, QueryFilter{ReturnLabels: labels, SinceRev: filter.SinceRev,
+		IncludeDeleted: filter.IncludeDeleted, OnlyDeleted: filter.OnlyDeleted})
+	if err != nil {
+		return nil, err
+	}
+	// Sorted by the groupBy labels, entities in a group are adjacent
+	fakeSort(entities, groupBy)
+	groups := []GroupResult{}
+	for _, e := range entities {
+		if n := len(groups); n > 0 && fakeSameGroup(groups[n-1].Group, e, groupBy) {
+			groups[n-1].Count++
+			continue
+		}
+		g := Entity{}
+		for _, label := range groupBy {
+			g[label] = e[label] // nil if not set
+		}
+		groups = append(groups, GroupResult{Group: g, Count: 1})
+	}
+	if filter.Offset > 0 {
+		if filter.Offset >= len(groups) {
+			return []GroupResult{}, nil
+		}
+		groups = groups[filter.Offset:]
+	}
+	if filter.Limit > 0 && filter.Limit < len(groups) {
+		groups = groups[:filter.Limit]
+	}
+	return groups, nil
+}
+
+func (c FakeEntityClient) Explain(query string, filter QueryFilter) (QueryPlan, error) {
+	return c.ExplainContext(c.Context(), query, filter)
+}
+
+// ExplainContext returns a collection scan plan: without indexes, the fake
+// examines every entity. TimeMs is zero.
+func (c FakeEntityClient) ExplainContext(ctx context.Context, query string, filter QueryFilter) (QueryPlan, error) {
+	if filter.Distinct {
+		return QueryPlan{}, Error{
+			Message:    "distinct queries cannot be explained",
+			Type:       "invalid-query",
+			HTTPStatus: http.StatusBadRequest,
+		}
+	}
+	entities, err := c.QueryContext(ctx, query, QueryFilter{ReturnLabels: []string{META_LABEL_ID}, Sort: filter.Sort,
+		Limit: filter.Limit, Offset: filter.Offset, SinceRev: filter.SinceRev,
+		IncludeDeleted: filter.IncludeDeleted, OnlyDeleted: filter.OnlyDeleted})
+	if err != nil {
+		return QueryPlan{}, err
+	}
+	c.store.mu.Lock()
+	n := len(c.store.entities)
+	c.store.mu.Unlock()
+	return QueryPlan{Stage: "COLLSCAN", DocsExamined: int64(n), Returned: int64(len(entities))}, nil
+}
+
+// fakeSameGroup returns true if the entity has the group's groupBy label values.
+func fakeSameGroup(group, e Entity, groupBy []string) bool {
+	for _, label := range groupBy {
+		if fakeCompare(group[label], e[label]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// BatchQuery runs the queries concurrently, like EntityClient.BatchQuery, at most
+// DEFAULT_BATCH_QUERY_CONCURRENCY at a time.
+func (c FakeEntityClient) BatchQuery(ctx context.Context, requests []QueryRequest) ([]QueryResponse, error) {
+	return batchQuery(c.QueryContext, ctx, requests, 0)
+}
+
+func (c FakeEntityClient) Stream(ctx context.Context, query string, filter QueryFilter) (*EntityIterator, error) {
+	if query == "" {
+		return nil, ErrNoQuery
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = DEFAULT_STREAM_PAGE_SIZE
+	}
+	if len(filter.Sort) == 0 {
+		filter.Sort = []string{META_LABEL_ID}
+	}
+	it := &EntityIterator{
+		ctx: ctx,
+		read: func(offset int) ([]Entity, error) {
+			f := filter
+			f.Offset = offset
+			return c.QueryContext(ctx, query, f)
+		},
+		pageSize: filter.Limit,
+		offset:   filter.Offset,
+	}
+	if err := it.readPage(); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+func (c FakeEntityClient) Get(id string) (Entity, error) {
+	return c.GetContext(c.Context(), id)
+}
+
+func (c FakeEntityClient) GetContext(ctx context.Context, id string) (Entity, error) {
+	return c.GetByIdContext(ctx, id, QueryFilter{})
+}
+
+func (c FakeEntityClient) GetById(id string, filter QueryFilter) (Entity, error) {
+	return c.GetByIdContext(c.Context(), id, filter)
+}
+
+func (c FakeEntityClient) GetByIdContext(ctx context.Context, id string, filter QueryFilter) (Entity, error) {
+	if err := fakeAborted(ctx); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, ErrIdNotSet
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	e, ok := c.store.entities[id]
+	if !ok {
+		return nil, ErrEntityNotFound
+	}
+	if len(filter.ReturnLabels) == 0 {
+		return e.Clone(), nil
+	}
+	partial := Entity{}
+	for _, label := range filter.ReturnLabels {
+		if v, ok := e[label]; ok {
+			partial[label] = cloneValue(v)
+		}
+	}
+	return partial, nil
+}
+
+func (c FakeEntityClient) GetByIds(ids []string, filter QueryFilter) (map[string]Entity, error) {
+	return c.GetByIdsContext(c.Context(), ids, filter)
+}
+
+func (c FakeEntityClient) GetByIdsContext(ctx context.Context, ids []string, filter QueryFilter) (map[string]Entity, error) {
+	return getByIds(c.QueryContext, ctx, ids, filter)
+}
+
+func (c FakeEntityClient) Insert(entities []Entity) (WriteResult, error) {
+	return c.InsertContext(c.Context(), entities)
+}
+
+func (c FakeEntityClient) InsertContext(ctx context.Context, entities []Entity) (WriteResult, error) {
+	if err := fakeAborted(ctx); err != nil {
+		return WriteResult{}, err
+	}
+	if len(entities) == 0 {
+		return WriteResult{}, ErrNoEntity
+	}
+	if c.writeOpts.DryRun {
+		return WriteResult{}, ErrDryRunInsert
+	}
+	entities, err := checkTypes(c.entityType, entities...)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	if err := validateEntities(entities...); err != nil {
+		return WriteResult{}, err
+	}
+	for _, e := range entities {
+		if err := e.Validate("insert"); err != nil {
+			return WriteResult{}, err
+		}
+		for label, v := range e {
+			if op, _, ok := ArrayOp(v); ok {
+				return WriteResult{}, Error{
+					Message:    fmt.Sprintf("array operator %s for key %s is only allowed on patch", op, label),
+					Type:       "invalid-array-op",
+					HTTPStatus: http.StatusBadRequest,
+				}
+			}
+			if _, ok := IncrementOp(v); ok {
+				return WriteResult{}, Error{
+					Message:    fmt.Sprintf("counter operator %s for key %s is only allowed on patch", COUNTER_OP_INC, label),
+					Type:       "invalid-counter-op",
+					HTTPStatus: http.StatusBadRequest,
+				}
+			}
+		}
+	}
+	if c.set.Size > 0 {
+		if entities, err = WithSet(c.set, entities); err != nil {
+			return WriteResult{}, err
+		}
+	}
+
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	key := IdempotencyKey(ctx)
+	hash := ""
+	if key != "" {
+		for _, e := range entities {
+			h, err := e.Hash()
+			if err != nil {
+				return WriteResult{}, err
+			}
+			hash += h + ","
+		}
+		if prev, ok := c.store.inserts[key]; ok {
+			if prev.hash != hash {
+				return WriteResult{Error: &Error{
+					Message:    "idempotency key was used for an insert with different entities",
+					Type:       "idempotency-key-reused",
+					HTTPStatus: http.StatusUnprocessableEntity,
+				}}, nil
+			}
+			wr := prev.wr
+			wr.Writes = append([]Write{}, prev.wr.Writes...)
+			wr.Replayed = true
+			return wr, nil
+		}
+	}
+	wr := WriteResult{Writes: make([]Write, len(entities))}
+	for i, e := range entities {
+		c.store.nextId++
+		id := fmt.Sprintf("%024x", c.store.nextId) // like a MongoDB ObjectID
+		e = e.Clone()
+		e[META_LABEL_ID] = id
+		e[META_LABEL_TYPE] = c.entityType
+		e[META_LABEL_REV] = int64(0)
+		c.store.entities[id] = e
+		c.store.record(CDC_OP_INSERT, e, 0, nil, e)
+		wr.Writes[i] = Write{EntityId: id, URI: API_ROOT + "/entity/" + id}
+	}
+	if key != "" {
+		c.store.inserts[key] = fakeInsert{hash: hash, wr: wr}
+	}
+	return wr, nil
+}
+
+// InsertStream inserts each entity like Insert, in order, as it's received.
+func (c FakeEntityClient) InsertStream(ctx context.Context, entities <-chan Entity) (<-chan Write, error) {
+	if c.writeOpts.DryRun {
+		return nil, ErrDryRunInsert
+	}
+	results := make(chan Write)
+	go func() {
+		defer close(results)
+		for i := 0; ; i++ {
+			var w Write
+			select {
+			case e, ok := <-entities:
+				if !ok {
+					return
+				}
+				wr, err := c.InsertContext(ctx, []Entity{e})
+				switch {
+				case err != nil:
+					w = Write{Error: &Error{Message: err.Error(), Type: "invalid-content", HTTPStatus: http.StatusBadRequest}}
+				case wr.Error != nil:
+					w = Write{Error: wr.Error}
+				default:
+					w = wr.Writes[0]
+				}
+				w.Index = i
+			case <-ctx.Done():
+				w = Write{Index: -1, Error: &Error{Message: fakeAborted(ctx).Error(), Type: "stream-error"}}
+			}
+			select {
+			case results <- w:
+			case <-ctx.Done():
+				return
+			}
+			if w.Index == -1 {
+				return
+			}
+		}
+	}()
+	return results, nil
+}
+
+func (c FakeEntityClient) InsertBatch(entities []Entity, batchSize int) ([]WriteResult, error) {
+	return c.InsertBatchContext(c.Context(), entities, batchSize)
+}
+
+func (c FakeEntityClient) InsertBatchContext(ctx context.Context, entities []Entity, batchSize int) ([]WriteResult, error) {
+	if len(entities) == 0 {
+		return nil, ErrNoEntity
+	}
+	if batchSize <= 0 {
+		batchSize = DEFAULT_INSERT_BATCH_SIZE
+	}
+	key := IdempotencyKey(ctx)
+	nBatches := (len(entities) + batchSize - 1) / batchSize
+	results := make([]WriteResult, 0, nBatches)
+	for i := 0; i < nBatches; i++ {
+		start := i * batchSize
+		end := start + batchSize
+		if end > len(entities) {
+			end = len(entities)
+		}
+		batchCtx := ctx
+		if key != "" {
+			batchCtx = WithIdempotencyKey(ctx, fmt.Sprintf("%s-%d", key, i+1))
+		}
+		wr, err := c.InsertContext(batchCtx, entities[start:end])
+		results = append(results, wr)
+		if err != nil {
+			return results, fmt.Errorf("insert batch %d of %d (entities %d-%d): %w", i+1, nBatches, start, end-1, err)
+		}
+	}
+	return results, nil
+}
+
+func (c FakeEntityClient) Update(query string, patch Entity) (WriteResult, error) {
+	return c.UpdateContext(c.Context(), query, patch)
+}
+
+func (c FakeEntityClient) UpdateContext(ctx context.Context, query string, patch Entity) (WriteResult, error) {
+	if err := fakeAborted(ctx); err != nil {
+		return WriteResult{}, err
+	}
+	if query == "" {
+		return WriteResult{}, ErrNoQuery
+	}
+	if len(patch) == 0 {
+		return WriteResult{}, ErrNoEntity
+	}
+	checked, err := checkTypes(c.entityType, patch)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	patch = checked[0]
+	if err := fakeValidatePatch(patch, c.writeOpts); err != nil {
+		return WriteResult{}, err
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	matches, err := c.store.match(query)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	wr := WriteResult{Writes: []Write{}, DryRun: c.writeOpts.DryRun}
+	for _, e := range matches {
+		w, werr := c.store.update(e.Id(), patch, c.writeOpts)
+		if werr != nil {
+			wr.Error = werr // partial write, like the API
+			return wr, nil
+		}
+		wr.Writes = append(wr.Writes, w)
+	}
+	return wr, nil
+}
+
+func (c FakeEntityClient) UpdateMany(query string, patch Entity, filter QueryFilter) (WriteResult, error) {
+	return c.UpdateManyContext(c.Context(), query, patch, filter)
+}
+
+func (c FakeEntityClient) UpdateManyContext(ctx context.Context, query string, patch Entity, filter QueryFilter) (WriteResult, error) {
+	if query == "" {
+		return WriteResult{}, ErrNoQuery
+	}
+	for _, ml := range []string{META_LABEL_ID, META_LABEL_TYPE, META_LABEL_REV} {
+		if patch.Has(ml) {
+			return WriteResult{}, fmt.Errorf("patch cannot set meta-label %s", ml)
+		}
+	}
+	if filter.Limit > 0 || filter.Offset > 0 || len(filter.Sort) > 0 || len(filter.ReturnLabels) > 0 || filter.Distinct {
+		return WriteResult{}, fmt.Errorf("invalid QueryFilter: UpdateMany supports only Timeout: %+v", filter)
+	}
+	return c.UpdateContext(ctx, query, patch)
+}
+
+func (c FakeEntityClient) UpdateOne(id string, patch Entity) (WriteResult, error) {
+	return c.UpdateOneContext(c.Context(), id, patch)
+}
+
+func (c FakeEntityClient) UpdateOneContext(ctx context.Context, id string, patch Entity) (WriteResult, error) {
+	if err := fakeAborted(ctx); err != nil {
+		return WriteResult{}, err
+	}
+	if id == "" {
+		return WriteResult{}, ErrIdNotSet
+	}
+	checked, err := checkTypes(c.entityType, patch)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	patch = checked[0]
+	if err := fakeValidatePatch(patch, c.writeOpts); err != nil {
+		return WriteResult{}, err
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	if _, ok := c.store.entities[id]; !ok {
+		return fakeNotFound(id), nil
+	}
+	w, werr := c.store.update(id, patch, c.writeOpts)
+	if werr != nil {
+		return WriteResult{Error: werr}, nil
+	}
+	return WriteResult{
+		Writes: []Write{w},
+		DryRun: c.writeOpts.DryRun,
+	}, nil
+}
+
+func (c FakeEntityClient) UpdateIfRev(entity Entity, expectedRev int64) (Write, error) {
+	return c.UpdateIfRevContext(c.Context(), entity, expectedRev)
+}
+
+func (c FakeEntityClient) UpdateIfRevContext(ctx context.Context, entity Entity, expectedRev int64) (Write, error) {
+	if err := fakeAborted(ctx); err != nil {
+		return Write{}, err
+	}
+	id, ok := entity.IdOK()
+	if !ok {
+		return Write{}, ErrIdNotSet
+	}
+	if _, err := checkTypes(c.entityType, entity); err != nil {
+		return Write{}, err
+	}
+	patch := Entity{}
+	for k, v := range entity {
+		if k == META_LABEL_ID || k == META_LABEL_TYPE || k == META_LABEL_REV {
+			continue
+		}
+		patch[k] = v
+	}
+	if len(patch) == 0 {
+		return Write{}, ErrNoEntity
+	}
+	if err := fakeValidatePatch(patch, c.writeOpts); err != nil {
+		return Write{}, err
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	e, ok := c.store.entities[id]
+	if !ok {
+		return Write{}, fakeNotFound(id).Err()
+	}
+	if e.Rev() != expectedRev {
+		return Write{}, Error{
+			Message:    fmt.Sprintf("entity _rev is %d, expected %d", e.Rev(), expectedRev),
+			Type:       "rev-conflict",
+			EntityId:   id,
+			HTTPStatus: http.StatusConflict,
+			Rev:        e.Rev(),
+		}
+	}
+	w, werr := c.store.update(id, patch, c.writeOpts)
+	if werr != nil {
+		return Write{}, *werr
+	}
+	return w, nil
+}
+
+func (c FakeEntityClient) MutateById(ctx context.Context, id string, mutate func(Entity) (Entity, error)) (Write, error) {
+	return mutateById(ctx, c, id, mutate, MUTATE_MAX_TRIES)
+}
+
+func (c FakeEntityClient) Upsert(uniqueLabel string, entity Entity) (Write, error) {
+	return c.UpsertContext(c.Context(), uniqueLabel, entity)
+}
+
+func (c FakeEntityClient) UpsertContext(ctx context.Context, uniqueLabel string, entity Entity) (Write, error) {
+	if len(entity) == 0 {
+		return Write{}, ErrNoEntity
+	}
+	if entity.Has(META_LABEL_ID) {
+		return Write{}, ErrIdSet
+	}
+	if c.writeOpts.DryRun {
+		return Write{}, ErrDryRunInsert
+	}
+	val, ok := entity[uniqueLabel].(string)
+	if !ok || val == "" {
+		return Write{}, fmt.Errorf("entity label %s is not set or not a string: %T", uniqueLabel, entity[uniqueLabel])
+	}
+	q, err := QueryBuilder{}.Equal(uniqueLabel, val).Build() // quotes the value, like "a,b"
+	if err != nil {
+		return Write{}, err
+	}
+	found, err := c.QueryContext(ctx, q, QueryFilter{ReturnLabels: []string{META_LABEL_ID}})
+	if err != nil {
+		return Write{}, err
+	}
+	switch len(found) {
+	case 0:
+		wr, err := c.InsertContext(ctx, []Entity{entity})
+		if err != nil {
+			return Write{}, err
+		}
+		w := wr.Writes[0]
+		w.Inserted = true
+		return w, nil
+	case 1:
+		wr, err := c.UpdateOneContext(ctx, found[0].Id(), entity)
+		if err != nil {
+			return Write{}, err
+		}
+		if err := wr.Err(); err != nil {
+			return Write{}, err
+		}
+		return wr.Writes[0], nil
+	default:
+		return Write{}, fmt.Errorf("%d %s entities match %s: label %s is not unique", len(found), c.entityType, q, uniqueLabel)
+	}
+}
+
+func (c FakeEntityClient) Delete(query string) (WriteResult, error) {
+	return c.DeleteContext(c.Context(), query)
+}
+
+func (c FakeEntityClient) DeleteContext(ctx context.Context, query string) (WriteResult, error) {
+	return c.DeleteByQueryContext(ctx, query, QueryFilter{})
+}
+
+func (c FakeEntityClient) DeleteByQuery(query string, filter QueryFilter) (WriteResult, error) {
+	return c.DeleteByQueryContext(c.Context(), query, filter)
+}
+
+func (c FakeEntityClient) DeleteByQueryContext(ctx context.Context, query string, filter QueryFilter) (WriteResult, error) {
+	if err := fakeAborted(ctx); err != nil {
+		return WriteResult{}, err
+	}
+	if query == "" {
+		return WriteResult{}, ErrNoQuery // never delete all entities
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	matches, err := c.store.match(query)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	// One request deletes all matching entities, so filter.Limit doesn't matter
+	wr := WriteResult{Writes: []Write{}, DryRun: c.writeOpts.DryRun}
+	for _, e := range matches {
+		wr.Writes = append(wr.Writes, c.store.delete(e.Id(), c.writeOpts.DryRun))
+	}
+	return wr, nil
+}
+
+func (c FakeEntityClient) DeleteOne(id string) (WriteResult, error) {
+	return c.DeleteOneContext(c.Context(), id)
+}
+
+func (c FakeEntityClient) DeleteOneContext(ctx context.Context, id string) (WriteResult, error) {
+	if err := fakeAborted(ctx); err != nil {
+		return WriteResult{}, err
+	}
+	if id == "" {
+		return WriteResult{}, ErrIdNotSet
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	if _, ok := c.store.entities[id]; !ok {
+		return fakeNotFound(id), nil
+	}
+	return WriteResult{
+		Writes: []Write{c.store.delete(id, c.writeOpts.DryRun)},
+		DryRun: c.writeOpts.DryRun,
+	}, nil
+}
+
+func (c FakeEntityClient) DeleteByIds(ids []string) (WriteResult, error) {
+	return c.DeleteByIdsContext(c.Context(), ids)
+}
+
+func (c FakeEntityClient) DeleteByIdsContext(ctx context.Context, ids []string) (WriteResult, error) {
+	return deleteByIds(c.DeleteOneContext, ctx, ids, c.writeOpts)
+}
+
+func (c FakeEntityClient) Labels(id string) ([]string, error) {
+	return c.LabelsContext(c.Context(), id)
+}
+
+func (c FakeEntityClient) LabelsContext(ctx context.Context, id string) ([]string, error) {
+	e, err := c.GetContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return e.Labels(), nil
+}
+
+func (c FakeEntityClient) History(id string, limit int) ([]CDCEvent, error) {
+	return c.HistoryContext(c.Context(), id, limit)
+}
+
+// HistoryContext returns the CDC events of the entity written by the fake.
+// Events are never expired, so the first event is always the insert.
+func (c FakeEntityClient) HistoryContext(ctx context.Context, id string, limit int) ([]CDCEvent, error) {
+	if err := fakeAborted(ctx); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, ErrIdNotSet
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	events := []CDCEvent{}
+	for _, e := range c.store.events {
+		if e.EntityId == id && e.EntityType == c.entityType {
+			events = append(events, e)
+		}
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events, nil
+}
+
+func (c FakeEntityClient) AllLabels() ([]string, error) {
+	return c.AllLabelsContext(c.Context())
+}
+
+func (c FakeEntityClient) AllLabelsContext(ctx context.Context) ([]string, error) {
+	if err := fakeAborted(ctx); err != nil {
+		return nil, err
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	seen := map[string]bool{}
+	labels := []string{}
+	for _, e := range c.store.entities {
+		for label := range e {
+			if !seen[label] {
+				seen[label] = true
+				labels = append(labels, label)
+			}
+		}
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
+
+func (c FakeEntityClient) DeleteLabel(id string, label string) (WriteResult, error) {
+	return c.DeleteLabelContext(c.Context(), id, label)
+}
+
+func (c FakeEntityClient) DeleteLabelContext(ctx context.Context, id string, label string) (WriteResult, error) {
+	if err := fakeAborted(ctx); err != nil {
+		return WriteResult{}, err
+	}
+	if id == "" {
+		return WriteResult{}, ErrIdNotSet
+	}
+	if label == "" {
+		return WriteResult{}, ErrNoLabel
+	}
+	if IsMetalabel(label) {
+		return WriteResult{Error: &Error{
+			Message:    "deleting metalabel " + label + " is not allowed",
+			Type:       "invalid-param",
+			HTTPStatus: http.StatusBadRequest,
+		}}, nil
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	e, ok := c.store.entities[id]
+	if !ok {
+		return WriteResult{}, nil // delete is idempotent
+	}
+	diff := Entity{
+		META_LABEL_ID:   id,
+		META_LABEL_TYPE: e[META_LABEL_TYPE],
+		META_LABEL_REV:  e.Rev(),
+	}
+	if v, ok := e[label]; ok {
+		diff[label] = v
+	}
+	if !c.writeOpts.DryRun {
+		old := Entity{}
+		if v, ok := e[label]; ok {
+			old[label] = v
+		}
+		delete(e, label)
+		e[META_LABEL_REV] = e.Rev() + 1
+		c.store.record(CDC_OP_UPDATE, e, e.Rev(), old, Entity{})
+	}
+	return WriteResult{
+		Writes: []Write{{EntityId: id, URI: API_ROOT + "/entity/" + id, Diff: diff}},
+		DryRun: c.writeOpts.DryRun,
+	}, nil
+}
+
+func (c FakeEntityClient) Ping() error {
+	return c.PingContext(c.Context())
+}
+
+func (c FakeEntityClient) PingContext(ctx context.Context) error {
+	return fakeAborted(ctx)
+}
+
+// Close does nothing: the fake has no connections, and it can be used after Close.
+func (c FakeEntityClient) Close() error {
+	return nil
+}
+
+func (c FakeEntityClient) ServerVersion() (string, error) {
+	return c.ServerVersionContext(c.Context())
+}
+
+func (c FakeEntityClient) ServerVersionContext(ctx context.Context) (string, error) {
+	if err := fakeAborted(ctx); err != nil {
+		return "", err
+	}
+	return VERSION, nil
+}
+
+// Stats returns zero stats: the fake doesn't make requests.
+func (c FakeEntityClient) Stats() ClientStats {
+	return ClientStats{}
+}
+
+// InvalidateQueryCache returns 0: the fake doesn't cache queries.
+func (c FakeEntityClient) InvalidateQueryCache(pattern string) (int, error) {
+	return 0, nil
+}
+
+// --------------------------------------------------------------------------
+
+// match returns the entities that match the query, sorted by _id. The caller
+// must lock the store.
+func (s *fakeStore) match(labelSelectors string) ([]Entity, error) {
+	q, err := query.Translate(labelSelectors)
+	if err != nil {
+		return nil, Error{
+			Message:    fmt.Sprintf("invalid query: %s", err),
+			Type:       "invalid-query",
+			HTTPStatus: http.StatusBadRequest,
+		}
+	}
+	matches := []Entity{}
+	for _, e := range s.sorted() {
+		ok, err := fakeMatch(e, q)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, e)
+		}
+	}
+	return matches, nil
+}
+
+// sorted returns copies of all entities sorted by _id. The caller must lock the store.
+func (s *fakeStore) sorted() []Entity {
+	entities := make([]Entity, 0, len(s.entities))
+	for _, e := range s.entities {
+		entities = append(entities, e.Clone())
+	}
+	sort.Slice(entities, func(i, j int) bool { return entities[i].Id() < entities[j].Id() })
+	return entities
+}
+
+// update patches the entity, or replaces its labels if opts.UpdateMode is
+// UPDATE_MODE_REPLACE, and increments its _rev, unless opts.DryRun is true, and
+// returns the Write with the previous values of the patched and removed labels.
+// Array operators (see Entity.AddToSet) are applied to the current arrays, and
+// counter operators (see Entity.Increment) to the current integers; if a label
+// is set but not the right type, it returns an error like the API and the entity
+// is not changed. The caller must lock the store and ensure the entity exists.
+func (s *fakeStore) update(id string, patch Entity, opts WriteOptions) (Write, *Error) {
+	e := s.entities[id]
+	applied := Entity{}
+	for label, v := range patch {
+		if delta, ok := IncrementOp(v); ok {
+			n, ok := ApplyIncrement(e[label], delta)
+			if !ok {
+				return Write{}, &Error{
+					Message:    fmt.Sprintf("cannot apply %s to label %s: value is not an integer", COUNTER_OP_INC, label),
+					Type:       "db-update",
+					EntityId:   id,
+					HTTPStatus: http.StatusInternalServerError,
+				}
+			}
+			applied[label] = n
+			continue
+		}
+		op, values, ok := ArrayOp(v)
+		if !ok {
+			applied[label] = cloneValue(v)
+			continue
+		}
+		arr, ok := ApplyArrayOp(e[label], op, values)
+		if !ok {
+			return Write{}, &Error{
+				Message:    fmt.Sprintf("cannot apply %s to label %s: value is not an array", op, label),
+				Type:       "db-update",
+				EntityId:   id,
+				HTTPStatus: http.StatusInternalServerError,
+			}
+		}
+		if arr != nil {
+			applied[label] = cloneValue(arr)
+		}
+	}
+	diff := Entity{
+		META_LABEL_ID:   id,
+		META_LABEL_TYPE: e[META_LABEL_TYPE],
+		META_LABEL_REV:  e.Rev(),
+	}
+	var remove []string
+	for label, v := range e {
+		if _, ok := patch[label]; ok {
+			diff[label] = v
+		} else if opts.UpdateMode == UPDATE_MODE_REPLACE && !IsMetalabel(label) {
+			diff[label] = v
+			remove = append(remove, label)
+		}
+	}
+	if !opts.DryRun {
+		old := Entity{}
+		for label, v := range diff {
+			if !IsMetalabel(label) {
+				old[label] = v
+			}
+		}
+		for label, v := range applied {
+			e[label] = v
+		}
+		for _, label := range remove {
+			delete(e, label)
+		}
+		e[META_LABEL_REV] = e.Rev() + 1
+		s.record(CDC_OP_UPDATE, e, e.Rev(), old, applied)
+	}
+	return Write{EntityId: id, URI: API_ROOT + "/entity/" + id, Diff: diff}, nil
+}
+
+// record saves a CDC event for History with the _id and _type of e, the rev,
+// and copies of old and new. The caller must lock the store.
+func (s *fakeStore) record(op string, e Entity, rev int64, old, new Entity) {
+	event := CDCEvent{
+		Id:         fmt.Sprintf("%024x", len(s.events)+1),
+		Ts:         time.Now().UnixMilli(),
+		Op:         op,
+		EntityId:   e.Id(),
+		EntityType: e.Type(),
+		EntityRev:  rev,
+	}
+	if old != nil {
+		old = old.Clone()
+		event.Old = &old
+	}
+	if new != nil {
+		new = new.Clone()
+		event.New = &new
+	}
+	s.events = append(s.events, event)
+}
+
+// delete deletes the entity, unless dryRun is true, and returns the Write with
+// the deleted entity. The caller must lock the store and ensure the entity exists.
+func (s *fakeStore) delete(id string, dryRun bool) Write {
+	e := s.entities[id]
+	if !dryRun {
+		delete(s.entities, id)
+		s.record(CDC_OP_DELETE, e, e.Rev()+1, e, nil) // like the API, the delete is a revision
+	}
+	return Write{EntityId: id, URI: API_ROOT + "/entity/" + id, Diff: e.Clone()}
+}
+
+// fakeMatch returns true if the entity matches all query predicates.
+func fakeMatch(e Entity, q query.Query) (bool, error) {
+	for _, p := range q.Predicates {
+		v, has := e[p.Label]
+		switch p.Operator {
+		case "exists":
+			if !has {
+				return false, nil
+			}
+		case "notexists":
+			if has {
+				return false, nil
+			}
+		case "isnull":
+			if !has || v != nil {
+				return false, nil
+			}
+		case "=", "==":
+			if !has || fmt.Sprint(v) != p.Value.(string) {
+				return false, nil
+			}
+		case "!=":
+			if has && fmt.Sprint(v) == p.Value.(string) {
+				return false, nil
+			}
+		case "in", "notin":
+			in := false
+			if has {
+				for _, val := range p.Value.([]string) {
+					if fmt.Sprint(v) == val {
+						in = true
+						break
+					}
+				}
+			}
+			if in != (p.Operator == "in") {
+				return false, nil
+			}
+		case "=~", "!~":
+			// Like MongoDB $regex, only string values match
+			s, ok := v.(string)
+			match := false
+			if ok {
+				match = regexp.MustCompile(p.Value.(string)).MatchString(s) // Translate compiled it
+			}
+			if match != (p.Operator == "=~") {
+				return false, nil
+			}
+		case "<", "<=", ">", ">=":
+			n, ok := toInt64(v)
+			if !has || !ok {
+				return false, nil
+			}
+			val := int64(p.Value.(int))
+			if (p.Operator == "<" && !(n < val)) ||
+				(p.Operator == "<=" && !(n <= val)) ||
+				(p.Operator == ">" && !(n > val)) ||
+				(p.Operator == ">=" && !(n >= val)) {
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("FakeEntityClient does not support query operator %s", p.Operator)
+		}
+	}
+	return true, nil
+}
+
+// fakeSort sorts entities by the labels like QueryFilter.Sort, then by _id.
+func fakeSort(entities []Entity, labels []string) {
+	sort.SliceStable(entities, func(i, j int) bool {
+		for _, label := range labels {
+			desc := label[0] == '-'
+			if desc {
+				label = label[1:]
+			}
+			cmp := fakeCompare(entities[i][label], entities[j][label])
+			if cmp == 0 {
+				continue
+			}
+			return (cmp < 0) != desc
+		}
+		return entities[i].Id() < entities[j].Id()
+	})
+}
+
+// fakeCompare compares label values: missing (nil) values first, then numbers,
+// then other values as strings, like MongoDB.
+func fakeCompare(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	fa, aNum := toFloat64(a)
+	fb, bNum := toFloat64(b)
+	switch {
+	case aNum && bNum:
+		if fa < fb {
+			return -1
+		} else if fa > fb {
+			return 1
+		}
+		return 0
+	case aNum:
+		return -1
+	case bNum:
+		return 1
+	}
+	sa, sb := fmt.Sprint(a), fmt.Sprint(b)
+	if sa < sb {
+		return -1
+	} else if sa > sb {
+		return 1
+	}
+	return 0
+}
+
+// fakeProject copies the label or dotted path (see QueryFilter.ReturnLabels) from
+// e to dst, like a MongoDB projection: a path returns the nested maps on the path
+// with only the keys on the path. It copies nothing if the path is not set, or a
+// value on it is not a map.
+func fakeProject(dst, e Entity, path string) {
+	src, d := map[string]interface{}(e), map[string]interface{}(dst)
+	keys := strings.Split(path, ".")
+	for i, key := range keys {
+		v, ok := src[key]
+		if !ok {
+			return
+		}
+		if i == len(keys)-1 {
+			d[key] = cloneValue(v)
+			return
+		}
+		if src, ok = toStringMap(v); !ok {
+			return
+		}
+		next, ok := d[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			d[key] = next
+		}
+		d = next
+	}
+}
+
+// fakeDeleted returns the entities that pass filter.IncludeDeleted and OnlyDeleted.
+// The fake deletes entities, like the API, so only entities inserted with _deleted
+// are tombstones.
+func fakeDeleted(entities []Entity, filter QueryFilter) []Entity {
+	if filter.IncludeDeleted && !filter.OnlyDeleted {
+		return entities
+	}
+	pass := make([]Entity, 0, len(entities))
+	for _, e := range entities {
+		if e.IsDeleted() == filter.OnlyDeleted {
+			pass = append(pass, e)
+		}
+	}
+	return pass
+}
+
+func fakePage(entities []Entity, filter QueryFilter) []Entity {
+	if filter.Offset > 0 {
+		if filter.Offset >= len(entities) {
+			return []Entity{}
+		}
+		entities = entities[filter.Offset:]
+	}
+	if filter.Limit > 0 && filter.Limit < len(entities) {
+		entities = entities[:filter.Limit]
+	}
+	return entities
+}
+
+// fakeValidatePatch returns an error if the patch has invalid labels or metalabels,
+// or the UpdateMode in opts is invalid,
+// which the API does not allow in a patch.
+func fakeValidatePatch(patch Entity, opts WriteOptions) error {
+	if err := validateUpdateMode(opts.UpdateMode); err != nil {
+		return err
+	}
+	if err := validateEntities(patch); err != nil {
+		return err
+	}
+	for label, v := range patch {
+		if IsMetalabel(label) {
+			return Error{
+				Message:    "patch cannot contain metalabel " + label,
+				Type:       "invalid-content",
+				HTTPStatus: http.StatusBadRequest,
+			}
+		}
+		if op, _, ok := ArrayOp(v); ok && opts.UpdateMode == UPDATE_MODE_REPLACE {
+			return Error{
+				Message:    fmt.Sprintf("array operator %s for label %s is not supported with updateMode=%s", op, label, UPDATE_MODE_REPLACE),
+				Type:       "invalid-param",
+				HTTPStatus: http.StatusBadRequest,
+			}
+		}
+		if _, ok := IncrementOp(v); ok && opts.UpdateMode == UPDATE_MODE_REPLACE {
+			return Error{
+				Message:    fmt.Sprintf("counter operator %s for label %s is not supported with updateMode=%s", COUNTER_OP_INC, label, UPDATE_MODE_REPLACE),
+				Type:       "invalid-param",
+				HTTPStatus: http.StatusBadRequest,
+			}
+		}
+	}
+	return nil
+}
+
+func fakeNotFound(id string) WriteResult {
+	return WriteResult{Error: &Error{
+		Message:    "entity not found",
+		Type:       "entity-not-found",
+		EntityId:   id,
+		HTTPStatus: http.StatusNotFound,
+	}}
+}
+
+func fakeAborted(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("request aborted: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,607 @@
+// Copyright 2026, Square, Inc.
+
+package etre_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/square/etre"
+)
+
+func TestFakeEntityClientWrites(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+
+	// Insert sets meta-labels
+	wr, err := ec.Insert([]etre.Entity{
+		{"host": "a", "zone": "east", "n": 1},
+		{"host": "b", "zone": "west", "n": 2},
+	})
+	require.NoError(t, err)
+	require.NoError(t, wr.Err())
+	require.Len(t, wr.Writes, 2)
+	idA, idB := wr.Writes[0].EntityId, wr.Writes[1].EntityId
+	assert.NotEqual(t, idA, idB)
+
+	a, err := ec.Get(idA)
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"_id": idA, "_type": "node", "_rev": int64(0), "host": "a", "zone": "east", "n": 1}, a)
+
+	// Update increments _rev and returns the previous values
+	wr, err = ec.Update("zone=east", etre.Entity{"zone": "north"})
+	require.NoError(t, err)
+	require.Len(t, wr.Writes, 1)
+	assert.Equal(t, etre.Entity{"_id": idA, "_type": "node", "_rev": int64(0), "zone": "east"}, wr.Writes[0].Diff)
+	a, err = ec.Get(idA)
+	require.NoError(t, err)
+	assert.Equal(t, "north", a["zone"])
+	assert.Equal(t, int64(1), a.Rev())
+
+	// UpdateIfRev with the old _rev is a conflict
+	_, err = ec.UpdateIfRev(etre.Entity{"_id": idA, "zone": "south"}, 0)
+	assert.True(t, errors.Is(err, etre.ErrRevConflict))
+	var etreErr etre.Error
+	require.True(t, errors.As(err, &etreErr))
+	assert.Equal(t, int64(1), etreErr.Rev)
+	w, err := ec.UpdateIfRev(etre.Entity{"_id": idA, "zone": "south"}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, idA, w.EntityId)
+
+	// Upsert updates the one matching entity, else inserts
+	w, err = ec.Upsert("host", etre.Entity{"host": "b", "zone": "east"})
+	require.NoError(t, err)
+	assert.Equal(t, idB, w.EntityId)
+	assert.False(t, w.Inserted)
+	w, err = ec.Upsert("host", etre.Entity{"host": "c"})
+	require.NoError(t, err)
+	assert.True(t, w.Inserted)
+	idC := w.EntityId
+
+	// DeleteLabel removes the label and increments _rev
+	wr, err = ec.DeleteLabel(idB, "zone")
+	require.NoError(t, err)
+	require.Len(t, wr.Writes, 1)
+	assert.Equal(t, "east", wr.Writes[0].Diff["zone"])
+	labels, err := ec.Labels(idB)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"_id", "_rev", "_type", "host", "n"}, labels)
+
+	// Dry run returns diffs but doesn't delete
+	wr, err = ec.WithWriteOptions(etre.WriteOptions{DryRun: true}).Delete("host=c")
+	require.NoError(t, err)
+	assert.True(t, wr.DryRun)
+	require.Len(t, wr.Writes, 1)
+	assert.Len(t, ec.Entities(), 3)
+
+	// Copies share the entities
+	wr, err = ec.WithContext(context.Background()).DeleteOne(idC)
+	require.NoError(t, err)
+	require.NoError(t, wr.Err())
+	assert.Len(t, ec.Entities(), 2)
+
+	// Single-entity writes on missing entity return entity-not-found
+	wr, err = ec.DeleteOne(idC)
+	require.NoError(t, err)
+	assert.True(t, errors.Is(wr.Err(), etre.ErrEntityNotFound))
+	wr, err = ec.UpdateOne(idC, etre.Entity{"x": "y"})
+	require.NoError(t, err)
+	assert.True(t, errors.Is(wr.Err(), etre.ErrEntityNotFound))
+}
+
+func TestFakeEntityClientUpdateMode(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	wr, err := ec.Insert([]etre.Entity{{"host": "a", "zone": "east", "n": 1}})
+	require.NoError(t, err)
+	id := wr.Writes[0].EntityId
+
+	// Replace removes labels not in the patch, and the diff has them
+	replace := ec.WithWriteOptions(etre.WriteOptions{UpdateMode: etre.UPDATE_MODE_REPLACE})
+	wr, err = replace.UpdateOne(id, etre.Entity{"host": "b", "n": 2})
+	require.NoError(t, err)
+	require.NoError(t, wr.Err())
+	require.Len(t, wr.Writes, 1)
+	assert.Equal(t, etre.Entity{"_id": id, "_type": "node", "_rev": int64(0), "host": "a", "zone": "east", "n": 1}, wr.Writes[0].Diff)
+	got, err := ec.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"_id": id, "_type": "node", "_rev": int64(1), "host": "b", "n": 2}, got)
+
+	// Merge, the default, does not
+	wr, err = ec.WithWriteOptions(etre.WriteOptions{UpdateMode: etre.UPDATE_MODE_MERGE}).UpdateOne(id, etre.Entity{"zone": "west"})
+	require.NoError(t, err)
+	require.NoError(t, wr.Err())
+	got, err = ec.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"_id": id, "_type": "node", "_rev": int64(2), "host": "b", "n": 2, "zone": "west"}, got)
+
+	_, err = ec.WithWriteOptions(etre.WriteOptions{UpdateMode: "patch"}).UpdateOne(id, etre.Entity{"n": 3})
+	assert.Error(t, err)
+}
+
+func TestFakeEntityClientArrayOps(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	wr, err := ec.Insert([]etre.Entity{{"host": "a"}})
+	require.NoError(t, err)
+	id := wr.Writes[0].EntityId
+
+	// AddToSet sets a label that's not set, with no duplicates
+	wr, err = ec.UpdateOne(id, etre.Entity{}.AddToSet("tags", "x", "y", "x"))
+	require.NoError(t, err)
+	require.NoError(t, wr.Err())
+	got, err := ec.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"x", "y"}, got["tags"])
+
+	// Pull and AddToSet on existing array, diff has previous array
+	wr, err = ec.Update("host=a", etre.Entity{"zone": "east"}.Pull("tags", "x").AddToSet("more", "z"))
+	require.NoError(t, err)
+	require.NoError(t, wr.Err())
+	require.Len(t, wr.Writes, 1)
+	assert.Equal(t, []interface{}{"x", "y"}, wr.Writes[0].Diff["tags"])
+	got, err = ec.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"_id": id, "_type": "node", "_rev": int64(2), "host": "a", "zone": "east", "tags": []interface{}{"y"}, "more": []interface{}{"z"}}, got)
+
+	// CDC event has the resulting arrays, not the operators
+	events, err := ec.History(id, 1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, etre.Entity{"zone": "east", "tags": []interface{}{"y"}, "more": []interface{}{"z"}}, *events[0].New)
+
+	// Label not an array
+	wr, err = ec.UpdateOne(id, etre.Entity{}.AddToSet("host", "b"))
+	require.NoError(t, err)
+	assert.Error(t, wr.Err())
+	got, err = ec.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, "a", got["host"])
+	assert.Equal(t, int64(2), got.Rev())
+
+	// Not allowed with replace or on insert
+	replace := ec.WithWriteOptions(etre.WriteOptions{UpdateMode: etre.UPDATE_MODE_REPLACE})
+	_, err = replace.UpdateOne(id, etre.Entity{}.AddToSet("tags", "x"))
+	assert.Error(t, err)
+	_, err = ec.Insert([]etre.Entity{etre.Entity{"host": "b"}.AddToSet("tags", "x")})
+	assert.Error(t, err)
+}
+
+func TestFakeEntityClientIncrement(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	wr, err := ec.Insert([]etre.Entity{{"host": "a", "restarts": 2}, {"host": "b"}})
+	require.NoError(t, err)
+	ida := wr.Writes[0].EntityId
+	idb := wr.Writes[1].EntityId
+
+	// Diff has the previous value, or no label if not set
+	wr, err = ec.Update("host", etre.Entity{}.Increment("restarts", 3))
+	require.NoError(t, err)
+	require.NoError(t, wr.Err())
+	require.Len(t, wr.Writes, 2)
+	for _, w := range wr.Writes {
+		if w.EntityId == ida {
+			assert.Equal(t, 2, w.Diff["restarts"])
+		} else {
+			assert.False(t, w.Diff.Has("restarts"))
+		}
+	}
+	got, err := ec.Get(ida)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), got["restarts"])
+	assert.Equal(t, int64(1), got.Rev())
+	got, err = ec.Get(idb)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), got["restarts"])
+
+	// CDC event has the incremented value, not the operator
+	events, err := ec.History(ida, 1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, etre.Entity{"restarts": int64(5)}, *events[0].New)
+
+	// Label not an integer
+	wr, err = ec.UpdateOne(ida, etre.Entity{}.Increment("host", 1))
+	require.NoError(t, err)
+	assert.Error(t, wr.Err())
+	got, err = ec.Get(ida)
+	require.NoError(t, err)
+	assert.Equal(t, "a", got["host"])
+	assert.Equal(t, int64(1), got.Rev())
+
+	// Not allowed with replace or on insert
+	replace := ec.WithWriteOptions(etre.WriteOptions{UpdateMode: etre.UPDATE_MODE_REPLACE})
+	_, err = replace.UpdateOne(ida, etre.Entity{}.Increment("restarts", 1))
+	assert.Error(t, err)
+	_, err = ec.Insert([]etre.Entity{etre.Entity{"host": "c"}.Increment("restarts", 1)})
+	assert.Error(t, err)
+}
+
+func TestFakeEntityClientDeleteByIds(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	wr, err := ec.Insert([]etre.Entity{{"host": "a"}, {"host": "b"}})
+	require.NoError(t, err)
+	idA, idB := wr.Writes[0].EntityId, wr.Writes[1].EntityId
+
+	wr, err = ec.WithWriteOptions(etre.WriteOptions{ContinueOnError: true}).DeleteByIds([]string{idA, "missing", idB})
+	require.NoError(t, err)
+	require.Len(t, wr.Writes, 2)
+	assert.ErrorIs(t, wr.Err(), etre.ErrEntityNotFound)
+	assert.Len(t, wr.Errors, 1)
+	assert.Contains(t, wr.Errors, "missing")
+	assert.Empty(t, ec.Entities())
+
+	// Idempotent
+	wr, err = ec.WithWriteOptions(etre.WriteOptions{IgnoreNotFound: true}).DeleteByIds([]string{idA, idB})
+	require.NoError(t, err)
+	assert.NoError(t, wr.Err())
+	assert.Empty(t, wr.Writes)
+}
+
+func TestFakeEntityClientInsertStream(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	entities := make(chan etre.Entity, 3)
+	entities <- etre.Entity{"host": "a"}
+	entities <- etre.Entity{"_id": "x"}
+	entities <- etre.Entity{"host": "b"}
+	close(entities)
+	results, err := ec.InsertStream(context.Background(), entities)
+	require.NoError(t, err)
+	var got []etre.Write
+	for w := range results {
+		got = append(got, w)
+	}
+	require.Len(t, got, 3)
+	assert.NoError(t, got[0].Err())
+	assert.Error(t, got[1].Err())
+	assert.Equal(t, 1, got[1].Index)
+	assert.NoError(t, got[2].Err())
+	assert.Len(t, ec.Entities(), 2)
+}
+
+func TestFakeEntityClientMutateById(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	wr, err := ec.Insert([]etre.Entity{{"host": "a", "n": 1}})
+	require.NoError(t, err)
+	id := wr.Writes[0].EntityId
+
+	// Changed concurrently on the first try, so mutate is called again with a fresh read
+	tries := 0
+	w, err := ec.MutateById(context.Background(), id, func(e etre.Entity) (etre.Entity, error) {
+		tries++
+		if tries == 1 {
+			_, err := ec.UpdateOne(id, etre.Entity{"n": 2})
+			require.NoError(t, err)
+		}
+		n, _ := e.Int("n")
+		e["n"] = n + 1
+		return e, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, id, w.EntityId)
+	assert.Equal(t, 2, tries)
+	got, err := ec.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), got["n"])
+	assert.Equal(t, int64(2), got.Rev())
+
+	_, err = ec.MutateById(context.Background(), "xyz", func(e etre.Entity) (etre.Entity, error) { return e, nil })
+	assert.ErrorIs(t, err, etre.ErrEntityNotFound)
+}
+
+func TestFakeEntityClientGetByIds(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	wr, err := ec.Insert([]etre.Entity{{"host": "a"}, {"host": "b"}, {"host": "c"}})
+	require.NoError(t, err)
+	idA, idC := wr.Writes[0].EntityId, wr.Writes[2].EntityId
+
+	got, err := ec.GetByIds([]string{idA, idC, "missing"}, etre.QueryFilter{ReturnLabels: []string{"host"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]etre.Entity{idA: {"host": "a"}, idC: {"host": "c"}}, got)
+
+	_, err = ec.GetByIds([]string{}, etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNoEntity)
+}
+
+func TestFakeEntityClientAggregate(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	_, err := ec.Insert([]etre.Entity{
+		{"host": "a", "dc": "west", "cores": 8},
+		{"host": "b", "dc": "east", "cores": 8},
+		{"host": "c", "dc": "east", "cores": 16},
+		{"host": "d", "dc": "east", "cores": 8},
+		{"host": "e", "cores": 8},
+	})
+	require.NoError(t, err)
+
+	got, err := ec.Aggregate("host", []string{"dc", "cores"}, etre.QueryFilter{})
+	require.NoError(t, err)
+	expect := []etre.GroupResult{
+		{Group: etre.Entity{"dc": nil, "cores": 8}, Count: 1},
+		{Group: etre.Entity{"dc": "east", "cores": 8}, Count: 2},
+		{Group: etre.Entity{"dc": "east", "cores": 16}, Count: 1},
+		{Group: etre.Entity{"dc": "west", "cores": 8}, Count: 1},
+	}
+	assert.Equal(t, expect, got)
+
+	got, err = ec.Aggregate("dc", []string{"dc"}, etre.QueryFilter{Offset: 1, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.GroupResult{{Group: etre.Entity{"dc": "west"}, Count: 1}}, got)
+
+	_, err = ec.Aggregate("host", nil, etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNoLabel)
+}
+
+func TestFakeEntityClientBatchQuery(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	_, err := ec.Insert([]etre.Entity{{"host": "a", "dc": "west"}, {"host": "b", "dc": "east"}})
+	require.NoError(t, err)
+
+	got, err := ec.BatchQuery(context.Background(), []etre.QueryRequest{
+		{Query: "dc=east", Filter: etre.QueryFilter{ReturnLabels: []string{"host"}}},
+		{Query: ""},
+		{Query: "host", Filter: etre.QueryFilter{ReturnLabels: []string{"host"}}},
+	})
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	assert.Equal(t, []etre.Entity{{"host": "b"}}, got[0].Entities)
+	assert.ErrorIs(t, got[1].Err, etre.ErrNoQuery)
+	assert.ElementsMatch(t, []etre.Entity{{"host": "a"}, {"host": "b"}}, got[2].Entities)
+}
+
+func TestFakeEntityClientDeleted(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	_, err := ec.Insert([]etre.Entity{{"host": "a"}, {"host": "b", "_deleted": true}})
+	require.NoError(t, err)
+
+	got, err := ec.Query("host", etre.QueryFilter{ReturnLabels: []string{"host"}})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"host": "a"}}, got)
+
+	n, err := ec.Count("host", etre.QueryFilter{IncludeDeleted: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	got, err = ec.Query("host", etre.QueryFilter{OnlyDeleted: true})
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.True(t, got[0].IsDeleted())
+	assert.Equal(t, "b", got[0]["host"])
+}
+
+func TestFakeEntityClientLabelPaths(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	_, err := ec.Insert([]etre.Entity{
+		{"host": "a", "metadata": map[string]interface{}{"region": "east", "zone": "1a"}},
+		{"host": "b", "metadata": map[string]interface{}{"zone": "1b"}},
+		{"host": "c", "metadata": "none"},
+	})
+	require.NoError(t, err)
+
+	got, err := ec.Query("host", etre.QueryFilter{ReturnLabels: []string{"host", "metadata.region"}, Sort: []string{"host"}})
+	require.NoError(t, err)
+	expect := []etre.Entity{
+		{"host": "a", "metadata": map[string]interface{}{"region": "east"}},
+		{"host": "b", "metadata": map[string]interface{}{}},
+		{"host": "c"},
+	}
+	assert.Equal(t, expect, got)
+	region, ok := got[0].GetPath("metadata.region")
+	assert.True(t, ok)
+	assert.Equal(t, "east", region)
+
+	// Distinct values of a path, like the API
+	values, err := ec.DistinctValues("metadata.zone", "host", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []interface{}{"1a", "1b"}, values)
+
+	_, err = ec.Query("host", etre.QueryFilter{ReturnLabels: []string{"metadata", "metadata.region"}})
+	assert.Error(t, err)
+}
+
+func TestFakeEntityClientErrors(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+
+	_, err := ec.Insert([]etre.Entity{{"_id": "abc", "host": "a"}})
+	assert.ErrorIs(t, err, etre.ErrIdSet)
+
+	_, err = ec.Insert([]etre.Entity{{"_type": "rack", "host": "a"}})
+	assert.ErrorIs(t, err, etre.ErrTypeMismatch)
+
+	_, err = ec.Insert([]etre.Entity{{"host": "a"}, {"_type": "rack", "host": "b"}})
+	assert.ErrorIs(t, err, etre.ErrTypeMismatch)
+	assert.Contains(t, err.Error(), "entity 1")
+
+	_, err = ec.UpdateOne("abc", etre.Entity{"_type": "rack", "host": "a"})
+	assert.ErrorIs(t, err, etre.ErrTypeMismatch)
+
+	_, err = ec.Get("abc")
+	assert.ErrorIs(t, err, etre.ErrEntityNotFound)
+
+	_, err = ec.Get("")
+	assert.ErrorIs(t, err, etre.ErrIdNotSet)
+
+	_, err = ec.UpdateOne("", etre.Entity{"x": "y"})
+	assert.ErrorIs(t, err, etre.ErrIdNotSet)
+
+	_, err = ec.UpdateIfRev(etre.Entity{"x": "y"}, 0)
+	assert.ErrorIs(t, err, etre.ErrIdNotSet)
+
+	_, err = ec.Query("", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+
+	_, err = ec.Query("a=(", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrInvalidQuery)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ec.QueryContext(ctx, "a=b", etre.QueryFilter{})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestFakeEntityClientQuery(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	_, err := ec.Insert([]etre.Entity{
+		{"host": "a", "zone": "east", "n": 3},
+		{"host": "b", "zone": "west", "n": 1},
+		{"host": "c", "zone": "east", "n": 2},
+		{"host": "d"},
+	})
+	require.NoError(t, err)
+
+	hosts := func(entities []etre.Entity) []string {
+		h := []string{}
+		for _, e := range entities {
+			h = append(h, e.String("host"))
+		}
+		return h
+	}
+
+	tests := []struct {
+		query string
+		hosts []string
+	}{
+		{"zone=east", []string{"a", "c"}},
+		{"zone==east", []string{"a", "c"}},
+		{"zone!=east", []string{"b", "d"}},
+		{"zone in (west, north)", []string{"b"}},
+		{"zone notin (west)", []string{"a", "c", "d"}},
+		{"zone", []string{"a", "b", "c"}},
+		{"!zone", []string{"d"}},
+		{"zone isnull", []string{}},
+		{"n>1", []string{"a", "c"}},
+		{"n<=2", []string{"b", "c"}},
+		{"n=1", []string{"b"}},
+		{"zone=east,n<3", []string{"c"}},
+		{"host=z", []string{}},
+	}
+	for _, tt := range tests {
+		entities, err := ec.Query(tt.query, etre.QueryFilter{})
+		require.NoError(t, err, tt.query)
+		assert.Equal(t, tt.hosts, hosts(entities), tt.query)
+	}
+
+	plan, err := ec.Explain("zone=east", etre.QueryFilter{Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, etre.QueryPlan{Stage: "COLLSCAN", DocsExamined: 4, Returned: 1}, plan)
+	_, err = ec.Explain("host", etre.QueryFilter{ReturnLabels: []string{"zone"}, Distinct: true})
+	assert.ErrorIs(t, err, etre.ErrInvalidQuery)
+
+	entities, err := ec.Query("host", etre.QueryFilter{Sort: []string{"-n"}, Limit: 2, Offset: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c", "b"}, hosts(entities))
+
+	entities, err = ec.Query("zone=east", etre.QueryFilter{ReturnLabels: []string{"host"}})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"host": "a"}, {"host": "c"}}, entities)
+
+	entities, err = ec.Query("host", etre.QueryFilter{ReturnLabels: []string{"zone"}, Distinct: true})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"zone": "east"}, {"zone": "west"}}, entities)
+
+	n, err := ec.Count("zone", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	it, err := ec.Stream(context.Background(), "host", etre.QueryFilter{Limit: 3})
+	require.NoError(t, err)
+	var streamed []etre.Entity
+	for it.Next() {
+		streamed = append(streamed, it.Entity())
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, []string{"a", "b", "c", "d"}, hosts(streamed))
+
+	values, err := ec.DistinctValues("zone", "", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"east", "west"}, values)
+	values, err = ec.DistinctValues("n", "zone=east", etre.QueryFilter{Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{3}, values)
+
+	labels, err := ec.AllLabels()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"_id", "_rev", "_type", "host", "n", "zone"}, labels)
+
+	// SinceRev matches only entities updated since
+	_, err = ec.Update("host=b", etre.Entity{"n": 4})
+	require.NoError(t, err)
+	_, err = ec.Update("host=b", etre.Entity{"n": 5})
+	require.NoError(t, err)
+	_, err = ec.Update("host=c", etre.Entity{"n": 6})
+	require.NoError(t, err)
+	entities, err = ec.Query("host", etre.QueryFilter{SinceRev: 0, Sort: []string{"_rev"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "d", "c", "b"}, hosts(entities))
+	entities, err = ec.Query("host", etre.QueryFilter{SinceRev: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b"}, hosts(entities))
+	n, err = ec.Count("zone", etre.QueryFilter{SinceRev: 0})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	n, err = ec.Count("zone", etre.QueryFilter{SinceRev: 1})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestFakeEntityClientIdempotencyKey(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	ctx := etre.WithIdempotencyKey(context.Background(), "k1")
+	wr1, err := ec.InsertContext(ctx, []etre.Entity{{"host": "a"}})
+	require.NoError(t, err)
+	assert.False(t, wr1.Replayed)
+
+	wr2, err := ec.InsertContext(ctx, []etre.Entity{{"host": "a"}})
+	require.NoError(t, err)
+	assert.True(t, wr2.Replayed)
+	assert.Equal(t, wr1.Writes, wr2.Writes)
+	assert.Len(t, ec.Entities(), 1)
+
+	wr, err := ec.InsertContext(ctx, []etre.Entity{{"host": "b"}})
+	require.NoError(t, err)
+	assert.ErrorIs(t, wr.Err(), etre.ErrIdempotencyKeyReused)
+	assert.Len(t, ec.Entities(), 1)
+
+	_, err = ec.InsertBatchContext(ctx, []etre.Entity{{"host": "b"}, {"host": "c"}}, 1)
+	require.NoError(t, err)
+	assert.Len(t, ec.Entities(), 3)
+}
+
+func TestFakeEntityClientHistory(t *testing.T) {
+	ec := etre.NewFakeEntityClient("node")
+	wr, err := ec.Insert([]etre.Entity{{"host": "a", "zone": "1"}})
+	require.NoError(t, err)
+	id := wr.Writes[0].EntityId
+	_, err = ec.UpdateOne(id, etre.Entity{"zone": "2"})
+	require.NoError(t, err)
+	_, err = ec.DeleteLabel(id, "zone")
+	require.NoError(t, err)
+	_, err = ec.DeleteOne(id)
+	require.NoError(t, err)
+
+	events, err := ec.History(id, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	ops := []string{}
+	for i, e := range events {
+		ops = append(ops, e.Op)
+		assert.Equal(t, int64(i), e.EntityRev)
+		assert.Equal(t, id, e.EntityId)
+		assert.Equal(t, "node", e.EntityType)
+	}
+	assert.Equal(t, []string{"i", "u", "u", "d"}, ops)
+	assert.Equal(t, etre.Entity{"zone": "1"}, *events[1].Old)
+	assert.Equal(t, etre.Entity{"zone": "2"}, *events[1].New)
+	assert.Equal(t, etre.Entity{"zone": "2"}, *events[2].Old)
+	assert.Nil(t, events[3].New)
+
+	events, err = ec.History(id, 2)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, int64(2), events[0].EntityRev)
+
+	events, err = ec.History("other", 0)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
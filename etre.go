@@ -4,60 +4,244 @@
 package etre
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"path"
+	"reflect"
+	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/square/etre/query"
 )
 
 const (
-	VERSION                  = "0.12.0"
-	API_ROOT          string = "/api/v1"
-	META_LABEL_ID            = "_id"
-	META_LABEL_TYPE          = "_type"
-	META_LABEL_REV           = "_rev"
-	CDC_WRITE_TIMEOUT int    = 5 // seconds
+	VERSION                   = "0.12.0"
+	API_ROOT           string = "/api/v1"
+	META_LABEL_ID             = "_id"
+	META_LABEL_TYPE           = "_type"
+	META_LABEL_REV            = "_rev"
+	META_LABEL_TS             = "_ts"
+	META_LABEL_DELETED        = "_deleted" // true on a tombstone; see QueryFilter.IncludeDeleted
+	LABEL_WHITESPACE          = " \t"      // label names cannot contain these; see ValidateLabel
+	CDC_WRITE_TIMEOUT  int    = 5          // seconds
 
 	VERSION_HEADER       = "X-Etre-Version"
 	TRACE_HEADER         = "X-Etre-Trace"
 	QUERY_TIMEOUT_HEADER = "X-Etre-Query-Timeout"
+	REQUEST_ID_HEADER    = "X-Etre-Request-Id"
+
+	IDEMPOTENCY_KEY_HEADER   = "X-Etre-Idempotency-Key"   // see WithIdempotencyKey
+	IDEMPOTENT_REPLAY_HEADER = "X-Etre-Idempotent-Replay" // see WriteResult.Replayed
+
+	CONTENT_TYPE_JSON   = "application/json"
+	CONTENT_TYPE_BSON   = "application/bson"     // entities as concatenated BSON documents
+	CONTENT_TYPE_NDJSON = "application/x-ndjson" // entities as newline-delimited JSON
+
+	// EntityClientConfig.ResponseFormat values
+	RESPONSE_FORMAT_BSON = "bson"
+	RESPONSE_FORMAT_JSON = "json"
+
+	// WriteOptions.UpdateMode values
+	UPDATE_MODE_MERGE   = "merge"
+	UPDATE_MODE_REPLACE = "replace"
+
+	// QueryFilter.Consistency values
+	CONSISTENCY_EVENTUAL         = "eventual"
+	CONSISTENCY_READ_YOUR_WRITES = "read-your-writes"
+	CONSISTENCY_STRONG           = "strong"
+
+	// Array operators in update patches, see Entity.AddToSet and Entity.Pull
+	ARRAY_OP_ADD_TO_SET = "$addToSet"
+	ARRAY_OP_PULL       = "$pull"
+
+	// Counter operator in update patches, see Entity.Increment
+	COUNTER_OP_INC = "$inc"
 )
 
 var (
-	ErrTypeMismatch   = errors.New("entity _type and Client entity type are different")
-	ErrIdSet          = errors.New("entity _id is set but not allowed on insert")
-	ErrIdNotSet       = errors.New("entity _id is not set")
-	ErrNoEntity       = errors.New("empty entity or id slice; at least one required")
-	ErrNoLabel        = errors.New("empty label slice; at least one required")
-	ErrNoQuery        = errors.New("empty query string")
-	ErrBadData        = errors.New("data from CDC feed is not event or control")
-	ErrCallerBlocked  = errors.New("caller blocked")
-	ErrEntityNotFound = errors.New("entity not found")
-	ErrClientTimeout  = errors.New("client timeout")
+	ErrTypeMismatch     = errors.New("entity _type and Client entity type are different")
+	ErrIdSet            = errors.New("entity _id is set but not allowed on insert")
+	ErrIdNotSet         = errors.New("entity _id is not set")
+	ErrNoEntity         = errors.New("empty entity or id slice; at least one required")
+	ErrNoLabel          = errors.New("empty label slice; at least one required")
+	ErrNoQuery          = errors.New("empty query string")
+	ErrBadData          = errors.New("data from CDC feed is not event or control")
+	ErrCallerBlocked    = errors.New("caller blocked")
+	ErrEntityNotFound   = errors.New("entity not found")
+	ErrClientTimeout    = errors.New("client timeout")
+	ErrRevConflict      = errors.New("entity _rev conflict")
+	ErrCDCRevGap        = errors.New("CDC event revision gap")
+	ErrDryRunInsert     = errors.New("dry run not supported on insert")
+	ErrVersionMismatch  = errors.New("client and server versions are not compatible")
+	ErrResponseTooLarge = errors.New("API response too large")
+	ErrClientClosed     = errors.New("client closed")
+	ErrCircuitOpen      = errors.New("circuit breaker open: API failing, request not sent")
+	ErrNoCDCPosition    = errors.New("no CDC feed position: feed not started with a start Ts and no event received")
+	ErrServerError      = errors.New("unhandled server error") // see ServerError
 )
 
+// Error type sentinels for errors.Is. An Error matches the sentinel for its
+// Type slug, including an Error returned by EntityClient from an API error
+// response. ErrDBError matches all database error types ("db-query", etc.).
+// ErrEntityNotFound and ErrRevConflict also match their Error types.
+//
+// ErrQueryTimeout matches a "db-query-timeout" Error: the server stopped the
+// query because it exceeded the query timeout (QUERY_TIMEOUT_HEADER), so retry
+// with a longer query timeout or a simpler query. It's distinct from
+// ErrClientTimeout: the HTTP client timed out waiting for the response, so
+// increase the http.Client timeout. Servers before v0.12 return a "db-query"
+// (or other "db-") Error with message "context deadline exceeded" for a query
+// timeout, which ErrQueryTimeout also matches.
+var (
+	ErrDBError         = errors.New("database error")
+	ErrDuplicateEntity = errors.New("duplicate entity")
+	ErrMissingParam    = errors.New("missing parameter")
+	ErrInvalidParam    = errors.New("invalid parameter")
+	ErrInvalidQuery    = errors.New("invalid query")
+	ErrInvalidContent  = errors.New("invalid content")
+	ErrAccessDenied    = errors.New("access denied")
+	ErrNotAuthorized   = errors.New("not authorized")
+	ErrCDCDisabled     = errors.New("CDC disabled")
+	ErrInternalError   = errors.New("internal error")
+	ErrQueryTimeout    = errors.New("query timeout")
+
+	ErrIdempotencyKeyReused = errors.New("idempotency key reused with different entities")
+)
+
+var errorTypes = map[error]string{
+	ErrDuplicateEntity: "duplicate-entity",
+	ErrEntityNotFound:  "entity-not-found",
+	ErrRevConflict:     "rev-conflict",
+	ErrMissingParam:    "missing-param",
+	ErrInvalidParam:    "invalid-param",
+	ErrInvalidQuery:    "invalid-query",
+	ErrInvalidContent:  "invalid-content",
+	ErrAccessDenied:    "access-denied",
+	ErrNotAuthorized:   "not-authorized",
+	ErrCDCDisabled:     "cdc-disabled",
+	ErrInternalError:   "internal-error",
+	ErrQueryTimeout:    "db-query-timeout",
+
+	ErrIdempotencyKeyReused: "idempotency-key-reused",
+}
+
+// CompatibleVersion returns true if client and server versions are compatible:
+// they have the same major version, and the same minor version if the major
+// version is 0 (e.g. 0.12.0 and 0.12.3, or 1.2.0 and 1.5.1), per semantic
+// versioning. Versions are "major.minor.patch" with an optional "v" prefix and
+// pre-release suffix. If either version cannot be parsed, it returns false.
+func CompatibleVersion(client, server string) bool {
+	cMajor, cMinor, ok := parseVersion(client)
+	if !ok {
+		return false
+	}
+	sMajor, sMinor, ok := parseVersion(server)
+	if !ok {
+		return false
+	}
+	if cMajor != sMajor {
+		return false
+	}
+	return cMajor > 0 || cMinor == sMinor
+}
+
+// parseVersion returns the major and minor numbers of a "major.minor.patch" version.
+func parseVersion(v string) (major, minor int, ok bool) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i > -1 {
+		v = v[:i] // pre-release or build metadata
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	var err error
+	if major, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, false
+	}
+	if minor, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
 // Entity represents a single Etre entity. The caller is responsible for knowing
 // or determining the type of value for each key.
 //
-// If label _type is set, the Client verifies that it matches its type. For example,
-// if _type = "foo", Insert or Update with a Client bound to entity type "bar"
-// returns ErrTypeMismatch. If label _type is not set, the Client entity type is
-// presumed.
+// If label _type is set, the Client verifies that it matches its type for every
+// entity before sending any. For example, if _type = "foo", Insert or Update with
+// a Client bound to entity type "bar" returns ErrTypeMismatch annotated with the
+// index of the entity, like "entity 2: ...". If label _type is not set, the Client
+// entity type is presumed, and the API sets _type to it. (A matching _type is not
+// sent because the API does not allow metalabels in writes.)
 //
 // Label _id cannot be set on insert. If set, Insert returns ErrIdSet. On update,
 // label _id must be set; if not, Update returns ErrIdNotSet. _id corresponds to
 // WriteResult.Writes[].Id.
 type Entity map[string]interface{}
 
+// Id returns the _id meta-label. It panics if _id is not set or not a string,
+// which can happen when QueryFilter.ReturnLabels excludes _id. Use IdOK for
+// entities that might be projected.
 func (e Entity) Id() string {
-	return e[META_LABEL_ID].(string)
+	id, ok := e.IdOK()
+	if !ok {
+		panic(fmt.Sprintf("entity _id is not set or not a string: %T", e[META_LABEL_ID]))
+	}
+	return id
 }
 
+// IdOK returns the _id meta-label and true, or an empty string and false if
+// _id is not set or not a string. Unlike Id, it never panics.
+func (e Entity) IdOK() (string, bool) {
+	v, ok := e.GetOK(META_LABEL_ID)
+	if !ok {
+		return "", false
+	}
+	id, ok := v.(string)
+	return id, ok
+}
+
+// Type returns the _type meta-label. It panics if _type is not set or not a
+// string. Use TypeOK for entities that might be projected.
 func (e Entity) Type() string {
-	return e[META_LABEL_TYPE].(string)
+	t, ok := e.TypeOK()
+	if !ok {
+		panic(fmt.Sprintf("entity _type is not set or not a string: %T", e[META_LABEL_TYPE]))
+	}
+	return t
+}
+
+// TypeOK returns the _type meta-label and true, or an empty string and false
+// if _type is not set or not a string. Unlike Type, it never panics.
+func (e Entity) TypeOK() (string, bool) {
+	v, ok := e.GetOK(META_LABEL_TYPE)
+	if !ok {
+		return "", false
+	}
+	t, ok := v.(string)
+	return t, ok
+}
+
+// GetOK returns the value of the label and true if the label is set, else nil
+// and false. The value can be nil if the label is set to null.
+func (e Entity) GetOK(label string) (interface{}, bool) {
+	v, ok := e[label]
+	return v, ok
 }
 
 func (e Entity) Rev() int64 {
@@ -66,18 +250,147 @@ func (e Entity) Rev() int64 {
 	// but that is magical in BSON: "int marshals to a BSON int32 if the value
 	// is between math.MinInt32 and math.MaxInt32, inclusive, and a BSON int64
 	// otherwise." As of v0.11 _rev is int64 everywhere, but for backwards-compat
-	// we check for int and int32.
+	// we check for int and int32 (and float64 with no fractional part, from JSON).
 	v := e[META_LABEL_REV]
-	switch v.(type) {
-	case int64:
-		return v.(int64)
-	case int32:
-		return int64(v.(int32))
-	case int:
-		return int64(v.(int))
+	if rev, ok := toInt64(v); ok {
+		return rev
 	}
+	id, _ := e.IdOK()
 	panic(fmt.Sprintf("entity %s has invalid _rev data type: %T; expected int64 (or int/int32 before v0.11)",
-		e.Id(), v))
+		id, v))
+}
+
+// Ts returns the _ts meta-label and true, or zero and false if _ts is not set
+// or not an integer. The Etre API does not set _ts, and clients cannot set it
+// (it's a meta-label), so it's only set on entities written to the database
+// by other means. When set, Ts and Time treat it as Unix milliseconds, like
+// CDCEvent.Ts. Like Int, it converts any integer type, and a float64 (from
+// JSON) with no fractional part, so it works for entities decoded from BSON
+// or JSON.
+func (e Entity) Ts() (int64, bool) {
+	return e.Int(META_LABEL_TS)
+}
+
+// Time returns the _ts meta-label (Unix milliseconds, see Ts) as a time.Time
+// and true, or the zero time and false if _ts is not set or not an integer.
+func (e Entity) Time() (time.Time, bool) {
+	ts, ok := e.Ts()
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ts), true
+}
+
+// GetPath returns the value at the path and true if it's set, else nil and false.
+// A path is a label, like GetOK, or a label and keys of nested maps (like Entity
+// or map[string]interface{} from JSON) separated by dots: "metadata.region" is
+// key region of the map in label metadata. A missing label or key, or a value
+// on the path that's not a map, returns false; slices are not navigated. Labels
+// cannot contain a dot (see ValidateLabel), but keys of nested maps can: escape
+// a dot in a key with a backslash, like `metadata.dc\.zone` for key "dc.zone",
+// and a backslash with another backslash. Paths in QueryFilter.ReturnLabels
+// cannot be escaped because MongoDB cannot project keys with a dot.
+func (e Entity) GetPath(path string) (interface{}, bool) {
+	var v interface{} = map[string]interface{}(e)
+	for _, key := range splitPath(path) {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			if m, ok = toStringMap(v); !ok {
+				return nil, false
+			}
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// splitPath splits an Entity.GetPath path into keys on dots that are not escaped
+// by a backslash, and unescapes the keys.
+func splitPath(path string) []string {
+	keys := []string{}
+	var key strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '\\' && i+1 < len(path):
+			i++
+			key.WriteByte(path[i])
+		case path[i] == '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		default:
+			key.WriteByte(path[i])
+		}
+	}
+	return append(keys, key.String())
+}
+
+// toStringMap returns v as a map[string]interface{} if it's a named type of one,
+// like Entity or bson.M, which don't match a type switch.
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	t := reflect.TypeOf(map[string]interface{}{})
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || rv.Kind() != reflect.Map || !rv.Type().ConvertibleTo(t) {
+		return nil, false
+	}
+	return rv.Convert(t).Interface().(map[string]interface{}), true
+}
+
+// ValidateLabelPaths returns an error if a path in ReturnLabels is invalid: empty,
+// with an empty key (like "a..b"), containing "$", or a prefix of another path
+// (like "a" and "a.b"), which MongoDB cannot project. Duplicate paths are valid
+// because they're removed (see UniqueLabels). A path is a label or a dotted path
+// to a nested key, like "metadata.region" (see GetPath). EntityClient calls it
+// for QueryFilter.ReturnLabels, and the API for the labels query parameter.
+func ValidateLabelPaths(paths []string) error {
+	for i, p := range paths {
+		if strings.Contains(p, "$") {
+			return fmt.Errorf("invalid return label %s: cannot contain $", p)
+		}
+		for _, key := range strings.Split(p, ".") {
+			if key == "" {
+				return fmt.Errorf("invalid return label '%s': empty label or key", p)
+			}
+		}
+		for _, other := range paths[i+1:] {
+			if strings.HasPrefix(other, p+".") || strings.HasPrefix(p, other+".") {
+				return fmt.Errorf("invalid return labels %s and %s: nested path", p, other)
+			}
+		}
+	}
+	return nil
+}
+
+// UniqueLabels returns the labels without duplicates, in the order they first
+// occur. It returns labels if there are no duplicates. EntityClient and the API
+// call it for QueryFilter.ReturnLabels, so ["a", "a"] is the same as ["a"].
+func UniqueLabels(labels []string) []string {
+	seen := make(map[string]bool, len(labels))
+	for i, label := range labels {
+		if !seen[label] {
+			seen[label] = true
+			continue
+		}
+		// Duplicate: copy the unique labels so far, and the rest without duplicates
+		unique := append([]string{}, labels[:i]...)
+		for _, label := range labels[i+1:] {
+			if !seen[label] {
+				seen[label] = true
+				unique = append(unique, label)
+			}
+		}
+		return unique
+	}
+	return labels
+}
+
+// IsDeleted returns true if the entity is a tombstone: meta-label _deleted is
+// true. Only queries with QueryFilter.IncludeDeleted or OnlyDeleted return
+// tombstones, so it's false for other entities.
+func (e Entity) IsDeleted() bool {
+	deleted, _ := e.Bool(META_LABEL_DELETED)
+	return deleted
 }
 
 // Has returns true of the entity has the label, regardless of its value.
@@ -116,6 +429,53 @@ func (e Entity) Set() Set {
 	return set
 }
 
+// SetGenerator returns the Set for a write of n entities, where op is "insert"
+// or "delete". The Set must have Id and Op set and Size n, or be the zero Set
+// to not make the write a set. See EntityClientConfig.SetGenerator.
+type SetGenerator func(op string, n int) Set
+
+// NewSet is a SetGenerator that returns a Set with a random (version 4) UUID
+// as Id, op as Op, and n as Size.
+func NewSet(op string, n int) Set {
+	return Set{Id: NewRequestId(), Op: op, Size: n}
+}
+
+// WithSet returns copies of the entities with the set labels _setId, _setOp, and
+// _setSize, which group the entities as one logical set in the CDC feed. If
+// set.Size is zero, it's set to len(entities). Set labels are all or nothing, so
+// it returns an error if only one of set.Id and set.Op is set. If neither is set,
+// the copies have no set labels, even if the entities did.
+//
+// This is for entities; for update and delete, use EntityClient.WithSet.
+func WithSet(set Set, entities []Entity) ([]Entity, error) {
+	if (set.Id == "") != (set.Op == "") {
+		return nil, fmt.Errorf("set id and op must both be set or both be empty: id='%s', op='%s'", set.Id, set.Op)
+	}
+	if set.Size < 0 {
+		return nil, fmt.Errorf("invalid set size: %d; must be greater than zero", set.Size)
+	}
+	if set.Size == 0 {
+		set.Size = len(entities)
+	}
+	withSet := make([]Entity, len(entities))
+	for i, e := range entities {
+		cp := make(Entity, len(e)+3)
+		for k, v := range e {
+			cp[k] = v
+		}
+		delete(cp, "_setId")
+		delete(cp, "_setOp")
+		delete(cp, "_setSize")
+		if set.Id != "" {
+			cp["_setId"] = set.Id
+			cp["_setOp"] = set.Op
+			cp["_setSize"] = set.Size
+		}
+		withSet[i] = cp
+	}
+	return withSet, nil
+}
+
 var metaLabels = map[string]bool{
 	"_id":      true,
 	"_rev":     true,
@@ -124,12 +484,307 @@ var metaLabels = map[string]bool{
 	"_setSize": true,
 	"_ts":      true,
 	"_type":    true,
+	"_deleted": true,
 }
 
 func IsMetalabel(label string) bool {
 	return metaLabels[label]
 }
 
+// ValidateLabel returns an error if the label name is invalid: empty, containing
+// a space or tab (LABEL_WHITESPACE), which the API rejects, starting with "_" but
+// not a meta-label (the "_" namespace is reserved), or containing "." or "$",
+// which MongoDB interprets as a dotted path or an operator. Meta-labels are valid.
+// EntityClient calls it for every label on insert and update.
+func ValidateLabel(label string) error {
+	if label == "" {
+		return fmt.Errorf("invalid label: empty name")
+	}
+	if strings.ContainsAny(label, LABEL_WHITESPACE) {
+		return fmt.Errorf("invalid label '%s': names cannot contain whitespace", label)
+	}
+	if IsMetalabel(label) {
+		return nil
+	}
+	if strings.HasPrefix(label, "_") {
+		return fmt.Errorf("invalid label %s: names starting with _ are reserved for meta-labels", label)
+	}
+	if strings.ContainsAny(label, ".$") {
+		return fmt.Errorf("invalid label %s: names cannot contain . or $", label)
+	}
+	return nil
+}
+
+// Validate returns an error if the entity is invalid for the write op: "insert",
+// "update", or "delete". It checks locally, before a write, some of the invariants
+// that the API checks: on insert, _id must not be set (ErrIdSet); on update and
+// delete, _id must be set (ErrIdNotSet). For all ops, _id and _type must be
+// strings if set, label names must be valid (see ValidateLabel), and values must
+// not be nil and must be valid (see ValidateValues). The API checks more, so a
+// valid entity can still fail to write.
+func (e Entity) Validate(op string) error {
+	switch op {
+	case "insert":
+		if e.Has(META_LABEL_ID) {
+			return ErrIdSet
+		}
+	case "update", "delete":
+		if !e.Has(META_LABEL_ID) {
+			return ErrIdNotSet
+		}
+	default:
+		return fmt.Errorf("invalid write op: %s; valid ops: insert, update, delete", op)
+	}
+	for _, ml := range []string{META_LABEL_ID, META_LABEL_TYPE} {
+		if v, ok := e[ml]; ok {
+			if _, ok := v.(string); !ok {
+				return fmt.Errorf("meta-label %s must be a string, not %T", ml, v)
+			}
+		}
+	}
+	for _, label := range e.Labels() {
+		if err := ValidateLabel(label); err != nil {
+			return err
+		}
+		if e[label] == nil {
+			return fmt.Errorf("label %s has nil value", label)
+		}
+	}
+	return e.ValidateValues()
+}
+
+// ValidateValues returns an error if a label value cannot be encoded as JSON
+// (sent to the API) or BSON (stored by the API): a function, channel, complex
+// number, NaN or infinite float, or map without string keys, at any depth. Valid
+// values are nil, bools, numbers, strings, types that encode themselves (like
+// time.Time), and slices, arrays, maps (like Entity), pointers, and structs of
+// valid values, nested at most MAX_VALUE_DEPTH levels, like BSON, which also
+// stops a pointer cycle. The error is for the first invalid label, in label
+// order, and names the path to the value, like "tags[1]" or "attrs.zone", and
+// its type. EntityClient calls it for every entity on insert and update.
+func (e Entity) ValidateValues() error {
+	for _, label := range e.Labels() {
+		if err := validateValue(label, reflect.ValueOf(e[label]), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// MAX_VALUE_DEPTH is the maximum nesting of label values, like MongoDB's maximum
+// BSON document nesting. See Entity.ValidateValues.
+const MAX_VALUE_DEPTH = 100
+
+// validateValue implements ValidateValues for the value v at path and depth.
+func validateValue(path string, v reflect.Value, depth int) error {
+	if !v.IsValid() {
+		return nil // nil interface
+	}
+	if depth > MAX_VALUE_DEPTH {
+		return fmt.Errorf("label %s has value nested more than %d levels (cycle?)", path, MAX_VALUE_DEPTH)
+	}
+	if v.Type().Implements(jsonMarshalerType) || v.Type().Implements(textMarshalerType) {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return nil
+	case reflect.Float32, reflect.Float64:
+		if f := v.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("label %s has invalid value %v (%s)", path, f, v.Type())
+		}
+		return nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Kind() == reflect.Interface {
+			return validateValue(path, v.Elem(), depth) // not a level, like a map value
+		}
+		return validateValue(path, v.Elem(), depth+1)
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return nil // []byte
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := validateValue(fmt.Sprintf("%s[%d]", path, i), v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("label %s has invalid value type %s: map keys must be strings", path, v.Type())
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, k := range keys {
+			if err := validateValue(path+"."+k.String(), v.MapIndex(k), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() || f.Tag.Get("json") == "-" {
+				continue // not encoded
+			}
+			if err := validateValue(path+"."+f.Name, v.Field(i), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("label %s has invalid value type %s", path, v.Type())
+}
+
+// JSON number decoding modes for EntityClientConfig.JSONNumbers.
+const (
+	JSON_NUMBERS_FLOAT64     = iota // float64, like encoding/json (default)
+	JSON_NUMBERS_INT64              // int64 if the number is an integer, else float64
+	JSON_NUMBERS_JSON_NUMBER        // json.Number
+)
+
+// intMetaLabels are decoded as int64 by Entity.UnmarshalJSON so that Rev and
+// Set work on entities decoded from JSON like they do on entities from BSON.
+var intMetaLabels = map[string]bool{
+	META_LABEL_REV: true,
+	"_setSize":     true,
+	"_ts":          true,
+}
+
+// UnmarshalJSON decodes a JSON object into the entity. Unlike the default for
+// a map, integer meta-labels (_rev, _setSize, _ts) are decoded as int64, not
+// float64. Other numbers are decoded as float64, like encoding/json, because
+// the API expects it. To decode them as int64 or json.Number, set
+// EntityClientConfig.JSONNumbers.
+func (e *Entity) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var m map[string]interface{}
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+	*e = entityFromJSON(m, JSON_NUMBERS_FLOAT64)
+	return nil
+}
+
+// entityFromJSON returns the entity of map m decoded with json.Decoder.UseNumber,
+// with integer meta-labels as int64 and other numbers decoded according to
+// numbers (JSON_NUMBERS_*). It returns nil if m is nil (JSON null).
+func entityFromJSON(m map[string]interface{}, numbers int) Entity {
+	if m == nil {
+		return nil
+	}
+	for label, v := range m {
+		if n, ok := v.(json.Number); ok && intMetaLabels[label] {
+			if i, err := n.Int64(); err == nil {
+				m[label] = i
+				continue
+			}
+		}
+		m[label] = decodeNumbers(v, numbers)
+	}
+	return Entity(m)
+}
+
+// decodeNumbers converts json.Number values in v, including nested values,
+// according to numbers (JSON_NUMBERS_*).
+func decodeNumbers(v interface{}, numbers int) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		switch numbers {
+		case JSON_NUMBERS_JSON_NUMBER:
+			return t
+		case JSON_NUMBERS_INT64:
+			if i, err := t.Int64(); err == nil {
+				return i
+			}
+		}
+		f, _ := t.Float64()
+		return f
+	case []interface{}:
+		for i := range t {
+			t[i] = decodeNumbers(t[i], numbers)
+		}
+	case map[string]interface{}:
+		for k := range t {
+			t[k] = decodeNumbers(t[k], numbers)
+		}
+	}
+	return v
+}
+
+// unmarshalJSON is json.Unmarshal with numbers in entities, and distinct values
+// (*[]interface{}), decoded according to numbers (JSON_NUMBERS_*). Only entity
+// response types are supported: *[]Entity, *Entity, *[]GroupResult, and
+// *[]interface{}; other types are decoded by json.Unmarshal.
+func unmarshalJSON(data []byte, v interface{}, numbers int) error {
+	if numbers == JSON_NUMBERS_FLOAT64 {
+		return json.Unmarshal(data, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	switch t := v.(type) {
+	case *[]Entity:
+		var maps []map[string]interface{}
+		if err := dec.Decode(&maps); err != nil {
+			return err
+		}
+		if maps == nil {
+			*t = nil
+			return nil
+		}
+		*t = make([]Entity, len(maps))
+		for i := range maps {
+			(*t)[i] = entityFromJSON(maps[i], numbers)
+		}
+	case *Entity:
+		var m map[string]interface{}
+		if err := dec.Decode(&m); err != nil {
+			return err
+		}
+		*t = entityFromJSON(m, numbers)
+	case *[]GroupResult:
+		var groups []struct {
+			Group map[string]interface{} `json:"group"`
+			Count int64                  `json:"count"`
+		}
+		if err := dec.Decode(&groups); err != nil {
+			return err
+		}
+		if groups == nil {
+			*t = nil
+			return nil
+		}
+		*t = make([]GroupResult, len(groups))
+		for i, g := range groups {
+			(*t)[i] = GroupResult{Group: entityFromJSON(g.Group, numbers), Count: g.Count}
+		}
+	case *[]interface{}:
+		var values []interface{}
+		if err := dec.Decode(&values); err != nil {
+			return err
+		}
+		for i := range values {
+			values[i] = decodeNumbers(values[i], numbers)
+		}
+		*t = values
+	default:
+		return json.Unmarshal(data, v)
+	}
+	return nil
+}
+
 // Labels returns all labels, sorted, including meta-labels (_id, _type, etc.)
 func (e Entity) Labels() []string {
 	labels := make([]string, len(e))
@@ -142,6 +797,30 @@ func (e Entity) Labels() []string {
 	return labels
 }
 
+// UserLabels returns all labels except meta-labels (see IsMetalabel), sorted.
+func (e Entity) UserLabels() []string {
+	labels := make([]string, 0, len(e))
+	for label := range e {
+		if !IsMetalabel(label) {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// MetaLabels returns the meta-labels (see IsMetalabel) that are set, sorted.
+func (e Entity) MetaLabels() []string {
+	labels := []string{}
+	for label := range e {
+		if IsMetalabel(label) {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
 // String returns the string value of the label. If the label is not set or
 // its value is not a string, an empty string is returned.
 func (e Entity) String(label string) string {
@@ -153,105 +832,1804 @@ func (e Entity) String(label string) string {
 	return ""
 }
 
-// QueryFilter represents filtering options for EntityClient.Query().
-type QueryFilter struct {
-	// ReturnLabels defines labels included in matching entities. An empty slice
-	// returns all labels, including meta-labels. Else, only labels in the slice
-	// are returned.
-	ReturnLabels []string
-
-	// Distinct returns unique entities if ReturnLabels contains a single value.
-	// Etre returns an error if enabled and ReturnLabels has more than one value.
-	Distinct bool
-}
-
-// WriteResult represents the result of a write operation (insert, update delete).
-// On success or failure, all write ops return a WriteResult.
-//
-// If Error is set (not nil), some or all writes failed. Writes stop on the first
-// error, so len(Writes) = index into slice of entities sent by client that failed.
-// For example, if the first entity causes an error, len(Writes) = 0. If the third
-// entity fails, len(Writes) = 2 (zero indexed).
-type WriteResult struct {
-	Writes []Write `json:"writes"`          // successful writes
-	Error  *Error  `json:"error,omitempty"` // error before, during, or after writes
-}
-
-func (wr WriteResult) IsZero() bool {
-	return wr.Error == nil && len(wr.Writes) == 0
+// Int returns the int64 value of the label. The bool is true if the label is
+// set and its value is an int, int32, int64, or a float with no fractional part
+// (JSON decodes all numbers as float64). Else, zero and false are returned.
+func (e Entity) Int(label string) (int64, bool) {
+	v, ok := e[label]
+	if !ok {
+		return 0, false
+	}
+	return toInt64(v)
 }
 
-// Write represents the successful write of one entity.
-type Write struct {
-	EntityId string `json:"entityId"`       // internal _id of entity (all write ops)
-	URI      string `json:"uri,omitempty"`  // fully-qualified address of new entity (insert)
-	Diff     Entity `json:"diff,omitempty"` // previous entity label values (update)
+// Float64 returns the float64 value of the label. The bool is true if the label
+// is set and its value is any numeric type. Else, zero and false are returned.
+func (e Entity) Float64(label string) (float64, bool) {
+	v, ok := e[label]
+	if !ok {
+		return 0, false
+	}
+	return toFloat64(v)
 }
 
-// Error is the standard response for all handled errors. Client errors (HTTP 400
-// codes) and internal errors (HTTP 500 codes) are returned as an Error, if handled.
-// If not handled (API crash, panic, etc.), Etre returns an HTTP 500 code and the
-// response data is undefined; the client should print any response data as a string.
-type Error struct {
-	Message    string `json:"message"`    // human-readable and loggable error message
-	Type       string `json:"type"`       // error slug (e.g. db-error, missing-param, etc.)
-	EntityId   string `json:"entityId"`   // entity ID that caused error, if any
-	HTTPStatus int    `json:"httpStatus"` // HTTP status code
+// Bool returns the bool value of the label. The bool is true if the label is set
+// and its value is a bool. Else, false and false are returned.
+func (e Entity) Bool(label string) (bool, bool) {
+	v, ok := e[label].(bool)
+	return v, ok
 }
 
-func (e Error) New(msgFmt string, msgArgs ...interface{}) Error {
-	if msgFmt != "" {
-		e.Message = fmt.Sprintf(msgFmt, msgArgs...)
+// toInt64 converts v to int64 if it's an integer type, a float in the int64
+// range with no fractional part, or an integer json.Number. BSON can return int, int32, or
+// int64 for the same value, and JSON returns float64 or, with UseNumber,
+// json.Number, so callers should not type assert label values.
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case int32:
+		return int64(n), true
+	case int:
+		return int64(n), true
+	case float64:
+		return floatToInt64(n)
+	case float32:
+		return floatToInt64(float64(n))
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
 	}
-	return e
+	return 0, false
 }
 
-func (e Error) String() string {
-	return fmt.Sprintf("Etre error %s: %s", e.Type, e.Message)
+// floatToInt64 converts f to int64 if it has no fractional part and is in the
+// int64 range. The range is half-open because math.MaxInt64 as a float64 is 2^63.
+func floatToInt64(f float64) (int64, bool) {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false // also NaN and ±Inf
+	}
+	return int64(f), true
 }
 
-func (e Error) Error() string {
-	return e.String()
+// toFloat64 converts any numeric type, including json.Number, to float64.
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
 }
 
-type CDCEvent struct {
-	Id     string `json:"eventId" bson:"_id,omitempty"`
-	Ts     int64  `json:"ts" bson:"ts"` // Unix nanoseconds
-	Op     string `json:"op" bson:"op"` // i=insert, u=update, d=delete
-	Caller string `json:"user" bson:"caller"`
+// DiffOption is an option for Diff and Changed.
+type DiffOption int
 
-	EntityId   string  `json:"entityId" bson:"entityId"`           // _id of entity
-	EntityType string  `json:"entityType" bson:"entityType"`       // user-defined
-	EntityRev  int64   `json:"rev" bson:"entityRev"`               // entity revision as of this op, 0 on insert
-	Old        *Entity `json:"old,omitempty" bson:"old,omitempty"` // old values of affected labels, null on insert
-	New        *Entity `json:"new,omitempty" bson:"new,omitempty"` // new values of affected labels, null on delete
+const (
+	// DIFF_IGNORE_METALABELS ignores meta-labels (_id, _rev, etc.), which is useful
+	// for making an update patch because meta-labels cannot be updated.
+	DIFF_IGNORE_METALABELS DiffOption = iota + 1
+)
 
-	// Set op fields are optional, copied from entity if set. The three
-	// fields are all or nothing: all should be set, or none should be set.
-	// Etre has no semantic awareness of set op values, nor does it validate
-	// them. The caller is responsible for ensuring they're correct.
-	SetId   string `json:"setId,omitempty" bson:"setId,omitempty"`
-	SetOp   string `json:"setOp,omitempty" bson:"setOp,omitempty"`
-	SetSize int    `json:"setSize,omitempty" bson:"setSize,omitempty"`
+// Diff returns the labels in new that are not in old or have a different value,
+// with the new values. Labels in old that are not in new are not returned because
+// a patch cannot delete labels (use EntityClient.DeleteLabel). Integer values are
+// equal regardless of type (int, int32, int64, or float64 from JSON) like Rev.
+// The returned entity is empty, not nil, if there are no changes.
+func Diff(old, new Entity, opts ...DiffOption) Entity {
+	ignoreMeta := false
+	for _, opt := range opts {
+		if opt == DIFF_IGNORE_METALABELS {
+			ignoreMeta = true
+		}
+	}
+	diff := Entity{}
+	for label, v := range new {
+		if ignoreMeta && IsMetalabel(label) {
+			continue
+		}
+		if oldv, ok := old[label]; ok && equalValues(oldv, v) {
+			continue
+		}
+		diff[label] = v
+	}
+	return diff
 }
 
-// Latency represents network latencies in milliseconds.
-type Latency struct {
-	Send int64 // client -> server
-	Recv int64 // server -> client
-	RTT  int64 // client -> server -> client
+// Changed returns the sorted names of the labels returned by Diff.
+func Changed(old, new Entity, opts ...DiffOption) []string {
+	return Diff(old, new, opts...).Labels()
 }
 
-var (
-	DebugEnabled = false
-	debugLog     = log.New(os.Stderr, "DEBUG ", log.LstdFlags|log.Lmicroseconds)
-)
-
-func Debug(msg string, v ...interface{}) {
-	if !DebugEnabled {
-		return
+// Equal returns true if the entities have the same labels and values. Like Diff,
+// integer values are equal regardless of type, so int(5), int32(5), and int64(5)
+// are equal, including in nested slices and maps. With DIFF_IGNORE_METALABELS,
+// meta-labels are not compared, so, for example, different revisions of the same
+// entity are equal if only the revision changed.
+func (e Entity) Equal(other Entity, opts ...DiffOption) bool {
+	ignoreMeta := false
+	for _, opt := range opts {
+		if opt == DIFF_IGNORE_METALABELS {
+			ignoreMeta = true
+		}
 	}
-	_, file, line, _ := runtime.Caller(1)
+	n := 0
+	for label, v := range e {
+		if ignoreMeta && IsMetalabel(label) {
+			continue
+		}
+		otherv, ok := other[label]
+		if !ok || !equalValues(v, otherv) {
+			return false
+		}
+		n++
+	}
+	for label := range other {
+		if ignoreMeta && IsMetalabel(label) {
+			continue
+		}
+		n--
+	}
+	return n == 0 // same number of labels
+}
+
+// equalValues returns true if a and b are the same label value. Integer types are
+// compared by value because BSON and JSON decode the same value as different types.
+func equalValues(a, b interface{}) bool {
+	if ai, ok := toInt64(a); ok {
+		if bi, ok := toInt64(b); ok {
+			return ai == bi
+		}
+	}
+	switch av := a.(type) {
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equalValues(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		return Entity(av).Equal(Entity(bv))
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// CanonicalJSON returns the entity as JSON that's byte-identical for equal
+// entities (see Equal), so it can be hashed (see Hash) to dedupe entities or as
+// a cache key. Labels are in Labels order, as are nested map keys, and numbers
+// are normalized: an integer of any type, or a float with no fractional part,
+// is an integer, so int(5), int32(5), int64(5), and float64(5) (from JSON) are
+// all 5. With DIFF_IGNORE_METALABELS, meta-labels are not included, so different
+// revisions of an entity with the same labels are the same. A nil entity is {}.
+// It returns an error if a value can't be encoded as JSON (see ValidateValues).
+func (e Entity) CanonicalJSON(opts ...DiffOption) ([]byte, error) {
+	ignoreMeta := false
+	for _, opt := range opts {
+		if opt == DIFF_IGNORE_METALABELS {
+			ignoreMeta = true
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	n := 0
+	for _, label := range e.Labels() {
+		if ignoreMeta && IsMetalabel(label) {
+			continue
+		}
+		v, err := canonicalValue(e[label])
+		if err != nil {
+			return nil, fmt.Errorf("label %s: %w", label, err)
+		}
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(label) // quote and escape
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+		n++
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// canonicalValue returns the CanonicalJSON of a label value. The value is encoded
+// and decoded as JSON, so any value (like a struct or time.Time) is normalized to
+// JSON values, then numbers are normalized and it's encoded again, which sorts
+// map keys.
+func canonicalValue(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var jv interface{}
+	if err := dec.Decode(&jv); err != nil {
+		return nil, err
+	}
+	return json.Marshal(canonicalNumbers(jv))
+}
+
+// canonicalNumbers converts json.Number values in v, including nested values, to
+// int64 if the number is an integer that fits, else float64.
+func canonicalNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		if f >= math.MinInt64 && f < math.MaxInt64 && f == math.Trunc(f) {
+			return int64(f) // like 1e3 or 5.0
+		}
+		return f
+	case []interface{}:
+		for i := range t {
+			t[i] = canonicalNumbers(t[i])
+		}
+	case map[string]interface{}:
+		for k := range t {
+			t[k] = canonicalNumbers(t[k])
+		}
+	}
+	return v
+}
+
+// Hash returns the hex-encoded SHA-256 digest of the entity's CanonicalJSON, with
+// the same options, so equal entities have the same hash. It returns the error
+// from CanonicalJSON, if any, like for an invalid value (see ValidateValues).
+func (e Entity) Hash(opts ...DiffOption) (string, error) {
+	b, err := e.CanonicalJSON(opts...)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Clone returns a deep copy of the entity: label values that are maps or slices,
+// including nested Entity values, are copied, not shared. It returns nil if the
+// entity is nil.
+func (e Entity) Clone() Entity {
+	if e == nil {
+		return nil
+	}
+	cp := make(Entity, len(e))
+	for k, v := range e {
+		cp[k] = cloneValue(v)
+	}
+	return cp
+}
+
+// Subset returns a new entity with only the given labels that the entity has.
+// Label values are not copied; use Clone first for a deep copy. It returns nil
+// if the entity is nil. The entity is not modified.
+func (e Entity) Subset(labels ...string) Entity {
+	if e == nil {
+		return nil
+	}
+	sub := make(Entity, len(labels))
+	for _, label := range labels {
+		if v, ok := e[label]; ok {
+			sub[label] = v
+		}
+	}
+	return sub
+}
+
+// Without returns a copy of the entity without the given labels. Label values
+// are not copied; use Clone first for a deep copy. It returns nil if the entity
+// is nil. The entity is not modified.
+func (e Entity) Without(labels ...string) Entity {
+	if e == nil {
+		return nil
+	}
+	cp := make(Entity, len(e))
+	for k, v := range e {
+		cp[k] = v
+	}
+	for _, label := range labels {
+		delete(cp, label)
+	}
+	return cp
+}
+
+// WithoutMeta returns a copy of the entity without meta-labels (_id, _type, etc.).
+// See Entity.Without.
+func (e Entity) WithoutMeta() Entity {
+	if e == nil {
+		return nil
+	}
+	cp := make(Entity, len(e))
+	for k, v := range e {
+		if !IsMetalabel(k) {
+			cp[k] = v
+		}
+	}
+	return cp
+}
+
+// AddToSet returns a copy of the entity with an array operator that adds the
+// values to array label, unless the array already has them (values are compared
+// by value, like Equal). If the label is not set, it's set to an array of the
+// values. Use it in an update patch:
+//
+//	patch := etre.Entity{"env": "prod"}.AddToSet("tags", "a", "b")
+//	wr, err := ec.UpdateOne(id, patch)
+//
+// The API applies array operators atomically, without a read-modify-write, so
+// concurrent AddToSet and Pull on the same label don't lose values, including
+// with multiple entities (Update). Like other labels, the diff in the WriteResult
+// has the previous array, and an update with an array operator increments _rev,
+// so UpdateIfRev with array operators applies them only if the entity is at the
+// expected revision. A label can have only one operator per update, and array
+// operators are not allowed with UPDATE_MODE_REPLACE or on insert. Values must
+// be strings, integers, or bools. The API returns an error if the label is set
+// but not an array. The entity is not modified. Servers before v0.12 do not
+// support array operators.
+func (e Entity) AddToSet(label string, values ...interface{}) Entity {
+	return e.withArrayOp(label, ARRAY_OP_ADD_TO_SET, values)
+}
+
+// Pull returns a copy of the entity with an array operator that removes all
+// occurrences of the values from array label. If the label is not set, it's not
+// changed. See AddToSet.
+func (e Entity) Pull(label string, values ...interface{}) Entity {
+	return e.withArrayOp(label, ARRAY_OP_PULL, values)
+}
+
+func (e Entity) withArrayOp(label, op string, values []interface{}) Entity {
+	cp := e.Without()
+	if cp == nil {
+		cp = Entity{}
+	}
+	cp[label] = map[string]interface{}{op: append([]interface{}{}, values...)}
+	return cp
+}
+
+// ArrayOp returns the array operator (ARRAY_OP_ADD_TO_SET or ARRAY_OP_PULL) and
+// values if label value v is an array operator from AddToSet or Pull, including
+// after decoding from JSON.
+func ArrayOp(v interface{}) (op string, values []interface{}, ok bool) {
+	var m map[string]interface{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m = t
+	case Entity:
+		m = t
+	default:
+		return "", nil, false
+	}
+	if len(m) != 1 {
+		return "", nil, false
+	}
+	for op, v := range m {
+		if op != ARRAY_OP_ADD_TO_SET && op != ARRAY_OP_PULL {
+			return "", nil, false
+		}
+		values, ok = v.([]interface{})
+		return op, values, ok
+	}
+	return "", nil, false
+}
+
+// ApplyArrayOp returns the array that results from applying the array operator
+// (see ArrayOp) to the current label value cur, and false if cur is set but not
+// an array. If cur is nil (label not set), AddToSet returns the values without
+// duplicates, and Pull returns nil (label still not set). Values are compared
+// like Equal. cur is not modified.
+func ApplyArrayOp(cur interface{}, op string, values []interface{}) ([]interface{}, bool) {
+	var arr []interface{}
+	if cur != nil {
+		v := reflect.ValueOf(cur)
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return nil, false
+		}
+		arr = make([]interface{}, v.Len())
+		for i := range arr {
+			arr[i] = v.Index(i).Interface()
+		}
+	} else if op == ARRAY_OP_PULL {
+		return nil, true
+	}
+	has := func(a []interface{}, x interface{}) bool {
+		for _, y := range a {
+			if equalValues(x, y) {
+				return true
+			}
+		}
+		return false
+	}
+	switch op {
+	case ARRAY_OP_ADD_TO_SET:
+		if arr == nil {
+			arr = []interface{}{}
+		}
+		for _, x := range values {
+			if !has(arr, x) {
+				arr = append(arr, x)
+			}
+		}
+	case ARRAY_OP_PULL:
+		kept := []interface{}{}
+		for _, x := range arr {
+			if !has(values, x) {
+				kept = append(kept, x)
+			}
+		}
+		arr = kept
+	}
+	return arr, true
+}
+
+// Increment returns a copy of the entity with a counter operator that adds delta,
+// which can be negative, to integer label. If the label is not set, it's set to
+// delta. Use it in an update patch:
+//
+//	patch := etre.Entity{"status": "restarted"}.Increment("restart_count", 1)
+//	wr, err := ec.UpdateOne(id, patch)
+//
+// The API increments the label atomically, without a read-modify-write, so
+// concurrent increments of the same label are not lost, including with multiple
+// entities (Update). Like other labels, the diff in the WriteResult has the
+// previous value, not the incremented one (add delta to get it; the diff doesn't
+// have the label if it was not set), and CDC events have the incremented value,
+// so Entity.Apply works. An update with Increment increments _rev like any other
+// update, so UpdateIfRev with Increment applies it only if the entity is at the
+// expected revision; use UpdateOne, not UpdateIfRev, for counters that many
+// writers change. Like array operators (see AddToSet), counter operators are not
+// allowed with UPDATE_MODE_REPLACE or on insert, and a label can have only one
+// operator per update. The API returns an error if the label is set but not an
+// integer. The entity is not modified. Servers before v0.12 do not support
+// counter operators.
+func (e Entity) Increment(label string, delta int64) Entity {
+	cp := e.Without()
+	if cp == nil {
+		cp = Entity{}
+	}
+	cp[label] = map[string]interface{}{COUNTER_OP_INC: delta}
+	return cp
+}
+
+// IncrementOp returns the delta if label value v is a counter operator from
+// Increment, including after decoding from JSON, where an integer delta can be
+// a float64 or json.Number.
+func IncrementOp(v interface{}) (delta int64, ok bool) {
+	var m map[string]interface{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m = t
+	case Entity:
+		m = t
+	default:
+		return 0, false
+	}
+	if len(m) != 1 {
+		return 0, false
+	}
+	d, ok := m[COUNTER_OP_INC]
+	if !ok {
+		return 0, false
+	}
+	return toInt64(d)
+}
+
+// ApplyIncrement returns the value that results from adding delta to the current
+// label value cur (see IncrementOp), and false if cur is set but not an integer.
+// If cur is nil (label not set), it returns delta.
+func ApplyIncrement(cur interface{}, delta int64) (int64, bool) {
+	if cur == nil {
+		return delta, true
+	}
+	n, ok := toInt64(cur)
+	if !ok {
+		return 0, false
+	}
+	return n + delta, true
+}
+
+// EntityBuilder builds an entity for a write op, so callers don't set meta-labels
+// by hand. NewEntity starts an entity to insert, and ForUpdate an entity to update
+// with _id set. Like QueryBuilder, every method returns a new EntityBuilder, so
+// builders can be reused:
+//
+//	e, err := etre.NewEntity().SetType("host").Set("hostname", "a").Build()
+//	e, err := etre.ForUpdate(id).Set("hostname", "b").Build()
+//
+// Build validates the entity for the op (see Entity.Validate), so mistakes like
+// setting _id on insert or an invalid label are returned before the write. An
+// entity for update has _id, so pass it to writes that take the whole entity,
+// like UpdateIfRev, or pass e.WithoutMeta() as the patch to UpdateOne.
+type EntityBuilder struct {
+	op     string // Entity.Validate op
+	labels []builderLabel
+}
+
+type builderLabel struct {
+	label string
+	value interface{}
+}
+
+// NewEntity returns a builder of an entity to insert.
+func NewEntity() EntityBuilder {
+	return EntityBuilder{op: "insert"}
+}
+
+// ForUpdate returns a builder of an entity to update with meta-label _id set to id.
+func ForUpdate(id string) EntityBuilder {
+	return EntityBuilder{op: "update"}.Set(META_LABEL_ID, id)
+}
+
+// SetType sets meta-label _type. It's optional: if not set, the entity type of
+// the client is presumed.
+func (b EntityBuilder) SetType(entityType string) EntityBuilder {
+	return b.Set(META_LABEL_TYPE, entityType)
+}
+
+// Set sets the label to the value. If the label is set again, the last value is
+// used. The label and value are validated by Build.
+func (b EntityBuilder) Set(label string, value interface{}) EntityBuilder {
+	// Full slice expression so append copies, not modifies, labels shared with b
+	b.labels = append(b.labels[:len(b.labels):len(b.labels)], builderLabel{label, value})
+	return b
+}
+
+// Build returns a new entity with the labels, or the error from Entity.Validate.
+// Label values are not copied. The zero EntityBuilder builds an entity to insert.
+func (b EntityBuilder) Build() (Entity, error) {
+	e := make(Entity, len(b.labels))
+	for _, l := range b.labels {
+		e[l.label] = l.value
+	}
+	op := b.op
+	if op == "" {
+		op = "insert"
+	}
+	if err := e.Validate(op); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// MergeOptions are options for Entity.Merge.
+type MergeOptions struct {
+	// Overwrite makes labels in the other entity overwrite labels in the entity.
+	// By default, the entity labels take precedence and only new labels are added.
+	Overwrite bool
+
+	// SkipMeta makes Merge ignore meta-labels in the other entity.
+	SkipMeta bool
+
+	// ErrorOnConflict makes Merge return an error if a label is in both entities
+	// with different values. Values are compared like Entity.Equal.
+	ErrorOnConflict bool
+}
+
+// Merge returns a new entity with the labels of the entity and other. Labels only
+// in other are added. For labels in both, the entity value is kept unless
+// opts.Overwrite is true. The identifying meta-labels _id and _type are never
+// overwritten: if both entities have one with different values, Merge returns an
+// error (ErrTypeMismatch for _type), so an entity cannot be merged with a
+// different entity. Label values are not copied, and neither entity is modified.
+func (e Entity) Merge(other Entity, opts MergeOptions) (Entity, error) {
+	merged := make(Entity, len(e)+len(other))
+	for k, v := range e {
+		merged[k] = v
+	}
+	for label, v := range other {
+		if opts.SkipMeta && IsMetalabel(label) {
+			continue
+		}
+		cur, ok := merged[label]
+		if !ok {
+			merged[label] = v
+			continue
+		}
+		if equalValues(cur, v) {
+			continue
+		}
+		switch label {
+		case META_LABEL_ID:
+			return nil, fmt.Errorf("cannot merge entity %v into entity %v: different _id", v, cur)
+		case META_LABEL_TYPE:
+			return nil, fmt.Errorf("cannot merge entity type %v into entity type %v: %w", v, cur, ErrTypeMismatch)
+		}
+		if opts.ErrorOnConflict {
+			return nil, fmt.Errorf("label %s conflict: value %v != %v", label, v, cur)
+		}
+		if opts.Overwrite {
+			merged[label] = v
+		}
+	}
+	return merged, nil
+}
+
+// CloneAll returns a deep copy of each entity. See Entity.Clone.
+func CloneAll(entities []Entity) []Entity {
+	if entities == nil {
+		return nil
+	}
+	cp := make([]Entity, len(entities))
+	for i, e := range entities {
+		cp[i] = e.Clone()
+	}
+	return cp
+}
+
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case Entity:
+		return v.Clone()
+	case *Entity:
+		if v == nil {
+			return v
+		}
+		cp := v.Clone()
+		return &cp
+	case map[string]interface{}:
+		return map[string]interface{}(Entity(v).Clone())
+	case []interface{}:
+		if v == nil {
+			return v
+		}
+		cp := make([]interface{}, len(v))
+		for i := range v {
+			cp[i] = cloneValue(v[i])
+		}
+		return cp
+	case []Entity:
+		return CloneAll(v)
+	case []string:
+		if v == nil {
+			return v
+		}
+		return append([]string{}, v...)
+	}
+	return v // scalar
+}
+
+// QueryFilter represents filtering options for EntityClient.Query().
+type QueryFilter struct {
+	// ReturnLabels defines labels included in matching entities. An empty slice
+	// returns all labels, including meta-labels. Else, only labels in the slice
+	// are returned. A label can be a dotted path to a key of a nested map, like
+	// "metadata.region", to return only that key: the entity has label metadata
+	// with only key region (read it with Entity.GetPath). Paths cannot overlap,
+	// like "metadata" and "metadata.region" (see ValidateLabelPaths). With
+	// Distinct, the values of the path are returned as label "metadata.region".
+	// Servers before v0.12 don't validate paths, so an invalid one is a db error.
+	ReturnLabels []string
+
+	// Distinct returns unique entities if ReturnLabels contains a single value.
+	// EntityClient returns an error without making a request if enabled and
+	// ReturnLabels does not have exactly one value.
+	Distinct bool
+
+	// Limit returns at most this many matching entities. Offset skips this many
+	// matching entities before returning any. Together, they page through large
+	// result sets: Limit=100, Offset=200 returns the third page of 100. When Limit
+	// is set, a query returns one page, not necessarily all matching entities.
+	// Zero values are not sent, so the default is all matching entities.
+	Limit  int
+	Offset int
+
+	// Sort orders matching entities by these labels, in order. A label prefixed
+	// with "-" sorts descending, else ascending. For example, []string{"hostname",
+	// "-_rev"} sorts by hostname, then by highest revision. Sort is needed for
+	// stable paging with Limit and Offset. It is ignored when Distinct is true.
+	Sort []string
+
+	// Timeout is the server-side query timeout, sent as QUERY_TIMEOUT_HEADER in
+	// time.Duration string format (e.g. "5s" or "1.5s") because the server parses
+	// it with time.ParseDuration. It overrides EntityClientConfig.QueryTimeout for
+	// this query. If zero, the client default is used, if any, else the server
+	// default (config datasource.query_timeout).
+	Timeout time.Duration
+
+	// SinceRev matches only entities with _rev greater than this value, like
+	// adding "_rev>N" to the query, which must not have another _rev predicate:
+	// the client returns ErrInvalidQuery if it does. Zero is not set. It applies to Query, Count, Stream, and DistinctValues.
+	//
+	// With Sort []string{"_rev"} and Limit, it pages through entities by revision,
+	// resuming from the highest _rev of the last page. But _rev is the number of
+	// times each entity was updated, not a global sequence, so an entity updated
+	// after the last page but with a lower _rev is not matched. And deleted
+	// entities never match. Use it for periodic reconciliation, like finding
+	// entities updated more than N times; for a reliable change feed, use
+	// CDCClient (Replay to catch up).
+	SinceRev int64
+
+	// IncludeDeleted returns tombstones, too: deleted entities that the API keeps
+	// for audit, with meta-label _deleted true (see Entity.IsDeleted). OnlyDeleted
+	// returns only tombstones and takes precedence. By default, tombstones are not
+	// returned. A tombstone has the _id and labels of the entity when it was
+	// deleted, and its _rev is the entity's last _rev plus one, like the EntityRev
+	// of the delete CDCEvent, so it's the highest _rev of the entity (see SinceRev).
+	// They apply to Query, Count, Aggregate, Stream, and DistinctValues. The Etre
+	// API deletes entities (use CDCClient to know an entity was deleted), so it
+	// doesn't make tombstones, and clients cannot set _deleted, but it filters
+	// entities with _deleted true that were written by other means, like a soft
+	// delete process that writes to the database. Servers before v0.12 ignore both
+	// and return entities with _deleted true like other entities.
+	IncludeDeleted bool
+	OnlyDeleted    bool
+
+	// Consistency selects the consistency/latency trade-off of the read, which
+	// the API maps to a MongoDB read preference and read concern:
+	//
+	//   CONSISTENCY_EVENTUAL: read preference secondaryPreferred, read concern
+	//     "local". Reads from a secondary, if any, which offloads the primary,
+	//     but can return stale entities: a write might not be replicated yet,
+	//     so it's not seen, even by the caller that made it.
+	//   CONSISTENCY_READ_YOUR_WRITES: read preference primary, read concern
+	//     "local". Reads the most recent data on the primary, where all writes
+	//     are made, so a write is seen once the API returns it. The data can
+	//     include writes that are not majority-committed, which can be rolled
+	//     back if the primary fails.
+	//   CONSISTENCY_STRONG: read preference primary, read concern "majority".
+	//     Reads only majority-committed data, which can't be rolled back. It's
+	//     slower, and a write that's not majority-committed yet is not seen. It's
+	//     not linearizable: during a failover, an old primary can serve reads.
+	//
+	// The default, empty string, uses the read preference and read concern of
+	// the API datasource URL (MongoDB defaults: primary and "local"), like before
+	// Consistency. It applies to Query, Count, Aggregate, Stream, DistinctValues,
+	// and GetById. The API returns ErrInvalidParam for other values, and the
+	// client returns an error without making a request. Servers before v0.12
+	// ignore it.
+	Consistency string
+}
+
+// ValidateConsistency returns an error if c is not a QueryFilter.Consistency
+// value. An empty string is valid: the API default.
+func ValidateConsistency(c string) error {
+	switch c {
+	case "", CONSISTENCY_EVENTUAL, CONSISTENCY_READ_YOUR_WRITES, CONSISTENCY_STRONG:
+		return nil
+	}
+	return fmt.Errorf("invalid consistency: %s; valid values: %s, %s, %s", c, CONSISTENCY_EVENTUAL, CONSISTENCY_READ_YOUR_WRITES, CONSISTENCY_STRONG)
+}
+
+// QueryDefaults are the default QueryFilter fields of EntityClientConfig.DefaultQueryFilter.
+// A field is applied only if the same QueryFilter field is not set: a number field
+// (Limit, Timeout, SinceRev) if zero, a slice field (ReturnLabels, Sort) if nil,
+// and Consistency if empty. An empty, non-nil slice like []string{} overrides a
+// default with nothing: all labels or no sort. QueryFilter fields Distinct,
+// IncludeDeleted, OnlyDeleted, and Offset cannot have defaults because zero (false
+// or the first entity) is a valid per-call value that couldn't override a default.
+type QueryDefaults struct {
+	ReturnLabels []string
+	Sort         []string
+	Limit        int
+	Timeout      time.Duration
+	SinceRev     int64
+	Consistency  string
+}
+
+// withDefaults returns the filter with the fields that are not set set from
+// defaults. See QueryDefaults.
+func (f QueryFilter) withDefaults(defaults QueryDefaults) QueryFilter {
+	if f.ReturnLabels == nil {
+		f.ReturnLabels = defaults.ReturnLabels
+	}
+	if f.Sort == nil {
+		f.Sort = defaults.Sort
+	}
+	if f.Limit == 0 {
+		f.Limit = defaults.Limit
+	}
+	if f.Timeout == 0 {
+		f.Timeout = defaults.Timeout
+	}
+	if f.SinceRev == 0 {
+		f.SinceRev = defaults.SinceRev
+	}
+	if f.Consistency == "" {
+		f.Consistency = defaults.Consistency
+	}
+	return f
+}
+
+// sinceRevQuery returns the query with a _rev predicate for filter.SinceRev,
+// if set, else the query.
+func sinceRevQuery(query string, filter QueryFilter) string {
+	if filter.SinceRev <= 0 {
+		return query
+	}
+	return query + "," + META_LABEL_REV + ">" + strconv.FormatInt(filter.SinceRev, 10)
+}
+
+// deletedParam returns the query string parameter for filter.IncludeDeleted or
+// OnlyDeleted, like "&deleted=include", or an empty string if neither is set.
+func deletedParam(filter QueryFilter) string {
+	switch {
+	case filter.OnlyDeleted:
+		return "&deleted=only"
+	case filter.IncludeDeleted:
+		return "&deleted=include"
+	}
+	return ""
+}
+
+// consistencyParam returns the query string parameter for filter.Consistency,
+// like "&consistency=strong", or an empty string if not set.
+func consistencyParam(filter QueryFilter) string {
+	if filter.Consistency == "" {
+		return ""
+	}
+	return "&consistency=" + filter.Consistency
+}
+
+// GroupResult is one group of entities returned by EntityClient.Aggregate. Group
+// has the value of each group-by label that the entities in the group share, or
+// nil for entities without the label. Count is the number of entities in the
+// group. Other aggregates of the group, like the sum of a numeric label, would
+// be new fields.
+type GroupResult struct {
+	Group Entity `json:"group"`
+	Count int64  `json:"count"`
+}
+
+// QueryPlan is the execution plan of a query returned by EntityClient.Explain.
+// The server executes the query to measure it, but doesn't return the entities.
+// Stage and Index are from the winning plan: Stage is the access stage, like
+// IXSCAN (index scan) or COLLSCAN (collection scan, no index), and Index is the
+// name of the index used, or empty if none. KeysExamined, DocsExamined, Returned,
+// and TimeMs are from the execution stats: a query that examines many more
+// documents than it returns needs a better index. Other fields of the MongoDB
+// explain output are not returned.
+type QueryPlan struct {
+	Stage        string `json:"stage"`        // like IXSCAN or COLLSCAN
+	Index        string `json:"index"`        // index name, empty if none
+	KeysExamined int64  `json:"keysExamined"` // index keys scanned
+	DocsExamined int64  `json:"docsExamined"` // documents scanned
+	Returned     int64  `json:"returned"`     // documents that matched
+	TimeMs       int64  `json:"timeMs"`       // execution time, milliseconds
+}
+
+// QueryRequest is one query for EntityClient.BatchQuery: the query and filter
+// to pass to Query.
+type QueryRequest struct {
+	Query  string
+	Filter QueryFilter
+}
+
+// QueryResponse is the result of a QueryRequest from EntityClient.BatchQuery:
+// the entities returned by Query, or the error. Like Query, Entities is nil on
+// error.
+type QueryResponse struct {
+	Entities []Entity
+	Err      error
+}
+
+// QueryBuilder builds a query string for EntityClient methods like Query, so
+// callers don't format queries by hand. The zero value is an empty query, and
+// every method returns a new QueryBuilder, so builders can be reused:
+//
+//	q := etre.QueryBuilder{}.Equal("zone", "east").Exists("host")
+//	entities, err := ec.Query(q.String(), etre.QueryFilter{})
+//
+// Values are quoted when needed (e.g. if they contain a comma or space), so any
+// value is matched literally. Servers older than the client might not parse
+// quoted values. Labels cannot be quoted, so an invalid label is an error returned by
+// Err and Build. The query language has no OR, so Or only combines Equal and In
+// on the same label, which is the same as In.
+//
+// The server supports operators =, ==, !=, in, notin, exists (label), notexists
+// (!label), <, <=, >, >= on integer values, since v0.12, =~ and !~ to match
+// a regular expression (see Regex and EqualFold), and isnull (label isnull) to
+// match an explicit null value (see IsNull).
+//
+// A label with a null value exists: it's returned with the entity and matches
+// Exists, not NotExists, like Entity.Has. Only IsNull tells a null value from a
+// missing label, and only NotExists matches a missing label. The comparison
+// operators never match null: Equal does not match "null" or "", and NotEqual
+// and NotIn match null values like missing labels. The client doesn't write
+// null values (see Entity.Validate), but entities written by other means can
+// have them.
+type QueryBuilder struct {
+	preds []queryPredicate
+	err   error
+}
+
+type queryPredicate struct {
+	label  string
+	op     string // =, !=, =~, !~, in, notin, exists, notexists, isnull
+	values []string
+}
+
+// Equal matches entities with the label value.
+func (b QueryBuilder) Equal(label, value string) QueryBuilder {
+	return b.add(label, "=", value)
+}
+
+// NotEqual matches entities without the label value, including entities that
+// do not have the label.
+func (b QueryBuilder) NotEqual(label, value string) QueryBuilder {
+	return b.add(label, "!=", value)
+}
+
+// Regex matches entities with a string label value that matches the regular
+// expression, like "^web-". It's not anchored, so use ^ and $ to match the whole
+// value. The server uses MongoDB $regex, which has PCRE syntax; the pattern must
+// compile with Go regexp (RE2) syntax, which is mostly a subset, else it's an
+// error returned by Err and Build. The pattern is quoted like any value, so it
+// can contain commas and parentheses.
+func (b QueryBuilder) Regex(label, pattern string) QueryBuilder {
+	return b.addRegex(label, "=~", pattern)
+}
+
+// NotRegex matches entities without a string label value that matches the
+// regular expression, including entities that do not have the label. See Regex.
+func (b QueryBuilder) NotRegex(label, pattern string) QueryBuilder {
+	return b.addRegex(label, "!~", pattern)
+}
+
+// EqualFold matches entities with the label value, ignoring case, like
+// strings.EqualFold. It's Regex with the value escaped, so regular expression
+// characters in the value are matched literally.
+func (b QueryBuilder) EqualFold(label, value string) QueryBuilder {
+	return b.add(label, "=~", `(?i)^`+regexp.QuoteMeta(value)+`$`)
+}
+
+// In matches entities with any of the label values.
+func (b QueryBuilder) In(label string, values ...string) QueryBuilder {
+	return b.add(label, "in", values...)
+}
+
+// NotIn matches entities with none of the label values, including entities that
+// do not have the label.
+func (b QueryBuilder) NotIn(label string, values ...string) QueryBuilder {
+	return b.add(label, "notin", values...)
+}
+
+// Exists matches entities that have the label, including entities with a null
+// label value.
+func (b QueryBuilder) Exists(label string) QueryBuilder {
+	return b.add(label, "exists")
+}
+
+// NotExists matches entities that do not have the label. It does not match
+// entities with a null label value; use IsNull for those.
+func (b QueryBuilder) NotExists(label string) QueryBuilder {
+	return b.add(label, "notexists")
+}
+
+// IsNull matches entities that have the label with a null value, not entities
+// that do not have the label. To match both, use two queries: IsNull and NotExists.
+// Servers older than the client return an invalid-query error.
+func (b QueryBuilder) IsNull(label string) QueryBuilder {
+	return b.add(label, "isnull")
+}
+
+// And matches entities that match b and all the other queries.
+func (b QueryBuilder) And(other ...QueryBuilder) QueryBuilder {
+	for _, o := range other {
+		b = b.copy(len(o.preds))
+		b.preds = append(b.preds, o.preds...)
+		if b.err == nil {
+			b.err = o.err
+		}
+	}
+	return b
+}
+
+// Or matches entities that match b or any of the other queries. Because the query
+// language has no OR, b and the other queries must each be one Equal or In on the
+// same label, and the result is In with all the values. Else, it's an error.
+func (b QueryBuilder) Or(other ...QueryBuilder) QueryBuilder {
+	all := other
+	if len(b.preds) > 0 || b.err != nil {
+		all = append([]QueryBuilder{b}, other...) // else b is the zero value
+	}
+	or := queryPredicate{op: "in"}
+	seen := map[string]bool{}
+	for _, q := range all {
+		if q.err != nil {
+			b.err = q.err
+			return b
+		}
+		if len(q.preds) != 1 || (q.preds[0].op != "=" && q.preds[0].op != "in") ||
+			(or.label != "" && q.preds[0].label != or.label) {
+			b.err = fmt.Errorf("invalid query: Or supports only one Equal or In on the same label, not: %s", q.String())
+			return b
+		}
+		or.label = q.preds[0].label
+		for _, v := range q.preds[0].values {
+			if !seen[v] {
+				seen[v] = true
+				or.values = append(or.values, v)
+			}
+		}
+	}
+	if or.label == "" {
+		b.err = fmt.Errorf("invalid query: Or requires at least one query")
+		return b
+	}
+	return QueryBuilder{preds: []queryPredicate{or}}
+}
+
+// Err returns the first error from building the query, or nil if it's valid.
+func (b QueryBuilder) Err() error {
+	return b.err
+}
+
+// Build returns the query string and the error, if any. It's the same as String
+// and Err. An empty query is an error because EntityClient methods require a query.
+func (b QueryBuilder) Build() (string, error) {
+	if b.err != nil {
+		return "", b.err
+	}
+	if len(b.preds) == 0 {
+		return "", ErrNoQuery
+	}
+	return b.String(), nil
+}
+
+// String returns the query string. If Err is not nil, the query is incomplete:
+// predicates with an invalid label are not included.
+func (b QueryBuilder) String() string {
+	s := make([]string, len(b.preds))
+	for i, p := range b.preds {
+		switch p.op {
+		case "exists":
+			s[i] = p.label
+		case "notexists":
+			s[i] = "!" + p.label
+		case "isnull":
+			s[i] = p.label + " isnull"
+		case "in", "notin":
+			vals := make([]string, len(p.values))
+			for j, v := range p.values {
+				vals[j] = quoteValue(v)
+			}
+			s[i] = p.label + " " + p.op + " (" + strings.Join(vals, ",") + ")"
+		default:
+			s[i] = p.label + p.op + quoteValue(p.values[0])
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (b QueryBuilder) add(label, op string, values ...string) QueryBuilder {
+	if b.err != nil {
+		return b
+	}
+	if err := validateQueryLabel(label); err != nil {
+		b.err = fmt.Errorf("invalid query: %w", err)
+		return b
+	}
+	if (op == "in" || op == "notin") && len(values) == 0 {
+		b.err = fmt.Errorf("invalid query: %s %s: at least one value required", label, op)
+		return b
+	}
+	b = b.copy(1)
+	b.preds = append(b.preds, queryPredicate{label: label, op: op, values: values})
+	return b
+}
+
+func (b QueryBuilder) addRegex(label, op, pattern string) QueryBuilder {
+	if b.err != nil {
+		return b
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		b.err = fmt.Errorf("invalid query: %s%s%s: invalid regular expression: %s", label, op, pattern, err)
+		return b
+	}
+	return b.add(label, op, pattern)
+}
+
+// copy returns b with a copy of the predicates, so that appending to them does
+// not modify the predicates of b, which can be reused. n is extra capacity.
+func (b QueryBuilder) copy(n int) QueryBuilder {
+	preds := make([]queryPredicate, len(b.preds), len(b.preds)+n)
+	copy(preds, b.preds)
+	b.preds = preds
+	return b
+}
+
+// validateQueryLabel returns an error if the label is invalid (see ValidateLabel)
+// or cannot be parsed in a query.
+func validateQueryLabel(label string) error {
+	if err := ValidateLabel(label); err != nil {
+		return err
+	}
+	for _, r := range label {
+		if query.IsInvalidLabelChar(r) || r == ',' || r == '"' || r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return fmt.Errorf("invalid label %s: %q is not valid in a query", label, r)
+		}
+	}
+	return nil
+}
+
+// quoteValue returns the value double-quoted if the query parser would not
+// read it literally, else it returns the value as-is.
+func quoteValue(v string) string {
+	if v == "" || strings.ContainsAny(v, `,()"\`) || strings.TrimSpace(v) != v || query.IsOp(rune(v[0])) || v[0] == '~' {
+		return strconv.Quote(v)
+	}
+	for _, r := range v {
+		if !strconv.IsPrint(r) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+// WriteOptions represents options for write operations. See EntityClient.WithWriteOptions.
+type WriteOptions struct {
+	// DryRun makes update and delete operations return the WriteResult they would
+	// return, including Write.Diff for each entity, without changing any entities
+	// or writing CDC events. The returned WriteResult.DryRun is true to show that
+	// the writes were simulated, not persisted. Insert and Upsert return
+	// ErrDryRunInsert. DeleteByQuery makes one request for all matching entities,
+	// ignoring QueryFilter.Limit, because nothing is deleted between batches.
+	DryRun bool
+
+	// UpdateMode is how updates (Update, UpdateMany, UpdateOne, UpdateIfRev,
+	// Upsert, and MutateById) change entities. With UPDATE_MODE_MERGE (default),
+	// only the labels in the patch are set; other labels are not changed. With
+	// UPDATE_MODE_REPLACE, the patch is the new entity: labels in the patch are
+	// set, and other labels are removed, except meta-labels, which are set by the
+	// API. Either way, Write.Diff has the previous values of the labels that were
+	// set, if any, and, on replace, of the labels that were removed, so it has
+	// every label changed. Inserts and deletes ignore it. The API returns an
+	// error for an invalid mode, but servers before v0.12 ignore it and merge.
+	UpdateMode string
+
+	// ContinueOnError makes DeleteByIds try to delete every ID instead of stopping
+	// on the first error. WriteResult.Errors has the error of each ID that failed.
+	ContinueOnError bool
+
+	// IgnoreNotFound makes DeleteByIds treat an ID that doesn't match an entity as
+	// already deleted, not an error, so deletes can be repeated (idempotent).
+	IgnoreNotFound bool
+}
+
+// WriteResult represents the result of a write operation (insert, update delete).
+// On success or failure, all write ops return a WriteResult.
+//
+// If Error is set (not nil), some or all writes failed. Writes stop on the first
+// error, so len(Writes) = index into slice of entities sent by client that failed.
+// For example, if the first entity causes an error, len(Writes) = 0. If the third
+// entity fails, len(Writes) = 2 (zero indexed).
+type WriteResult struct {
+	Writes    []Write `json:"writes"`              // successful writes
+	Error     *Error  `json:"error,omitempty"`     // error before, during, or after writes
+	DryRun    bool    `json:"dryRun,omitempty"`    // writes were not persisted (see WriteOptions)
+	RequestId string  `json:"requestId,omitempty"` // request ID, if any (see WithRequestId)
+
+	// Warnings are non-fatal messages from the API about the writes, like a
+	// deprecated label or a coerced value. Writes with warnings succeeded, so
+	// warnings are not errors: Err and IsZero ignore them. Servers before v0.12
+	// don't send warnings.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Errors has the error of each entity ID that failed, if the client made one
+	// request per ID, like DeleteByIds. It's not sent by the API.
+	Errors map[string]Error `json:"-"`
+
+	// Replayed is true if the API returned the result of an earlier insert with
+	// the same idempotency key instead of inserting the entities again (see
+	// WithIdempotencyKey). It's set from header IDEMPOTENT_REPLAY_HEADER, not
+	// sent in the result.
+	Replayed bool `json:"-"`
+}
+
+func (wr WriteResult) IsZero() bool {
+	return wr.Error == nil && len(wr.Writes) == 0
+}
+
+// Err returns Error as an error value, or nil if Error is nil. The error is an
+// Error (not *Error), so use errors.As with an Error to get the details:
+//
+//	if err := wr.Err(); err != nil { ... }
+func (wr WriteResult) Err() error {
+	if wr.Error == nil {
+		return nil // not a typed nil *Error
+	}
+	return *wr.Error
+}
+
+// DiffFor returns the Diff of the write of the entity with the given ID. The bool
+// is true if the entity was written, even if its Diff is nil (insert). Else, nil
+// and false are returned. It scans Writes, so callers looking up many entities
+// should build a map of Writes by EntityId instead.
+func (wr WriteResult) DiffFor(entityId string) (Entity, bool) {
+	for _, w := range wr.Writes {
+		if w.EntityId == entityId {
+			return w.Diff, true
+		}
+	}
+	return nil, false
+}
+
+// MergeWriteResults returns one WriteResult with the Writes of all results, in
+// order, and the first Error, if any. DryRun is true if all results are dry runs.
+// With no results, it returns a zero WriteResult.
+//
+// The merged result keeps the index semantics of WriteResult if results are
+// batches of one input slice in order and the failed batch is the last, like
+// the results from EntityClient.InsertBatch, which stops on the first error:
+// len(Writes) is the index of the failed entity in the input. Generally, the
+// index of the failed entity is the number of Writes in the results before the
+// failed one plus the number of Writes in the failed one. Writes of results
+// after the failed one are appended, too, in which case len(Writes) is greater
+// than the index.
+func MergeWriteResults(results ...WriteResult) WriteResult {
+	var merged WriteResult
+	if len(results) == 0 {
+		return merged
+	}
+	merged.DryRun = true
+	for _, wr := range results {
+		merged.Writes = append(merged.Writes, wr.Writes...)
+		if merged.Error == nil && wr.Error != nil {
+			merged.Error = wr.Error
+		}
+		merged.DryRun = merged.DryRun && wr.DryRun
+	}
+	return merged
+}
+
+// Write represents the successful write of one entity.
+type Write struct {
+	EntityId string `json:"entityId"`       // internal _id of entity (all write ops)
+	URI      string `json:"uri,omitempty"`  // fully-qualified address of new entity (insert); see ResolveURI
+	Diff     Entity `json:"diff,omitempty"` // previous entity label values (update)
+	Inserted bool   `json:"-"`              // true if EntityClient.Upsert inserted the entity
+
+	// Index and Error are set only by EntityClient.InsertStream: Index is the
+	// position (from 0) of the entity in the input, or -1 if Error is not for one
+	// entity, and Error is the error inserting the entity, if any.
+	Index int    `json:"index,omitempty"`
+	Error *Error `json:"error,omitempty"`
+}
+
+// Err returns Error as an error value, or nil if Error is nil, like WriteResult.Err.
+func (w Write) Err() error {
+	if w.Error == nil {
+		return nil
+	}
+	return *w.Error
+}
+
+// ResolveURI returns the URI of the entity at the given base URL. The server makes
+// the URI from its own address (config server.addr), which might not be reachable
+// by clients, for example behind a proxy. The URI has two parts: the base, which
+// is the scheme, host, and port, like "http://127.0.0.1:3848", and the path, which
+// is API_ROOT+"/entity/"+EntityId. The base is replaced by the given base, which
+// can have a path prefix, like "https://proxy.example.com/etre". If the URI is not
+// set, the path is made from EntityId. If neither is set, it returns "". See also
+// EntityClientConfig.BaseURL.
+func (w Write) ResolveURI(base string) string {
+	path := ""
+	if i := strings.Index(w.URI, API_ROOT+"/"); i >= 0 {
+		path = w.URI[i:]
+	} else if w.EntityId != "" {
+		path = API_ROOT + "/entity/" + w.EntityId
+	} else {
+		return ""
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
+
+// Error is the standard response for all handled errors. Client errors (HTTP 400
+// codes) and internal errors (HTTP 500 codes) are returned as an Error, if handled.
+// If not handled (API crash, panic, etc.), Etre returns an HTTP 500 code and the
+// response data is undefined; the client should print any response data as a string.
+// EntityClient returns a *ServerError with the response data for that.
+type Error struct {
+	Message    string `json:"message"`       // human-readable and loggable error message
+	Type       string `json:"type"`          // error slug (e.g. db-error, missing-param, etc.)
+	EntityId   string `json:"entityId"`      // entity ID that caused error, if any
+	HTTPStatus int    `json:"httpStatus"`    // HTTP status code
+	Rev        int64  `json:"rev,omitempty"` // current entity _rev (rev-conflict)
+}
+
+// ServerError is returned by EntityClient when the API returns an HTTP 5xx
+// response that's not an Error, like the undefined response of an unhandled
+// error (see Error). Body is the raw response, at most SERVER_ERROR_MAX_BODY
+// bytes, so log it to see the server output. errors.Is(err, ErrServerError) is
+// true for a *ServerError; use errors.As to get it.
+type ServerError struct {
+	HTTPStatus int    // HTTP status code
+	Body       string // raw response body, empty if none
+	Truncated  bool   // true if the body was longer than Body
+}
+
+// SERVER_ERROR_MAX_BODY is the maximum number of response body bytes kept in
+// ServerError.Body.
+const SERVER_ERROR_MAX_BODY = 4096
+
+func newServerError(status int, body []byte) *ServerError {
+	e := &ServerError{HTTPStatus: status}
+	if len(body) > SERVER_ERROR_MAX_BODY {
+		body = body[:SERVER_ERROR_MAX_BODY]
+		e.Truncated = true
+	}
+	e.Body = string(body)
+	return e
+}
+
+func (e *ServerError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("Server error: HTTP status %d, no response (check API logs)", e.HTTPStatus)
+	}
+	if e.Truncated {
+		return fmt.Sprintf("Server error: HTTP status %d, unhandled response: %s... (truncated)", e.HTTPStatus, e.Body)
+	}
+	return fmt.Sprintf("Server error: HTTP status %d, unhandled response: %s", e.HTTPStatus, e.Body)
+}
+
+func (e *ServerError) Unwrap() error { return ErrServerError }
+
+func (e Error) New(msgFmt string, msgArgs ...interface{}) Error {
+	if msgFmt != "" {
+		e.Message = fmt.Sprintf(msgFmt, msgArgs...)
+	}
+	return e
+}
+
+func (e Error) String() string {
+	return fmt.Sprintf("Etre error %s: %s", e.Type, e.Message)
+}
+
+func (e Error) Error() string {
+	return e.String()
+}
+
+// Is makes errors.Is(err, sentinel) true if the sentinel matches the Type slug,
+// like ErrRevConflict for a rev-conflict Error, or ErrDBError for a db-query Error.
+// It's also true if target is an Error with the same Type. Use errors.As to get
+// the Error and its fields, like the current entity _rev in Error.Rev.
+func (e Error) Is(target error) bool {
+	if t, ok := target.(Error); ok {
+		return t.Type == e.Type
+	}
+	if target == ErrDBError {
+		return strings.HasPrefix(e.Type, "db-")
+	}
+	if target == ErrQueryTimeout && strings.HasPrefix(e.Type, "db-") && e.Message == "context deadline exceeded" {
+		return true // older server
+	}
+	t, ok := errorTypes[target]
+	return ok && e.Type == t
+}
+
+// TraceContext is trace metadata sent in the X-Etre-Trace header (TRACE_HEADER),
+// like app=foo or request-id=123. The server reports the values in trace metrics,
+// and auth plugins can require keys (ACL trace_keys_required). Trace values are
+// not authenticated, so the CDC event caller is never from the trace.
+type TraceContext map[string]string
+
+// String returns the X-Etre-Trace header value: key=value pairs sorted by key and
+// separated by commas, like "app=foo,request-id=123,user=bar". The format is
+// stable. The server cannot parse keys that are empty or contain "=" or ",",
+// or values that contain ",", so these pairs are omitted.
+func (t TraceContext) String() string {
+	keys := make([]string, 0, len(t))
+	for k, v := range t {
+		if k == "" || strings.ContainsAny(k, "=,") || strings.Contains(v, ",") {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + t[k]
+	}
+	return strings.Join(pairs, ",")
+}
+
+// ParseTraceContext parses an X-Etre-Trace header value. Pairs without "=" are
+// ignored. If a key is repeated, the first value is used. It returns nil if
+// there are no valid pairs.
+func ParseTraceContext(s string) TraceContext {
+	var t TraceContext
+	for _, kv := range strings.Split(s, ",") {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			continue // bad value, ignore
+		}
+		if _, ok := t[p[0]]; ok {
+			continue
+		}
+		if t == nil {
+			t = TraceContext{}
+		}
+		t[p[0]] = p[1]
+	}
+	return t
+}
+
+type traceContextKey struct{}
+
+// ContextWithTrace returns a copy of ctx with the TraceContext for one call,
+// like EntityClient.QueryContext. Its values are added to, and override, the
+// EntityClient TraceContext.
+func ContextWithTrace(ctx context.Context, t TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, t)
+}
+
+type requestIdKey struct{}
+
+// WithRequestId returns a copy of ctx with the request ID for one call, like
+// EntityClient.QueryContext. The client sends it in the X-Etre-Request-Id header
+// (REQUEST_ID_HEADER). The server logs it with errors, returns it in
+// WriteResult.RequestId, and sets it in the CDC events of the write. Without a
+// request ID, the client sends none unless EntityClientConfig.GenerateRequestIds
+// is true. The server ignores IDs longer than 128 characters or with characters
+// other than letters, digits, and "-_.:".
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestId returns the request ID from WithRequestId, or "" if not set.
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey returns a copy of ctx with the idempotency key for one call
+// to EntityClient.InsertContext. The client sends it in the X-Etre-Idempotency-Key
+// header (IDEMPOTENCY_KEY_HEADER) on every try. The key doesn't enable retries:
+// set RetryPolicy.RetryInserts for that. For InsertBatchContext, the key of
+// each batch is the key with suffix "-" and the batch number (from 1), like
+// "abc-1". EntityClientConfig.IdempotentInserts makes the client generate a key
+// for each insert that doesn't have one.
+//
+// The server saves the result of the first insert with a key for its idempotency
+// window (default 10 minutes, from when the insert was received). An insert with
+// the same key and the same entities, in the same order, in the window returns
+// the saved result with WriteResult.Replayed true, including the error if only
+// some entities were inserted. An insert with the same key and different
+// entities returns an error that matches ErrIdempotencyKeyReused, and inserts
+// nothing. If the first insert is still in progress, the server waits for it.
+// If the first insert inserted nothing, the result isn't saved, so the key can
+// be used again. After the window, the key is forgotten, so an insert with it
+// inserts the entities again. Keys are unique per entity type and caller, and
+// saved in memory, per server instance: if a retry goes to a different server
+// instance, it's not deduped. A server saves a limited number of keys, so a key
+// can be forgotten before the window if there are many. Keys are at most 128
+// characters of letters, digits, and "-_.:"; the server returns ErrInvalidParam
+// for another key. Servers before v0.12 ignore the key.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// IdempotencyKey returns the idempotency key from WithIdempotencyKey, or "" if
+// not set.
+func IdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	return key
+}
+
+// NewRequestId returns a random (version 4) UUID, like
+// "2f1b6a9e-3c4d-4e5f-8a9b-0c1d2e3f4a5b".
+func NewRequestId() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand.Read: %s", err)) // never happens on supported platforms
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// CDCEvent.Op values.
+const (
+	CDC_OP_INSERT = "i"
+	CDC_OP_UPDATE = "u"
+	CDC_OP_DELETE = "d"
+)
+
+type CDCEvent struct {
+	Id     string `json:"eventId" bson:"_id,omitempty"`
+	Ts     int64  `json:"ts" bson:"ts"` // Unix milliseconds
+	Op     string `json:"op" bson:"op"` // CDC_OP_INSERT, CDC_OP_UPDATE, CDC_OP_DELETE
+	Caller string `json:"user" bson:"caller"`
+
+	RequestId string `json:"requestId,omitempty" bson:"requestId,omitempty"` // request ID of the write, if any (see WithRequestId)
+
+	EntityId   string  `json:"entityId" bson:"entityId"`           // _id of entity
+	EntityType string  `json:"entityType" bson:"entityType"`       // user-defined
+	EntityRev  int64   `json:"rev" bson:"entityRev"`               // entity revision as of this op, 0 on insert
+	Old        *Entity `json:"old,omitempty" bson:"old,omitempty"` // old values of affected labels, null on insert
+	New        *Entity `json:"new,omitempty" bson:"new,omitempty"` // new values of affected labels, null on delete
+
+	// Set op fields are optional, copied from entity if set. The three
+	// fields are all or nothing: all should be set, or none should be set.
+	// Etre has no semantic awareness of set op values, nor does it validate
+	// them. The caller is responsible for ensuring they're correct.
+	SetId   string `json:"setId,omitempty" bson:"setId,omitempty"`
+	SetOp   string `json:"setOp,omitempty" bson:"setOp,omitempty"`
+	SetSize int    `json:"setSize,omitempty" bson:"setSize,omitempty"`
+}
+
+// IsInsert returns true if the event is an insert (Op is CDC_OP_INSERT).
+func (e CDCEvent) IsInsert() bool { return e.Op == CDC_OP_INSERT }
+
+// IsUpdate returns true if the event is an update (Op is CDC_OP_UPDATE).
+func (e CDCEvent) IsUpdate() bool { return e.Op == CDC_OP_UPDATE }
+
+// IsDelete returns true if the event is a delete (Op is CDC_OP_DELETE).
+func (e CDCEvent) IsDelete() bool { return e.Op == CDC_OP_DELETE }
+
+// HasOld returns true if Old is set, which is false on insert.
+func (e CDCEvent) HasOld() bool { return e.Old != nil }
+
+// HasNew returns true if New is set, which is false on delete.
+func (e CDCEvent) HasNew() bool { return e.New != nil }
+
+// OldEntity returns Old, or a new empty entity if Old is nil (insert). When Old
+// is set, the entity is not copied, so changing it changes the event.
+func (e CDCEvent) OldEntity() Entity {
+	if e.Old == nil || *e.Old == nil {
+		return Entity{}
+	}
+	return *e.Old
+}
+
+// NewEntity returns New, or a new empty entity if New is nil (delete). When New
+// is set, the entity is not copied, so changing it changes the event.
+func (e CDCEvent) NewEntity() Entity {
+	if e.New == nil || *e.New == nil {
+		return Entity{}
+	}
+	return *e.New
+}
+
+// ChangedLabels returns the sorted names of the labels with a different value in
+// Old and New: labels in New that are not in Old or have a different value, like
+// Changed, and labels in Old that are not in New. Integer values are equal
+// regardless of type, like Diff. On insert, it's every label in New; on delete,
+// every label in Old.
+func (e CDCEvent) ChangedLabels() []string {
+	old, new := e.OldEntity(), e.NewEntity()
+	changed := Diff(old, new)
+	for label, v := range old {
+		if _, ok := new[label]; !ok {
+			changed[label] = v
+		}
+	}
+	return changed.Labels()
+}
+
+// Validate returns an error if Op is invalid or Old and New are not set correctly
+// for the op: on insert, Old is nil and New is set; on update, both are set; and
+// on delete, Old is set and New is nil.
+func (e CDCEvent) Validate() error {
+	switch e.Op {
+	case CDC_OP_INSERT:
+		if e.Old != nil {
+			return fmt.Errorf("CDC event %s: old must be nil on insert", e.Id)
+		}
+		if e.New == nil {
+			return fmt.Errorf("CDC event %s: new not set on insert", e.Id)
+		}
+	case CDC_OP_UPDATE:
+		if e.Old == nil || e.New == nil {
+			return fmt.Errorf("CDC event %s: old and new must be set on update", e.Id)
+		}
+	case CDC_OP_DELETE:
+		if e.Old == nil {
+			return fmt.Errorf("CDC event %s: old not set on delete", e.Id)
+		}
+		if e.New != nil {
+			return fmt.Errorf("CDC event %s: new must be nil on delete", e.Id)
+		}
+	default:
+		return fmt.Errorf("CDC event %s: invalid op: %s; valid ops: i, u, d", e.Id, e.Op)
+	}
+	return nil
+}
+
+// CDCFilter filters the CDC feed by entity type and op. The API sends only
+// events that match; a zero value matches all events.
+type CDCFilter struct {
+	Types []string `json:"types,omitempty"` // entity types to send, or all if empty
+	Ops   []string `json:"ops,omitempty"`   // CDC_OP_INSERT, CDC_OP_UPDATE, CDC_OP_DELETE, or all if empty
+}
+
+// CDCLatest is returned by the API for GET /changes/latest. See CDCClient.Lag.
+type CDCLatest struct {
+	Ts int64 `json:"ts"` // Ts of the most recent CDC event, or zero if there are none
+}
+
+// Validate returns an error if an op is not CDC_OP_INSERT, CDC_OP_UPDATE, or
+// CDC_OP_DELETE, or an entity type is empty.
+func (f CDCFilter) Validate() error {
+	for _, t := range f.Types {
+		if t == "" {
+			return fmt.Errorf("invalid CDC filter: empty entity type")
+		}
+	}
+	for _, op := range f.Ops {
+		switch op {
+		case CDC_OP_INSERT, CDC_OP_UPDATE, CDC_OP_DELETE:
+		default:
+			return fmt.Errorf("invalid CDC filter: invalid op: %s; valid ops: i, u, d", op)
+		}
+	}
+	return nil
+}
+
+// Match returns true if the event entity type and op match the filter.
+func (f CDCFilter) Match(e CDCEvent) bool {
+	return matchAny(f.Types, e.EntityType) && matchAny(f.Ops, e.Op)
+}
+
+// matchAny returns true if list is empty or contains v.
+func matchAny(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns a copy of the entity with the CDC event applied, or nil if the
+// event is a delete. The entity is not modified. On insert, the entity must be
+// nil or empty, and the new entity is the event New labels. On update, New labels
+// are set, and Old labels not in New are removed (e.g. from DeleteLabel).
+//
+// The event must be for the entity (EntityId equals _id) and the next revision
+// (EntityRev equals _rev + 1). If EntityRev is greater, the error wraps ErrCDCRevGap,
+// which means events were missed. If less, the event was already applied.
+func (e Entity) Apply(event CDCEvent) (Entity, error) {
+	if err := event.Validate(); err != nil {
+		return nil, err
+	}
+
+	if event.IsInsert() {
+		if len(e) > 0 {
+			return nil, fmt.Errorf("CDC event %s: cannot apply insert of entity %s to existing entity", event.Id, event.EntityId)
+		}
+		new := Entity{}
+		for k, v := range *event.New {
+			new[k] = v
+		}
+		new[META_LABEL_ID] = event.EntityId
+		if event.EntityType != "" {
+			new[META_LABEL_TYPE] = event.EntityType
+		}
+		new[META_LABEL_REV] = event.EntityRev
+		return new, nil
+	}
+
+	id, _ := e.IdOK()
+	if id != event.EntityId {
+		return nil, fmt.Errorf("CDC event %s: entity id %s does not match entity _id %s", event.Id, event.EntityId, id)
+	}
+	rev, ok := toInt64(e[META_LABEL_REV])
+	if !ok {
+		return nil, fmt.Errorf("entity %s has invalid _rev data type: %T", id, e[META_LABEL_REV])
+	}
+	if event.EntityRev > rev+1 {
+		return nil, fmt.Errorf("CDC event %s: entity %s rev %d, expected %d: %w", event.Id, id, event.EntityRev, rev+1, ErrCDCRevGap)
+	}
+	if event.EntityRev <= rev {
+		return nil, fmt.Errorf("CDC event %s: entity %s rev %d already applied, current rev %d", event.Id, id, event.EntityRev, rev)
+	}
+
+	if event.IsDelete() {
+		return nil, nil
+	}
+
+	new := Entity{}
+	for k, v := range e {
+		new[k] = v
+	}
+	for k := range *event.Old {
+		if _, ok := (*event.New)[k]; !ok && !IsMetalabel(k) {
+			delete(new, k)
+		}
+	}
+	for k, v := range *event.New {
+		if !IsMetalabel(k) {
+			new[k] = v
+		}
+	}
+	new[META_LABEL_REV] = event.EntityRev
+	return new, nil
+}
+
+// Latency represents network latencies in milliseconds.
+type Latency struct {
+	Send int64 // client -> server
+	Recv int64 // server -> client
+	RTT  int64 // client -> server -> client
+}
+
+// ClientStats are EntityClient request stats returned by EntityClient.Stats.
+// Requests includes retries, and Errors are requests that failed or returned an
+// API error (HTTP status 400 or greater). RTT, Send, and Recv are exponential
+// moving averages of the Latency of the Responses (requests that received a
+// response, including API errors), so network errors and timeouts don't skew
+// them. They're zero until the first response. Send and Recv are zero unless
+// EntityClientConfig.LatencyEMASendRecv is true.
+type ClientStats struct {
+	Requests  int64
+	Errors    int64
+	Responses int64
+	RTT       time.Duration
+	Send      time.Duration
+	Recv      time.Duration
+}
+
+var (
+	DebugEnabled = false
+	debugLog     = log.New(os.Stderr, "DEBUG ", log.LstdFlags|log.Lmicroseconds)
+)
+
+// Logger is an optional debug logger for an EntityClient or CDCClient. If set,
+// the client sends all its debug output to the Logger instead of the global
+// Debug, which is the default. Debugf is called only if debug is enabled
+// (EntityClientConfig.Debug, CDCClientConfig.Debug, or DebugEnabled for an
+// EntityClient); the message is prefixed with the file and line that logged it.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+}
+
+func Debug(msg string, v ...interface{}) {
+	if !DebugEnabled {
+		return
+	}
+	_, file, line, _ := runtime.Caller(1)
 	msg = fmt.Sprintf("%s:%d %s", path.Base(file), line, msg)
 	debugLog.Printf(msg, v...)
 }
+
+// debugf logs to logger if not nil, else to debugLog. depth is the number of
+// stack frames to skip to report the file and line of the caller.
+func debugf(logger Logger, depth int, msg string, v ...interface{}) {
+	_, file, line, _ := runtime.Caller(depth + 1)
+	msg = fmt.Sprintf("%s:%d %s", path.Base(file), line, msg)
+	if logger != nil {
+		logger.Debugf(msg, v...)
+		return
+	}
+	debugLog.Printf(msg, v...)
+}
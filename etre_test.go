@@ -0,0 +1,1143 @@
+// Copyright 2017-2020, Square, Inc.
+
+package etre_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/square/etre"
+	"github.com/square/etre/query"
+)
+
+func TestEntityInt(t *testing.T) {
+	e := etre.Entity{
+		"int":     5,
+		"int32":   int32(5),
+		"int64":   int64(5),
+		"float":   float64(5),
+		"frac":    5.5,
+		"string":  "5",
+		"bool":    true,
+		"float32": float32(5),
+		"big":     1e20,
+		"min":     -1e20,
+		"inf":     math.Inf(1),
+		"nan":     math.NaN(),
+	}
+	for _, label := range []string{"int", "int32", "int64", "float", "float32"} {
+		n, ok := e.Int(label)
+		assert.True(t, ok, label)
+		assert.Equal(t, int64(5), n, label)
+	}
+	for _, label := range []string{"frac", "string", "bool", "missing", "big", "min", "inf", "nan"} {
+		n, ok := e.Int(label)
+		assert.False(t, ok, label)
+		assert.Equal(t, int64(0), n, label)
+	}
+}
+
+func TestEntityFloat64(t *testing.T) {
+	e := etre.Entity{
+		"int":    5,
+		"int32":  int32(5),
+		"int64":  int64(5),
+		"uint8":  uint8(5),
+		"float":  5.0,
+		"number": json.Number("5"),
+		"string": "5",
+	}
+	for _, label := range []string{"int", "int32", "int64", "uint8", "float", "number"} {
+		f, ok := e.Float64(label)
+		assert.True(t, ok, label)
+		assert.Equal(t, 5.0, f, label)
+	}
+	for _, label := range []string{"string", "missing"} {
+		f, ok := e.Float64(label)
+		assert.False(t, ok, label)
+		assert.Equal(t, 0.0, f, label)
+	}
+	f, ok := etre.Entity{"a": json.Number("1.5")}.Float64("a") // JSON_NUMBERS_JSON_NUMBER
+	assert.True(t, ok)
+	assert.Equal(t, 1.5, f)
+}
+
+func TestEntityBool(t *testing.T) {
+	e := etre.Entity{
+		"t":      true,
+		"f":      false,
+		"int":    1,
+		"string": "true",
+	}
+	b, ok := e.Bool("t")
+	assert.True(t, ok)
+	assert.True(t, b)
+
+	b, ok = e.Bool("f")
+	assert.True(t, ok)
+	assert.False(t, b)
+
+	for _, label := range []string{"int", "string", "missing"} {
+		b, ok = e.Bool(label)
+		assert.False(t, ok, label)
+		assert.False(t, b, label)
+	}
+}
+
+func TestEntityTs(t *testing.T) {
+	ms := int64(1700000000123)
+	for _, v := range []interface{}{ms, int(ms), float64(ms)} {
+		e := etre.Entity{"_ts": v}
+		ts, ok := e.Ts()
+		assert.True(t, ok, "%T", v)
+		assert.Equal(t, ms, ts, "%T", v)
+		tm, ok := e.Time()
+		assert.True(t, ok, "%T", v)
+		assert.Equal(t, time.UnixMilli(ms), tm, "%T", v)
+		assert.Equal(t, 123*time.Millisecond, time.Duration(tm.Nanosecond()))
+	}
+	ts, ok := etre.Entity{"_ts": int32(5)}.Ts()
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), ts)
+
+	for _, e := range []etre.Entity{{}, {"_ts": "1"}, {"_ts": 1.5}} {
+		ts, ok := e.Ts()
+		assert.False(t, ok, "%v", e)
+		assert.Zero(t, ts)
+		tm, ok := e.Time()
+		assert.False(t, ok, "%v", e)
+		assert.True(t, tm.IsZero())
+	}
+
+	// From JSON, _ts is decoded as int64
+	var e etre.Entity
+	require.NoError(t, json.Unmarshal([]byte(`{"_ts":1700000000123}`), &e))
+	ts, ok = e.Ts()
+	assert.True(t, ok)
+	assert.Equal(t, ms, ts)
+}
+
+func TestEntityGetOK(t *testing.T) {
+	e := etre.Entity{
+		"_id":   "abc",
+		"_type": "node",
+		"nil":   nil,
+	}
+	v, ok := e.GetOK("_id")
+	assert.True(t, ok)
+	assert.Equal(t, "abc", v)
+
+	v, ok = e.GetOK("nil")
+	assert.True(t, ok)
+	assert.Nil(t, v)
+
+	v, ok = e.GetOK("missing")
+	assert.False(t, ok)
+	assert.Nil(t, v)
+
+	id, ok := e.IdOK()
+	assert.True(t, ok)
+	assert.Equal(t, "abc", id)
+	assert.Equal(t, "abc", e.Id())
+
+	typ, ok := e.TypeOK()
+	assert.True(t, ok)
+	assert.Equal(t, "node", typ)
+	assert.Equal(t, "node", e.Type())
+
+	// Projected entity without meta-labels: OK funcs don't panic, others do
+	p := etre.Entity{"hostname": "local", "_type": 1}
+	id, ok = p.IdOK()
+	assert.False(t, ok)
+	assert.Empty(t, id)
+	typ, ok = p.TypeOK()
+	assert.False(t, ok)
+	assert.Empty(t, typ)
+	assert.Panics(t, func() { p.Id() })
+	assert.Panics(t, func() { p.Type() })
+}
+
+func TestWriteResultErr(t *testing.T) {
+	wr := etre.WriteResult{Writes: []etre.Write{{EntityId: "abc"}}}
+	assert.NoError(t, wr.Err())
+	assert.True(t, wr.Err() == nil, "typed nil error") // not a nil *Error in an error
+
+	wr.Error = &etre.Error{Type: "db-error", Message: "fake error"}
+	err := wr.Err()
+	require.Error(t, err)
+	var etreErr etre.Error
+	require.ErrorAs(t, err, &etreErr)
+	assert.Equal(t, "db-error", etreErr.Type)
+}
+
+func TestMergeWriteResults(t *testing.T) {
+	assert.True(t, etre.MergeWriteResults().IsZero())
+	assert.True(t, etre.MergeWriteResults(etre.WriteResult{}, etre.WriteResult{}).IsZero())
+
+	// Batches of 2: the first succeeded, the second failed on its second entity,
+	// so the failed entity is index 3 in the input
+	err1 := &etre.Error{Type: "duplicate-entity", Message: "dupe"}
+	err2 := &etre.Error{Type: "db-error", Message: "fake error"}
+	merged := etre.MergeWriteResults(
+		etre.WriteResult{Writes: []etre.Write{{EntityId: "a"}, {EntityId: "b"}}},
+		etre.WriteResult{Writes: []etre.Write{{EntityId: "c"}}, Error: err1},
+	)
+	assert.False(t, merged.IsZero())
+	assert.Equal(t, []etre.Write{{EntityId: "a"}, {EntityId: "b"}, {EntityId: "c"}}, merged.Writes)
+	assert.Equal(t, err1, merged.Error)
+	assert.Len(t, merged.Writes, 3)
+	assert.False(t, merged.DryRun)
+
+	// Writes after the failed result are appended; the first error is kept
+	merged = etre.MergeWriteResults(
+		etre.WriteResult{Error: err1},
+		etre.WriteResult{Writes: []etre.Write{{EntityId: "a"}}, Error: err2},
+	)
+	assert.Equal(t, []etre.Write{{EntityId: "a"}}, merged.Writes)
+	assert.Equal(t, err1, merged.Error)
+
+	merged = etre.MergeWriteResults(
+		etre.WriteResult{Writes: []etre.Write{{EntityId: "a"}}, DryRun: true},
+		etre.WriteResult{DryRun: true},
+	)
+	assert.True(t, merged.DryRun)
+	assert.NoError(t, merged.Err())
+}
+
+func TestWriteResultDiffFor(t *testing.T) {
+	wr := etre.WriteResult{Writes: []etre.Write{
+		{EntityId: "a", Diff: etre.Entity{"_id": "a", "x": "1"}},
+		{EntityId: "b"},
+	}}
+	diff, ok := wr.DiffFor("a")
+	assert.True(t, ok)
+	assert.Equal(t, etre.Entity{"_id": "a", "x": "1"}, diff)
+
+	diff, ok = wr.DiffFor("b")
+	assert.True(t, ok)
+	assert.Nil(t, diff)
+
+	diff, ok = wr.DiffFor("c")
+	assert.False(t, ok)
+	assert.Nil(t, diff)
+}
+
+func TestErrorIs(t *testing.T) {
+	var err error = etre.Error{Type: "duplicate-entity", Message: "dupe"}
+	assert.ErrorIs(t, err, etre.ErrDuplicateEntity)
+	assert.NotErrorIs(t, err, etre.ErrDBError)
+	assert.NotErrorIs(t, err, etre.ErrRevConflict)
+
+	// Wrapped
+	err = fmt.Errorf("insert failed: %w", etre.Error{Type: "entity-not-found"})
+	assert.ErrorIs(t, err, etre.ErrEntityNotFound)
+
+	// All db-* types are ErrDBError
+	for _, dbType := range []string{"db-error", "db-query", "db-insert"} {
+		assert.ErrorIs(t, etre.Error{Type: dbType}, etre.ErrDBError, dbType)
+	}
+
+	// Query timeout is a db error but not other db errors, unless an older
+	// server sent a db error for a query timeout
+	err = etre.Error{Type: "db-query-timeout", Message: "context deadline exceeded"}
+	assert.ErrorIs(t, err, etre.ErrQueryTimeout)
+	assert.ErrorIs(t, err, etre.ErrDBError)
+	assert.NotErrorIs(t, err, etre.ErrClientTimeout)
+	assert.NotErrorIs(t, etre.Error{Type: "db-query", Message: "connection reset"}, etre.ErrQueryTimeout)
+	assert.ErrorIs(t, etre.Error{Type: "db-read", Message: "context deadline exceeded"}, etre.ErrQueryTimeout)
+
+	// Error target matches Type, not other fields
+	err = etre.Error{Type: "invalid-param", Message: "invalid limit"}
+	assert.ErrorIs(t, err, etre.Error{Type: "invalid-param"})
+	assert.ErrorIs(t, err, etre.ErrInvalidParam)
+	assert.NotErrorIs(t, err, etre.Error{Type: "missing-param"})
+}
+
+func TestDiff(t *testing.T) {
+	old := etre.Entity{
+		"_id":   "abc",
+		"_rev":  int64(3),
+		"x":     int32(1),
+		"y":     "a",
+		"z":     true,
+		"gone":  "x",
+		"float": 1.5,
+	}
+	new := etre.Entity{
+		"_id":   "abc",
+		"_rev":  int64(4),
+		"x":     int64(1), // same value, different type
+		"y":     "b",
+		"z":     true,
+		"new":   "n",
+		"float": 1.5,
+	}
+	expect := etre.Entity{
+		"_rev": int64(4),
+		"y":    "b",
+		"new":  "n",
+	}
+	assert.Equal(t, expect, etre.Diff(old, new))
+	assert.Equal(t, []string{"_rev", "new", "y"}, etre.Changed(old, new))
+
+	// Ignore meta-labels
+	expect = etre.Entity{
+		"y":   "b",
+		"new": "n",
+	}
+	assert.Equal(t, expect, etre.Diff(old, new, etre.DIFF_IGNORE_METALABELS))
+	assert.Equal(t, []string{"new", "y"}, etre.Changed(old, new, etre.DIFF_IGNORE_METALABELS))
+
+	// No changes
+	assert.Equal(t, etre.Entity{}, etre.Diff(old, old))
+	assert.Empty(t, etre.Changed(old, old))
+
+	// JSON decodes numbers as float64
+	assert.Empty(t, etre.Diff(etre.Entity{"x": int64(5)}, etre.Entity{"x": float64(5)}))
+}
+
+func TestEntityUserLabels(t *testing.T) {
+	e := etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(1), "zone": "east", "host": "a"}
+	assert.Equal(t, []string{"_id", "_rev", "_type", "host", "zone"}, e.Labels())
+	assert.Equal(t, []string{"host", "zone"}, e.UserLabels())
+	assert.Equal(t, []string{"_id", "_rev", "_type"}, e.MetaLabels())
+
+	e = etre.Entity{"host": "a"}
+	assert.Equal(t, []string{}, e.MetaLabels())
+	assert.Equal(t, []string{}, etre.Entity{}.UserLabels())
+}
+
+func TestEntityClone(t *testing.T) {
+	nested := etre.Entity{"n": int64(1)}
+	e := etre.Entity{
+		"_id":    "abc",
+		"x":      "1",
+		"list":   []interface{}{"a", map[string]interface{}{"b": "c"}},
+		"names":  []string{"a", "b"},
+		"nested": nested,
+		"ptr":    &nested,
+	}
+	cp := e.Clone()
+	assert.Equal(t, e, cp)
+
+	// Changing the copy, including nested values, does not change the original
+	cp["x"] = "2"
+	cp["list"].([]interface{})[0] = "z"
+	cp["list"].([]interface{})[1].(map[string]interface{})["b"] = "z"
+	cp["names"].([]string)[0] = "z"
+	cp["nested"].(etre.Entity)["n"] = int64(2)
+	(*cp["ptr"].(*etre.Entity))["n"] = int64(3)
+	assert.Equal(t, "1", e["x"])
+	assert.Equal(t, []interface{}{"a", map[string]interface{}{"b": "c"}}, e["list"])
+	assert.Equal(t, []string{"a", "b"}, e["names"])
+	assert.Equal(t, etre.Entity{"n": int64(1)}, e["nested"])
+	assert.Equal(t, etre.Entity{"n": int64(1)}, *e["ptr"].(*etre.Entity))
+
+	var nilEntity etre.Entity
+	assert.Nil(t, nilEntity.Clone())
+
+	all := []etre.Entity{{"x": "1"}, {"x": "2"}}
+	cpAll := etre.CloneAll(all)
+	assert.Equal(t, all, cpAll)
+	cpAll[0]["x"] = "z"
+	assert.Equal(t, "1", all[0]["x"])
+	assert.Nil(t, etre.CloneAll(nil))
+}
+
+func TestEntitySubsetWithout(t *testing.T) {
+	e := etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(1), "_setId": "s1", "x": "1", "y": "2"}
+	orig := e.Clone()
+
+	assert.Equal(t, etre.Entity{"_id": "abc", "x": "1"}, e.Subset("_id", "x", "z"))
+	assert.Equal(t, etre.Entity{}, e.Subset())
+	assert.Equal(t, etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(1), "_setId": "s1", "y": "2"}, e.Without("x", "z"))
+	assert.Equal(t, e, e.Without())
+	assert.Equal(t, etre.Entity{"x": "1", "y": "2"}, e.WithoutMeta())
+
+	// The entity is not modified
+	sub := e.Subset("x")
+	sub["x"] = "9"
+	without := e.Without("y")
+	without["x"] = "9"
+	assert.Equal(t, orig, e)
+
+	var nilEntity etre.Entity
+	assert.Nil(t, nilEntity.Subset("x"))
+	assert.Nil(t, nilEntity.Without("x"))
+	assert.Nil(t, nilEntity.WithoutMeta())
+}
+
+func TestEntityMerge(t *testing.T) {
+	defaults := etre.Entity{"env": "dev", "zone": "east", "n": int64(1)}
+	overrides := etre.Entity{"env": "prod", "n": float64(1), "app": "foo"}
+
+	// By default, existing labels take precedence
+	merged, err := defaults.Merge(overrides, etre.MergeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"env": "dev", "zone": "east", "n": int64(1), "app": "foo"}, merged)
+
+	merged, err = defaults.Merge(overrides, etre.MergeOptions{Overwrite: true})
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"env": "prod", "zone": "east", "n": int64(1), "app": "foo"}, merged) // n equal, not overwritten
+
+	// Neither entity is modified
+	assert.Equal(t, etre.Entity{"env": "dev", "zone": "east", "n": int64(1)}, defaults)
+	assert.Equal(t, etre.Entity{"env": "prod", "n": float64(1), "app": "foo"}, overrides)
+
+	_, err = defaults.Merge(overrides, etre.MergeOptions{ErrorOnConflict: true})
+	assert.ErrorContains(t, err, "label env conflict")
+	_, err = defaults.Merge(etre.Entity{"n": 1, "x": "y"}, etre.MergeOptions{ErrorOnConflict: true})
+	assert.NoError(t, err)
+
+	// Meta-labels
+	e := etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(2), "x": "1"}
+	merged, err = e.Merge(etre.Entity{"_id": "abc", "_rev": int64(1), "y": "2"}, etre.MergeOptions{Overwrite: true})
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(1), "x": "1", "y": "2"}, merged)
+
+	merged, err = etre.Entity{"x": "1"}.Merge(e, etre.MergeOptions{SkipMeta: true})
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"x": "1"}, merged)
+
+	_, err = e.Merge(etre.Entity{"_id": "def"}, etre.MergeOptions{Overwrite: true})
+	assert.ErrorContains(t, err, "different _id")
+	_, err = e.Merge(etre.Entity{"_type": "rack"}, etre.MergeOptions{Overwrite: true})
+	assert.ErrorIs(t, err, etre.ErrTypeMismatch)
+	_, err = e.Merge(etre.Entity{"_id": "def", "_type": "rack"}, etre.MergeOptions{SkipMeta: true})
+	assert.NoError(t, err)
+
+	var nilEntity etre.Entity
+	merged, err = nilEntity.Merge(nil, etre.MergeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{}, merged)
+}
+
+func TestEntityEqual(t *testing.T) {
+	a := etre.Entity{
+		"_id":  "abc",
+		"_rev": int32(1),
+		"x":    5,
+		"y":    "a",
+		"z":    []interface{}{int32(1), map[string]interface{}{"n": int64(2)}},
+	}
+	b := etre.Entity{
+		"_id":  "abc",
+		"_rev": int64(1),
+		"x":    float64(5), // from JSON
+		"y":    "a",
+		"z":    []interface{}{float64(1), map[string]interface{}{"n": 2}},
+	}
+	assert.True(t, a.Equal(b))
+	assert.True(t, b.Equal(a))
+	assert.True(t, a.Equal(a))
+	assert.True(t, etre.Entity{}.Equal(nil))
+
+	// Different value, missing label, or extra label
+	assert.False(t, a.Equal(etre.Entity{"_id": "abc", "_rev": 1, "x": 6, "y": "a", "z": b["z"]}))
+	assert.False(t, a.Equal(etre.Entity{"_id": "abc", "_rev": 1, "x": 5, "y": "a"}))
+	assert.False(t, etre.Entity{"_id": "abc", "_rev": 1, "x": 5, "y": "a"}.Equal(a))
+	assert.False(t, etre.Entity{"z": []interface{}{1}}.Equal(etre.Entity{"z": []interface{}{1, 2}}))
+	assert.False(t, etre.Entity{"x": 1.5}.Equal(etre.Entity{"x": 1}))
+
+	// Ignore meta-labels
+	c := etre.Entity{"_rev": int64(2), "_type": "node", "x": 5}
+	assert.False(t, c.Equal(etre.Entity{"_rev": int64(1), "x": 5}))
+	assert.True(t, c.Equal(etre.Entity{"_rev": int64(1), "x": 5}, etre.DIFF_IGNORE_METALABELS))
+	assert.True(t, c.Equal(etre.Entity{"x": 5}, etre.DIFF_IGNORE_METALABELS))
+	assert.False(t, c.Equal(etre.Entity{"x": 5, "y": 1}, etre.DIFF_IGNORE_METALABELS))
+}
+
+func TestEntityCanonicalJSON(t *testing.T) {
+	a := etre.Entity{
+		"_id":  "abc",
+		"_rev": int32(1),
+		"x":    5,
+		"y":    "a",
+		"z":    []interface{}{int32(1), map[string]interface{}{"n": int64(2), "m": 1.5}},
+	}
+	b := etre.Entity{
+		"z":    []interface{}{float64(1), map[string]interface{}{"m": 1.5, "n": 2}},
+		"y":    "a",
+		"x":    float64(5), // from JSON
+		"_rev": int64(1),
+		"_id":  "abc",
+	}
+	expect := `{"_id":"abc","_rev":1,"x":5,"y":"a","z":[1,{"m":1.5,"n":2}]}`
+	for _, e := range []etre.Entity{a, b} {
+		got, err := e.CanonicalJSON()
+		require.NoError(t, err)
+		assert.Equal(t, expect, string(got))
+	}
+	assert.Equal(t, hash(t, a), hash(t, b))
+	assert.Len(t, hash(t, a), 64)
+
+	// Decoded from JSON, the entity is the same
+	var c etre.Entity
+	require.NoError(t, json.Unmarshal([]byte(expect), &c))
+	assert.Equal(t, hash(t, a), hash(t, c))
+
+	// Different entities, different hashes
+	assert.NotEqual(t, hash(t, a), hash(t, a.Without("y")))
+	assert.NotEqual(t, hash(t, etre.Entity{"x": 1.5}), hash(t, etre.Entity{"x": 1}))
+
+	// Without meta-labels
+	got, err := etre.Entity{"_id": "abc", "_rev": int64(2), "x": 1e3}.CanonicalJSON(etre.DIFF_IGNORE_METALABELS)
+	require.NoError(t, err)
+	assert.Equal(t, `{"x":1000}`, string(got))
+	assert.Equal(t, hash(t, a, etre.DIFF_IGNORE_METALABELS), hash(t, etre.Entity{"_rev": int64(9), "x": 5, "y": "a", "z": b["z"]}, etre.DIFF_IGNORE_METALABELS))
+
+	got, err = etre.Entity(nil).CanonicalJSON()
+	require.NoError(t, err)
+	assert.Equal(t, "{}", string(got))
+
+	_, err = etre.Entity{"x": math.NaN()}.CanonicalJSON()
+	assert.Error(t, err)
+	_, err = etre.Entity{"x": math.NaN()}.Hash()
+	assert.Error(t, err)
+}
+
+// hash returns the entity's Hash and requires no error.
+func hash(t *testing.T, e etre.Entity, opts ...etre.DiffOption) string {
+	t.Helper()
+	h, err := e.Hash(opts...)
+	require.NoError(t, err)
+	return h
+}
+
+func TestEntityGetPath(t *testing.T) {
+	e := etre.Entity{
+		"host": "a",
+		"metadata": map[string]interface{}{
+			"region":  "east",
+			"dc.zone": "1a",
+			"rack":    etre.Entity{"row": int64(3)},
+			"tags":    []interface{}{"x"},
+			"nil":     nil,
+		},
+	}
+	tests := []struct {
+		path  string
+		value interface{}
+		ok    bool
+	}{
+		{"host", "a", true},
+		{"metadata.region", "east", true},
+		{`metadata.dc\.zone`, "1a", true},
+		{"metadata.rack.row", int64(3), true},
+		{"metadata.tags", []interface{}{"x"}, true},
+		{"metadata.nil", nil, true},
+		{"metadata.missing", nil, false},
+		{"missing.region", nil, false},
+		{"host.region", nil, false},     // not a map
+		{"metadata.tags.0", nil, false}, // slices not navigated
+		{"metadata.dc.zone", nil, false},
+		{"", nil, false},
+	}
+	for _, tt := range tests {
+		v, ok := e.GetPath(tt.path)
+		assert.Equal(t, tt.ok, ok, tt.path)
+		assert.Equal(t, tt.value, v, tt.path)
+	}
+	v, ok := etre.Entity(nil).GetPath("a.b")
+	assert.False(t, ok)
+	assert.Nil(t, v)
+}
+
+func TestValidateLabelPaths(t *testing.T) {
+	assert.NoError(t, etre.ValidateLabelPaths(nil))
+	assert.NoError(t, etre.ValidateLabelPaths([]string{"_id", "host", "metadata.region", "metadata.zone", "meta"}))
+	assert.NoError(t, etre.ValidateLabelPaths([]string{"a", "a"})) // duplicates are removed
+	invalid := [][]string{
+		{""},
+		{"a."},
+		{"a..b"},
+		{"$a"},
+		{"a.$b"},
+		{"a", "a.b"},
+		{"a.b.c", "a.b"},
+	}
+	for _, paths := range invalid {
+		assert.Error(t, etre.ValidateLabelPaths(paths), paths)
+	}
+}
+
+func TestUniqueLabels(t *testing.T) {
+	assert.Nil(t, etre.UniqueLabels(nil))
+	assert.Equal(t, []string{"a", "b"}, etre.UniqueLabels([]string{"a", "b"}))
+	assert.Equal(t, []string{"a", "b", "c"}, etre.UniqueLabels([]string{"a", "b", "a", "c", "b", "c"}))
+
+	// Labels are not modified
+	labels := []string{"a", "a", "b"}
+	assert.Equal(t, []string{"a", "b"}, etre.UniqueLabels(labels))
+	assert.Equal(t, []string{"a", "a", "b"}, labels)
+}
+
+func TestEntityValidate(t *testing.T) {
+	// Valid
+	assert.NoError(t, etre.Entity{"x": 1, "_type": "node"}.Validate("insert"))
+	assert.NoError(t, etre.Entity{"_id": "abc", "_rev": int64(1), "x": 1}.Validate("update"))
+	assert.NoError(t, etre.Entity{"_id": "abc"}.Validate("delete"))
+
+	// _id set on insert, not set on update and delete
+	assert.ErrorIs(t, etre.Entity{"_id": "abc", "x": 1}.Validate("insert"), etre.ErrIdSet)
+	assert.ErrorIs(t, etre.Entity{"x": 1}.Validate("update"), etre.ErrIdNotSet)
+	assert.ErrorIs(t, etre.Entity{"x": 1}.Validate("delete"), etre.ErrIdNotSet)
+
+	// Invalid for all ops
+	invalid := []etre.Entity{
+		{"_id": 1, "x": 1},        // _id not a string
+		{"_id": "a", "_type": 1},  // _type not a string
+		{"_id": "a", "_foo": "x"}, // unknown meta-label
+		{"_id": "a", "x": nil},    // nil value
+	}
+	for _, e := range invalid {
+		assert.Error(t, e.Validate("update"), "%v", e)
+	}
+	assert.Error(t, etre.Entity{"x": 1}.Validate("upsert"))
+}
+
+func TestEntityBuilder(t *testing.T) {
+	e, err := etre.NewEntity().SetType("host").Set("hostname", "a").Set("cores", 8).Build()
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"_type": "host", "hostname": "a", "cores": 8}, e)
+
+	// Builders are reusable: Set returns a new builder
+	b := etre.ForUpdate("abc").Set("hostname", "b")
+	e1, err := b.Set("zone", "east").Build()
+	require.NoError(t, err)
+	e2, err := b.Set("zone", "west").Build()
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"_id": "abc", "hostname": "b", "zone": "east"}, e1)
+	assert.Equal(t, etre.Entity{"_id": "abc", "hostname": "b", "zone": "west"}, e2)
+
+	// Last value wins
+	e, err = etre.NewEntity().Set("x", 1).Set("x", 2).Build()
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"x": 2}, e)
+
+	// Build validates for the op
+	_, err = etre.NewEntity().Set("_id", "abc").Build()
+	assert.ErrorIs(t, err, etre.ErrIdSet)
+	_, err = etre.ForUpdate("abc").Set("_foo", 1).Build()
+	assert.EqualError(t, err, "invalid label _foo: names starting with _ are reserved for meta-labels")
+	_, err = etre.ForUpdate("abc").Set("x", nil).Build()
+	assert.EqualError(t, err, "label x has nil value")
+	e, err = etre.EntityBuilder{}.Set("x", 1).Build()
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"x": 1}, e)
+}
+
+func TestEntityValidateValues(t *testing.T) {
+	type attrs struct {
+		Zone string
+		Fn   func() `json:"-"`
+		fn   func()
+	}
+	n := 1
+	valid := etre.Entity{
+		"nil":    nil,
+		"bool":   true,
+		"int":    1,
+		"uint8":  uint8(1),
+		"float":  1.5,
+		"string": "a",
+		"bytes":  []byte("a"),
+		"time":   time.Now(),
+		"ptr":    &n,
+		"slice":  []interface{}{1, "a", nil, []string{"b"}},
+		"array":  [2]int{1, 2},
+		"map":    map[string]interface{}{"a": etre.Entity{"b": []int{1}}},
+		"struct": attrs{Zone: "east"},
+		"number": json.Number("1"),
+	}
+	assert.NoError(t, valid.ValidateValues())
+
+	invalid := []struct {
+		entity etre.Entity
+		err    string
+	}{
+		{etre.Entity{"x": func() {}}, "label x has invalid value type func()"},
+		{etre.Entity{"x": make(chan int)}, "label x has invalid value type chan int"},
+		{etre.Entity{"x": complex64(1)}, "label x has invalid value type complex64"},
+		{etre.Entity{"x": math.Inf(1)}, "label x has invalid value +Inf (float64)"},
+		{etre.Entity{"x": map[int]string{1: "a"}}, "label x has invalid value type map[int]string: map keys must be strings"},
+		{etre.Entity{"x": []interface{}{1, []interface{}{func() {}}}}, "label x[1][0] has invalid value type func()"},
+		{etre.Entity{"x": map[string]interface{}{"b": 1, "a": make(chan int)}}, "label x.a has invalid value type chan int"},
+		{etre.Entity{"x": struct{ C chan int }{}}, "label x.C has invalid value type chan int"},
+		{etre.Entity{"a": 1, "b": func() {}, "c": func() {}}, "label b has invalid value type func()"}, // first label
+	}
+	for _, tt := range invalid {
+		assert.EqualError(t, tt.entity.ValidateValues(), tt.err)
+	}
+
+	// Pointer cycle and too deeply nested values
+	type node struct{ Next *node }
+	cycle := &node{}
+	cycle.Next = cycle
+	err := etre.Entity{"x": cycle}.ValidateValues()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "nested more than")
+	deep := map[string]interface{}{}
+	nested := deep
+	for i := 0; i <= etre.MAX_VALUE_DEPTH; i++ {
+		m := map[string]interface{}{}
+		nested["a"] = m
+		nested = m
+	}
+	assert.Error(t, etre.Entity{"x": deep}.ValidateValues())
+	assert.NoError(t, etre.Entity{"x": deep["a"]}.ValidateValues())
+
+	// Validate checks values, too
+	assert.EqualError(t, etre.Entity{"x": func() {}}.Validate("insert"), "label x has invalid value type func()")
+}
+
+func TestValidateLabel(t *testing.T) {
+	for _, label := range []string{"x", "host-name", "a_b", "_id", "_type", "_setSize"} {
+		assert.NoError(t, etre.ValidateLabel(label), label)
+	}
+	for _, label := range []string{"", "_foo", "a.b", "$set", "a$", "a b", "a\tb", " "} {
+		err := etre.ValidateLabel(label)
+		require.Error(t, err, label)
+		assert.Contains(t, err.Error(), label)
+	}
+}
+
+func TestWithSet(t *testing.T) {
+	entities := []etre.Entity{{"x": 1}, {"x": 2}}
+	got, err := etre.WithSet(etre.Set{Id: "abc", Op: "provision"}, entities)
+	require.NoError(t, err)
+	expect := []etre.Entity{
+		{"x": 1, "_setId": "abc", "_setOp": "provision", "_setSize": 2},
+		{"x": 2, "_setId": "abc", "_setOp": "provision", "_setSize": 2},
+	}
+	assert.Equal(t, expect, got)
+	assert.Equal(t, etre.Set{Id: "abc", Op: "provision", Size: 2}, got[0].Set())
+	assert.Equal(t, []etre.Entity{{"x": 1}, {"x": 2}}, entities, "entities modified")
+
+	// Explicit size
+	got, err = etre.WithSet(etre.Set{Id: "abc", Op: "provision", Size: 10}, entities)
+	require.NoError(t, err)
+	assert.Equal(t, 10, got[1].Set().Size)
+
+	// All or nothing
+	_, err = etre.WithSet(etre.Set{Id: "abc"}, entities)
+	assert.Error(t, err)
+	_, err = etre.WithSet(etre.Set{Op: "provision"}, entities)
+	assert.Error(t, err)
+	got, err = etre.WithSet(etre.Set{}, []etre.Entity{{"x": 1, "_setId": "old"}})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"x": 1}}, got)
+}
+
+func TestTraceContextString(t *testing.T) {
+	// Sorted by key, invalid pairs omitted
+	trace := etre.TraceContext{
+		"user":       "bob",
+		"app":        "foo",
+		"request-id": "a=b", // "=" in value is ok
+		"":           "x",
+		"k,k":        "x",
+		"k=k":        "x",
+		"k":          "x,y",
+	}
+	assert.Equal(t, "app=foo,request-id=a=b,user=bob", trace.String())
+	assert.Empty(t, etre.TraceContext{}.String())
+
+	// Round-trip
+	expect := etre.TraceContext{"app": "foo", "request-id": "a=b", "user": "bob"}
+	assert.Equal(t, expect, etre.ParseTraceContext(trace.String()))
+
+	// Parse ignores invalid pairs and uses first value like the server
+	assert.Equal(t, etre.TraceContext{"app": "foo"}, etre.ParseTraceContext("app=foo,host,=x,app=bar"))
+	assert.Nil(t, etre.ParseTraceContext(""))
+}
+
+func TestEntityUnmarshalJSON(t *testing.T) {
+	data := []byte(`{"_id":"abc","_rev":3,"_setId":"s","_setOp":"op","_setSize":2,"x":5,"y":1.5,"z":[1,{"a":2}]}`)
+
+	// Default: integer meta-labels are int64, other numbers are float64
+	var e etre.Entity
+	require.NoError(t, json.Unmarshal(data, &e))
+	assert.Equal(t, int64(3), e["_rev"])
+	assert.Equal(t, int64(3), e.Rev()) // doesn't panic
+	assert.Equal(t, etre.Set{Id: "s", Op: "op", Size: 2}, e.Set())
+	assert.Equal(t, float64(5), e["x"])
+	assert.Equal(t, 1.5, e["y"])
+	assert.Equal(t, []interface{}{float64(1), map[string]interface{}{"a": float64(2)}}, e["z"])
+
+	// Slices of entities and nested entities too
+	var entities []etre.Entity
+	require.NoError(t, json.Unmarshal([]byte("["+string(data)+"]"), &entities))
+	assert.Equal(t, int64(3), entities[0].Rev())
+	var event etre.CDCEvent
+	require.NoError(t, json.Unmarshal([]byte(`{"eventId":"1","new":`+string(data)+`}`), &event))
+	assert.Equal(t, int64(3), event.New.Rev())
+
+	// JSON null
+	e = etre.Entity{"x": 1}
+	require.NoError(t, json.Unmarshal([]byte("null"), &e))
+	assert.Nil(t, e)
+
+	// Marshal is unchanged and round-trips _rev as an integer
+	bytes, err := json.Marshal(etre.Entity{"_rev": int64(3)})
+	require.NoError(t, err)
+	assert.Equal(t, `{"_rev":3}`, string(bytes))
+}
+
+func TestCDCEventOldNew(t *testing.T) {
+	e := etre.Entity{"x": "1"}
+	insert := etre.CDCEvent{Op: etre.CDC_OP_INSERT, New: &e}
+	del := etre.CDCEvent{Op: etre.CDC_OP_DELETE, Old: &e}
+
+	assert.False(t, insert.HasOld())
+	assert.True(t, insert.HasNew())
+	assert.True(t, del.HasOld())
+	assert.False(t, del.HasNew())
+
+	assert.Equal(t, e, insert.NewEntity())
+	assert.Equal(t, e, del.OldEntity())
+	assert.Equal(t, "", insert.OldEntity().String("x"))
+
+	// Empty entities are not nil and not shared
+	old := insert.OldEntity()
+	require.NotNil(t, old)
+	old["x"] = "2"
+	assert.Equal(t, etre.Entity{}, insert.OldEntity())
+	assert.Nil(t, insert.Old)
+	assert.Equal(t, etre.Entity{}, del.NewEntity())
+	var nilEntity etre.Entity
+	assert.NotNil(t, etre.CDCEvent{Old: &nilEntity}.OldEntity())
+}
+
+func TestCDCEventOp(t *testing.T) {
+	e := etre.Entity{"x": "1"}
+	insert := etre.CDCEvent{Op: etre.CDC_OP_INSERT, New: &e}
+	update := etre.CDCEvent{Op: etre.CDC_OP_UPDATE, Old: &e, New: &e}
+	del := etre.CDCEvent{Op: etre.CDC_OP_DELETE, Old: &e}
+
+	assert.True(t, insert.IsInsert())
+	assert.False(t, insert.IsUpdate())
+	assert.False(t, insert.IsDelete())
+	assert.True(t, update.IsUpdate())
+	assert.False(t, update.IsInsert())
+	assert.True(t, del.IsDelete())
+	assert.False(t, del.IsUpdate())
+
+	assert.NoError(t, insert.Validate())
+	assert.NoError(t, update.Validate())
+	assert.NoError(t, del.Validate())
+
+	invalid := []etre.CDCEvent{
+		{Op: etre.CDC_OP_INSERT},                   // no new
+		{Op: etre.CDC_OP_INSERT, Old: &e, New: &e}, // old on insert
+		{Op: etre.CDC_OP_UPDATE, New: &e},          // no old
+		{Op: etre.CDC_OP_DELETE},                   // no old
+		{Op: etre.CDC_OP_DELETE, Old: &e, New: &e}, // new on delete
+		{Op: "x", Old: &e, New: &e},                // invalid op
+	}
+	for _, ev := range invalid {
+		assert.Error(t, ev.Validate(), "%+v", ev)
+	}
+}
+
+func TestEntityApply(t *testing.T) {
+	// Insert into nil entity
+	var e etre.Entity
+	e, err := e.Apply(etre.CDCEvent{
+		Id:         "e1",
+		Op:         etre.CDC_OP_INSERT,
+		EntityId:   "abc",
+		EntityType: "node",
+		EntityRev:  0,
+		New:        &etre.Entity{"_id": "abc", "_type": "node", "_rev": 0, "x": "1", "y": "2"},
+	})
+	require.NoError(t, err)
+	expect := etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(0), "x": "1", "y": "2"}
+	assert.Equal(t, expect, e)
+
+	// Update sets new labels
+	e2, err := e.Apply(etre.CDCEvent{
+		Id:        "e2",
+		Op:        etre.CDC_OP_UPDATE,
+		EntityId:  "abc",
+		EntityRev: 1,
+		Old:       &etre.Entity{"x": "1"},
+		New:       &etre.Entity{"x": "3", "z": "4"},
+	})
+	require.NoError(t, err)
+	expect = etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(1), "x": "3", "y": "2", "z": "4"}
+	assert.Equal(t, expect, e2)
+	assert.Equal(t, int64(0), e["_rev"], "original entity modified")
+
+	// Update from DeleteLabel removes old labels not in new
+	e3, err := e2.Apply(etre.CDCEvent{
+		Id:        "e3",
+		Op:        etre.CDC_OP_UPDATE,
+		EntityId:  "abc",
+		EntityRev: 2,
+		Old:       &etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(1), "y": "2"},
+		New:       &etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(2)},
+	})
+	require.NoError(t, err)
+	expect = etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(2), "x": "3", "z": "4"}
+	assert.Equal(t, expect, e3)
+
+	// Gap: missed rev 3
+	_, err = e3.Apply(etre.CDCEvent{Op: etre.CDC_OP_UPDATE, EntityId: "abc", EntityRev: 4, Old: &etre.Entity{}, New: &etre.Entity{"x": "5"}})
+	assert.ErrorIs(t, err, etre.ErrCDCRevGap)
+
+	// Already applied
+	_, err = e3.Apply(etre.CDCEvent{Op: etre.CDC_OP_UPDATE, EntityId: "abc", EntityRev: 2, Old: &etre.Entity{}, New: &etre.Entity{"x": "5"}})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, etre.ErrCDCRevGap)
+
+	// Wrong entity
+	_, err = e3.Apply(etre.CDCEvent{Op: etre.CDC_OP_UPDATE, EntityId: "def", EntityRev: 3, Old: &etre.Entity{}, New: &etre.Entity{"x": "5"}})
+	assert.Error(t, err)
+
+	// Insert into existing entity
+	_, err = e3.Apply(etre.CDCEvent{Op: etre.CDC_OP_INSERT, EntityId: "abc", New: &etre.Entity{"x": "5"}})
+	assert.Error(t, err)
+
+	// Delete returns nil entity
+	e4, err := e3.Apply(etre.CDCEvent{Op: etre.CDC_OP_DELETE, EntityId: "abc", EntityRev: 3, Old: &e3})
+	require.NoError(t, err)
+	assert.Nil(t, e4)
+}
+
+func TestEntityArrayOps(t *testing.T) {
+	patch := etre.Entity{"env": "prod"}
+	got := patch.AddToSet("tags", "a", "b").Pull("old", 1)
+	expect := etre.Entity{
+		"env":  "prod",
+		"tags": map[string]interface{}{etre.ARRAY_OP_ADD_TO_SET: []interface{}{"a", "b"}},
+		"old":  map[string]interface{}{etre.ARRAY_OP_PULL: []interface{}{1}},
+	}
+	assert.Equal(t, expect, got)
+	assert.Equal(t, etre.Entity{"env": "prod"}, patch, "entity modified")
+
+	// Same after JSON round trip, like the API receives it
+	b, err := json.Marshal(got)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"env":"prod","tags":{"$addToSet":["a","b"]},"old":{"$pull":[1]}}`, string(b))
+	var decoded etre.Entity
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	op, values, ok := etre.ArrayOp(decoded["tags"])
+	assert.True(t, ok)
+	assert.Equal(t, etre.ARRAY_OP_ADD_TO_SET, op)
+	assert.Equal(t, []interface{}{"a", "b"}, values)
+	_, _, ok = etre.ArrayOp(decoded["env"])
+	assert.False(t, ok)
+	_, _, ok = etre.ArrayOp(map[string]interface{}{"$set": []interface{}{"a"}})
+	assert.False(t, ok)
+	_, _, ok = etre.ArrayOp(map[string]interface{}{etre.ARRAY_OP_PULL: "a"})
+	assert.False(t, ok)
+
+	// Values compared by value, so int64(1) from BSON equals float64(1) from JSON
+	arr, ok := etre.ApplyArrayOp([]interface{}{"a", int64(1)}, etre.ARRAY_OP_ADD_TO_SET, []interface{}{"b", float64(1), "b"})
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{"a", int64(1), "b"}, arr)
+	arr, ok = etre.ApplyArrayOp([]string{"a", "b", "a"}, etre.ARRAY_OP_PULL, []interface{}{"a", "c"})
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{"b"}, arr)
+
+	// Label not set
+	arr, ok = etre.ApplyArrayOp(nil, etre.ARRAY_OP_ADD_TO_SET, []interface{}{"a", "a"})
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{"a"}, arr)
+	arr, ok = etre.ApplyArrayOp(nil, etre.ARRAY_OP_PULL, []interface{}{"a"})
+	assert.True(t, ok)
+	assert.Nil(t, arr)
+
+	// Label not an array
+	_, ok = etre.ApplyArrayOp("a", etre.ARRAY_OP_ADD_TO_SET, []interface{}{"b"})
+	assert.False(t, ok)
+}
+
+func TestEntityIncrement(t *testing.T) {
+	patch := etre.Entity{"status": "restarted"}
+	got := patch.Increment("restarts", 1)
+	expect := etre.Entity{
+		"status":   "restarted",
+		"restarts": map[string]interface{}{etre.COUNTER_OP_INC: int64(1)},
+	}
+	assert.Equal(t, expect, got)
+	assert.Equal(t, etre.Entity{"status": "restarted"}, patch, "entity modified")
+
+	// Same after JSON round trip, like the API receives it
+	b, err := json.Marshal(got.Increment("n", -2))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"status":"restarted","restarts":{"$inc":1},"n":{"$inc":-2}}`, string(b))
+	var decoded etre.Entity
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	delta, ok := etre.IncrementOp(decoded["n"])
+	assert.True(t, ok)
+	assert.Equal(t, int64(-2), delta)
+	_, ok = etre.IncrementOp(decoded["status"])
+	assert.False(t, ok)
+	_, ok = etre.IncrementOp(map[string]interface{}{etre.COUNTER_OP_INC: 1.5})
+	assert.False(t, ok)
+	_, ok = etre.IncrementOp(map[string]interface{}{etre.COUNTER_OP_INC: "1"})
+	assert.False(t, ok)
+	_, ok = etre.IncrementOp(map[string]interface{}{etre.ARRAY_OP_PULL: 1})
+	assert.False(t, ok)
+	delta, ok = etre.IncrementOp(map[string]interface{}{etre.COUNTER_OP_INC: json.Number("3")}) // UseNumber
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), delta)
+
+	n, ok := etre.ApplyIncrement(int32(5), 2)
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), n)
+	n, ok = etre.ApplyIncrement(nil, -1) // label not set
+	assert.True(t, ok)
+	assert.Equal(t, int64(-1), n)
+	_, ok = etre.ApplyIncrement("5", 1)
+	assert.False(t, ok)
+	n, ok = etre.ApplyIncrement(json.Number("5"), 1)
+	assert.True(t, ok)
+	assert.Equal(t, int64(6), n)
+}
+
+func TestCompatibleVersion(t *testing.T) {
+	compatible := [][2]string{
+		{"0.12.0", "0.12.0"},
+		{"0.12.0", "0.12.3"},
+		{"v0.12.1", "0.12.0-rc1"},
+		{"1.2.0", "1.5.1"},
+	}
+	for _, v := range compatible {
+		assert.True(t, etre.CompatibleVersion(v[0], v[1]), "%v", v)
+	}
+	incompatible := [][2]string{
+		{"0.12.0", "0.11.0"},
+		{"1.2.0", "2.0.0"},
+		{"0.12.0", ""},
+		{"abc", "0.12.0"},
+		{"1", "1"},
+	}
+	for _, v := range incompatible {
+		assert.False(t, etre.CompatibleVersion(v[0], v[1]), "%v", v)
+	}
+}
+
+func TestQueryBuilder(t *testing.T) {
+	tests := []struct {
+		q      etre.QueryBuilder
+		expect string
+		values [][]string // parsed values of each predicate
+	}{
+		{etre.QueryBuilder{}.Equal("zone", "east").Exists("host"), "zone=east,host", [][]string{{"east"}, nil}},
+		{etre.QueryBuilder{}.NotEqual("x", "a b").NotExists("y"), "x!=a b,!y", [][]string{{"a b"}, nil}},
+		{etre.QueryBuilder{}.IsNull("x").Exists("y"), "x isnull,y", [][]string{nil, nil}},
+		{etre.QueryBuilder{}.Equal("host", "a,b"), `host="a,b"`, [][]string{{"a,b"}}},
+		{etre.QueryBuilder{}.Equal("x", " y"), `x=" y"`, [][]string{{" y"}}},
+		{etre.QueryBuilder{}.Equal("x", "=y"), `x="=y"`, [][]string{{"=y"}}},
+		{etre.QueryBuilder{}.Equal("x", `"y"`), `x="\"y\""`, [][]string{{`"y"`}}},
+		{etre.QueryBuilder{}.Equal("x", ""), `x=""`, [][]string{{""}}},
+		{etre.QueryBuilder{}.In("x", "a", "b,c", "(d)"), `x in (a,"b,c","(d)")`, [][]string{{"a", "b,c", "(d)"}}},
+		{etre.QueryBuilder{}.NotIn("x", "a"), "x notin (a)", [][]string{{"a"}}},
+		{etre.QueryBuilder{}.Equal("a", "1").And(etre.QueryBuilder{}.Equal("b", "2"), etre.QueryBuilder{}.Exists("c")), "a=1,b=2,c", [][]string{{"1"}, {"2"}, nil}},
+		{etre.QueryBuilder{}.Equal("x", "a").Or(etre.QueryBuilder{}.Equal("x", "b"), etre.QueryBuilder{}.In("x", "a", "c")), "x in (a,b,c)", [][]string{{"a", "b", "c"}}},
+	}
+	for _, tt := range tests {
+		got, err := tt.q.Build()
+		require.NoError(t, err, tt.expect)
+		assert.Equal(t, tt.expect, got)
+		assert.Equal(t, tt.expect, tt.q.String())
+
+		// The parser must return the original values
+		reqs, err := query.Parse(got)
+		require.NoError(t, err, got)
+		require.Len(t, reqs, len(tt.values), got)
+		for i := range reqs {
+			assert.Equal(t, tt.values[i], reqs[i].Values, got)
+		}
+	}
+
+	// Builders are reusable: adding to a copy doesn't change the original
+	base := etre.QueryBuilder{}.Equal("a", "1").Equal("b", "2")
+	q1 := base.Equal("c", "3")
+	q2 := base.Equal("d", "4")
+	assert.Equal(t, "a=1,b=2", base.String())
+	assert.Equal(t, "a=1,b=2,c=3", q1.String())
+	assert.Equal(t, "a=1,b=2,d=4", q2.String())
+
+	// Errors
+	invalid := []etre.QueryBuilder{
+		{},
+		etre.QueryBuilder{}.Equal("a b", "x"),
+		etre.QueryBuilder{}.Equal("a,b", "x"),
+		etre.QueryBuilder{}.Exists("!a"),
+		etre.QueryBuilder{}.Equal("_x", "y"),
+		etre.QueryBuilder{}.In("x"),
+		etre.QueryBuilder{}.Equal("x", "a").Or(etre.QueryBuilder{}.Equal("y", "b")),
+		etre.QueryBuilder{}.NotEqual("x", "a").Or(etre.QueryBuilder{}.Equal("x", "b")),
+		etre.QueryBuilder{}.Equal("x", "a").And(etre.QueryBuilder{}.Exists("a=b")),
+	}
+	for i, q := range invalid {
+		_, err := q.Build()
+		assert.Error(t, err, "%d: %s", i, q.String())
+	}
+
+	// Fake client uses the same parser, so a value with a comma matches
+	ec := etre.NewFakeEntityClient("node")
+	_, err := ec.Insert([]etre.Entity{{"host": "a,b"}, {"host": "a"}})
+	require.NoError(t, err)
+	entities, err := ec.Query(etre.QueryBuilder{}.Equal("host", "a,b").String(), etre.QueryFilter{})
+	require.NoError(t, err)
+	require.Len(t, entities, 1)
+	assert.Equal(t, "a,b", entities[0]["host"])
+}
+
+func TestQueryBuilderRegex(t *testing.T) {
+	q, err := etre.QueryBuilder{}.Regex("host", "^web-").NotRegex("zone", "(east|west),").EqualFold("env", "Prod.1").Build()
+	require.NoError(t, err)
+	assert.Equal(t, `host=~^web-,zone!~"(east|west),",env=~"(?i)^Prod\\.1$"`, q)
+
+	// Invalid pattern
+	_, err = etre.QueryBuilder{}.Regex("host", "web-[").Build()
+	assert.EqualError(t, err, "invalid query: host=~web-[: invalid regular expression: error parsing regexp: missing closing ]: `[`")
+
+	// Value starting with ~ is quoted, so Equal doesn't become a regex
+	assert.Equal(t, `x="~a"`, etre.QueryBuilder{}.Equal("x", "~a").String())
+
+	// Fake client uses the same parser and Go regexp
+	ec := etre.NewFakeEntityClient("node")
+	_, err = ec.Insert([]etre.Entity{
+		{"host": "web-1", "env": "PROD.1"},
+		{"host": "db-1", "env": "prod.1"},
+		{"host": "web-2", "env": "prodx1"},
+		{"host": "web-3", "env": 1},
+	})
+	require.NoError(t, err)
+	hosts := func(q etre.QueryBuilder) []string {
+		entities, err := ec.Query(q.String(), etre.QueryFilter{Sort: []string{"host"}})
+		require.NoError(t, err)
+		hosts := []string{}
+		for _, e := range entities {
+			hosts = append(hosts, e.String("host"))
+		}
+		return hosts
+	}
+	assert.Equal(t, []string{"web-1", "web-2", "web-3"}, hosts(etre.QueryBuilder{}.Regex("host", "^web-")))
+	assert.Equal(t, []string{"db-1", "web-1"}, hosts(etre.QueryBuilder{}.EqualFold("env", "prod.1")))
+	assert.Equal(t, []string{"web-2", "web-3"}, hosts(etre.QueryBuilder{}.NotRegex("env", "(?i)^prod\\.1$")))
+}
+
+func TestWriteResolveURI(t *testing.T) {
+	w := etre.Write{EntityId: "abc", URI: "http://127.0.0.1:3848" + etre.API_ROOT + "/entity/abc"}
+	assert.Equal(t, "https://etre.example.com"+etre.API_ROOT+"/entity/abc", w.ResolveURI("https://etre.example.com"))
+	assert.Equal(t, "https://proxy.example.com/etre"+etre.API_ROOT+"/entity/abc", w.ResolveURI("https://proxy.example.com/etre/"))
+
+	// No URI: path from EntityId
+	w = etre.Write{EntityId: "abc"}
+	assert.Equal(t, "https://etre.example.com"+etre.API_ROOT+"/entity/abc", w.ResolveURI("https://etre.example.com"))
+
+	assert.Equal(t, "", etre.Write{}.ResolveURI("https://etre.example.com"))
+}
@@ -4,12 +4,17 @@ package query
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
 // A Requirement represents one predicate parsed from a selector. For example,
 // selector "x=y,z" has two requirements: "x=y" and "z". Op is the literal operator,
-// or "exists" (p) or "notexists" (!p).
+// or "exists" (p) or "notexists" (!p). Ops =~ and !~ match (or not) a regular
+// expression, like "host=~^web-". This is backward-incompatible: "a=~x" used to
+// be op = and value "~x"; use op == ("a==~x") for a value that starts with ~.
+// Op "isnull" (p isnull) has no value: it matches a label with an explicit null
+// value, not a missing label.
 type Requirement struct {
 	Label  string
 	Op     string
@@ -70,7 +75,9 @@ func IsInvalidLabelChar(r rune) bool {
 
 var Debug = false
 
-// Parse parses a Kubernetes Label Selector sttring.
+// Parse parses a Kubernetes Label Selector sttring. A value that starts with a
+// double quote is a Go quoted string, so it can contain commas and parens, like
+// `host="a, b"`. A double quote elsewhere in a value is a value char.
 func Parse(selector string) ([]Requirement, error) {
 	if selector == "" {
 		return []Requirement{}, nil
@@ -83,7 +90,36 @@ func Parse(selector string) ([]Requirement, error) {
 	startOffset := 0
 	pred := []string{}
 	inValueList := false // skip commas inside "(val1,valN)"
+	inQuote := false     // skip commas and parens inside a "quoted value"
+	quoteOffset := 0     // where the quoted value starts, for the error if not terminated
+	escaped := false     // previous char was \ inside a quoted value
+	valueStart := false  // no value chars since the op, (, or list comma, so " starts a quoted value
+	prev := ' '
 	for endOffset, r := range selector {
+		if inQuote {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				inQuote = false
+			}
+			continue
+		}
+		if r == '"' && valueStart {
+			inQuote = true
+			quoteOffset = endOffset
+			valueStart = false
+			continue
+		}
+		switch {
+		case IsOp(r), r == '~' && IsOp(prev), r == '(', r == ',' && inValueList:
+			valueStart = true
+		case !isSpace(r):
+			valueStart = false
+		}
+		prev = r
 		if inValueList {
 			if r == ')' {
 				inValueList = false
@@ -100,6 +136,9 @@ func Parse(selector string) ([]Requirement, error) {
 		pred = append(pred, selector[startOffset:endOffset])
 		startOffset = endOffset + 1 // first char after ,
 	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quoted value: %s", selector[quoteOffset:])
+	}
 	if startOffset < len(selector) {
 		// Last predicate to end of selector, e.g. "bar" in "x=y,foo,bar"
 		pred = append(pred, selector[startOffset:])
@@ -202,8 +241,9 @@ func Parse(selector string) ([]Requirement, error) {
 						continue // more chars in op
 					}
 				case state_symbol_op:
-					// Set op ends on space or non-op char
-					if !isSpace(cur) && cur == '=' {
+					// Set op ends on space or non-op char, or after ~ in =~ and !~
+					if !isSpace(cur) && selector[right-1] != '~' &&
+						(cur == '=' || (cur == '~' && right == left+1 && (selector[left] == '=' || selector[left] == '!'))) {
 						continue // more chars in op
 					}
 				}
@@ -238,7 +278,13 @@ func Parse(selector string) ([]Requirement, error) {
 			if req.Op == "" {
 				req.Op = "exists"
 			}
-		case state_op, state_symbol_op, state_set_op:
+		case state_set_op:
+			// Only isnull has no value: "foo isnull"
+			if selector[left:] != "isnull" {
+				return nil, fmt.Errorf("stopped parsing in %s", stateName[state])
+			}
+			req.Op = "isnull"
+		case state_op, state_symbol_op:
 			return nil, fmt.Errorf("stopped parsing in %s", stateName[state])
 		case state_value:
 			if req.Label == "" || req.Op == "" {
@@ -246,25 +292,33 @@ func Parse(selector string) ([]Requirement, error) {
 			}
 			req.val = strings.TrimSpace(selector[left:])
 		case state_space:
-			if req.Op != "" {
-				return nil, fmt.Errorf("no value after op")
-			} else if req.Label != "" {
+			if req.Op == "" && req.Label != "" {
 				req.Op = "exists"
-			} else {
+			} else if req.Op == "" {
 				return nil, fmt.Errorf("empty string")
+			} else if req.Op != "isnull" { // isnull has no value: "foo isnull "
+				return nil, fmt.Errorf("no value after op")
 			}
 		default:
 			return nil, fmt.Errorf("stopped parsing in %s", stateName[state])
 		}
 
 		if IsOp(rune(req.Op[0])) {
-			req.Values = []string{req.val}
+			val, err := unquote(req.val)
+			if err != nil {
+				return nil, fmt.Errorf("'%s': invalid quoted value: %s: %s", selector, req.val, err)
+			}
+			req.Values = []string{val}
 		} else if req.Op == "in" || req.Op == "notin" {
 			if len(req.val) < 3 {
 				return nil, fmt.Errorf("invalid [not]in value list: %s", req.val)
 			}
-			req.Values = strings.Split(req.val[1:len(req.val)-1], ",")
-		} else if req.Op == "exists" || req.Op == "notexists" {
+			vals, err := splitValues(req.val[1 : len(req.val)-1])
+			if err != nil {
+				return nil, fmt.Errorf("'%s': invalid quoted value in list: %s", selector, err)
+			}
+			req.Values = vals
+		} else if req.Op == "exists" || req.Op == "notexists" || req.Op == "isnull" {
 			// No values
 		} else {
 			return nil, fmt.Errorf("invalid op: %s", req.Op)
@@ -283,3 +337,57 @@ func Parse(selector string) ([]Requirement, error) {
 func isSpace(r rune) bool {
 	return r == 0x20 || r == 0x09 || r == 0x0D || r == 0x0A
 }
+
+// unquote returns the value unquoted if it's a double-quoted Go string literal,
+// like "a,b" or "a \"b\"", else it returns the value as-is. Values must be quoted
+// if they contain a comma, parenthesis, or double quote, or start or end with space.
+func unquote(val string) (string, error) {
+	if len(val) == 0 || val[0] != '"' {
+		return val, nil
+	}
+	return strconv.Unquote(val)
+}
+
+// splitValues splits a [not]in value list on commas outside quoted values and
+// unquotes the values.
+func splitValues(list string) ([]string, error) {
+	vals := []string{}
+	start := 0
+	inQuote := false
+	escaped := false
+	valueStart := true // " starts a quoted value only before other value chars
+	for i, r := range list {
+		if inQuote {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				inQuote = false
+			}
+			continue
+		}
+		if r == '"' && valueStart {
+			inQuote = true
+			valueStart = false
+		} else if r == ',' {
+			vals = append(vals, list[start:i])
+			start = i + 1
+			valueStart = true
+		} else if !isSpace(r) {
+			valueStart = false
+		}
+	}
+	vals = append(vals, list[start:])
+	for i, val := range vals {
+		if v := strings.TrimSpace(val); len(v) > 0 && v[0] == '"' {
+			uq, err := strconv.Unquote(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", v, err)
+			}
+			vals[i] = uq
+		}
+	}
+	return vals, nil
+}
@@ -190,6 +190,61 @@ func TestParseInequality(t *testing.T) {
 	}
 }
 
+func TestParseRegex(t *testing.T) {
+	tests := []struct {
+		sel   string
+		op    string
+		value string
+	}{
+		{"host=~^web-", "=~", "^web-"},
+		{"host !~ ^web-", "!~", "^web-"},
+		{`host=~"^(web|db)-[0-9]+,"`, "=~", "^(web|db)-[0-9]+,"},
+		{"host=~~web", "=~", "~web"}, // only one ~ in op
+		{"host=~=web", "=~", "=web"},
+		{"host==~web", "==", "~web"}, // not a regex op
+		{"host<~web", "<", "~web"},
+	}
+	for _, tt := range tests {
+		got, err := query.Parse(tt.sel)
+		require.NoError(t, err, tt.sel)
+		expect := []query.Requirement{
+			{
+				Label:  "host",
+				Op:     tt.op,
+				Values: []string{tt.value},
+			},
+		}
+		diff := deep.Equal(got, expect) // can't use assert.Equal because some unexported fields don't match. deep.Equal only compares exported fields.
+		assert.Nil(t, diff, tt.sel)
+	}
+}
+
+func TestParseIsNull(t *testing.T) {
+	for _, sel := range []string{"host isnull", "  host   isnull  "} {
+		got, err := query.Parse(sel + ",x=y")
+		require.NoError(t, err, sel)
+		expect := []query.Requirement{
+			{
+				Label: "host",
+				Op:    "isnull",
+			},
+			{
+				Label:  "x",
+				Op:     "=",
+				Values: []string{"y"},
+			},
+		}
+		diff := deep.Equal(got, expect) // can't use assert.Equal because some unexported fields don't match. deep.Equal only compares exported fields.
+		assert.Nil(t, diff, sel)
+	}
+
+	// Only isnull is a set op without a value
+	for _, sel := range []string{"host isnul", "host in", "host notin"} {
+		_, err := query.Parse(sel)
+		assert.Error(t, err, sel)
+	}
+}
+
 func TestParseMixed(t *testing.T) {
 
 	// equality, exists
@@ -332,6 +387,68 @@ func TestParseQueryId(t *testing.T) {
 	assert.Nil(t, diff)
 }
 
+func TestParseQuoted(t *testing.T) {
+	// Quoted values can contain commas, parens, quotes, and leading or trailing space
+	sel := `host="a, b",x != " (y) ",z in ("1,2", 3, "\"4\""),w`
+	got, err := query.Parse(sel)
+	require.NoError(t, err)
+	expect := []query.Requirement{
+		{
+			Label:  "host",
+			Op:     "=",
+			Values: []string{"a, b"},
+		},
+		{
+			Label:  "x",
+			Op:     "!=",
+			Values: []string{" (y) "},
+		},
+		{
+			Label:  "z",
+			Op:     "in",
+			Values: []string{"1,2", " 3", `"4"`},
+		},
+		{
+			Label:  "w",
+			Op:     "exists",
+			Values: nil,
+		},
+	}
+	diff := deep.Equal(got, expect) // can't use assert.Equal because some unexported fields don't match. deep.Equal only compares exported fields.
+	assert.Nil(t, diff)
+
+	// Unterminated quote is an error, not the rest of the selector
+	_, err = query.Parse(`host="a`)
+	assert.Error(t, err)
+	_, err = query.Parse(`host="a,b=c`)
+	assert.Error(t, err)
+	_, err = query.Parse(`z in ("1, 2)`)
+	assert.Error(t, err)
+
+	// Quotes only start quoted values, so a quote inside a value is a value char
+	got, err = query.Parse(`a=x"y,b=c,d in (e"f, g)`)
+	require.NoError(t, err)
+	expect = []query.Requirement{
+		{
+			Label:  "a",
+			Op:     "=",
+			Values: []string{`x"y`},
+		},
+		{
+			Label:  "b",
+			Op:     "=",
+			Values: []string{"c"},
+		},
+		{
+			Label:  "d",
+			Op:     "in",
+			Values: []string{`e"f`, " g"},
+		},
+	}
+	diff = deep.Equal(got, expect)
+	assert.Nil(t, diff)
+}
+
 func TestParseInvalid(t *testing.T) {
 	invalid := []string{
 		// Invalid first chars
@@ -9,6 +9,8 @@
 package query
 
 import (
+	"fmt"
+	"regexp"
 	"strconv"
 )
 
@@ -35,6 +37,13 @@ func Translate(labelSelectors string) (Query, error) {
 	}
 
 	for _, r := range req {
+		if r.Op == "=~" || r.Op == "!~" {
+			// Server uses MongoDB $regex (PCRE). Go regexp (RE2) syntax is mostly
+			// a subset, so this catches most invalid patterns before the query.
+			if _, err := regexp.Compile(r.Values[0]); err != nil {
+				return query, fmt.Errorf("%s%s%s: invalid regular expression: %s", r.Label, r.Op, r.Values[0], err)
+			}
+		}
 		p := Predicate{
 			Label:    r.Label,
 			Operator: r.Op,
@@ -57,13 +66,13 @@ func translateValues(operator string, values []string) interface{} {
 	case "in", "notin":
 		// Values set must be non-empty.
 		value = values
-	case "=", "==", "!=":
+	case "=", "==", "!=", "=~", "!~":
 		// Values set must contain one value.
 		value = values[0]
 	case ">", ">=", "<", "<=":
 		// Values set must contain only one value, which was interpreted as an integer, so convert from string to integer
 		value, _ = strconv.Atoi(values[0])
-	case "exists", "notexists":
+	case "exists", "notexists", "isnull":
 		// No values
 	}
 	return value
@@ -83,6 +83,23 @@ func TestQueryTranslate(t *testing.T) {
 				},
 			},
 		},
+		{
+			query: `host=~^web-,env!~"(?i)^prod$"`,
+			expect: query.Query{
+				Predicates: []query.Predicate{
+					query.Predicate{
+						Label:    "host",
+						Operator: "=~",
+						Value:    "^web-",
+					},
+					query.Predicate{
+						Label:    "env",
+						Operator: "!~",
+						Value:    "(?i)^prod$",
+					},
+				},
+			},
+		},
 
 		// Invalid
 		// ------------------------------------------------------------------
@@ -94,6 +111,10 @@ func TestQueryTranslate(t *testing.T) {
 			query:        "=val", // missing label
 			returnsError: true,
 		},
+		{
+			query:        "host=~web-[", // invalid regex
+			returnsError: true,
+		},
 	}
 	for _, tc := range testCases {
 		got, err := query.Translate(tc.query)
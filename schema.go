@@ -0,0 +1,132 @@
+// Copyright 2026, Square, Inc.
+
+package etre
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LabelType is the expected type of a label value in a Schema.
+type LabelType string
+
+// Schema label types
+const (
+	LABEL_TYPE_ANY    LabelType = "any"    // any non-nil value
+	LABEL_TYPE_STRING LabelType = "string" // string
+	LABEL_TYPE_INT    LabelType = "int"    // integer, converted like Entity.Int
+	LABEL_TYPE_FLOAT  LabelType = "float"  // any number, converted like Entity.Float64
+	LABEL_TYPE_BOOL   LabelType = "bool"   // bool
+)
+
+// Schema is the labels and value types that entities of a type must have. It's
+// checked by the client, not the API, so it's optional data-quality enforcement:
+// set EntityClientConfig.Schema to check every insert and update, or call
+// Entity.ValidateSchema. Meta-labels are not checked, and labels not in the
+// schema are allowed.
+type Schema struct {
+	// Required labels must be set to a non-nil value of the type.
+	Required map[string]LabelType
+
+	// Optional labels can be missing, but if set must be a value of the type.
+	Optional map[string]LabelType
+}
+
+// SchemaError is returned by Entity.ValidateSchema. It has every violation, in
+// label order, not just the first.
+type SchemaError struct {
+	Violations []string
+}
+
+func (e *SchemaError) Error() string {
+	return "entity does not match schema: " + strings.Join(e.Violations, "; ")
+}
+
+// ValidateSchema returns a *SchemaError if the entity does not conform to the
+// schema: a required label is not set, or a label in the schema has a value
+// that's not the type. Numbers are converted like Entity.Int and Entity.Float64,
+// so an int label can be an int, int32, int64, or float64 (from JSON) value with
+// no fractional part. If the schema has no labels, nil is returned.
+func (e Entity) ValidateSchema(schema Schema) error {
+	return schema.validate(e, false)
+}
+
+// validate implements Entity.ValidateSchema. If patch is true, e is a partial
+// entity (an update patch), so missing required labels are not violations, and
+// labels with operators (see IncrementOp and ArrayOp) are checked by the type of
+// the value they set.
+func (s Schema) validate(e Entity, patch bool) error {
+	labels := make([]string, 0, len(s.Required)+len(s.Optional))
+	types := make(map[string]LabelType, len(s.Required)+len(s.Optional))
+	for label, t := range s.Optional {
+		labels = append(labels, label)
+		types[label] = t
+	}
+	for label, t := range s.Required {
+		if _, ok := types[label]; !ok {
+			labels = append(labels, label)
+		}
+		types[label] = t // required wins
+	}
+	sort.Strings(labels)
+
+	violations := []string{}
+	for _, label := range labels {
+		v, ok := e[label]
+		if !ok {
+			if _, required := s.Required[label]; required && !patch {
+				violations = append(violations, fmt.Sprintf("label %s not set", label))
+			}
+			continue
+		}
+		if patch {
+			// Operators set the label to a value computed by the API, so check
+			// the type of the result: an integer for $inc, an array for $addToSet
+			// and $pull, which only LABEL_TYPE_ANY matches
+			if delta, ok := IncrementOp(v); ok {
+				if !types[label].match(delta) {
+					violations = append(violations, fmt.Sprintf("label %s: %s result is not %s", label, COUNTER_OP_INC, types[label]))
+				}
+				continue
+			}
+			if op, values, ok := ArrayOp(v); ok {
+				if !types[label].match(values) {
+					violations = append(violations, fmt.Sprintf("label %s: %s result is not %s", label, op, types[label]))
+				}
+				continue
+			}
+		}
+		if !types[label].match(v) {
+			violations = append(violations, fmt.Sprintf("label %s: %T value %v is not %s", label, v, v, types[label]))
+		}
+	}
+	if len(violations) > 0 {
+		return &SchemaError{Violations: violations}
+	}
+	return nil
+}
+
+// match returns true if v is a value of type t.
+func (t LabelType) match(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	switch t {
+	case LABEL_TYPE_ANY:
+		return true
+	case LABEL_TYPE_STRING:
+		_, ok := v.(string)
+		return ok
+	case LABEL_TYPE_INT:
+		_, ok := toInt64(v)
+		return ok
+	case LABEL_TYPE_FLOAT:
+		_, ok := toFloat64(v)
+		return ok
+	case LABEL_TYPE_BOOL:
+		_, ok := v.(bool)
+		return ok
+	}
+	return false // unknown type
+}
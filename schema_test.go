@@ -0,0 +1,54 @@
+// Copyright 2026, Square, Inc.
+
+package etre_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/square/etre"
+)
+
+var hostSchema = etre.Schema{
+	Required: map[string]etre.LabelType{
+		"hostname": etre.LABEL_TYPE_STRING,
+		"cores":    etre.LABEL_TYPE_INT,
+	},
+	Optional: map[string]etre.LabelType{
+		"load": etre.LABEL_TYPE_FLOAT,
+		"up":   etre.LABEL_TYPE_BOOL,
+		"tags": etre.LABEL_TYPE_ANY,
+	},
+}
+
+func TestValidateSchema(t *testing.T) {
+	valid := []etre.Entity{
+		{"hostname": "a", "cores": 8},
+		{"hostname": "a", "cores": int32(8), "load": 1},
+		{"hostname": "a", "cores": int64(8), "load": 0.5, "up": true, "tags": []string{"x"}},
+		{"hostname": "a", "cores": float64(8), "other": nil}, // like JSON; other not in schema
+		{"_id": "abc", "_rev": int64(1), "hostname": "a", "cores": 8},
+	}
+	for _, e := range valid {
+		assert.NoError(t, e.ValidateSchema(hostSchema), e)
+	}
+
+	// Every violation in label order
+	err := etre.Entity{"cores": 1.5, "load": "high", "tags": nil}.ValidateSchema(hostSchema)
+	require.Error(t, err)
+	var schemaErr *etre.SchemaError
+	require.ErrorAs(t, err, &schemaErr)
+	expect := []string{
+		"label cores: float64 value 1.5 is not int",
+		"label hostname not set",
+		"label load: string value high is not float",
+		"label tags: <nil> value <nil> is not any",
+	}
+	assert.Equal(t, expect, schemaErr.Violations)
+	assert.Equal(t, "entity does not match schema: label cores: float64 value 1.5 is not int; label hostname not set; label load: string value high is not float; label tags: <nil> value <nil> is not any", err.Error())
+
+	// No labels, no violations
+	assert.NoError(t, etre.Entity{"x": 1}.ValidateSchema(etre.Schema{}))
+}
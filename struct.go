@@ -0,0 +1,223 @@
+// Copyright 2026, Square, Inc.
+
+package etre
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// structField is an exported struct field mapped to a label.
+type structField struct {
+	name      string // Go field name, for errors
+	label     string
+	index     []int
+	omitempty bool
+}
+
+// structFields returns the fields of struct type t mapped to labels. A field's
+// label is the name in its etre tag, like `etre:"host"`, else its name. Tag "-"
+// skips the field, and option omitempty, like `etre:"zone,omitempty"`, makes the
+// label optional. Fields of embedded structs without a tag are included as if
+// they were fields of t, like encoding/json.
+func structFields(t reflect.Type) ([]structField, error) {
+	fields := []structField{}
+	seen := map[string]string{}
+	var walk func(t reflect.Type, index []int) error
+	walk = func(t reflect.Type, index []int) error {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag, hasTag := f.Tag.Lookup("etre")
+			if tag == "-" {
+				continue
+			}
+			fi := append(append([]int{}, index...), i)
+			if f.Anonymous && !hasTag && f.Type.Kind() == reflect.Struct {
+				if err := walk(f.Type, fi); err != nil {
+					return err
+				}
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			label, opts, _ := strings.Cut(tag, ",")
+			if label == "" {
+				label = f.Name
+			}
+			if other, ok := seen[label]; ok {
+				return fmt.Errorf("fields %s and %s have the same label: %s", other, f.Name, label)
+			}
+			seen[label] = f.Name
+			fields = append(fields, structField{
+				name:      f.Name,
+				label:     label,
+				index:     fi,
+				omitempty: opts == "omitempty",
+			})
+		}
+		return nil
+	}
+	if err := walk(t, nil); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// DecodeInto sets the fields of the struct pointed to by dst to the values of
+// the labels they map to: the name in the field's etre tag, like `etre:"host"`,
+// else the field name. Tag "-" skips the field. Unexported fields and labels
+// not mapped to a field are ignored.
+//
+// Every mapped label must be set unless the tag has option omitempty, like
+// `etre:"zone,omitempty"`, which leaves the field unchanged if the label is
+// not set. Numbers are converted like Int and Float64, so an int field can
+// decode an int32, int64, or float64 (from JSON) value if it has no fractional
+// part and doesn't overflow the field. Slices and maps are converted element
+// by element. A label value that can't be converted to the field type is an
+// error that names the label and field.
+func (e Entity) DecodeInto(dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("DecodeInto requires a non-nil pointer to a struct, got %T", dst)
+	}
+	rv = rv.Elem()
+	fields, err := structFields(rv.Type())
+	if err != nil {
+		return fmt.Errorf("%s: %s", rv.Type(), err)
+	}
+	for _, f := range fields {
+		v, ok := e[f.label]
+		if !ok {
+			if f.omitempty {
+				continue
+			}
+			return fmt.Errorf("label %s not set (field %s.%s)", f.label, rv.Type(), f.name)
+		}
+		if err := setValue(rv.FieldByIndex(f.index), v); err != nil {
+			return fmt.Errorf("label %s: cannot decode into field %s.%s: %s", f.label, rv.Type(), f.name, err)
+		}
+	}
+	return nil
+}
+
+// EntityFromStruct returns a new entity with labels from the exported fields of
+// struct (or pointer to struct) src, mapped like DecodeInto. Fields with option
+// omitempty are not set if they have the zero value. Field values are not
+// converted or copied, so slice and map values are shared with src.
+func EntityFromStruct(src interface{}) (Entity, error) {
+	rv := reflect.ValueOf(src)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("EntityFromStruct requires a struct, got nil %T", src)
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("EntityFromStruct requires a struct, got %T", src)
+	}
+	fields, err := structFields(rv.Type())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", rv.Type(), err)
+	}
+	e := Entity{}
+	for _, f := range fields {
+		fv := rv.FieldByIndex(f.index)
+		if f.omitempty && fv.IsZero() {
+			continue
+		}
+		e[f.label] = fv.Interface()
+	}
+	return e, nil
+}
+
+// setValue sets fv to v, converting v to the type of fv if needed.
+func setValue(fv reflect.Value, v interface{}) error {
+	if v == nil {
+		fv.Set(reflect.Zero(fv.Type()))
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := toInt64(v)
+		if !ok {
+			return fmt.Errorf("%T value %v is not an integer", v, v)
+		}
+		if fv.OverflowInt(n) {
+			return fmt.Errorf("value %d overflows %s", n, fv.Type())
+		}
+		fv.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := toInt64(v)
+		if !ok || n < 0 {
+			return fmt.Errorf("%T value %v is not an unsigned integer", v, v)
+		}
+		if fv.OverflowUint(uint64(n)) {
+			return fmt.Errorf("value %d overflows %s", n, fv.Type())
+		}
+		fv.SetUint(uint64(n))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, ok := toFloat64(v)
+		if !ok {
+			return fmt.Errorf("%T value %v is not a number", v, v)
+		}
+		fv.SetFloat(f)
+		return nil
+	case reflect.Ptr:
+		p := reflect.New(fv.Type().Elem())
+		if err := setValue(p.Elem(), v); err != nil {
+			return err
+		}
+		fv.Set(p)
+		return nil
+	case reflect.Slice:
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			break
+		}
+		if rv.Type().AssignableTo(fv.Type()) {
+			fv.Set(rv)
+			return nil
+		}
+		s := reflect.MakeSlice(fv.Type(), rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			if err := setValue(s.Index(i), rv.Index(i).Interface()); err != nil {
+				return fmt.Errorf("index %d: %s", i, err)
+			}
+		}
+		fv.Set(s)
+		return nil
+	case reflect.Map:
+		if rv.Kind() != reflect.Map || fv.Type().Key().Kind() != reflect.String || rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if rv.Type().AssignableTo(fv.Type()) {
+			fv.Set(rv)
+			return nil
+		}
+		m := reflect.MakeMapWithSize(fv.Type(), rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			ev := reflect.New(fv.Type().Elem()).Elem()
+			if err := setValue(ev, iter.Value().Interface()); err != nil {
+				return fmt.Errorf("key %s: %s", iter.Key(), err)
+			}
+			m.SetMapIndex(iter.Key().Convert(fv.Type().Key()), ev)
+		}
+		fv.Set(m)
+		return nil
+	}
+	if rv.Type().AssignableTo(fv.Type()) {
+		fv.Set(rv)
+		return nil
+	}
+	// Named types, like type Zone string
+	if rv.Kind() == fv.Kind() && rv.Type().ConvertibleTo(fv.Type()) {
+		fv.Set(rv.Convert(fv.Type()))
+		return nil
+	}
+	return fmt.Errorf("%T value %v is not a %s", v, v, fv.Type())
+}
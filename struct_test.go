@@ -0,0 +1,139 @@
+// Copyright 2026, Square, Inc.
+
+package etre_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/square/etre"
+)
+
+type zone string
+
+type meta struct {
+	Id  string `etre:"_id"`
+	Rev int64  `etre:"_rev"`
+}
+
+type node struct {
+	meta
+	Host    string            `etre:"host"`
+	Zone    zone              `etre:"zone,omitempty"`
+	Cores   int               `etre:"cores"`
+	Load    float64           `etre:"load,omitempty"`
+	Up      bool              `etre:"up,omitempty"`
+	Tags    []string          `etre:"tags,omitempty"`
+	Attrs   map[string]int    `etre:"attrs,omitempty"`
+	Port    *uint16           `etre:"port,omitempty"`
+	Any     interface{}       `etre:"any,omitempty"`
+	Ignored string            `etre:"-"`
+	Name    string            // label "Name"
+	notes   map[string]string // unexported
+}
+
+func TestEntityDecodeInto(t *testing.T) {
+	e := etre.Entity{
+		"_id":   "abc",
+		"_rev":  int32(2),
+		"host":  "a",
+		"zone":  "east",
+		"cores": float64(8), // like JSON
+		"load":  int64(1),
+		"up":    true,
+		"tags":  []interface{}{"x", "y"},
+		"attrs": map[string]interface{}{"n": int32(1)},
+		"port":  float64(80),
+		"any":   []interface{}{1, "z"},
+		"Name":  "n",
+		"other": "not mapped",
+	}
+	var got node
+	require.NoError(t, e.DecodeInto(&got))
+	port := uint16(80)
+	expect := node{
+		meta:  meta{Id: "abc", Rev: 2},
+		Host:  "a",
+		Zone:  "east",
+		Cores: 8,
+		Load:  1,
+		Up:    true,
+		Tags:  []string{"x", "y"},
+		Attrs: map[string]int{"n": 1},
+		Port:  &port,
+		Any:   []interface{}{1, "z"},
+		Name:  "n",
+	}
+	assert.Equal(t, expect, got)
+
+	// Optional labels can be missing, and nil sets the zero value
+	got = node{Zone: "west", Cores: 1}
+	require.NoError(t, etre.Entity{"_id": "abc", "_rev": 0, "host": "a", "cores": nil, "Name": ""}.DecodeInto(&got))
+	assert.Equal(t, node{meta: meta{Id: "abc"}, Host: "a", Zone: "west"}, got)
+
+	// Errors
+	tests := []struct {
+		entity etre.Entity
+		err    string
+	}{
+		{etre.Entity{"_id": "abc", "_rev": 0, "cores": 1, "Name": ""}, "label host not set (field etre_test.node.Host)"},
+		{etre.Entity{"_id": "abc", "_rev": 0, "host": 1, "cores": 1, "Name": ""}, "label host: cannot decode into field etre_test.node.Host: int value 1 is not a string"},
+		{etre.Entity{"_id": "abc", "_rev": 0, "host": "a", "cores": 1.5, "Name": ""}, "label cores: cannot decode into field etre_test.node.Cores: float64 value 1.5 is not an integer"},
+		{etre.Entity{"_id": "abc", "_rev": 0, "host": "a", "cores": 1, "Name": "", "port": -1}, "label port: cannot decode into field etre_test.node.Port: int value -1 is not an unsigned integer"},
+		{etre.Entity{"_id": "abc", "_rev": 0, "host": "a", "cores": 1, "Name": "", "port": 70000}, "label port: cannot decode into field etre_test.node.Port: value 70000 overflows uint16"},
+		{etre.Entity{"_id": "abc", "_rev": 0, "host": "a", "cores": 1, "Name": "", "tags": []interface{}{"x", 2}}, "label tags: cannot decode into field etre_test.node.Tags: index 1: int value 2 is not a string"},
+	}
+	for _, tt := range tests {
+		err := tt.entity.DecodeInto(&node{})
+		require.Error(t, err, tt.err)
+		assert.Equal(t, tt.err, err.Error())
+	}
+
+	err := e.DecodeInto(node{})
+	assert.EqualError(t, err, "DecodeInto requires a non-nil pointer to a struct, got etre_test.node")
+
+	type dupe struct {
+		A string `etre:"x"`
+		B string `etre:"x"`
+	}
+	err = e.DecodeInto(&dupe{})
+	assert.EqualError(t, err, "etre_test.dupe: fields A and B have the same label: x")
+}
+
+func TestEntityFromStruct(t *testing.T) {
+	n := node{
+		meta:    meta{Id: "abc", Rev: 1},
+		Host:    "a",
+		Cores:   8,
+		Tags:    []string{"x"},
+		Ignored: "y",
+	}
+	expect := etre.Entity{
+		"_id":   "abc",
+		"_rev":  int64(1),
+		"host":  "a",
+		"cores": 8,
+		"tags":  []string{"x"},
+		"Name":  "",
+	}
+	e, err := etre.EntityFromStruct(n)
+	require.NoError(t, err)
+	assert.Equal(t, expect, e)
+
+	e, err = etre.EntityFromStruct(&n)
+	require.NoError(t, err)
+	assert.Equal(t, expect, e)
+
+	// Round trip
+	var got node
+	require.NoError(t, e.DecodeInto(&got))
+	n.Ignored = ""
+	assert.Equal(t, n, got)
+
+	_, err = etre.EntityFromStruct((*node)(nil))
+	assert.EqualError(t, err, "EntityFromStruct requires a struct, got nil *etre_test.node")
+	_, err = etre.EntityFromStruct("a")
+	assert.EqualError(t, err, "EntityFromStruct requires a struct, got string")
+}
@@ -12,8 +12,10 @@ import (
 var _ cdc.Store = CDCStore{}
 
 type CDCStore struct {
-	WriteFunc func(context.Context, etre.CDCEvent) error
-	ReadFunc  func(cdc.Filter) ([]etre.CDCEvent, error)
+	WriteFunc    func(context.Context, etre.CDCEvent) error
+	ReadFunc     func(cdc.Filter) ([]etre.CDCEvent, error)
+	LatestTsFunc func(context.Context, etre.CDCFilter) (int64, error)
+	HistoryFunc  func(ctx context.Context, entityType, entityId string, limit int64) ([]etre.CDCEvent, error)
 }
 
 func (s CDCStore) Write(ctx context.Context, e etre.CDCEvent) error {
@@ -30,6 +32,20 @@ func (s CDCStore) Read(filter cdc.Filter) ([]etre.CDCEvent, error) {
 	return nil, nil
 }
 
+func (s CDCStore) LatestTs(ctx context.Context, filter etre.CDCFilter) (int64, error) {
+	if s.LatestTsFunc != nil {
+		return s.LatestTsFunc(ctx, filter)
+	}
+	return 0, nil
+}
+
+func (s CDCStore) History(ctx context.Context, entityType, entityId string, limit int64) ([]etre.CDCEvent, error) {
+	if s.HistoryFunc != nil {
+		return s.HistoryFunc(ctx, entityType, entityId, limit)
+	}
+	return nil, nil
+}
+
 // Some test events that can be insterted into a db.
 var CDCEvents = []etre.CDCEvent{
 	etre.CDCEvent{Id: "nru", EntityId: "e1", EntityRev: 0, Ts: 10},
@@ -13,10 +13,14 @@ import (
 type EntityStore struct {
 	WithContextFunc       func(context.Context) entity.Store
 	ReadEntitiesFunc      func(string, query.Query, etre.QueryFilter) ([]etre.Entity, error)
+	CountEntitiesFunc     func(string, query.Query, etre.QueryFilter) (int64, error)
+	AggregateEntitiesFunc func(string, query.Query, []string, etre.QueryFilter) ([]etre.GroupResult, error)
+	ExplainEntitiesFunc   func(string, query.Query, etre.QueryFilter) (etre.QueryPlan, error)
+	ReadLabelsFunc        func(string) ([]string, error)
 	DeleteEntityLabelFunc func(entity.WriteOp, string) (etre.Entity, error)
 	CreateEntitiesFunc    func(entity.WriteOp, []etre.Entity) ([]string, error)
 	UpdateEntitiesFunc    func(entity.WriteOp, query.Query, etre.Entity) ([]etre.Entity, error)
-	DeleteEntitiesFunc    func(entity.WriteOp, query.Query) ([]etre.Entity, error)
+	DeleteEntitiesFunc    func(entity.WriteOp, query.Query, int) ([]etre.Entity, error)
 	DeleteLabelFunc       func(entity.WriteOp, string) (etre.Entity, error)
 }
 
@@ -48,6 +52,34 @@ func (s EntityStore) ReadEntities(entityType string, q query.Query, f etre.Query
 	return nil, nil
 }
 
+func (s EntityStore) CountEntities(entityType string, q query.Query, f etre.QueryFilter) (int64, error) {
+	if s.CountEntitiesFunc != nil {
+		return s.CountEntitiesFunc(entityType, q, f)
+	}
+	return 0, nil
+}
+
+func (s EntityStore) AggregateEntities(entityType string, q query.Query, groupBy []string, f etre.QueryFilter) ([]etre.GroupResult, error) {
+	if s.AggregateEntitiesFunc != nil {
+		return s.AggregateEntitiesFunc(entityType, q, groupBy, f)
+	}
+	return nil, nil
+}
+
+func (s EntityStore) ExplainEntities(entityType string, q query.Query, f etre.QueryFilter) (etre.QueryPlan, error) {
+	if s.ExplainEntitiesFunc != nil {
+		return s.ExplainEntitiesFunc(entityType, q, f)
+	}
+	return etre.QueryPlan{}, nil
+}
+
+func (s EntityStore) ReadLabels(entityType string) ([]string, error) {
+	if s.ReadLabelsFunc != nil {
+		return s.ReadLabelsFunc(entityType)
+	}
+	return nil, nil
+}
+
 func (s EntityStore) UpdateEntities(wo entity.WriteOp, q query.Query, u etre.Entity) ([]etre.Entity, error) {
 	if s.UpdateEntitiesFunc != nil {
 		return s.UpdateEntitiesFunc(wo, q, u)
@@ -55,9 +87,9 @@ func (s EntityStore) UpdateEntities(wo entity.WriteOp, q query.Query, u etre.Ent
 	return nil, nil
 }
 
-func (s EntityStore) DeleteEntities(wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+func (s EntityStore) DeleteEntities(wo entity.WriteOp, q query.Query, limit int) ([]etre.Entity, error) {
 	if s.DeleteEntitiesFunc != nil {
-		return s.DeleteEntitiesFunc(wo, q)
+		return s.DeleteEntitiesFunc(wo, q, limit)
 	}
 	return nil, nil
 }